@@ -0,0 +1,203 @@
+package advertise
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/urfave/cli/v2"
+)
+
+var Cmd = &cli.Command{
+	Name:      "advertise",
+	Usage:     "build IPNI advertisements of the blocks in the pieces of a run, for announcing them to indexers",
+	ArgsUsage: "<metadata.csv|metadata.yaml>",
+	Action:    advertiseAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "output",
+			Aliases:  []string{"o"},
+			Required: true,
+			Usage:    "directory to write the advertisements and entry chunks to, each in a file named after its cid, created if it doesn't exist.",
+		},
+		&cli.StringFlag{
+			Name:     "key",
+			Required: true,
+			Usage:    "file with the private key of the provider, base64 of a libp2p protobuf encoded ed25519 key as in the index-provider config. A new key is generated into it if it doesn't exist.",
+		},
+		&cli.StringSliceFlag{
+			Name:     "address",
+			Required: true,
+			Usage:    "multiaddr the content can be retrieved from, e.g. /dns4/sp.example.com/tcp/443/https. Can be repeated.",
+		},
+		&cli.StringSliceFlag{
+			Name:     "protocol",
+			Required: false,
+			Value:    cli.NewStringSlice("graphsync"),
+			Usage:    "retrieval protocol to advertise: bitswap, graphsync (filecoin graphsync, with the piece cid) or http (trustless gateway). Can be repeated.",
+		},
+		&cli.StringFlag{
+			Name:     "previous",
+			Required: false,
+			Usage:    "optional cid of the latest advertisement of the provider, for the new ones to follow it in its chain.",
+		},
+		&cli.BoolFlag{
+			Name:     "verified",
+			Required: false,
+			Value:    true,
+			Usage:    "advertise the deals as verified, in the graphsync metadata.",
+		},
+		&cli.BoolFlag{
+			Name:     "fast-retrieval",
+			Required: false,
+			Value:    true,
+			Usage:    "advertise an unsealed copy for fast retrieval, in the graphsync metadata.",
+		},
+		&cli.IntFlag{
+			Name:     "entries-chunk-size",
+			Required: false,
+			Value:    16384,
+			Usage:    "number of multihashes per entry chunk.",
+		},
+		&cli.StringFlag{
+			Name:     "pieces-dir",
+			Required: false,
+			Usage:    "optional directory to find the pieces in, by the base name of their file, instead of at the paths recorded in the metadata.",
+		},
+	},
+}
+
+// advertiseAction builds an advertisement for every piece of a run, with the piece cid as context id and the
+// multihashes of the blocks in the piece as entries, chained in the order of the pieces. The head of the chain is
+// written to a file named head.
+func advertiseAction(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		return fmt.Errorf("expected a metadata file")
+	}
+	chunkSize := c.Int("entries-chunk-size")
+	if chunkSize < 1 {
+		return fmt.Errorf("--entries-chunk-size must be at least 1")
+	}
+	m, err := metadata.Read(c.Args().First())
+	if err != nil {
+		return err
+	}
+	key, err := loadKey(c.String("key"))
+	if err != nil {
+		return err
+	}
+	provider, err := key.peerID()
+	if err != nil {
+		return err
+	}
+	previous := cid.Undef
+	if s := c.String("previous"); s != "" {
+		if previous, err = cid.Decode(s); err != nil {
+			return fmt.Errorf("invalid previous advertisement cid: %s", err)
+		}
+	}
+	output := c.String("output")
+	if err := os.MkdirAll(output, 0o755); err != nil {
+		return err
+	}
+
+	var ads int
+	for _, cf := range m.CarPiecesMeta.CarPieces {
+		if !cf.CommP.Defined() {
+			logging.Warn("skipping piece without commP", "piece", cf.Name)
+			continue
+		}
+		var mhs []multihash.Multihash
+		err := splitter.PieceCids(cf, c.String("pieces-dir"), func(b cid.Cid) error {
+			// identity cids hold their data, there is nothing to retrieve
+			if b.Prefix().MhType != multihash.IDENTITY {
+				mhs = append(mhs, b.Hash())
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(mhs) == 0 {
+			logging.Warn("skipping piece without blocks to advertise", "piece", cf.Name)
+			continue
+		}
+		entries, err := writeEntries(output, mhs, chunkSize)
+		if err != nil {
+			return err
+		}
+		md, err := transportMetadata(c.StringSlice("protocol"), cf.CommP.Cid, c.Bool("verified"), c.Bool("fast-retrieval"))
+		if err != nil {
+			return err
+		}
+		ad := advertisement{
+			Entries:   linkNode{entries.String()},
+			Metadata:  md,
+			Provider:  provider,
+			Addresses: c.StringSlice("address"),
+			ContextID: cf.CommP.Bytes(),
+		}
+		if previous.Defined() {
+			ad.PreviousID = &linkNode{previous.String()}
+		}
+		if err := key.sign(&ad, previous, entries); err != nil {
+			return err
+		}
+		if previous, err = writeNode(output, ad); err != nil {
+			return err
+		}
+		ads++
+		fmt.Printf("%s: advertisement %s, %d multihashes\n", cf.Name, previous, len(mhs))
+	}
+	if ads == 0 {
+		return fmt.Errorf("no pieces to advertise")
+	}
+	if err := os.WriteFile(filepath.Join(output, "head"), []byte(previous.String()+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to write the head of the advertisements: %s", err)
+	}
+	fmt.Printf("provider = %s\n", provider)
+	fmt.Printf("head = %s, %d advertisements\n", previous, ads)
+	return nil
+}
+
+// writeEntries writes the multihashes in chunks of up to chunkSize each, every chunk linking to the next one, and
+// returns the cid of the first chunk.
+func writeEntries(dir string, mhs []multihash.Multihash, chunkSize int) (cid.Cid, error) {
+	// written back to front, as every chunk links to the one after it
+	next := cid.Undef
+	for start := (len(mhs) - 1) / chunkSize * chunkSize; start >= 0; start -= chunkSize {
+		end := start + chunkSize
+		if end > len(mhs) {
+			end = len(mhs)
+		}
+		chunk := entryChunk{}
+		for _, mh := range mhs[start:end] {
+			chunk.Entries = append(chunk.Entries, bytesNode(mh))
+		}
+		if next.Defined() {
+			chunk.Next = &linkNode{next.String()}
+		}
+		var err error
+		if next, err = writeNode(dir, chunk); err != nil {
+			return cid.Undef, err
+		}
+	}
+	return next, nil
+}
+
+// writeNode writes the dag-json encoding of a node to a file named after its cid.
+func writeNode(dir string, node interface{}) (cid.Cid, error) {
+	data, c, err := encodeNode(node)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, c.String()), data, 0o644); err != nil {
+		return cid.Undef, fmt.Errorf("failed to write %s: %s", c, err)
+	}
+	return c, nil
+}
@@ -0,0 +1,271 @@
+package advertise
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// the signature of an advertisement is a libp2p signed envelope of this domain and payload type
+	adSignatureDomain = "indexer"
+	adSignatureCodec  = "/indexer/ingest/adSignature"
+
+	// libp2p key type of ed25519 keys
+	keyTypeEd25519 = 1
+
+	// multicodecs of the retrieval protocols in the metadata of an advertisement
+	transportBitswap           = 0x0900
+	transportGraphsyncFilecoin = 0x0910
+	transportIpfsGatewayHttp   = 0x0920
+)
+
+// bytesNode is a bytes value in dag-json.
+type bytesNode []byte
+
+func (b bytesNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]map[string]string{"/": {"bytes": base64.RawStdEncoding.EncodeToString(b)}})
+}
+
+// linkNode is a link in dag-json.
+type linkNode struct {
+	Cid string `json:"/"`
+}
+
+// The fields of the nodes below are in the key order go-ipld-prime encodes dag-json maps in, shortest key first.
+
+// advertisement is the Advertisement of the IPNI ingestion schema, see github.com/ipni/go-libipni/ingest/schema.
+type advertisement struct {
+	IsRm       bool      `json:"IsRm"`
+	Entries    linkNode  `json:"Entries"`
+	Metadata   bytesNode `json:"Metadata"`
+	Provider   string    `json:"Provider"`
+	Addresses  []string  `json:"Addresses"`
+	ContextID  bytesNode `json:"ContextID"`
+	Signature  bytesNode `json:"Signature"`
+	PreviousID *linkNode `json:"PreviousID,omitempty"`
+}
+
+// entryChunk is an EntryChunk of the IPNI ingestion schema, a chunk of the multihashes of an advertisement.
+type entryChunk struct {
+	Next    *linkNode   `json:"Next,omitempty"`
+	Entries []bytesNode `json:"Entries"`
+}
+
+// encodeNode returns the dag-json encoding of a node and its cid.
+func encodeNode(node interface{}) ([]byte, cid.Cid, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(node); err != nil {
+		return nil, cid.Undef, err
+	}
+	data := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	mh, err := multihash.Sum(data, multihash.SHA2_256, -1)
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	return data, cid.NewCidV1(cid.DagJSON, mh), nil
+}
+
+// sign sets the signature of an advertisement, linking to the previous one (if defined) and to its entries: a signed
+// envelope of the multihash of its fields, as indexers check it.
+func (k privateKey) sign(ad *advertisement, previous, entries cid.Cid) error {
+	var buf bytes.Buffer
+	if previous.Defined() {
+		buf.Write(previous.Bytes())
+	}
+	buf.Write(entries.Bytes())
+	buf.WriteString(ad.Provider)
+	for _, addr := range ad.Addresses {
+		buf.WriteString(addr)
+	}
+	buf.Write(ad.ContextID)
+	buf.Write(ad.Metadata)
+	if ad.IsRm {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	payload, err := multihash.Sum(buf.Bytes(), multihash.SHA2_256, -1)
+	if err != nil {
+		return err
+	}
+	ad.Signature = k.seal([]byte(adSignatureCodec), payload)
+	return nil
+}
+
+// privateKey is the ed25519 identity of the provider the advertisements are signed with.
+type privateKey ed25519.PrivateKey
+
+// loadKey reads a private key from path, base64 of a libp2p protobuf encoded ed25519 key (as in the config of
+// index-provider). If the file doesn't exist, a new key is generated and written to it.
+func loadKey(path string) (privateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate a key: %s", err)
+		}
+		encoded := base64.StdEncoding.EncodeToString(marshalKey(keyTypeEd25519, k))
+		if err := os.WriteFile(path, []byte(encoded+"\n"), 0o600); err != nil {
+			return nil, fmt.Errorf("failed to write the key: %s", err)
+		}
+		return privateKey(k), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the key: %s", err)
+	}
+	pb, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %s", path, err)
+	}
+	// the type (field 1) and the key (field 2) of a libp2p PrivateKey message
+	if len(pb) < 4 || pb[0] != 0x08 || pb[2] != 0x12 {
+		return nil, fmt.Errorf("invalid key in %s, expected a libp2p protobuf encoded private key", path)
+	}
+	if pb[1] != keyTypeEd25519 {
+		return nil, fmt.Errorf("unsupported key type %d in %s, expected an ed25519 key", pb[1], path)
+	}
+	n, l := binary.Uvarint(pb[3:])
+	raw := pb[3+l:]
+	if l <= 0 || uint64(len(raw)) != n || (n != ed25519.PrivateKeySize && n != ed25519.PrivateKeySize+ed25519.PublicKeySize) {
+		return nil, fmt.Errorf("invalid ed25519 key in %s", path)
+	}
+	// older keys have the public key appended once more
+	return privateKey(raw[:ed25519.PrivateKeySize]), nil
+}
+
+// peerID returns the libp2p peer id of the key: the identity multihash of its protobuf encoded public key.
+func (k privateKey) peerID() (string, error) {
+	mh, err := multihash.Sum(k.publicKey(), multihash.IDENTITY, -1)
+	if err != nil {
+		return "", err
+	}
+	return mh.B58String(), nil
+}
+
+// publicKey returns the libp2p protobuf encoding of the public key.
+func (k privateKey) publicKey() []byte {
+	return marshalKey(keyTypeEd25519, ed25519.PrivateKey(k).Public().(ed25519.PublicKey))
+}
+
+// seal returns a libp2p signed envelope of the payload: the public key, the payload type and the payload, signed with
+// the domain in front of them, each prefixed with its length.
+func (k privateKey) seal(payloadType, payload []byte) []byte {
+	var unsigned []byte
+	for _, field := range [][]byte{[]byte(adSignatureDomain), payloadType, payload} {
+		unsigned = binary.AppendUvarint(unsigned, uint64(len(field)))
+		unsigned = append(unsigned, field...)
+	}
+	sig := ed25519.Sign(ed25519.PrivateKey(k), unsigned)
+
+	var envelope []byte
+	envelope = appendField(envelope, 1, k.publicKey())
+	envelope = appendField(envelope, 2, payloadType)
+	envelope = appendField(envelope, 3, payload)
+	return appendField(envelope, 5, sig)
+}
+
+// marshalKey returns the libp2p protobuf encoding of a key: its type, and its bytes.
+func marshalKey(keyType byte, key []byte) []byte {
+	return appendField([]byte{0x08, keyType}, 2, key)
+}
+
+// appendField appends a length delimited protobuf field.
+func appendField(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3|2))
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// transportMetadata returns the metadata of an advertisement: every protocol the content can be retrieved with, by
+// its multicodec in increasing order, followed by its parameters. Graphsync retrievals take the piece cid.
+func transportMetadata(protocols []string, pieceCid cid.Cid, verified, fastRetrieval bool) ([]byte, error) {
+	var codes []uint64
+	for _, p := range protocols {
+		switch p {
+		case "bitswap":
+			codes = append(codes, transportBitswap)
+		case "graphsync":
+			codes = append(codes, transportGraphsyncFilecoin)
+		case "http":
+			codes = append(codes, transportIpfsGatewayHttp)
+		default:
+			return nil, fmt.Errorf("unknown retrieval protocol %q, expected bitswap, graphsync or http", p)
+		}
+	}
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("no retrieval protocols to advertise")
+	}
+	var md []byte
+	for _, code := range []uint64{transportBitswap, transportGraphsyncFilecoin, transportIpfsGatewayHttp} {
+		if !containsCode(codes, code) {
+			continue
+		}
+		md = binary.AppendUvarint(md, code)
+		if code == transportGraphsyncFilecoin {
+			md = append(md, graphsyncParams(pieceCid, verified, fastRetrieval)...)
+		}
+	}
+	return md, nil
+}
+
+func containsCode(codes []uint64, code uint64) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// graphsyncParams returns the dag-cbor encoded GraphsyncFilecoinV1 metadata: {PieceCID, VerifiedDeal, FastRetrieval}.
+func graphsyncParams(pieceCid cid.Cid, verified, fastRetrieval bool) []byte {
+	b := []byte{0xa3}
+	b = appendCborText(b, "PieceCID")
+	// a link is tag 42 of the cid bytes behind a zero byte
+	b = append(b, 0xd8, 0x2a)
+	b = appendCborHead(b, 2, uint64(len(pieceCid.Bytes())+1))
+	b = append(b, 0)
+	b = append(b, pieceCid.Bytes()...)
+	b = appendCborText(b, "VerifiedDeal")
+	b = appendCborBool(b, verified)
+	b = appendCborText(b, "FastRetrieval")
+	return appendCborBool(b, fastRetrieval)
+}
+
+func appendCborHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major<<5|byte(n))
+	case n < 1<<8:
+		return append(b, major<<5|24, byte(n))
+	case n < 1<<16:
+		return binary.BigEndian.AppendUint16(append(b, major<<5|25), uint16(n))
+	case n < 1<<32:
+		return binary.BigEndian.AppendUint32(append(b, major<<5|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, major<<5|27), n)
+	}
+}
+
+func appendCborText(b []byte, s string) []byte {
+	return append(appendCborHead(b, 3, uint64(len(s))), s...)
+}
+
+func appendCborBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xf5)
+	}
+	return append(b, 0xf4)
+}
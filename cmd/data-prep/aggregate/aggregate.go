@@ -0,0 +1,188 @@
+package aggregate
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+var Cmd = &cli.Command{
+	Name:      "aggregate",
+	Usage:     "aggregate car pieces into a single piece with a data segment index (FRC-0058)",
+	ArgsUsage: "<car files or directories of car files>",
+	Action:    aggregate,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "metadata",
+			Aliases:  []string{"m"},
+			Required: false,
+			Value:    "__aggregate.yaml",
+			Usage:    "yaml file to write the aggregate piece and its segments to.",
+		},
+		&cli.StringFlag{
+			Name:     "output",
+			Aliases:  []string{"o"},
+			Required: false,
+			Usage:    "optional prefix of the aggregate file name, may include a directory.",
+		},
+		&cli.Uint64Flag{
+			Name:     "deal-size",
+			Required: false,
+			Usage:    "optional padded size of the aggregate, e.g. 34359738368 for a 32GiB sector. Defaults to the smallest size holding all pieces and the index.",
+		},
+		&cli.IntFlag{
+			Name:     "workers",
+			Required: false,
+			Value:    runtime.NumCPU(),
+			Usage:    "number of car files to calculate commP for concurrently.",
+		},
+		&cli.BoolFlag{
+			Name:     "commp-skip-zeros",
+			Required: false,
+			Usage:    "optional, short-circuit commP over all-zero regions instead of hashing them. Gives the same commP, but is much faster on sparse pieces.",
+		},
+	},
+}
+
+// aggregateMetadata is what gets written to the --metadata file.
+type aggregateMetadata struct {
+	Aggregate splitter.CarFile   `yaml:"aggregate"`
+	Segments  []splitter.Segment `yaml:"segments"`
+	Tool      metadata.Tool      `yaml:"tool"`
+}
+
+// aggregate calculates the commP of every car file given, lays them out as the segments of an aggregate, and writes
+// the aggregate along with its data segment index. The aggregate is named after its commP, like a piece.
+func aggregate(c *cli.Context) error {
+	if c.Args().Len() == 0 {
+		return fmt.Errorf("expected car files or directories of car files to aggregate")
+	}
+	paths, err := carFiles(c.Args().Slice())
+	if err != nil {
+		return err
+	}
+	prefix, err := splitter.NamePrefix(c.String("output"), true)
+	if err != nil {
+		return err
+	}
+
+	workers := c.Int("workers")
+	if workers < 1 {
+		workers = 1
+	}
+	skipZeros := c.Bool("commp-skip-zeros")
+	pieces := make([]splitter.CarFile, len(paths))
+	errs := make([]error, len(paths))
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+	for i, p := range paths {
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			// FRC-0058 is defined for the commP of unsealed sectors only
+			pieces[i], errs[i] = splitter.ExistingPiece(p, splitter.FilCommitmentUnsealed, skipZeros)
+		}(i, p)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	segments, dealSize, err := splitter.LayoutAggregate(pieces, c.Uint64("deal-size"))
+	if err != nil {
+		return err
+	}
+	fname := prefix + "aggregate.car"
+	rawCommP, err := splitter.WriteAggregate(fname, segments, dealSize)
+	if err != nil {
+		os.Remove(fname)
+		return err
+	}
+	commCid, err := commcid.DataCommitmentV1ToCID(rawCommP)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s%s.car", prefix, commCid)
+	if err := os.Rename(fname, name); err != nil {
+		return err
+	}
+
+	proofs, err := splitter.AggregateProofs(segments, dealSize)
+	if err != nil {
+		return err
+	}
+	for i := range segments {
+		segments[i].Proof = &proofs[i]
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	m := aggregateMetadata{
+		Aggregate: splitter.CarFile{
+			Name:        name,
+			CommP:       splitter.PieceCid{Cid: commCid},
+			PaddedSize:  dealSize,
+			ContentSize: uint64(fi.Size()),
+		},
+		Segments: segments,
+		Tool:     metadata.NewTool(c),
+	}
+	b, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.String("metadata"), b, 0o644); err != nil {
+		return fmt.Errorf("failed to write metadata: %s", err)
+	}
+
+	fmt.Printf("aggregate piece cid = %s\n", commCid)
+	fmt.Printf("padded size = %d, %d segments\n", dealSize, len(segments))
+	return nil
+}
+
+// carFiles returns the given car files, and the .car files below the given directories in lexical order.
+func carFiles(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		err = filepath.WalkDir(arg, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && strings.EqualFold(filepath.Ext(p), ".car") {
+				paths = append(paths, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no car files found in %s", strings.Join(args, ", "))
+	}
+	return paths, nil
+}
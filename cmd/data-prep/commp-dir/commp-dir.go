@@ -0,0 +1,167 @@
+package commp_dir
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/urfave/cli/v2"
+)
+
+var Cmd = &cli.Command{
+	Name:      "commp-dir",
+	Usage:     "calculate commP of existing car pieces and write their metadata",
+	ArgsUsage: "<directory of car files>",
+	Action:    commpDir,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "metadata",
+			Aliases:  []string{"m"},
+			Required: false,
+			Value:    "__metadata.csv",
+			Usage:    "metadata file name. ",
+		},
+		&cli.IntFlag{
+			Name:     "workers",
+			Required: false,
+			Value:    runtime.NumCPU(),
+			Usage:    "number of car files to calculate commP for concurrently.",
+		},
+		&cli.BoolFlag{
+			Name:     "commp-skip-zeros",
+			Required: false,
+			Usage:    "optional, short-circuit commP over all-zero regions instead of hashing them. Gives the same commP, but is much faster on sparse pieces.",
+		},
+		&cli.StringFlag{
+			Name:     "commp-algorithm",
+			Required: false,
+			Value:    splitter.FilCommitmentUnsealed.Name(),
+			Usage:    "piece commitment algorithm, one of: " + strings.Join(splitter.CommPAlgorithmNames(), ", ") + ". Recorded in the metadata.",
+		},
+		&cli.StringFlag{
+			Name:     "format",
+			Required: false,
+			Value:    metadata.FormatCSV,
+			Usage:    "format of the piece table: csv, parquet or ndjson (written next to the metadata file, with a .parquet or .ndjson extension, instead of the csv). The yaml metadata is written either way.",
+		},
+		&cli.StringFlag{
+			Name:     "timestamp-format",
+			Required: false,
+			Value:    "rfc3339",
+			Usage:    "format of the csv metadata timestamps: rfc3339, unix (epoch seconds), unix-ms (epoch milliseconds) or a Go time layout like \"2006-01-02 15:04:05\".",
+		},
+		&cli.StringFlag{
+			Name:     "timezone",
+			Required: false,
+			Value:    "UTC",
+			Usage:    "timezone of the csv metadata timestamps: UTC, Local or an IANA name like Europe/Berlin.",
+		},
+	},
+}
+
+// commpDir backfills the metadata of a directory of car pieces: every .car file below it (in lexical order) is read
+// once to calculate its commP, and the results are written as the usual csv and yaml metadata files. The pieces are
+// not renamed.
+func commpDir(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		return fmt.Errorf("expected a directory of car files")
+	}
+	ts, err := metadata.NewTimestamps(c.String("timestamp-format"), c.String("timezone"))
+	if err != nil {
+		return err
+	}
+	if err := metadata.ValidateFormat(c.String("format")); err != nil {
+		return err
+	}
+
+	var paths []string
+	err = filepath.WalkDir(c.Args().First(), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.EqualFold(filepath.Ext(p), ".car") {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no car files found in %s", c.Args().First())
+	}
+
+	workers := c.Int("workers")
+	if workers < 1 {
+		workers = 1
+	}
+	skipZeros := c.Bool("commp-skip-zeros")
+	algorithm, err := splitter.ParseCommPAlgorithm(c.String("commp-algorithm"))
+	if err != nil {
+		return err
+	}
+	pieces := make([]splitter.CarFile, len(paths))
+	errs := make([]error, len(paths))
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+	for i, p := range paths {
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			pieces[i], errs[i] = splitter.ExistingPiece(p, algorithm, skipZeros)
+		}(i, p)
+	}
+	wg.Wait()
+
+	m := &splitter.CarPiecesAndMetadata{CommPAlgorithm: algorithm.Name()}
+	var failed int
+	for i, err := range errs {
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			continue
+		}
+		m.CarPieces = append(m.CarPieces, pieces[i])
+	}
+
+	if err := writeMetadata(c.String("metadata"), c.String("format"), m, metadata.NewTool(c), ts); err != nil {
+		return err
+	}
+	fmt.Printf("%d pieces\n", len(m.CarPieces))
+	if failed > 0 {
+		return fmt.Errorf("%d of %d car files failed", failed, len(paths))
+	}
+	return nil
+}
+
+// writeMetadata writes the piece table (csv, or parquet or ndjson next to the metadata path), and next to it the yaml file.
+// The csv gets a column for the size of the index if any of the car files is a CARv2 file.
+func writeMetadata(meta string, tableFormat string, m *splitter.CarPiecesAndMetadata, tool metadata.Tool, ts metadata.Timestamps) error {
+	columns := []string{
+		metadata.ColumnTimestamp,
+		metadata.ColumnCarFile,
+		metadata.ColumnPieceCid,
+		metadata.ColumnPaddedSize,
+		metadata.ColumnHeaderSize,
+		metadata.ColumnContentSize,
+	}
+	for _, cf := range m.CarPieces {
+		if cf.IndexSize > 0 {
+			columns = append(columns, metadata.ColumnIndexSize)
+			break
+		}
+	}
+	sink, err := metadata.NewFileSink(meta, tableFormat, columns, ts)
+	if err != nil {
+		return err
+	}
+	return metadata.Write(sink, metadata.Summary{CarPiecesMeta: m, Tool: tool})
+}
@@ -0,0 +1,110 @@
+package commp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/urfave/cli/v2"
+)
+
+var Cmd = &cli.Command{
+	Name:      "commp",
+	Usage:     "calculate commP of car files or piece payloads without splitting or writing anything",
+	ArgsUsage: "[<file> ...]",
+	Action:    commpAction,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:     "commp-skip-zeros",
+			Required: false,
+			Usage:    "optional, short-circuit commP over all-zero regions instead of hashing them. Gives the same commP, but is much faster on sparse inputs.",
+		},
+		&cli.StringFlag{
+			Name:     "commp-algorithm",
+			Required: false,
+			Value:    splitter.FilCommitmentUnsealed.Name(),
+			Usage:    "piece commitment algorithm, one of: " + strings.Join(splitter.CommPAlgorithmNames(), ", ") + ".",
+		},
+		&cli.BoolFlag{
+			Name:     "json",
+			Required: false,
+			Usage:    "print the results as json instead of a table.",
+			Value:    false,
+		},
+	},
+}
+
+type commpRow struct {
+	File        string `json:"file"`
+	PieceCid    string `json:"pieceCid"`
+	PaddedSize  uint64 `json:"paddedSize"`
+	PayloadSize int64  `json:"payloadSize"`
+}
+
+// commpAction calculates commP of every file given, or of stdin if there are none (or for "-"). Every input is taken
+// as the payload of a piece as is, a car file or anything else, and is read once. Inputs that fail are reported, and
+// the others still printed.
+func commpAction(c *cli.Context) error {
+	algorithm, err := splitter.ParseCommPAlgorithm(c.String("commp-algorithm"))
+	if err != nil {
+		return err
+	}
+	inputs := c.Args().Slice()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	var rows []commpRow
+	var failed int
+	for _, in := range inputs {
+		row, err := commP(in, algorithm, c.Bool("commp-skip-zeros"))
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: %s\n", in, err)
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(rows); err != nil {
+			return err
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "piece cid\tpadded size\tpayload size\tfile\t")
+		for _, r := range rows {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t\n", r.PieceCid, r.PaddedSize, r.PayloadSize, r.File)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d inputs failed", failed, len(inputs))
+	}
+	return nil
+}
+
+func commP(in string, algorithm splitter.CommPAlgorithm, skipZeros bool) (commpRow, error) {
+	var r io.Reader = os.Stdin
+	if in != "-" {
+		f, err := os.Open(in)
+		if err != nil {
+			return commpRow{}, err
+		}
+		defer f.Close()
+		r = f
+	}
+	pieceCid, paddedSize, n, err := splitter.CommP(r, algorithm, skipZeros)
+	if err != nil {
+		return commpRow{}, err
+	}
+	return commpRow{File: in, PieceCid: pieceCid.String(), PaddedSize: paddedSize, PayloadSize: n}, nil
+}
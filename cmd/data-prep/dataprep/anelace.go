@@ -0,0 +1,487 @@
+package dataprep
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anjor/anelace"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/preflight"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	unixfspb "github.com/ipfs/go-unixfs/pb"
+	"github.com/multiformats/go-multihash"
+)
+
+// The dag layouts of DagOptions.Layout.
+const (
+	LayoutTrickle  = "trickle"
+	LayoutBalanced = "balanced"
+)
+
+// maxChunkSize is the largest leaf anelace builds.
+const maxChunkSize = 1 << 20
+
+// The links of the nodes of trickle dags, as anelace builds them: a trickle node links to its direct leaves, then to
+// up to maxSiblingSubgroups subgroups for every level below it. No file comes close to maxTrickleDepth levels.
+const (
+	defaultTrickleLeaves = 2048
+	maxSiblingSubgroups  = 8
+	maxTrickleDepth      = 24
+)
+
+// The defaults of kubo: leaves of kuboChunkSize, and up to kuboMaxLinks links per node. kubo also repeats every level
+// of a trickle dag kuboLayerRepeat times.
+const (
+	kuboChunkSize   = 1 << 18
+	kuboMaxLinks    = 174
+	kuboLayerRepeat = 4
+)
+
+// defaultInlineMaxSize is the largest block anelace inlines into an identity cid by default.
+const defaultInlineMaxSize = 36
+
+// DagOptions configures how anelace builds the dags of the files. The zero value builds them with the anelace
+// defaults: leaves of 1MiB of data as CIDv1 raw blocks, in a trickle dag of up to 2048 direct leaves, hashed with
+// sha2-256. The directory nodes built here follow the cid version and hash of the file dags.
+type DagOptions struct {
+	// Chunker cuts the files into leaves: "fixed:<size>", of up to 1MiB, or the content defined "rabin" or "buzhash",
+	// with the parameters of kubo.
+	Chunker string
+	// Layout is the shape of the dag: LayoutTrickle (the default) or LayoutBalanced.
+	Layout string
+	// MaxLinks, if set, is the most links of a node: the direct leaves of a trickle node, 2048 by default, or the
+	// children of a balanced node, 174 by default as in kubo.
+	MaxLinks int
+	// CidV0 builds the dag-pb nodes as CIDv0, for pinsets of CIDv0 cids, and inlines no blocks. It needs sha2-256.
+	CidV0 bool
+	// Hash is the hash function of the blocks: "sha2-256" (the default), "sha3-512" or "blake2b-256".
+	Hash string
+	// NoRawLeaves wraps the data of the leaves into unixfs nodes, as ipfs add does for CIDv0, instead of raw blocks.
+	NoRawLeaves bool
+	// IpfsAddCommand, if set, builds the dags like this ipfs add command does, e.g. "ipfs add --cid-version=1
+	// --chunker=size-262144", instead of by any of the options above. It takes the --cid-version, --hash,
+	// --raw-leaves, --chunker, --trickle, --inline and --inline-limit options of ipfs add.
+	IpfsAddCommand string
+}
+
+// dagHashes are the hash functions anelace can build dags with, by their multihash names.
+var dagHashes = []string{"sha2-256", "sha3-512", "blake2b-256"}
+
+// dagFormat is what the blocks of the dags are built as, for the directory nodes to match the dags of the files.
+type dagFormat struct {
+	cidV0  bool
+	mhType uint64
+	// rawLeaves are leaves as raw blocks, otherwise they are wrapped into unixfs nodes of leafType
+	rawLeaves bool
+	leafType  unixfspb.Data_DataType
+	// inlineMaxSize is the largest block inlined into an identity cid, 0 if none are
+	inlineMaxSize int
+	// minLeafSize and maxLeafSize bound the file data of a leaf, but for the last one of a file
+	minLeafSize, maxLeafSize int
+	// maxLinks is the most links of a node of the dags
+	maxLinks int
+	// argv are the anelace arguments to build the dags of the files with
+	argv []string
+}
+
+// format checks the options and returns what the dags are built as. The options are checked here, anelace exits the
+// process on arguments it can't parse.
+func (d DagOptions) format() (dagFormat, error) {
+	if d.IpfsAddCommand != "" {
+		if d != (DagOptions{IpfsAddCommand: d.IpfsAddCommand}) {
+			return dagFormat{}, fmt.Errorf("an ipfs add command can't be combined with other dag options, it sets all of them")
+		}
+		return parseIpfsAdd(d.IpfsAddCommand)
+	}
+	f, err := dagHash(d.Hash, d.CidV0)
+	if err != nil {
+		return dagFormat{}, err
+	}
+
+	switch {
+	case d.Chunker == "":
+		f.minLeafSize, f.maxLeafSize = maxChunkSize, maxChunkSize
+	case d.Chunker == "rabin":
+		f.argv = append(f.argv, "--chunker=rabin_polynomial=17437180132763653_window-size=16_state-target=0_state-mask-bits=18_min-size=87381_max-size=393216")
+		f.minLeafSize, f.maxLeafSize = 87381, 393216
+	case d.Chunker == "buzhash":
+		f.argv = append(f.argv, "--chunker=buzhash_hash-table=GoIPFSv0_state-target=0_state-mask-bits=17_min-size=131072_max-size=524288")
+		f.minLeafSize, f.maxLeafSize = 131072, 524288
+	case strings.HasPrefix(d.Chunker, "fixed:"):
+		size, err := strconv.Atoi(strings.TrimPrefix(d.Chunker, "fixed:"))
+		if err != nil || size < 1 || size > maxChunkSize {
+			return dagFormat{}, fmt.Errorf("invalid chunker %q, the size of fixed size chunks must be between 1 and %d bytes", d.Chunker, maxChunkSize)
+		}
+		f.argv = append(f.argv, fmt.Sprintf("--chunker=fixed-size_%d", size))
+		f.minLeafSize, f.maxLeafSize = size, size
+	default:
+		return dagFormat{}, fmt.Errorf("unknown chunker %q, expected one of: fixed:<size>, rabin, buzhash", d.Chunker)
+	}
+
+	if d.MaxLinks < 0 {
+		return dagFormat{}, fmt.Errorf("max links must not be negative, got %d", d.MaxLinks)
+	}
+	f.rawLeaves = !d.NoRawLeaves
+	f.inlineMaxSize = defaultInlineMaxSize
+	// wrapped leaves are unixfs raw nodes in a trickle dag and file nodes in a balanced one, as in kubo
+	f.leafType = unixfspb.Data_Raw
+	switch d.Layout {
+	case "", LayoutTrickle:
+		leaves := defaultTrickleLeaves
+		if d.MaxLinks > 0 {
+			leaves = d.MaxLinks
+			f.argv = append(f.argv, fmt.Sprintf("--collector=trickle_max-direct-leaves=%d_max-sibling-subgroups=%d", d.MaxLinks, maxSiblingSubgroups))
+		}
+		f.maxLinks = leaves + maxSiblingSubgroups*maxTrickleDepth
+	case LayoutBalanced:
+		maxLinks := d.MaxLinks
+		if maxLinks == 0 {
+			maxLinks = kuboMaxLinks
+		}
+		if maxLinks < 2 {
+			return dagFormat{}, fmt.Errorf("the nodes of a %s dag need at least 2 links, got %d", LayoutBalanced, maxLinks)
+		}
+		f.argv = append(f.argv, fmt.Sprintf("--collector=fixed-outdegree_max-outdegree=%d", maxLinks))
+		f.maxLinks = maxLinks
+		f.leafType = unixfspb.Data_File
+	default:
+		return dagFormat{}, fmt.Errorf("unknown dag layout %q, expected one of: %s, %s", d.Layout, LayoutTrickle, LayoutBalanced)
+	}
+
+	if d.CidV0 || d.NoRawLeaves {
+		// the nodes are encoded like go-ipfs does, so that the cids match those of ipfs add
+		encoder := []string{"unixfsv1", "merkledag-compat-protobuf"}
+		if d.CidV0 {
+			encoder = append(encoder, "cidv0")
+		}
+		if d.NoRawLeaves {
+			encoder = append(encoder, fmt.Sprintf("unixfs-leaf-decorator-type=%d", f.leafType))
+		}
+		f.argv = append(f.argv, "--node-encoder="+strings.Join(encoder, "_"))
+	}
+	if d.CidV0 {
+		// identity cids are CIDv1, kubo doesn't inline blocks into CIDv0 dags
+		f.argv = append(f.argv, "--inline-max-size=0")
+		f.inlineMaxSize = 0
+	}
+	return f, nil
+}
+
+// dagHash returns the format of dags with the given hash function and cid version, with the anelace argument to
+// select the hash if it is not the default.
+func dagHash(hash string, cidV0 bool) (dagFormat, error) {
+	f := dagFormat{cidV0: cidV0, mhType: multihash.SHA2_256}
+	if hash == "" || hash == "sha2-256" {
+		return f, nil
+	}
+	for _, h := range dagHashes {
+		if h == hash {
+			if cidV0 {
+				return dagFormat{}, fmt.Errorf("CIDv0 only supports sha2-256, not %s", hash)
+			}
+			f.mhType = multihash.Names[hash]
+			f.argv = append(f.argv, "--hash="+hash)
+			return f, nil
+		}
+	}
+	return dagFormat{}, fmt.Errorf("unknown hash function %q, expected one of: %s", hash, strings.Join(dagHashes, ", "))
+}
+
+// parseIpfsAdd parses an ipfs add command, and returns the format of the dags it builds, with the command as anelace
+// takes it.
+func parseIpfsAdd(command string) (dagFormat, error) {
+	args := strings.Fields(command)
+	if len(args) > 0 && args[0] == "ipfs" {
+		args = args[1:]
+	}
+	if len(args) == 0 || args[0] != "add" {
+		return dagFormat{}, fmt.Errorf("invalid ipfs add command %q: expected it to start with ipfs add", command)
+	}
+
+	// kubo defaults to CIDv0, and to raw leaves with CIDv1
+	cidVersion, hash := 0, ""
+	var rawLeaves *bool
+	trickle := false
+	minLeafSize, maxLeafSize := kuboChunkSize, kuboChunkSize
+	// kubo inlines no blocks unless asked to, and then up to 32 bytes
+	inline, inlineLimit := false, 32
+	var options []string
+	for i := 1; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(args[i], "--"), "=")
+		if !strings.HasPrefix(args[i], "--") {
+			return dagFormat{}, fmt.Errorf("invalid ipfs add command %q: unexpected argument %q", command, args[i])
+		}
+		switch name {
+		case "raw-leaves", "trickle", "inline":
+			if !hasValue {
+				value = "true"
+			}
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return dagFormat{}, fmt.Errorf("invalid ipfs add command %q: --%s takes true or false, got %q", command, name, value)
+			}
+			switch name {
+			case "raw-leaves":
+				rawLeaves = &b
+			case "trickle":
+				trickle = b
+			case "inline":
+				inline = b
+			}
+			options = append(options, fmt.Sprintf("--%s=%s", name, value))
+			continue
+		case "cid-version", "hash", "chunker", "inline-limit":
+		default:
+			return dagFormat{}, fmt.Errorf("invalid ipfs add command %q: unsupported option --%s", command, name)
+		}
+		if !hasValue {
+			if i++; i == len(args) {
+				return dagFormat{}, fmt.Errorf("invalid ipfs add command %q: --%s needs a value", command, name)
+			}
+			value = args[i]
+		}
+		switch name {
+		case "cid-version":
+			v, err := strconv.Atoi(value)
+			if err != nil || (v != 0 && v != 1) {
+				return dagFormat{}, fmt.Errorf("invalid ipfs add command %q: --cid-version must be 0 or 1, got %q", command, value)
+			}
+			cidVersion = v
+			continue
+		case "hash":
+			hash = value
+		case "chunker":
+			var err error
+			if minLeafSize, maxLeafSize, err = ipfsChunkSizes(value); err != nil {
+				return dagFormat{}, fmt.Errorf("invalid ipfs add command %q: %s", command, err)
+			}
+		case "inline-limit":
+			v, err := strconv.Atoi(value)
+			if err != nil || v < 4 || v >= maxChunkSize {
+				return dagFormat{}, fmt.Errorf("invalid ipfs add command %q: --inline-limit must be between 4 and %d, got %q", command, maxChunkSize-1, value)
+			}
+			inlineLimit = v
+		}
+		options = append(options, fmt.Sprintf("--%s=%s", name, value))
+	}
+
+	f, err := dagHash(hash, cidVersion == 0)
+	if err != nil {
+		return dagFormat{}, fmt.Errorf("invalid ipfs add command %q: %s", command, err)
+	}
+	f.rawLeaves = cidVersion == 1
+	if rawLeaves != nil {
+		f.rawLeaves = *rawLeaves
+	}
+	f.minLeafSize, f.maxLeafSize = minLeafSize, maxLeafSize
+	f.leafType = unixfspb.Data_File
+	f.maxLinks = kuboMaxLinks
+	if trickle {
+		f.leafType = unixfspb.Data_Raw
+		f.maxLinks = kuboMaxLinks + kuboLayerRepeat*maxTrickleDepth
+	}
+	if inline {
+		f.inlineMaxSize = inlineLimit
+	}
+	// anelace reports CIDv1 roots for CIDv0 dags only if asked to, they are turned into CIDv0 in fileRoots
+	cmd := []string{"add", fmt.Sprintf("--cid-version=%d", cidVersion)}
+	if cidVersion == 0 {
+		cmd = append(cmd, "--upgrade-cidv0-in-output=true")
+	}
+	cmd = append(cmd, options...)
+	// anelace takes the hash from the command itself
+	f.argv = []string{"--ipfs-add-compatible-command=" + strings.Join(cmd, " ")}
+	return f, nil
+}
+
+// ipfsChunkSizes checks a chunker of ipfs add: size or size-<bytes>, rabin, rabin-<avg> or rabin-<min>-<avg>-<max>,
+// or buzhash. It returns the smallest and largest leaves the chunker cuts, but for the last one of a file.
+func ipfsChunkSizes(chunker string) (int, int, error) {
+	parts := strings.Split(chunker, "-")
+	sizes := make([]int, len(parts)-1)
+	for i, p := range parts[1:] {
+		var err error
+		if sizes[i], err = strconv.Atoi(p); err != nil || sizes[i] < 1 {
+			return 0, 0, fmt.Errorf("invalid chunker %q", chunker)
+		}
+	}
+	switch {
+	case parts[0] == "size" && len(sizes) <= 1:
+		if len(sizes) == 0 {
+			return kuboChunkSize, kuboChunkSize, nil
+		}
+		if sizes[0] > maxChunkSize {
+			return 0, 0, fmt.Errorf("invalid chunker %q, the size of chunks must be at most %d bytes", chunker, maxChunkSize)
+		}
+		return sizes[0], sizes[0], nil
+	case parts[0] == "rabin" && (len(sizes) == 0 || len(sizes) == 1 || len(sizes) == 3):
+		// anelace derives the bounds from the average chunk size as kubo does, if only that is given
+		switch len(sizes) {
+		case 0:
+			sizes = []int{kuboChunkSize}
+			fallthrough
+		case 1:
+			sizes = []int{sizes[0] / 3, sizes[0], sizes[0] + sizes[0]/2}
+		}
+		if sizes[1] < 32 || sizes[1] >= 1<<23 || sizes[0] >= sizes[2] || sizes[2] > maxChunkSize {
+			return 0, 0, fmt.Errorf("invalid chunker %q, expected min < max <= %d bytes and an average of at least 32 bytes", chunker, maxChunkSize)
+		}
+		return sizes[0], sizes[2], nil
+	case parts[0] == "buzhash" && len(sizes) == 0:
+		return 131072, 524288, nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported chunker %q, expected size-<bytes>, rabin-<avg>, rabin-<min>-<avg>-<max> or buzhash", chunker)
+	}
+}
+
+// anelaceArgv returns the arguments to set up anelace with, without any emitters: the car stream and the roots are
+// taken from it directly.
+func (f dagFormat) anelaceArgv() []string {
+	return append([]string{"anelace", "--emit-stdout=none", "--emit-stderr=none"}, f.argv...)
+}
+
+// Blocks checks the options and returns the bounds of the blocks of the dags they build, which the target size of the
+// pieces has to fit (see preflight.ValidateTargetSize).
+func (d DagOptions) Blocks() (preflight.Blocks, error) {
+	f, err := d.format()
+	if err != nil {
+		return preflight.Blocks{}, err
+	}
+	return f.blocks()
+}
+
+// blocks returns the bounds of the blocks of the dags: the largest is a leaf, or a node with the most links.
+func (f dagFormat) blocks() (preflight.Blocks, error) {
+	b := preflight.Blocks{MaxSize: f.maxLeafSize, MinLeafSize: f.minLeafSize}
+	// the cids of a hash function are of the same length for any block, but for inlined ones
+	builders := []cid.Builder{f.builder(), cid.V1Builder{Codec: cid.Raw, MhType: f.mhType}}
+	var inlined []byte
+	if f.inlineMaxSize > 0 {
+		builders = append(builders, cid.V1Builder{Codec: cid.DagProtobuf, MhType: multihash.IDENTITY})
+		inlined = make([]byte, f.inlineMaxSize)
+	}
+	for _, builder := range builders {
+		c, err := builder.Sum(inlined)
+		if err != nil {
+			return preflight.Blocks{}, err
+		}
+		if c.ByteLen() > b.MaxCidLen {
+			b.MaxCidLen = c.ByteLen()
+		}
+	}
+	if size := preflight.NodeSize(f.maxLinks, b.MaxCidLen); size > b.MaxSize {
+		b.MaxSize = size
+	}
+	return b, nil
+}
+
+// builder returns the cid builder of the dag-pb nodes built here.
+func (f dagFormat) builder() cid.Builder {
+	if f.cidV0 {
+		return cid.V0Builder{}
+	}
+	return cid.V1Builder{Codec: cid.DagProtobuf, MhType: f.mhType}
+}
+
+// leaf builds a leaf of the file data.
+func (f dagFormat) leaf(data []byte) (format.Node, error) {
+	if f.rawLeaves {
+		return merkledag.NewRawNodeWPrefix(data, cid.Prefix{Version: 1, Codec: cid.Raw, MhType: f.mhType, MhLength: -1})
+	}
+	fsn := unixfs.NewFSNode(f.leafType)
+	fsn.SetData(data)
+	ndbs, err := fsn.GetBytes()
+	if err != nil {
+		return nil, err
+	}
+	nd := merkledag.NodeWithData(ndbs)
+	nd.SetCidBuilder(f.builder())
+	return nd, nil
+}
+
+// fileRoots turns the roots of the files emitted by anelace, which are always CIDv1, into CIDv0 for CIDv0 dags. Raw
+// leaves and blocks inlined into identity cids stay CIDv1, as in kubo.
+func (f dagFormat) fileRoots(rs []roots) error {
+	if !f.cidV0 {
+		return nil
+	}
+	for i := range rs {
+		c, err := cid.Decode(rs[i].Cid)
+		if err != nil {
+			return fmt.Errorf("invalid root %q: %s", rs[i].Cid, err)
+		}
+		if c.Type() == cid.DagProtobuf && c.Prefix().MhType == multihash.SHA2_256 {
+			rs[i].Cid = cid.NewCidV0(c.Hash()).String()
+		}
+	}
+	return nil
+}
+
+var (
+	// anelaceMu serializes setting up anelace with options, which swaps os.Stdout.
+	anelaceMu sync.Mutex
+	// devNull stays open for as long as the process runs, anelace keeps writing to it.
+	devNull     *os.File
+	devNullOnce sync.Once
+	devNullErr  error
+)
+
+// newAnelace sets up anelace to build dags of the format, writing the car stream to car. The roots are passed on by
+// processReader.
+func newAnelace(f dagFormat, car io.Writer) (*anelace.Anelace, error) {
+	if len(f.argv) == 0 {
+		// the anelace defaults, its emitters can be given writers of their own
+		anl, errs := anelace.NewAnelaceWithWriters(io.Discard, car)
+		if errs != nil {
+			return nil, fmt.Errorf("unexpected error: %s", errs)
+		}
+		return anl, nil
+	}
+
+	devNullOnce.Do(func() {
+		devNull, devNullErr = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	})
+	if devNullErr != nil {
+		return nil, fmt.Errorf("failed to open %s: %s", os.DevNull, devNullErr)
+	}
+
+	// NewAnelaceFromArgv, the only way to pass anelace options, first sets anelace up with its default emitters, which
+	// print the roots to os.Stdout whatever the emitters in argv, so they are pointed elsewhere while it does
+	anelaceMu.Lock()
+	stdout := os.Stdout
+	os.Stdout = devNull
+	anl := anelace.NewAnelaceFromArgv(f.anelaceArgv())
+	os.Stdout = stdout
+	anelaceMu.Unlock()
+
+	anl.SetCarWriter(car)
+	return anl, nil
+}
+
+// processReader runs r through anelace, writing the roots it emits to roots as jsonl, in the format read by getRoots.
+func processReader(anl *anelace.Anelace, r io.Reader, roots io.Writer) error {
+	events := make(chan anelace.IngestionEvent)
+	rootsErr := make(chan error, 1)
+	go func() {
+		var err error
+		// anelace closes the channel once done, drain it even after a failed write so it doesn't block
+		for ev := range events {
+			if ev.Type == anelace.NewRootJsonl && err == nil {
+				_, err = io.WriteString(roots, ev.Body)
+			}
+		}
+		rootsErr <- err
+	}()
+
+	err := anl.ProcessReader(r, events)
+	if rerr := <-rootsErr; err == nil && rerr != nil {
+		return fmt.Errorf("failed to write roots: %s", rerr)
+	}
+	return err
+}
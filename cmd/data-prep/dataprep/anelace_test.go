@@ -0,0 +1,212 @@
+package dataprep
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/preflight"
+)
+
+func TestDagFormat(t *testing.T) {
+	cases := []struct {
+		name          string
+		dag           DagOptions
+		wantV0        bool
+		wantRawLeaves bool
+		wantHash      uint64
+	}{
+		{name: "defaults", wantRawLeaves: true, wantHash: multihash.SHA2_256},
+		{name: "cidv0", dag: DagOptions{CidV0: true, NoRawLeaves: true}, wantV0: true, wantHash: multihash.SHA2_256},
+		{name: "sha3", dag: DagOptions{Hash: "sha3-512"}, wantRawLeaves: true, wantHash: multihash.SHA3_512},
+		{name: "ipfs add", dag: DagOptions{IpfsAddCommand: "ipfs add"}, wantV0: true, wantHash: multihash.SHA2_256},
+		{name: "ipfs add raw leaves", dag: DagOptions{IpfsAddCommand: "ipfs add --raw-leaves"}, wantV0: true, wantRawLeaves: true, wantHash: multihash.SHA2_256},
+		{name: "ipfs add cidv1", dag: DagOptions{IpfsAddCommand: "ipfs add --cid-version=1 --hash=blake2b-256"}, wantRawLeaves: true, wantHash: multihash.BLAKE2B_MIN + 31},
+		{name: "ipfs add cidv1 wrapped leaves", dag: DagOptions{IpfsAddCommand: "ipfs add --cid-version=1 --raw-leaves=false"}, wantHash: multihash.SHA2_256},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := tc.dag.format()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.cidV0 != tc.wantV0 || f.rawLeaves != tc.wantRawLeaves || f.mhType != tc.wantHash {
+				t.Errorf("got CIDv0 %t, raw leaves %t and hash %#x, want %t, %t and %#x", f.cidV0, f.rawLeaves, f.mhType, tc.wantV0, tc.wantRawLeaves, tc.wantHash)
+			}
+			// the directory nodes and the leaves of the manifest are built in the same format
+			leaf, err := f.leaf([]byte("manifest"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p := leaf.Cid().Prefix(); p.MhType != tc.wantHash || (p.Codec == cid.Raw) != tc.wantRawLeaves || (p.Version == 0) != (tc.wantV0 && !tc.wantRawLeaves) {
+				t.Errorf("got a leaf of prefix %+v", p)
+			}
+		})
+	}
+}
+
+func TestAnelaceArgv(t *testing.T) {
+	cases := []struct {
+		name    string
+		dag     DagOptions
+		want    []string
+		wantErr string
+	}{
+		{name: "defaults"},
+		{name: "fixed size chunks", dag: DagOptions{Chunker: "fixed:262144"}, want: []string{"--chunker=fixed-size_262144"}},
+		{name: "largest fixed size chunks", dag: DagOptions{Chunker: "fixed:1048576"}, want: []string{"--chunker=fixed-size_1048576"}},
+		{name: "rabin", dag: DagOptions{Chunker: "rabin"}, want: []string{"--chunker=rabin_"}},
+		{name: "buzhash", dag: DagOptions{Chunker: "buzhash"}, want: []string{"--chunker=buzhash_"}},
+		{name: "trickle", dag: DagOptions{Layout: LayoutTrickle}},
+		{name: "trickle max links", dag: DagOptions{Layout: LayoutTrickle, MaxLinks: 174}, want: []string{"--collector=trickle_max-direct-leaves=174_"}},
+		{name: "balanced", dag: DagOptions{Layout: LayoutBalanced}, want: []string{"--collector=fixed-outdegree_max-outdegree=174"}},
+		{name: "balanced max links", dag: DagOptions{Layout: LayoutBalanced, MaxLinks: 2}, want: []string{"--collector=fixed-outdegree_max-outdegree=2"}},
+		{name: "chunk too large", dag: DagOptions{Chunker: "fixed:1048577"}, wantErr: "must be between 1 and 1048576 bytes"},
+		{name: "empty chunk", dag: DagOptions{Chunker: "fixed:0"}, wantErr: "must be between 1 and 1048576 bytes"},
+		{name: "chunk size not a number", dag: DagOptions{Chunker: "fixed:1MiB"}, wantErr: "must be between 1 and 1048576 bytes"},
+		{name: "anelace chunker name", dag: DagOptions{Chunker: "fixed-size_1024"}, wantErr: "unknown chunker"},
+		{name: "unknown layout", dag: DagOptions{Layout: "flat"}, wantErr: "unknown dag layout"},
+		{name: "negative max links", dag: DagOptions{MaxLinks: -1}, wantErr: "must not be negative"},
+		{name: "balanced single link", dag: DagOptions{Layout: LayoutBalanced, MaxLinks: 1}, wantErr: "need at least 2 links"},
+		{name: "default hash", dag: DagOptions{Hash: "sha2-256"}},
+		{name: "blake2b", dag: DagOptions{Hash: "blake2b-256"}, want: []string{"--hash=blake2b-256"}},
+		{name: "unknown hash", dag: DagOptions{Hash: "md5"}, wantErr: "unknown hash function"},
+		{name: "cidv0", dag: DagOptions{CidV0: true, NoRawLeaves: true}, want: []string{"--node-encoder=unixfsv1_merkledag-compat-protobuf_cidv0_unixfs-leaf-decorator-type=0", "--inline-max-size=0"}},
+		{name: "cidv0 raw leaves", dag: DagOptions{CidV0: true}, want: []string{"--node-encoder=unixfsv1_merkledag-compat-protobuf_cidv0", "--inline-max-size=0"}},
+		{name: "cidv0 sha3", dag: DagOptions{CidV0: true, Hash: "sha3-512"}, wantErr: "CIDv0 only supports sha2-256"},
+		{name: "balanced wrapped leaves", dag: DagOptions{Layout: LayoutBalanced, NoRawLeaves: true}, want: []string{"--collector=fixed-outdegree_", "--node-encoder=unixfsv1_merkledag-compat-protobuf_unixfs-leaf-decorator-type=2"}},
+		{name: "ipfs add", dag: DagOptions{IpfsAddCommand: "ipfs add"}, want: []string{"--ipfs-add-compatible-command=add --cid-version=0 --upgrade-cidv0-in-output=true"}},
+		{name: "ipfs add cidv1", dag: DagOptions{IpfsAddCommand: "add --cid-version 1 --chunker=size-262144 --trickle"}, want: []string{"--ipfs-add-compatible-command=add --cid-version=1 --chunker=size-262144 --trickle=true"}},
+		{name: "ipfs add rabin", dag: DagOptions{IpfsAddCommand: "ipfs add --chunker=rabin-1024-4096-8192 --hash=sha2-256"}, want: []string{"--ipfs-add-compatible-command=add --cid-version=0 --upgrade-cidv0-in-output=true --chunker=rabin-1024-4096-8192 --hash=sha2-256"}},
+		{name: "ipfs add with other options", dag: DagOptions{IpfsAddCommand: "ipfs add", Layout: LayoutBalanced}, wantErr: "can't be combined"},
+		{name: "not ipfs add", dag: DagOptions{IpfsAddCommand: "ipfs cat"}, wantErr: "expected it to start with ipfs add"},
+		{name: "ipfs add unsupported option", dag: DagOptions{IpfsAddCommand: "ipfs add --wrap-with-directory"}, wantErr: "unsupported option --wrap-with-directory"},
+		{name: "ipfs add path", dag: DagOptions{IpfsAddCommand: "ipfs add file.txt"}, wantErr: "unexpected argument"},
+		{name: "ipfs add cid version", dag: DagOptions{IpfsAddCommand: "ipfs add --cid-version=2"}, wantErr: "must be 0 or 1"},
+		{name: "ipfs add cidv0 hash", dag: DagOptions{IpfsAddCommand: "ipfs add --hash=blake2b-256"}, wantErr: "CIDv0 only supports sha2-256"},
+		{name: "ipfs add missing value", dag: DagOptions{IpfsAddCommand: "ipfs add --chunker"}, wantErr: "needs a value"},
+		{name: "ipfs add chunk too large", dag: DagOptions{IpfsAddCommand: "ipfs add --chunker=size-2097152"}, wantErr: "at most 1048576 bytes"},
+		{name: "ipfs add rabin bounds", dag: DagOptions{IpfsAddCommand: "ipfs add --chunker=rabin-8192-4096-1024"}, wantErr: "expected min < max"},
+		{name: "ipfs add unknown chunker", dag: DagOptions{IpfsAddCommand: "ipfs add --chunker=fixed-1024"}, wantErr: "unsupported chunker"},
+		{name: "ipfs add raw leaves", dag: DagOptions{IpfsAddCommand: "ipfs add --raw-leaves=maybe"}, wantErr: "takes true or false"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := tc.dag.format()
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			argv := f.anelaceArgv()
+			// the emitters are always off, and only the options given are passed on
+			if len(argv) != 3+len(tc.want) || argv[1] != "--emit-stdout=none" || argv[2] != "--emit-stderr=none" {
+				t.Fatalf("got argv %q, want the emitters off and %q", argv, tc.want)
+			}
+			for i, w := range tc.want {
+				if !strings.HasPrefix(argv[3+i], w) {
+					t.Errorf("argument %d is %q, want %q", i, argv[3+i], w)
+				}
+			}
+		})
+	}
+}
+
+func TestDagBlocks(t *testing.T) {
+	cases := []struct {
+		name       string
+		dag        DagOptions
+		wantCidLen int
+		// wantNodes is whether the largest block is a node rather than a leaf
+		wantNodes bool
+	}{
+		{name: "defaults", wantCidLen: 36},
+		{name: "sha3", dag: DagOptions{Hash: "sha3-512"}, wantCidLen: 68},
+		{name: "cidv0", dag: DagOptions{CidV0: true, NoRawLeaves: true}, wantCidLen: 36},
+		{name: "small chunks", dag: DagOptions{Chunker: "fixed:1024"}, wantCidLen: 36, wantNodes: true},
+		{name: "balanced small chunks", dag: DagOptions{Chunker: "fixed:1024", Layout: LayoutBalanced}, wantCidLen: 36, wantNodes: true},
+		{name: "ipfs add", dag: DagOptions{IpfsAddCommand: "ipfs add"}, wantCidLen: 36},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := tc.dag.format()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := tc.dag.Blocks()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.MaxCidLen < tc.wantCidLen {
+				t.Errorf("got cids of up to %d bytes, want at least %d", b.MaxCidLen, tc.wantCidLen)
+			}
+			if b.MinLeafSize > f.maxLeafSize || b.MaxSize < f.maxLeafSize {
+				t.Errorf("got leaves of at least %d bytes and blocks of up to %d bytes, for leaves of up to %d bytes", b.MinLeafSize, b.MaxSize, f.maxLeafSize)
+			}
+			if (b.MaxSize > f.maxLeafSize) != tc.wantNodes {
+				t.Errorf("got blocks of up to %d bytes, for leaves of up to %d bytes", b.MaxSize, f.maxLeafSize)
+			}
+		})
+	}
+}
+
+// TestTargetSizeNearLimit preps with small chunks, and a target size right at the limit the dag options allow: every
+// block of the pieces has to be within the bounds the limit was derived from.
+func TestTargetSizeNearLimit(t *testing.T) {
+	dag := DagOptions{Chunker: "fixed:1024"}
+	b, err := dag.Blocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := b.MinTargetSize()
+	if err := preflight.ValidateTargetSize(size-1, b); err == nil {
+		t.Fatalf("target size %d is valid, want it too small", size-1)
+	}
+	// small chunks allow a smaller target size than the leaves of 1MiB of the defaults
+	if err := preflight.ValidateTargetSize(size, preflight.DefaultBlocks); err == nil {
+		t.Fatalf("target size %d is valid for the defaults, want it too small", size)
+	}
+
+	in := filepath.Join(t.TempDir(), "big.bin")
+	data := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := os.WriteFile(in, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Prep(context.Background(), Options{
+		Paths:           []string{in},
+		TargetSize:      size,
+		Output:          filepath.Join(t.TempDir(), "piece"),
+		IgnoreDiskSpace: true,
+		Dag:             dag,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var largest int
+	for _, p := range res.Pieces.CarPieces {
+		_, blocks := readPiece(t, p.Name)
+		for _, nd := range blocks {
+			if len(nd.RawData()) > b.MaxSize || nd.Cid().ByteLen() > b.MaxCidLen {
+				t.Errorf("piece %s: block %s of %d bytes, want at most %d bytes and cids of at most %d bytes", p.Name, nd.Cid(), len(nd.RawData()), b.MaxSize, b.MaxCidLen)
+			}
+			if len(nd.RawData()) > largest {
+				largest = len(nd.RawData())
+			}
+		}
+	}
+	if largest <= 1024 {
+		t.Errorf("the largest block is of %d bytes, want a node linking to more leaves than fit in a leaf", largest)
+	}
+}
@@ -0,0 +1,163 @@
+package dataprep
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/ipfs/go-cid"
+)
+
+// carPerFile preps every file into cars of its own instead of splitting one stream of all files by size: each file is
+// run through anelace separately and its car stream is split on its own, so a piece never holds blocks of more than
+// one file. Files larger than the target size still end up in several pieces. The directory nodes tying the files
+// together (and the manifest, if embedded) go into a final piece. Along with the root cid and the pieces, it returns the
+// size of the file data in the dag. With trackLargeFiles, it also returns the pieces and byte ranges of the files larger
+// than the target size, and with trackAllFiles those of every file. On failure, the pieces completed so far are returned
+// along with the error.
+func carPerFile(
+	ctx context.Context,
+	paths []string,
+	files []string,
+	names []string,
+	links []symlink,
+	fileReaders []io.Reader,
+	targetSize int,
+	namePrefix string,
+	opts splitter.Options,
+	pipeBuffer int,
+	dag dagFormat,
+	strictRoots bool,
+	embedManifest bool,
+	blockOrder string,
+	shardThreshold int,
+	trackLargeFiles bool,
+	trackAllFiles bool,
+) (cid.Cid, *splitter.CarPiecesAndMetadata, uint64, []metadata.FilePieces, []metadata.FilePieces, error) {
+	if len(files) == 0 {
+		return cid.Undef, nil, 0, nil, nil, fmt.Errorf("no files to prep")
+	}
+
+	out := &splitter.CarPiecesAndMetadata{}
+	rs := make([]roots, 0, len(files))
+	var spanning, allFiles []metadata.FilePieces
+	for i, fr := range fileReaders {
+		var tracker *blockTracker
+		mr, ok := fr.(*multipartReader)
+		large := ok && trackLargeFiles && mr.size > int64(targetSize)
+		if large || trackAllFiles {
+			tracker = newBlockTracker()
+		}
+		// the pieces of every file are numbered on from those of the files before
+		opts.FirstIndex = len(out.CarPieces)
+		r, m, err := prepFile(ctx, files[i], fr, targetSize, namePrefix, opts, pipeBuffer, dag, strictRoots, tracker)
+		if err != nil {
+			if m != nil {
+				out.CarPieces = append(out.CarPieces, m.CarPieces...)
+			}
+			return cid.Undef, out, 0, nil, nil, fmt.Errorf("failed to prep %s: %s", files[i], err)
+		}
+		if tracker != nil {
+			fp, err := tracker.fileRanges(files[i], r.Cid, m)
+			if err != nil {
+				return cid.Undef, nil, 0, nil, nil, err
+			}
+			if large {
+				spanning = append(spanning, fp)
+			}
+			if trackAllFiles {
+				allFiles = append(allFiles, fp)
+			}
+		}
+		for _, cf := range m.CarPieces {
+			cf.File = files[i]
+			cf.FileRoot = r.Cid
+			out.CarPieces = append(out.CarPieces, cf)
+		}
+		// all streams are written by anelace with the same header
+		out.OriginalCarHeaderSize = m.OriginalCarHeaderSize
+		out.OriginalCarHeader = m.OriginalCarHeader
+		out.CommPAlgorithm = m.CommPAlgorithm
+		rs = append(rs, r)
+	}
+
+	rcid, blocks, err := directoryBlocks(paths, names, rs, links, embedManifest, blockOrder, shardThreshold, dag)
+	if err != nil {
+		return cid.Undef, nil, 0, nil, nil, err
+	}
+	treePieces, err := splitDirectoryBlocks(ctx, blocks, out.OriginalCarHeader, targetSize, namePrefix, len(out.CarPieces), opts)
+	if err != nil {
+		return cid.Undef, out, 0, nil, nil, err
+	}
+	out.CarPieces = append(out.CarPieces, treePieces...)
+
+	return rcid, out, payloadSize(rs), spanning, allFiles, nil
+}
+
+// prepFile runs a single file through anelace and splits the resulting car stream. If tracker is set, it follows the
+// stream on its way to the splitter. If the split fails, the pieces completed before are returned along with the error.
+func prepFile(
+	ctx context.Context,
+	file string,
+	fr io.Reader,
+	targetSize int,
+	namePrefix string,
+	opts splitter.Options,
+	pipeBuffer int,
+	dag dagFormat,
+	strictRoots bool,
+	tracker *blockTracker,
+) (roots, *splitter.CarPiecesAndMetadata, error) {
+	rerr, werr := io.Pipe()
+	rout, wout := newPipe(pipeBuffer)
+
+	anl, err := newAnelace(dag, wout)
+	if err != nil {
+		return roots{}, nil, err
+	}
+	anl.SetMultipart(true)
+
+	go func() {
+		err := processReader(anl, &ctxReader{ctx: ctx, r: fr}, werr)
+		werr.CloseWithError(err)
+		wout.CloseWithError(err)
+	}()
+
+	var rs []roots
+	var rootsErr error
+	rootsDone := make(chan struct{})
+	go func() {
+		defer close(rootsDone)
+		rs, rootsErr = getRoots(rerr, strictRoots)
+	}()
+
+	var stream io.Reader = rout
+	if tracker != nil {
+		stream = tracker.track(rout)
+	}
+	m, err := splitter.SplitAndCommpContext(ctx, stream, targetSize, namePrefix, opts)
+	// unblock anelace in case the split stopped early
+	rout.Close()
+	<-rootsDone
+	if tracker != nil {
+		if terr := tracker.wait(); err == nil {
+			err = terr
+		}
+	}
+	if err != nil {
+		return roots{}, m, err
+	}
+	if rootsErr != nil {
+		return roots{}, nil, rootsErr
+	}
+	if rs, err = reconcileRoots([]string{file}, fileSizes([]io.Reader{fr}), rs, dag); err != nil {
+		return roots{}, nil, err
+	}
+	if err := dag.fileRoots(rs); err != nil {
+		return roots{}, nil, err
+	}
+
+	return rs[0], m, nil
+}
@@ -0,0 +1,265 @@
+package dataprep
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	mdtest "github.com/ipfs/go-merkledag/test"
+	uio "github.com/ipfs/go-unixfs/io"
+	car "github.com/ipld/go-car"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+)
+
+// TestPiecesReadByGoCar preps a directory, reads every piece with go-car's reader and checks that the blocks of all
+// pieces together are the dag of the directory, with the contents of all its files, whatever the shape of the dag.
+func TestPiecesReadByGoCar(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	files := map[string][]byte{
+		"a.txt":             []byte("hello"),
+		"empty":             nil,
+		"big.bin":           random(5<<20 + 123),
+		"sub/b.bin":         random(300 << 10),
+		"sub/deeper/c.bin":  random(2<<20 + 1),
+		"sub/deeper/d.txt":  []byte("world"),
+		"other/e.bin":       random(1 << 20),
+		"other/zeros.bin":   make([]byte, 3<<20),
+		"other/x/y/z/f.bin": random(70000),
+	}
+	in := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(in, "data", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name string
+		mode splitter.PieceRootMode
+		dag  DagOptions
+		// wantEmpty is the cid of the empty file, if known
+		wantEmpty string
+		// sameAs is the case building the same dag, if any
+		sameAs string
+	}{
+		{name: "null roots", mode: splitter.PieceRootNull},
+		{name: "first block roots", mode: splitter.PieceRootFirstBlock},
+		{name: "balanced dag", mode: splitter.PieceRootNull, dag: DagOptions{Chunker: "fixed:65536", Layout: LayoutBalanced, MaxLinks: 3}},
+		{name: "trickle dag", mode: splitter.PieceRootNull, dag: DagOptions{Chunker: "fixed:65536", Layout: LayoutTrickle, MaxLinks: 3}},
+		{name: "rabin chunks", mode: splitter.PieceRootNull, dag: DagOptions{Chunker: "rabin"}},
+		{name: "buzhash chunks", mode: splitter.PieceRootNull, dag: DagOptions{Chunker: "buzhash", Layout: LayoutBalanced}},
+		{name: "cidv0", mode: splitter.PieceRootNull, dag: DagOptions{CidV0: true, NoRawLeaves: true, Chunker: "fixed:262144", Layout: LayoutBalanced}, wantEmpty: "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"},
+		{name: "blake2b", mode: splitter.PieceRootNull, dag: DagOptions{Hash: "blake2b-256"}},
+		{name: "ipfs add", mode: splitter.PieceRootNull, dag: DagOptions{IpfsAddCommand: "ipfs add"}, wantEmpty: "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH", sameAs: "cidv0"},
+		{name: "ipfs add cidv1", mode: splitter.PieceRootNull, dag: DagOptions{IpfsAddCommand: "ipfs add --cid-version=1 --hash=sha3-512 --trickle"}},
+	}
+	roots := make(map[string]string)
+	for _, tc := range cases {
+		mode := tc.mode
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			res, err := Prep(ctx, Options{
+				Paths:           []string{filepath.Join(in, "data")},
+				TargetSize:      2 << 20,
+				Output:          filepath.Join(t.TempDir(), "piece"),
+				IgnoreDiskSpace: true,
+				FileManifest:    true,
+				EmbedManifest:   true,
+				Dag:             tc.dag,
+				Split:           splitter.Options{PieceRootMode: mode},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the piece root mode doesn't change the dag, every other case does, but for the options ipfs add sets
+			if other, ok := roots[res.RootCid.String()]; ok && tc.dag != (DagOptions{}) && other != tc.sameAs {
+				t.Errorf("root %s is the one of %s as well", res.RootCid, other)
+			} else if !ok && tc.sameAs != "" {
+				t.Errorf("root %s, want the one of %s", res.RootCid, tc.sameAs)
+			}
+			roots[res.RootCid.String()] = tc.name
+			if len(res.Pieces.CarPieces) < 2 {
+				t.Fatalf("got %d pieces, want the dag split over several", len(res.Pieces.CarPieces))
+			}
+
+			dserv := inlineBlocks{mdtest.Mock()}
+			for _, p := range res.Pieces.CarPieces {
+				headerRoot, blocks := readPiece(t, p.Name)
+				if len(blocks) == 0 {
+					t.Fatalf("piece %s holds no blocks", p.Name)
+				}
+				if mode == splitter.PieceRootFirstBlock && !headerRoot.Equals(blocks[0].Cid()) {
+					t.Errorf("piece %s: header root %s, want its first block %s", p.Name, headerRoot, blocks[0].Cid())
+				}
+				for _, nd := range blocks {
+					if err := dserv.Add(ctx, nd); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			root, err := dserv.Get(ctx, res.RootCid)
+			if err != nil {
+				t.Fatalf("root %s is in none of the pieces: %s", res.RootCid, err)
+			}
+			// the directories are built in the format of the files
+			dag, err := tc.dag.format()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p := res.RootCid.Prefix(); (p.Version == 0) != dag.cidV0 || p.MhType != dag.mhType {
+				t.Errorf("root %s of prefix %+v, want CIDv0 %t with hash %#x", res.RootCid, p, dag.cidV0, dag.mhType)
+			}
+			if tc.wantEmpty != "" {
+				l, _, err := root.ResolveLink([]string{"empty"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if l.Cid.String() != tc.wantEmpty {
+					t.Errorf("empty file %s, want %s", l.Cid, tc.wantEmpty)
+				}
+			}
+			got := make(map[string][]byte)
+			readDir(ctx, t, dserv, root, "", got)
+			delete(got, ManifestName)
+			if len(got) != len(files) {
+				t.Errorf("dag holds %d files, want %d", len(got), len(files))
+			}
+			for name, content := range files {
+				if g, ok := got[name]; !ok {
+					t.Errorf("%s is missing from the dag", name)
+				} else if !bytes.Equal(g, content) {
+					t.Errorf("%s: dag holds %d bytes that differ from the %d of the file", name, len(g), len(content))
+				}
+			}
+		})
+	}
+}
+
+// readPiece reads the header root and the blocks of a piece with go-car, checking that every block matches its cid.
+func readPiece(t *testing.T, path string) (cid.Cid, []format.Node) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cr, err := car.NewCarReader(f)
+	if err != nil {
+		t.Fatalf("go-car can't read the header of %s: %s", path, err)
+	}
+	if cr.Header.Version != 1 || len(cr.Header.Roots) != 1 {
+		t.Fatalf("%s: header of version %d with %d roots, want version 1 with 1 root", path, cr.Header.Version, len(cr.Header.Roots))
+	}
+
+	var nodes []format.Node
+	for {
+		blk, err := cr.Next()
+		if err == io.EOF {
+			return cr.Header.Roots[0], nodes
+		}
+		if err != nil {
+			t.Fatalf("go-car can't read block %d of %s: %s", len(nodes), path, err)
+		}
+		check, err := blk.Cid().Prefix().Sum(blk.RawData())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !check.Equals(blk.Cid()) {
+			t.Fatalf("%s: block %s holds data of %s", path, blk.Cid(), check)
+		}
+		nd, err := decodeNode(blk.Cid(), blk.RawData())
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		nodes = append(nodes, nd)
+	}
+}
+
+// inlineBlocks serves the blocks inlined into identity cids, which are in no car, on top of a dag service. The nodes
+// keep their identity cids, for the dag walkers to match them to their links.
+type inlineBlocks struct{ format.DAGService }
+
+func (d inlineBlocks) Get(ctx context.Context, c cid.Cid) (format.Node, error) {
+	if c.Prefix().MhType != multihash.IDENTITY {
+		return d.DAGService.Get(ctx, c)
+	}
+	dmh, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return nil, err
+	}
+	return decodeNode(c, dmh.Digest)
+}
+
+func (d inlineBlocks) GetMany(ctx context.Context, cids []cid.Cid) <-chan *format.NodeOption {
+	out := make(chan *format.NodeOption, len(cids))
+	for _, c := range cids {
+		nd, err := d.Get(ctx, c)
+		out <- &format.NodeOption{Node: nd, Err: err}
+	}
+	close(out)
+	return out
+}
+
+func decodeNode(c cid.Cid, data []byte) (format.Node, error) {
+	if c.Type() == cid.Raw {
+		return merkledag.NewRawNodeWPrefix(data, c.Prefix())
+	}
+	nd, err := merkledag.DecodeProtobuf(data)
+	if err != nil {
+		return nil, err
+	}
+	nd.SetCidBuilder(c.Prefix())
+	return nd, nil
+}
+
+// readDir reads the files below a unixfs directory node into files, by their path.
+func readDir(ctx context.Context, t *testing.T, dserv format.DAGService, nd format.Node, dir string, files map[string][]byte) {
+	t.Helper()
+
+	d, err := uio.NewDirectoryFromNode(dserv, nd)
+	if err != nil {
+		t.Fatalf("%s: %s", dir, err)
+	}
+	err = d.ForEachLink(ctx, func(l *format.Link) error {
+		child, err := l.GetNode(ctx, dserv)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, l.Name)
+		if _, err := uio.NewDirectoryFromNode(dserv, child); err == nil {
+			readDir(ctx, t, dserv, child, path, files)
+			return nil
+		}
+		r, err := uio.NewDagReader(ctx, child, dserv)
+		if err != nil {
+			return err
+		}
+		if files[path], err = io.ReadAll(r); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s: %s", dir, err)
+	}
+}
@@ -0,0 +1,748 @@
+package dataprep
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/preflight"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/progress"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+)
+
+// Options configures a data prep run: where the files come from, how the dag is built from them, and how its car
+// stream is split into pieces. The zero value of every field but Paths (or Fds) and TargetSize is a usable default.
+type Options struct {
+	// Paths are the files and directories to prep. With InputFormat zip they are zip archives, with GitRef git
+	// repositories. A path may also be an s3://bucket/prefix url, whose objects are read with the aws command line tool.
+	Paths []string
+	// Fds are already open file descriptors to read inputs from, given as fd[:name[:size]].
+	Fds []string
+	// StdinName, if set, preps a single file streamed on stdin, of any size, under this name instead of any paths.
+	StdinName string
+	// InputFormat is how Paths are read: "files" (the default) or "zip".
+	InputFormat string
+	// GitRef, if set, preps the tree at this ref of every path, which must be a git repository.
+	GitRef string
+	// S3EndpointURL, if set, is the endpoint of an S3 compatible object store to read s3:// paths from, instead of AWS.
+	S3EndpointURL string
+	// Include, if set, only preps the files matching one of these patterns, or in a directory matching one. Exclude
+	// leaves out the files and directories matching any of these patterns, and IgnoreFile, if set, those ignored by the
+	// rules of this file. Patterns are in gitignore syntax, matched against paths relative to every input path.
+	Include    []string
+	Exclude    []string
+	IgnoreFile string
+	// Symlinks is the handling of symlinks in input directories: SymlinksFollow (the default) preps what they point to,
+	// failing on cycles, SymlinksPreserve adds them as unixfs symlink nodes, and SymlinksSkip leaves them out.
+	Symlinks string
+	// OnlyFiles, if set, only preps these files of the local input paths, as listed by ListFiles, e.g. the files that
+	// are new since an earlier run. They are still named relative to the input paths.
+	OnlyFiles []string
+
+	// TargetSize is the size in bytes to split the car stream into pieces of.
+	TargetSize int
+	// Output is the prefix of the piece file names, may include a directory (see splitter.NamePrefix).
+	Output string
+	// DryRun calculates the pieces without writing them.
+	DryRun bool
+	// IgnoreDiskSpace skips checking for enough free space in the output directory.
+	IgnoreDiskSpace bool
+
+	// MaxFileSize, if set, fails the run up front if any file is larger.
+	MaxFileSize int64
+	// LargeFiles is the handling of files larger than TargetSize: LargeFilesRecord (the default), LargeFilesWarn or
+	// LargeFilesFail.
+	LargeFiles string
+	// SkipErrors skips files that fail to open or to read from the start, instead of failing the run.
+	SkipErrors bool
+	// ReadTimeout, if set, fails opening a file or a read from it taking longer.
+	ReadTimeout time.Duration
+
+	// RenameRoot, if set, is the name of the single file or directory of the dag root.
+	RenameRoot string
+	// Flatten puts all files directly into the root directory, telling apart names by FlattenCollisions: "suffix" (the
+	// default), "path" or "error".
+	Flatten           bool
+	FlattenCollisions string
+	// MaxDagDepth, if set, fails the run up front if the directory tree would be deeper.
+	MaxDagDepth int
+	// BlockOrder is the order of the files and directory nodes in the car stream: "dfs" (the default) or "bfs".
+	BlockOrder string
+	// Dag configures how anelace builds the dags of the files.
+	Dag DagOptions
+	// EmbedManifest adds a manifest of all files to the root directory.
+	EmbedManifest bool
+	// DirSharding, if set, shards the directories with more entries than that as unixfs HAMTs. If not set, directories
+	// are sharded once their node would get larger than 256KiB, like kubo does.
+	DirSharding int
+	// GroupDirNodes splits the directory nodes into pieces of their own.
+	GroupDirNodes bool
+	// CarPerFile splits the car stream of every file on its own, so that a piece never holds blocks of several files.
+	CarPerFile bool
+	// StrictRoots fails on roots emitted by anelace that can't be parsed, instead of skipping them.
+	StrictRoots bool
+	// FileManifest records the pieces and byte ranges of every file in Result.Files.
+	FileManifest bool
+
+	// Parallel, if greater than 1, builds the dags of up to that many paths concurrently, with their car streams
+	// buffered in temporary files in ParallelTmpDir.
+	Parallel       int
+	ParallelTmpDir string
+	// PipeBuffer is the size in bytes of the buffer between dag building and splitting.
+	PipeBuffer int
+
+	// Split controls how the car stream is split. Its OnPiece callback is called for every piece as it completes.
+	Split splitter.Options
+	// Progress, if set, counts the files and bytes read and the pieces written. Reporting it is left to the caller.
+	Progress *progress.Progress
+}
+
+// Result is the outcome of a data prep run.
+type Result struct {
+	RootCid cid.Cid
+	Pieces  *splitter.CarPiecesAndMetadata
+	// SpanningFiles are the pieces holding the files larger than the target size, if recorded.
+	SpanningFiles []metadata.FilePieces
+	// Files are the pieces holding every file, with Options.FileManifest.
+	Files []metadata.FilePieces
+	// InputSize is the size of the files read, Payload the size of the file data in the dag.
+	InputSize uint64
+	Payload   uint64
+}
+
+// input is the files of a run, along with their readers, names in the dag, and the readers of every path.
+type input struct {
+	paths  []string
+	files  []string
+	names  []string
+	links  []symlink
+	frs    []io.Reader
+	inputs [][]io.Reader
+	// tar, if set, is the stream of the files of tar archives, which fills in the other fields once read
+	tar *tarStream
+}
+
+// Prep builds a unixfs dag of the files given by the options, and splits its car stream into pieces, calculating
+// commP for each. It returns the root cid of the dag along with the metadata of the pieces. Writing the metadata is
+// left to the caller.
+//
+// Cancelling ctx stops the run: the input stops being read, and the piece being written is removed. As on any failure
+// once pieces have been written, the Result returned along with the error then holds the pieces completed so far, and
+// no root cid.
+func Prep(ctx context.Context, opts Options) (*Result, error) {
+	if len(opts.Paths) == 0 && len(opts.Fds) == 0 && opts.StdinName == "" {
+		return nil, fmt.Errorf("expected some data to be processed, found none")
+	}
+	if opts.InputFormat == "" {
+		opts.InputFormat = inputFormatFiles
+	}
+	if opts.LargeFiles == "" {
+		opts.LargeFiles = LargeFilesRecord
+	}
+	if opts.FlattenCollisions == "" {
+		opts.FlattenCollisions = "suffix"
+	}
+	if opts.BlockOrder == "" {
+		opts.BlockOrder = blockOrderDFS
+	}
+	if opts.DirSharding < 0 {
+		return nil, fmt.Errorf("dir sharding threshold must not be negative, got %d", opts.DirSharding)
+	}
+	dag, err := opts.Dag.format()
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := dag.blocks()
+	if err != nil {
+		return nil, err
+	}
+	if err := preflight.ValidateTargetSize(opts.TargetSize, blocks); err != nil {
+		return nil, err
+	}
+	if opts.Split.PieceRootMode == splitter.PieceRootDataset {
+		// the dataset root is only known once all file blocks have been streamed, i.e. after most pieces are written
+		return nil, fmt.Errorf("piece root mode %q is not supported by fil-data-prep", opts.Split.PieceRootMode)
+	}
+	if opts.Split.NameTemplate.UsesRootCid() {
+		// for the same reason, the root can't go into the piece names
+		return nil, fmt.Errorf("{rootcid} in the name template is not supported by fil-data-prep")
+	}
+	if err := opts.Split.Validate(); err != nil {
+		return nil, err
+	}
+
+	in, err := readInput(opts)
+	if err != nil {
+		return nil, err
+	}
+	if in.tar == nil && opts.StdinName == "" {
+		// the files of tar archives and stdin are only known as they are read
+		opts.Progress.SetTotal(inputSize(in.frs), len(in.files))
+	}
+	if p := opts.Progress; p != nil {
+		next := opts.Split.OnPiece
+		opts.Split.OnPiece = func(cf splitter.CarFile) error {
+			p.Piece(cf.HeaderSize + cf.ContentSize)
+			if next != nil {
+				return next(cf)
+			}
+			return nil
+		}
+	}
+	largeFiles, err := checkLargeFiles(in.files, in.frs, opts.TargetSize, opts.LargeFiles)
+	if err != nil {
+		return nil, err
+	}
+	trackLargeFiles := largeFiles && opts.LargeFiles == LargeFilesRecord
+	if in.tar != nil || opts.StdinName != "" {
+		// the sizes of the files of tar archives and stdin are only known as they are read
+		trackLargeFiles = opts.LargeFiles == LargeFilesRecord
+	}
+
+	filenamePrefix, err := splitter.NamePrefix(opts.Output, !opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.DryRun && !opts.IgnoreDiskSpace {
+		// everything is estimated to go to the output directory, resumed runs included. The pieces are never
+		// compressed, so compressed archives count for the size of their files.
+		size := inputSize(in.frs)
+		if in.tar != nil {
+			if size, err = in.tar.size(); err != nil {
+				return nil, err
+			}
+		}
+		if err := preflight.CheckDiskSpace(filepath.Dir(opts.Output), preflight.EstimateOutputSize(size, blocks)); err != nil {
+			return nil, err
+		}
+	}
+
+	switch opts.BlockOrder {
+	case blockOrderDFS:
+	case blockOrderBFS:
+		if opts.Parallel > 1 {
+			// every input is built on its own, the files can't be interleaved across inputs
+			return nil, fmt.Errorf("--block-order %s is not supported with --parallel", opts.BlockOrder)
+		}
+		in.files, in.names, in.frs = breadthFirst(in.files, in.names, in.frs)
+	default:
+		return nil, fmt.Errorf("unknown block order %q, expected one of: %s, %s", opts.BlockOrder, blockOrderDFS, blockOrderBFS)
+	}
+
+	if opts.CarPerFile {
+		if opts.Parallel > 1 {
+			return nil, fmt.Errorf("--parallel is not supported with --car-per-file")
+		}
+		if opts.Split.CheckpointInterval > 0 || opts.Split.Resume != nil {
+			return nil, fmt.Errorf("--checkpoint-interval and --resume are not supported with --car-per-file")
+		}
+		if opts.SkipErrors {
+			return nil, fmt.Errorf("--skip-errors is not supported with --car-per-file")
+		}
+		if opts.Split.CommPEvery > 1 || (opts.Split.CommPSample > 0 && opts.Split.CommPSample < 1) {
+			// pieces without commP are named by their index, which is not unique across files
+			return nil, fmt.Errorf("--commp-every and --commp-sample are not supported with --car-per-file")
+		}
+
+		rcid, m, payload, spanning, allFiles, err := carPerFile(ctx, in.paths, in.files, in.names, in.links, in.frs, opts.TargetSize, filenamePrefix, opts.Split, opts.PipeBuffer, dag, opts.StrictRoots, opts.EmbedManifest, opts.BlockOrder, opts.DirSharding, trackLargeFiles, opts.FileManifest)
+		if err != nil {
+			return partialResult(m), err
+		}
+		return &Result{RootCid: rcid, Pieces: m, SpanningFiles: spanning, Files: allFiles, InputSize: inputSize(in.frs), Payload: payload}, nil
+	}
+
+	if err := withCheckpointInputs(&opts.Split, in.files, in.frs); err != nil {
+		return nil, err
+	}
+	return prepStream(ctx, opts, dag, in, filenamePrefix, trackLargeFiles)
+}
+
+// withCheckpointInputs records the files of the run, in the order of the car stream, in every checkpoint, and checks
+// that a run resumed from a checkpoint reads the same files.
+func withCheckpointInputs(opts *splitter.Options, files []string, frs []io.Reader) error {
+	if opts.Resume == nil && opts.OnCheckpoint == nil {
+		return nil
+	}
+	// nothing was read yet, so no file was skipped and the sizes line up with the files
+	sizes := fileSizes(frs)
+	inputs := make([]splitter.CheckpointInput, len(files))
+	for i := range files {
+		inputs[i] = splitter.CheckpointInput{Path: files[i], Size: sizes[i]}
+	}
+	if opts.Resume != nil {
+		if err := splitter.ValidateResumeInputs(opts.Resume, inputs); err != nil {
+			return err
+		}
+	}
+	if next := opts.OnCheckpoint; next != nil {
+		opts.OnCheckpoint = func(cp splitter.Checkpoint) error {
+			cp.Inputs = inputs
+			return next(cp)
+		}
+	}
+	return nil
+}
+
+// readInput gathers the files of all paths and fds, and works out their names in the dag.
+func readInput(opts Options) (*input, error) {
+	in := &input{paths: append([]string(nil), opts.Paths...)}
+	switch opts.InputFormat {
+	case inputFormatFiles:
+	case inputFormatZip, inputFormatTar:
+		if opts.GitRef != "" {
+			return nil, fmt.Errorf("--input-format %s is not supported with --git-ref", opts.InputFormat)
+		}
+	default:
+		return nil, fmt.Errorf("unknown input format %q, expected one of: %s, %s, %s", opts.InputFormat, inputFormatFiles, inputFormatZip, inputFormatTar)
+	}
+	if err := validateSymlinks(opts.Symlinks); err != nil {
+		return nil, err
+	}
+	if opts.OnlyFiles != nil {
+		if opts.InputFormat != inputFormatFiles || opts.GitRef != "" || opts.StdinName != "" || len(opts.Fds) > 0 {
+			return nil, fmt.Errorf("only files of local input paths can be picked")
+		}
+		if opts.Symlinks == SymlinksPreserve {
+			// the symlinks are not files, they would be added to the dag whatever the files picked
+			return nil, fmt.Errorf("picking files is not supported with --symlinks %s", SymlinksPreserve)
+		}
+	}
+	if opts.StdinName != "" {
+		s, err := newStdinStream(opts.StdinName, opts)
+		if err != nil {
+			return nil, err
+		}
+		s.progress = opts.Progress
+		in.paths, in.files, in.frs = []string{s.name}, []string{s.name}, []io.Reader{s}
+		in.inputs = [][]io.Reader{in.frs}
+		if err := in.nameFiles(opts); err != nil {
+			return nil, err
+		}
+		return in, nil
+	}
+	filter, err := newPathFilter(opts.Include, opts.Exclude, opts.IgnoreFile)
+	if err != nil {
+		return nil, err
+	}
+	// a single input path - is a tar archive on stdin, unless given in another format
+	stdinTar := opts.InputFormat == inputFormatFiles && opts.GitRef == "" && len(opts.Paths) == 1 && opts.Paths[0] == "-"
+	if opts.InputFormat == inputFormatTar || stdinTar {
+		// the files of tar archives are only known as they are read, and are named once the stream is done
+		if in.tar, err = newTarStream(opts, in.paths, filter); err != nil {
+			return nil, err
+		}
+		return in, nil
+	}
+	for i, path := range opts.Paths {
+		var fs []string
+		var frs []io.Reader
+		var links []symlink
+		var err error
+		if isS3URL(path) {
+			if opts.GitRef != "" || opts.InputFormat != inputFormatFiles {
+				return nil, fmt.Errorf("s3 paths are not supported with --git-ref or --input-format %s", opts.InputFormat)
+			}
+			// the objects are named in the dag as if the bucket was a directory
+			if in.paths[i], err = s3DagPath(path); err != nil {
+				return nil, err
+			}
+			fs, frs, err = getAllFileReadersFromS3(path, opts.S3EndpointURL)
+		} else if opts.GitRef != "" {
+			fs, frs, err = getAllFileReadersFromGitRef(path, opts.GitRef)
+		} else if opts.InputFormat == inputFormatZip {
+			fs, frs, err = getAllFileReadersFromZip(path)
+		} else {
+			fs, frs, links, err = getAllFileReadersFromPath(path, filter, opts.Symlinks)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// local paths are filtered as they are walked, the others once listed
+		fs, frs = filter.filterFiles(in.paths[i], fs, frs)
+		if len(fs) == 0 && len(links) == 0 && filter != nil {
+			return nil, fmt.Errorf("all files of %s are filtered out", path)
+		}
+		if opts.OnlyFiles != nil {
+			fs, frs = onlyFiles(opts.OnlyFiles, fs, frs)
+		}
+
+		in.files = append(in.files, fs...)
+		in.links = append(in.links, links...)
+		in.frs = append(in.frs, frs...)
+		in.inputs = append(in.inputs, frs)
+	}
+	if opts.OnlyFiles != nil && len(in.files) == 0 {
+		return nil, fmt.Errorf("none of the files to prep were found in the input paths")
+	}
+
+	// every fd stream is an input of its own, named like a path
+	fdFiles, fdReaders, err := getFileReadersFromFds(opts.Fds)
+	if err != nil {
+		return nil, err
+	}
+	for i := range fdFiles {
+		in.paths = append(in.paths, fdFiles[i])
+		in.files = append(in.files, fdFiles[i])
+		in.frs = append(in.frs, fdReaders[i])
+		in.inputs = append(in.inputs, fdReaders[i:i+1])
+	}
+
+	if opts.MaxFileSize > 0 {
+		if err := checkMaxFileSize(in.files, in.frs, opts.MaxFileSize); err != nil {
+			return nil, err
+		}
+	}
+	setReadOptions(in.frs, opts.ReadTimeout, opts.SkipErrors, opts.Progress)
+
+	if err := in.nameFiles(opts); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// nameFiles works out the names of the files and preserved symlinks in the dag.
+func (in *input) nameFiles(opts Options) error {
+	var err error
+	// the preserved symlinks are named along with the files, so that flattening tells apart their names as well
+	all := in.files
+	if len(in.links) > 0 {
+		all = append(make([]string, 0, len(in.files)+len(in.links)), in.files...)
+		for _, l := range in.links {
+			all = append(all, l.path)
+		}
+	}
+	if in.names, err = dagNames(in.paths, all, opts.RenameRoot); err != nil {
+		return err
+	}
+	if opts.Flatten {
+		if in.names, err = flattenNames(in.names, opts.FlattenCollisions); err != nil {
+			return err
+		}
+	}
+	if opts.MaxDagDepth > 0 {
+		if depth, deepest := deepestPath(in.paths, in.names); depth > opts.MaxDagDepth {
+			return fmt.Errorf("the directory tree would be %d levels deep at %s, more than the --max-dag-depth of %d", depth, deepest, opts.MaxDagDepth)
+		}
+	}
+	for i := range in.links {
+		in.links[i].name = in.names[len(in.files)+i]
+	}
+	in.names = in.names[:len(in.files):len(in.files)]
+	return nil
+}
+
+// prepStream runs all files through anelace as a single car stream, and splits it. Three stages run concurrently:
+// anelace building the dags of the files, the tree stage building the directory nodes from their roots once all files
+// are read, and the splitter. The first stage to fail fails the others by closing the pipes between them, and its error
+// is the one returned.
+func prepStream(ctx context.Context, opts Options, dag dagFormat, in *input, filenamePrefix string, trackLargeFiles bool) (*Result, error) {
+	tracer := opts.Split.Tracer
+
+	rerr, werr := io.Pipe()
+	// the car stream is consumed concurrently by the splitter, buffer it so the stages don't run in lock-step
+	rout, wout := newPipe(opts.PipeBuffer)
+
+	// with a tracer, the car stream records the time anelace is held up by the splitter, and the splitter by anelace
+	anl, err := newAnelace(dag, tracer.Writer("dag", "write car stream", wout))
+	if err != nil {
+		return nil, err
+	}
+	// a file streamed on stdin is of unknown size, it can't be announced in a multipart stream
+	stdin := opts.StdinName != ""
+	anl.SetMultipart(!stdin)
+
+	g := &stageGroup{}
+	g.Go(StageDagBuild, func() error {
+		span := tracer.Start("dag", "stage", "build dag")
+		defer span.End()
+		if opts.Parallel > 1 {
+			return buildParallel(ctx, in.inputs, opts.Parallel, opts.ParallelTmpDir, dag, werr, wout)
+		}
+		stream := io.MultiReader(in.frs...)
+		if in.tar != nil {
+			stream = in.tar
+		}
+		return processReader(anl, tracer.Reader("dag", "read input", &ctxReader{ctx: ctx, r: stream}), werr)
+	}, func(err error) {
+		if err != nil {
+			// the roots and the car stream are incomplete, fail both readers instead of letting them see a clean end:
+			// a tree built from the roots seen so far would silently leave out files
+			werr.CloseWithError(err)
+			wout.CloseWithError(err)
+		}
+		werr.Close()
+	})
+
+	var rcid cid.Cid
+	var dirBlocks []format.Node
+	var payload uint64
+	// the files in the dag and their roots
+	var dagFiles []string
+	var dagRoots []roots
+	g.Go(StageTreeConstruct, func() error {
+		rootsSpan := tracer.Start("tree", "stage", "read roots")
+		rs, err := getRoots(rerr, opts.StrictRoots)
+		if err != nil {
+			return err
+		}
+		rootsSpan.Arg("roots", len(rs)).End()
+		if stdin {
+			// anelace only numbers the streams of a multipart stream
+			for i := range rs {
+				rs[i].Stream = 1
+			}
+		}
+		if in.tar != nil {
+			// the archives are read, and with them all their files
+			if err := in.tar.finish(in, opts); err != nil {
+				return err
+			}
+		}
+		// the roots stream ends once all files have been read, so all skipped files are known by now
+		files, names := in.files, in.names
+		if opts.SkipErrors {
+			files, names = withoutSkipped(in.frs, files, names)
+			if len(files) == 0 {
+				return fmt.Errorf("all input files were skipped")
+			}
+		}
+		// every file is a separate multipart stream, with a root of its own
+		if rs, err = reconcileRoots(files, fileSizes(in.frs), rs, dag); err != nil {
+			return err
+		}
+		if err := dag.fileRoots(rs); err != nil {
+			return err
+		}
+
+		payload = payloadSize(rs)
+		dagFiles, dagRoots = files, rs
+
+		treeSpan := tracer.Start("tree", "stage", "directory nodes")
+		defer treeSpan.End()
+		var blocks []format.Node
+		rcid, blocks, err = directoryBlocks(in.paths, names, rs, in.links, opts.EmbedManifest, opts.BlockOrder, opts.DirSharding, dag)
+		if err != nil {
+			return err
+		}
+		if opts.GroupDirNodes {
+			// split on their own once the content is done
+			dirBlocks = blocks
+			return nil
+		}
+		if err := writeBlocks(blocks, wout); err != nil {
+			return fmt.Errorf("failed to write directory nodes: %s", err)
+		}
+		return nil
+	}, func(err error) {
+		if err != nil {
+			// unblock anelace if it is still writing roots, and make sure the splitter fails on the truncated stream,
+			// instead of treating it as a clean end of the car
+			rerr.CloseWithError(err)
+			wout.CloseWithError(err)
+		}
+		wout.Close()
+	})
+
+	var m *splitter.CarPiecesAndMetadata
+	var spanning, allFiles []metadata.FilePieces
+	g.Go(StageSplit, func() error {
+		span := tracer.Start("split", "stage", "split")
+		var stream io.Reader = tracer.Reader("split", "read car stream", rout)
+		var tracker *blockTracker
+		if trackLargeFiles || opts.FileManifest {
+			tracker = newBlockTracker()
+			stream = tracker.track(stream)
+		}
+		var err error
+		if m, err = splitter.SplitAndCommpContext(ctx, stream, opts.TargetSize, filenamePrefix, opts.Split); err != nil {
+			return err
+		}
+		span.Arg("pieces", len(m.CarPieces)).End()
+		if tracker != nil {
+			if err := tracker.wait(); err != nil {
+				return err
+			}
+		}
+		// before the grouped directory pieces are added, they are not part of the tracked stream
+		if trackLargeFiles {
+			if spanning, err = tracker.filePieces(dagFiles, dagRoots, m, opts.TargetSize); err != nil {
+				return err
+			}
+		}
+		if opts.FileManifest {
+			if allFiles, err = tracker.filePieces(dagFiles, dagRoots, m, -1); err != nil {
+				return err
+			}
+		}
+		if opts.GroupDirNodes {
+			// the content stream only ends once the tree stage is done with the directory blocks
+			treePieces, err := splitDirectoryBlocks(ctx, dirBlocks, m.OriginalCarHeader, opts.TargetSize, filenamePrefix, len(m.CarPieces), opts.Split)
+			if err != nil {
+				return err
+			}
+			m.CarPieces = append(m.CarPieces, treePieces...)
+		}
+		return nil
+	}, func(err error) {
+		if err != nil {
+			// unblock anelace and the tree stage writing into the car stream
+			rout.Close()
+		}
+	})
+
+	if err := g.Wait(); err != nil {
+		return partialResult(m), err
+	}
+	return &Result{RootCid: rcid, Pieces: m, SpanningFiles: spanning, Files: allFiles, InputSize: inputSize(in.frs), Payload: payload}, nil
+}
+
+// partialResult is the result of a failed run, if it completed any pieces.
+func partialResult(m *splitter.CarPiecesAndMetadata) *Result {
+	if m == nil || len(m.CarPieces) == 0 {
+		return nil
+	}
+	return &Result{Pieces: m}
+}
+
+// ctxReader fails reads once its context is done, which fails the stages downstream in turn.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// directoryBlocks builds the directory nodes tying the files together (plus the blocks of the manifest, if embedded),
+// and returns the root cid along with all blocks that still need to go into the car stream, the nodes of the preserved
+// symlinks first. Directories are sharded as set by shardThreshold, see node.constructNode. The blocks are built in the
+// format of the dags of the files.
+func directoryBlocks(paths []string, files []string, rs []roots, links []symlink, embedManifest bool, blockOrder string, shardThreshold int, dag dagFormat) (cid.Cid, []format.Node, error) {
+	tr, err := constructTree(files, rs, links, shardThreshold, dag.builder())
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	nodes := getDirectoryNodes(tr, blockOrder)
+
+	// use fake root directory if multiple args, or if a file was passed as input (len(nodes) = 1).
+	// If there are nested paths it will wrap all the intermediate directories up in the fake root
+	var rootDepth int
+	if len(nodes) > 1 && len(paths) == 1 {
+		// Need to do this to handle nested paths, where the root cid should be the actual final directory
+		// for example, if the input is /opt/data/data_dir, the root cid should correspond to data_dir and not to /
+		rootDepth = len(strings.Split(paths[0], "/"))
+	}
+
+	var blocks []format.Node
+	for _, l := range links {
+		blocks = append(blocks, l.node)
+	}
+	if embedManifest {
+		manifestBlocks, err := addManifest(tr, strings.Split(paths[0], "/")[:rootDepth], files, rs, shardThreshold, dag)
+		if err != nil {
+			return cid.Undef, nil, err
+		}
+		blocks = append(blocks, manifestBlocks...)
+		nodes = getDirectoryNodes(tr, blockOrder)
+	}
+	for _, nd := range nodes[rootDepth:] {
+		blocks = append(blocks, nd)
+	}
+
+	return nodes[rootDepth].Cid(), blocks, nil
+}
+
+// splitDirectoryBlocks splits the directory blocks into pieces of their own, with the same car header as the content
+// pieces (base64 encoded, as recorded in the metadata). The pieces are marked as holding the tree nodes, and numbered on
+// from firstIndex, behind the content pieces. Their commP is always calculated.
+func splitDirectoryBlocks(ctx context.Context, blocks []format.Node, originalCarHeader string, targetSize int, namePrefix string, firstIndex int, opts splitter.Options) ([]splitter.CarFile, error) {
+	header, err := base64.StdEncoding.DecodeString(originalCarHeader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode car header: %s", err)
+	}
+	var dirStream bytes.Buffer
+	dirStream.Write(appendVarint(nil, uint64(len(header))))
+	dirStream.Write(header)
+	if err := writeBlocks(blocks, &dirStream); err != nil {
+		return nil, err
+	}
+
+	opts.CommPEvery, opts.CommPSample = 0, 0
+	opts.FirstIndex = firstIndex
+	// the directory nodes are split in one go, there is nothing to checkpoint or resume
+	opts.CheckpointInterval, opts.OnCheckpoint, opts.Resume = 0, nil, nil
+	m, err := splitter.SplitAndCommpContext(ctx, &dirStream, targetSize, namePrefix, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split directory nodes: %s", err)
+	}
+	for i := range m.CarPieces {
+		m.CarPieces[i].TreeNodes = true
+	}
+	return m.CarPieces, nil
+}
+
+func writeBlocks(blocks []format.Node, wout io.Writer) error {
+	for _, b := range blocks {
+		if err := writeBlock(b, wout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBlock writes a single block to the car stream, framed as varint(len(cid)+len(data)) || cid || data
+func writeBlock(nd format.Node, wout io.Writer) error {
+	c := []byte(nd.Cid().KeyString())
+	d := nd.RawData()
+
+	frame := appendVarint(nil, uint64(len(c))+uint64(len(d)))
+	frame = append(frame, c...)
+	frame = append(frame, d...)
+
+	if _, err := wout.Write(frame); err != nil {
+		return fmt.Errorf("failed to write block %s: %s", nd.Cid(), err)
+	}
+	return nil
+}
+
+// getRoots reads the roots jsonl stream emitted by anelace. In strict mode any line that can't be parsed is an error,
+// otherwise it is logged and skipped.
+func getRoots(rerr io.Reader, strict bool) ([]roots, error) {
+	var rs []roots
+	bs, err := io.ReadAll(rerr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read roots: %s", err)
+	}
+	e := string(bs)
+	els := strings.Split(e, "\n")
+	for i, el := range els {
+		if el == "" {
+			continue
+		}
+		var r roots
+		err := json.Unmarshal([]byte(el), &r)
+		if err != nil {
+			if strict {
+				return nil, fmt.Errorf("failed to parse line %d of the roots stream %q: %s", i+1, el, err)
+			}
+			logging.Warn("skipping unparsable root", "line", i+1, "root", el, "err", err)
+			continue
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
@@ -0,0 +1,108 @@
+package dataprep
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+)
+
+// failingWriter fails once more than n bytes are written, after writing what fits.
+type failingWriter struct {
+	w   *pipeWriter
+	n   int
+	err error
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) <= f.n {
+		f.n -= len(p)
+		return f.w.Write(p)
+	}
+	written, _ := f.w.Write(p[:f.n])
+	f.n = 0
+	return written, f.err
+}
+
+func testBlocks(n, size int) []format.Node {
+	var blocks []format.Node
+	for i := 0; i < n; i++ {
+		blocks = append(blocks, merkledag.NewRawNode(bytes.Repeat([]byte{byte(i)}, size)))
+	}
+	return blocks
+}
+
+func TestWriteBlocksError(t *testing.T) {
+	blocks := testBlocks(3, 1000)
+	var stream bytes.Buffer
+	if err := writeBlocks(blocks, &stream); err != nil {
+		t.Fatal(err)
+	}
+
+	// fail in the middle of every block, and right at its start
+	for _, limit := range []int{0, 500, 1040, 2100} {
+		_, w := newPipe(1 << 20)
+		failed := errors.New("disk full")
+		fw := &failingWriter{w: w.(*pipeWriter), n: limit, err: failed}
+		err := writeBlocks(blocks, fw)
+		if err == nil || !strings.Contains(err.Error(), "disk full") || !strings.Contains(err.Error(), "failed to write block") {
+			t.Errorf("limit %d: got error %v, want a failed block write", limit, err)
+		}
+	}
+}
+
+// TestWriteErrorFailsSplit runs a block write error through the pipeline the way prepStream does: the failing stage
+// closes the car stream with its error, and the splitter has to fail with it instead of finishing a piece that holds a
+// partial block.
+func TestWriteErrorFailsSplit(t *testing.T) {
+	// a nul root, as the piece headers have
+	header := "\xA2\x65roots\x81\xD8\x2A\x45\x00\x01\x55\x00\x00\x67version\x01"
+	blocks := testBlocks(50, 10000)
+	var frame bytes.Buffer
+	if err := writeBlock(blocks[0], &frame); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limit := range []int{10, 200000, 350017} {
+		dir := t.TempDir()
+		r, w := newPipe(64 << 10)
+		failed := errors.New("disk full")
+		go func() {
+			fw := &failingWriter{w: w.(*pipeWriter), n: limit, err: failed}
+			if _, err := fw.Write(append(appendVarint(nil, uint64(len(header))), header...)); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			if err := writeBlocks(blocks, fw); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			w.Close()
+		}()
+
+		m, err := splitter.SplitAndCommp(r, 100000, filepath.Join(dir, "p-"), splitter.Options{})
+		if err == nil || !strings.Contains(err.Error(), "disk full") {
+			t.Fatalf("limit %d: got error %v, want the write error", limit, err)
+		}
+
+		// only the pieces completed before the error are left, and they hold whole blocks only
+		ents, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ents) != len(m.CarPieces) {
+			t.Errorf("limit %d: %d files left for %d completed pieces", limit, len(ents), len(m.CarPieces))
+		}
+		for _, p := range m.CarPieces {
+			if p.ContentSize%uint64(frame.Len()) != 0 {
+				t.Errorf("limit %d: piece %s holds %d bytes, not a whole number of blocks", limit, p.Name, p.ContentSize)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package dataprep
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/progress"
+)
+
+// getFileReadersFromFds returns the named streams of already open file descriptors, given as fd[:name[:size]]. The
+// name is the path of the stream in the dag and defaults to fd-<fd>. The size of a regular file is taken from the file,
+// other streams like pipes must announce theirs, as it goes into the multipart size prefix before any of the content.
+func getFileReadersFromFds(specs []string) ([]string, []io.Reader, error) {
+	var files []string
+	var frs []io.Reader
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		fields := strings.SplitN(spec, ":", 3)
+		fd, err := strconv.ParseUint(fields[0], 10, 31)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid --fd %q: expected fd[:name[:size]]", spec)
+		}
+		if fd <= 2 {
+			return nil, nil, fmt.Errorf("invalid --fd %q: fds 0, 1 and 2 are reserved", spec)
+		}
+
+		name := fmt.Sprintf("fd-%d", fd)
+		if len(fields) > 1 && fields[1] != "" {
+			name = fields[1]
+		}
+		if err := validateExternalName(name); err != nil {
+			return nil, nil, fmt.Errorf("invalid --fd %q: %s", spec, err)
+		}
+		if seen[name] {
+			return nil, nil, fmt.Errorf("invalid --fd %q: there is another stream named %s", spec, name)
+		}
+		seen[name] = true
+
+		f := os.NewFile(uintptr(fd), name)
+		info, err := f.Stat()
+		if err != nil {
+			return nil, nil, fmt.Errorf("fd %d is not open: %s", fd, err)
+		}
+
+		var size int64
+		switch {
+		case len(fields) == 3:
+			if size, err = strconv.ParseInt(fields[2], 10, 64); err != nil || size < 0 {
+				return nil, nil, fmt.Errorf("invalid --fd %q: invalid size %q", spec, fields[2])
+			}
+		case info.Mode().IsRegular():
+			size = info.Size()
+		default:
+			return nil, nil, fmt.Errorf("fd %d is not a regular file, give its size as --fd %d:%s:<size>", fd, fd, name)
+		}
+
+		files = append(files, name)
+		frs = append(frs, newMultipartReader(name, size, fdOpener(f)))
+	}
+	return files, frs, nil
+}
+
+// fdOpener hands out the stream of an fd once, it can't be reopened like a file on disk.
+func fdOpener(f *os.File) func() (io.ReadCloser, error) {
+	opened := false
+	return func() (io.ReadCloser, error) {
+		if opened {
+			return nil, fmt.Errorf("stream %s was already read", f.Name())
+		}
+		opened = true
+		return f, nil
+	}
+}
+
+// stdinStream is the content of a single file streamed on stdin, whose size is only known once it has been read. It
+// can't go into a multipart stream, which announces the size of every file up front, so anelace reads it as a plain
+// stream. Files larger than maxSize fail the run as soon as they are read past it, with the error of tooLarge.
+type stdinStream struct {
+	name     string
+	r        io.Reader
+	size     int64
+	maxSize  int64
+	tooLarge func(name string, maxSize int64) error
+	progress *progress.Progress
+}
+
+func (s *stdinStream) Read(p []byte) (int, error) {
+	if s.size == 0 {
+		s.progress.StartFile(s.name)
+	}
+	n, err := s.r.Read(p)
+	s.size += int64(n)
+	s.progress.Read(n)
+	if err == io.EOF {
+		s.progress.FileDone()
+	}
+	if s.maxSize > 0 && s.size > s.maxSize {
+		return n, s.tooLarge(s.name, s.maxSize)
+	}
+	return n, err
+}
+
+// newStdinStream returns the stream of a single file named name read from stdin. Its size is limited by the
+// --max-file-size, and by the target size with LargeFilesFail.
+func newStdinStream(name string, opts Options) (*stdinStream, error) {
+	if strings.Contains(name, "/") || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid stdin name %q: expected a plain file name", name)
+	}
+	switch {
+	case len(opts.Paths) > 0 || len(opts.Fds) > 0:
+		return nil, fmt.Errorf("--stdin takes no other inputs")
+	case opts.CarPerFile:
+		return nil, fmt.Errorf("--car-per-file is not supported with --stdin")
+	case opts.Split.CheckpointInterval > 0 || opts.Split.Resume != nil:
+		return nil, fmt.Errorf("--checkpoint-interval and --resume are not supported with --stdin, as stdin can't be read again")
+	}
+	s := &stdinStream{name: name, r: os.Stdin}
+	if opts.MaxFileSize > 0 {
+		s.maxSize = opts.MaxFileSize
+		s.tooLarge = func(name string, maxSize int64) error {
+			return fmt.Errorf("%s is more than the --max-file-size of %d bytes", name, maxSize)
+		}
+	}
+	if opts.LargeFiles == LargeFilesFail && (s.maxSize == 0 || int64(opts.TargetSize) < s.maxSize) {
+		s.maxSize = int64(opts.TargetSize)
+		s.tooLarge = func(name string, maxSize int64) error {
+			return fmt.Errorf("%s is more than the target piece size of %d bytes", name, maxSize)
+		}
+	}
+	return s, nil
+}
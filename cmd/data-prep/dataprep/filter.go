@@ -0,0 +1,251 @@
+package dataprep
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// pathFilter picks the files of every input path to prep, by their paths relative to it: files and directories
+// matching an exclude pattern or ignored by the rules of an ignore file are left out, and with include patterns, only
+// the files matching one of them (or in a directory matching one) are kept. A nil pathFilter keeps everything.
+type pathFilter struct {
+	include []*globPattern
+	exclude []*globPattern
+	ignore  []*globPattern
+}
+
+// newPathFilter compiles the include and exclude patterns and reads the ignore file, if any. It returns nil if there is
+// nothing to filter.
+func newPathFilter(include, exclude []string, ignoreFile string) (*pathFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 && ignoreFile == "" {
+		return nil, nil
+	}
+	f := &pathFilter{}
+	var err error
+	if f.include, err = compileGlobs(include, "--include"); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compileGlobs(exclude, "--exclude"); err != nil {
+		return nil, err
+	}
+	if ignoreFile != "" {
+		if f.ignore, err = readIgnoreFile(ignoreFile); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func compileGlobs(patterns []string, flag string) ([]*globPattern, error) {
+	var globs []*globPattern
+	for _, p := range patterns {
+		g, err := compileGlob(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %s", flag, p, err)
+		}
+		if g == nil {
+			continue
+		}
+		if g.negate {
+			return nil, fmt.Errorf("invalid %s pattern %q: negation is only supported in an ignore file", flag, p)
+		}
+		globs = append(globs, g)
+	}
+	return globs, nil
+}
+
+// readIgnoreFile reads the rules of an ignore file in gitignore syntax.
+func readIgnoreFile(path string) ([]*globPattern, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ignore file: %s", err)
+	}
+	defer file.Close()
+
+	var rules []*globPattern
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		g, err := compileGlob(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid pattern: %s", path, line, err)
+		}
+		if g != nil {
+			rules = append(rules, g)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ignore file: %s", err)
+	}
+	return rules, nil
+}
+
+// excluded reports whether the file or directory at rel, a slash separated path relative to its input path, is left
+// out by itself, regardless of the directories it is in.
+func (f *pathFilter) excluded(rel string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+	for _, g := range f.exclude {
+		if g.match(rel, isDir) {
+			return true
+		}
+	}
+	// as in gitignore, the last matching rule wins
+	ignored := false
+	for _, g := range f.ignore {
+		if g.match(rel, isDir) {
+			ignored = !g.negate
+		}
+	}
+	return ignored
+}
+
+// keep reports whether the file at rel, a slash separated path relative to its input path, is prepped.
+func (f *pathFilter) keep(rel string) bool {
+	if f == nil {
+		return true
+	}
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if f.excluded(strings.Join(parts[:i], "/"), true) {
+			return false
+		}
+	}
+	if f.excluded(rel, false) {
+		return false
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for i := 1; i <= len(parts); i++ {
+		for _, g := range f.include {
+			if g.match(strings.Join(parts[:i], "/"), i < len(parts)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterFiles drops the files of the input path root that aren't kept, along with their readers.
+func (f *pathFilter) filterFiles(root string, files []string, frs []io.Reader) ([]string, []io.Reader) {
+	if f == nil {
+		return files, frs
+	}
+	var keptFiles []string
+	var keptFrs []io.Reader
+	for i, file := range files {
+		if f.keep(relativePath(root, file)) {
+			keptFiles = append(keptFiles, file)
+			keptFrs = append(keptFrs, frs[i])
+		}
+	}
+	return keptFiles, keptFrs
+}
+
+// relativePath returns the slash separated path of file relative to the input path root, or its base name if root is
+// the file itself.
+func relativePath(root, file string) string {
+	rel, err := filepath.Rel(root, file)
+	if err != nil || rel == "." {
+		return filepath.Base(file)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// globPattern is a pattern in gitignore syntax: a pattern without a slash (other than a trailing one) matches a name at
+// any depth, otherwise it matches paths relative to the input path. * and ? match within a name, ** across
+// directories, a trailing slash only matches directories, and a leading ! negates the pattern.
+type globPattern struct {
+	re      *regexp.Regexp
+	dirOnly bool
+	negate  bool
+}
+
+// compileGlob compiles a pattern, returning nil for blank lines and comments.
+func compileGlob(pattern string) (*globPattern, error) {
+	pattern = strings.TrimRight(pattern, " \t\r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return nil, nil
+	}
+	g := &globPattern{}
+	if strings.HasPrefix(pattern, "!") {
+		g.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		g.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+
+	var re strings.Builder
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch ch := pattern[i]; ch {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**") && (i == 0 || pattern[i-1] == '/') {
+				rest := pattern[i+2:]
+				switch {
+				case rest == "":
+					re.WriteString(".*")
+					i++
+					continue
+				case strings.HasPrefix(rest, "/"):
+					re.WriteString("(?:.*/)?")
+					i += 2
+					continue
+				}
+			}
+			re.WriteString("[^/]*")
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	re.WriteString("$")
+
+	var err error
+	if g.re, err = regexp.Compile(re.String()); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *globPattern) match(rel string, isDir bool) bool {
+	if g.dirOnly && !isDir {
+		return false
+	}
+	return g.re.MatchString(rel)
+}
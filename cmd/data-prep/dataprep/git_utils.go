@@ -0,0 +1,109 @@
+package dataprep
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+)
+
+const (
+	gitModeSymlink   = "120000"
+	gitModeSubmodule = "160000"
+)
+
+// getAllFileReadersFromGitRef enumerates the files of the tree at the given ref of the git repository at repoPath,
+// without needing a checkout. Paths are prefixed with repoPath, just like when walking a checkout on disk, so the
+// resulting dag has the same shape. Blob contents are streamed from git as they are read, so the git binary needs to
+// be on the PATH.
+func getAllFileReadersFromGitRef(repoPath, ref string) ([]string, []io.Reader, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, nil, fmt.Errorf("reading ref %s of %s needs the git binary, which was not found on the PATH: %s", ref, repoPath, err)
+	}
+	out, err := runGit(repoPath, "ls-tree", "-r", "-z", "--long", "--full-tree", ref)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []string
+	var frs []io.Reader
+	for _, entry := range bytes.Split(out, []byte{0}) {
+		if len(entry) == 0 {
+			continue
+		}
+		// <mode> SP <type> SP <object> SP+ <size> TAB <path>
+		meta, p, ok := strings.Cut(string(entry), "\t")
+		if !ok {
+			return nil, nil, fmt.Errorf("unexpected git ls-tree output: %q", entry)
+		}
+		fields := strings.Fields(meta)
+		if len(fields) != 4 {
+			return nil, nil, fmt.Errorf("unexpected git ls-tree output: %q", entry)
+		}
+		mode, typ, object := fields[0], fields[1], fields[2]
+
+		if typ != "blob" || mode == gitModeSubmodule {
+			logging.Warn("skipping unsupported git entry", "path", p, "type", typ)
+			continue
+		}
+		if mode == gitModeSymlink {
+			logging.Warn("skipping git symlink, symlinks are not supported", "path", p)
+			continue
+		}
+
+		if err := validateExternalName(p); err != nil {
+			return nil, nil, fmt.Errorf("unsafe path in git tree %s: %s", ref, err)
+		}
+
+		size, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unexpected size in git ls-tree output %q: %s", entry, err)
+		}
+
+		name := filepath.Join(repoPath, p)
+		files = append(files, name)
+		frs = append(frs, newMultipartReader(name, size, gitBlobOpener(repoPath, object)))
+	}
+
+	return files, frs, nil
+}
+
+func gitBlobOpener(repoPath, object string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		cmd := exec.Command("git", "-C", repoPath, "cat-file", "blob", object)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("failed to run git cat-file for %s: %s", object, err)
+		}
+		return &cmdReadCloser{ReadCloser: stdout, cmd: cmd}, nil
+	}
+}
+
+type cmdReadCloser struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdReadCloser) Close() error {
+	c.ReadCloser.Close()
+	return c.cmd.Wait()
+}
+
+func runGit(repoPath string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", append([]string{"-C", repoPath}, args...)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
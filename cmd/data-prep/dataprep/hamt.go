@@ -0,0 +1,116 @@
+package dataprep
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/spaolacci/murmur3"
+)
+
+const (
+	// autoShardSize is the size a directory node is estimated to have, from the names and cids of its links, above
+	// which the directory is sharded by default, the same threshold kubo uses.
+	autoShardSize = 256 << 10
+
+	// hamtFanout is the number of slots of every shard node, as in kubo. Every level of the trie takes 8 bits of the
+	// hash of an entry name to pick a slot.
+	hamtFanout = 256
+	// hamtMurmur3 is the multicodec of the murmur3-x64-64 hash of the entry names, recorded in every shard node.
+	hamtMurmur3 = 0x22
+)
+
+// shouldShard reports whether a directory with the given entries is sharded: with a threshold, if it has more entries
+// than that, otherwise if its node would be larger than autoShardSize.
+func shouldShard(children []*node, threshold int) bool {
+	if threshold > 0 {
+		return len(children) > threshold
+	}
+	var size int
+	for _, child := range children {
+		size += len(child.name) + child.cid.ByteLen()
+	}
+	return size > autoShardSize
+}
+
+// shardDirectory builds a directory as a unixfs HAMT, the way go-unixfs does: every entry goes into the slot picked by
+// the next 8 bits of the murmur3 hash of its name, and a slot that more than one entry falls into holds a shard node of
+// its own for them, one level down. The result only depends on the entries, not on their order. It returns the root
+// shard node, the shard nodes below it, and the size of the directory as for a plain directory node: the sum of the
+// sizes of its links. The shard nodes are built with builder.
+func shardDirectory(children []*node, builder cid.Builder) (*merkledag.ProtoNode, []*merkledag.ProtoNode, uint64, error) {
+	entries := make([]hamtEntry, len(children))
+	for i, child := range children {
+		var h [8]byte
+		binary.BigEndian.PutUint64(h[:], murmur3.Sum64([]byte(child.name)))
+		entries[i] = hamtEntry{child: child, hash: h}
+	}
+	var shards []*merkledag.ProtoNode
+	nd, size, err := buildShard(entries, 0, builder, &shards)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	// the root is the last shard built, the ones below it come in the order they were built
+	return nd, shards[:len(shards)-1], size, nil
+}
+
+type hamtEntry struct {
+	child *node
+	hash  [8]byte
+}
+
+// buildShard builds the shard node of the entries whose hashes share their first depth bytes, after building the shard
+// nodes below it and appending them to shards, and appends it as well. It returns the node and the sum of the sizes
+// of its links.
+func buildShard(entries []hamtEntry, depth int, builder cid.Builder, shards *[]*merkledag.ProtoNode) (*merkledag.ProtoNode, uint64, error) {
+	if depth >= len(entries[0].hash) {
+		return nil, 0, fmt.Errorf("can't shard directory: the names %q and %q have the same hash", entries[0].child.name, entries[1].child.name)
+	}
+	var slots [hamtFanout][]hamtEntry
+	for _, e := range entries {
+		slots[e.hash[depth]] = append(slots[e.hash[depth]], e)
+	}
+
+	nd := new(merkledag.ProtoNode)
+	nd.SetCidBuilder(builder)
+	bitfield := new(big.Int)
+	var size uint64
+	for i, slot := range slots {
+		if len(slot) == 0 {
+			continue
+		}
+		bitfield.SetBit(bitfield, i, 1)
+		prefix := fmt.Sprintf("%02X", i)
+		if len(slot) == 1 {
+			child := slot[0].child
+			if err := nd.AddRawLink(prefix+child.name, &format.Link{Cid: child.cid, Size: child.size}); err != nil {
+				return nil, 0, err
+			}
+			size += child.size
+			continue
+		}
+		sub, subSize, err := buildShard(slot, depth+1, builder, shards)
+		if err != nil {
+			return nil, 0, err
+		}
+		// links to shard nodes carry the cumulative size of the shard, its own block included
+		subSize += uint64(len(sub.RawData()))
+		if err := nd.AddRawLink(prefix, &format.Link{Cid: sub.Cid(), Size: subSize}); err != nil {
+			return nil, 0, err
+		}
+		size += subSize
+	}
+
+	// the bitfield is stored with all its bytes, leading zeros included, as go-unixfs does
+	data, err := unixfs.HAMTShardData(bitfield.FillBytes(make([]byte, hamtFanout/8)), hamtFanout, hamtMurmur3)
+	if err != nil {
+		return nil, 0, err
+	}
+	nd.SetData(data)
+	*shards = append(*shards, nd)
+	return nd, size, nil
+}
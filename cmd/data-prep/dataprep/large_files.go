@@ -0,0 +1,296 @@
+package dataprep
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/multiformats/go-multihash"
+)
+
+// Handling of input files larger than the target size, whose data is spread over several pieces.
+const (
+	LargeFilesRecord = "record"
+	LargeFilesWarn   = "warn"
+	LargeFilesFail   = "fail"
+)
+
+// checkLargeFiles warns about the input files larger than the target size, and reports whether there are any. With
+// --large-files fail, it fails on the first one instead.
+func checkLargeFiles(files []string, frs []io.Reader, targetSize int, mode string) (bool, error) {
+	switch mode {
+	case LargeFilesRecord, LargeFilesWarn, LargeFilesFail:
+	default:
+		return false, fmt.Errorf("unknown large file handling %q, expected one of: %s, %s, %s", mode, LargeFilesRecord, LargeFilesWarn, LargeFilesFail)
+	}
+	var found bool
+	for i, fr := range frs {
+		mr, ok := fr.(*multipartReader)
+		if !ok || mr.size <= int64(targetSize) {
+			continue
+		}
+		if mode == LargeFilesFail {
+			return false, fmt.Errorf("%s is %d bytes, more than the target piece size of %d bytes", files[i], mr.size, targetSize)
+		}
+		found = true
+		logging.Warn("file larger than the target piece size, its data will be spread over several pieces", "path", files[i], "size", mr.size, "targetSize", targetSize)
+	}
+	if found && mode == LargeFilesRecord {
+		logging.Info("the pieces holding the byte ranges of files larger than the target piece size are recorded in the yaml metadata")
+	}
+	return found, nil
+}
+
+// blockTracker follows a car stream on its way to the splitter and keeps where every block of it is, to work out
+// afterwards which pieces hold the data of a file. Only the cid, stream offset, links and size of the file data of
+// the blocks are kept, not the data itself.
+type blockTracker struct {
+	pw     *io.PipeWriter
+	done   chan struct{}
+	err    error
+	blocks map[string]trackedBlock
+}
+
+type trackedBlock struct {
+	// offset and length of the block frame in the car stream
+	offset int64
+	length int64
+	// size of the file data held by a leaf
+	size  uint64
+	links []cid.Cid
+}
+
+func newBlockTracker() *blockTracker {
+	return &blockTracker{done: make(chan struct{}), blocks: make(map[string]trackedBlock)}
+}
+
+// track returns a reader passing r through, while the tracker follows along.
+func (t *blockTracker) track(r io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	t.pw = pw
+	go func() {
+		defer close(t.done)
+		t.err = t.parse(bufio.NewReaderSize(pr, 1<<20))
+		// keep the stream flowing if parsing stopped early
+		io.Copy(io.Discard, pr)
+	}()
+	return io.TeeReader(r, pw)
+}
+
+// wait waits for the tracker to get through the stream, once it has been read to its end.
+func (t *blockTracker) wait() error {
+	t.pw.Close()
+	<-t.done
+	return t.err
+}
+
+func (t *blockTracker) parse(r *bufio.Reader) error {
+	var offset int64
+	var buf []byte
+	readFrame := func() ([]byte, int64, error) {
+		start := offset
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += int64(len(binary.AppendUvarint(nil, l)))
+		if cap(buf) < int(l) {
+			buf = make([]byte, l)
+		}
+		buf = buf[:l]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, 0, err
+		}
+		offset += int64(l)
+		return buf, start, nil
+	}
+
+	if _, _, err := readFrame(); err != nil {
+		return fmt.Errorf("failed to read the car header: %s", err)
+	}
+	for {
+		frame, start, err := readFrame()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the block at offset %d: %s", start, err)
+		}
+		n, c, err := cid.CidFromBytes(frame)
+		if err != nil {
+			return fmt.Errorf("undecodeable cid of the block at offset %d: %s", start, err)
+		}
+		b := trackedBlock{offset: start, length: offset - start}
+		if b.size, b.links, err = blockContent(c, frame[n:]); err != nil {
+			return err
+		}
+		t.blocks[blockKey(c)] = b
+	}
+}
+
+// blockKey is the key of a block in blockTracker.blocks: the bytes of its CIDv1, as CIDv0 dags may link their nodes
+// by either.
+func blockKey(c cid.Cid) string {
+	if c.Version() == 0 {
+		c = cid.NewCidV1(cid.DagProtobuf, c.Hash())
+	}
+	return string(c.Bytes())
+}
+
+// blockContent returns the size of the file data in a block, and its links.
+func blockContent(c cid.Cid, data []byte) (uint64, []cid.Cid, error) {
+	switch c.Type() {
+	case cid.Raw:
+		return uint64(len(data)), nil, nil
+	case cid.DagProtobuf:
+		pn, err := merkledag.DecodeProtobuf(data)
+		if err != nil {
+			return 0, nil, fmt.Errorf("undecodeable block %s: %s", c, err)
+		}
+		var links []cid.Cid
+		for _, l := range pn.Links() {
+			links = append(links, l.Cid)
+		}
+		fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+		if err != nil {
+			// not a unixfs node, it holds no file data
+			return 0, links, nil
+		}
+		return uint64(len(fsn.Data())), links, nil
+	}
+	return 0, nil, nil
+}
+
+// fileRanges walks the dag of a file from its root, and returns the byte ranges of the file in order, each with the
+// piece holding its blocks and where in the piece file these are. m holds the pieces split from the tracked stream, and
+// no others.
+func (t *blockTracker) fileRanges(file string, root string, m *splitter.CarPiecesAndMetadata) (metadata.FilePieces, error) {
+	fp := metadata.FilePieces{File: file, Cid: root}
+	rootCid, err := cid.Decode(root)
+	if err != nil {
+		return fp, err
+	}
+
+	// the blocks of piece k start at starts[k] in the stream, and end at ends[k]
+	starts := make([]int64, len(m.CarPieces))
+	ends := make([]int64, len(m.CarPieces))
+	end := int64(m.OriginalCarHeaderSize)
+	for k, cf := range m.CarPieces {
+		starts[k] = end
+		end += int64(cf.ContentSize)
+		ends[k] = end
+	}
+	pieceAt := func(offset int64) (int, error) {
+		k := sort.Search(len(ends), func(k int) bool { return ends[k] > offset })
+		if k == len(ends) {
+			return 0, fmt.Errorf("offset %d is behind the last piece", offset)
+		}
+		return k, nil
+	}
+
+	// add adds the file data of a block in piece k. b is the block, unless it is inlined into its parent. Blocks without
+	// file data, the nodes linking the leaves, don't count towards the ranges.
+	add := func(size uint64, k int, b *trackedBlock) {
+		if size == 0 {
+			return
+		}
+		if k < 0 {
+			// a file small enough to be inlined into its cid as a whole, its data is in no piece of its own
+			fp.Size += size
+			return
+		}
+		n := len(fp.Ranges)
+		if n == 0 || fp.Ranges[n-1].Piece != m.CarPieces[k].Name {
+			fp.Ranges = append(fp.Ranges, metadata.PieceRange{
+				Piece:    m.CarPieces[k].Name,
+				PieceCid: m.CarPieces[k].CommP.String(),
+				Offset:   fp.Size,
+			})
+			n++
+		}
+		r := &fp.Ranges[n-1]
+		r.Length += size
+		fp.Size += size
+		if b != nil {
+			// the piece file starts with its own header, followed by the blocks from starts[k] on
+			start := m.CarPieces[k].HeaderSize + uint64(b.offset-starts[k])
+			end := start + uint64(b.length)
+			if r.PieceLength == 0 || start < r.PieceOffset {
+				if r.PieceLength > 0 {
+					r.PieceLength += r.PieceOffset - start
+				}
+				r.PieceOffset = start
+			}
+			if end > r.PieceOffset+r.PieceLength {
+				r.PieceLength = end - r.PieceOffset
+			}
+		}
+	}
+
+	var walk func(c cid.Cid, parent int) error
+	walk = func(c cid.Cid, parent int) error {
+		if c.Prefix().MhType == multihash.IDENTITY {
+			// inlined into the cid, and with it into the parent block
+			dmh, err := multihash.Decode(c.Hash())
+			if err != nil {
+				return err
+			}
+			size, links, err := blockContent(c, dmh.Digest)
+			if err != nil {
+				return err
+			}
+			add(size, parent, nil)
+			// small files are inlined as a whole, a node linking to an inlined leaf
+			for _, l := range links {
+				if err := walk(l, parent); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		b, ok := t.blocks[blockKey(c)]
+		if !ok {
+			return fmt.Errorf("block %s of %s is not in the car stream", c, file)
+		}
+		k, err := pieceAt(b.offset)
+		if err != nil {
+			return err
+		}
+		add(b.size, k, &b)
+		for _, l := range b.links {
+			if err := walk(l, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(rootCid, -1); err != nil {
+		return fp, err
+	}
+	return fp, nil
+}
+
+// filePieces returns the pieces and byte ranges of the files whose file data is larger than minSize, or of all files if
+// minSize is negative. files and rs are the files in the dag and their roots. The tracker must be done with the stream.
+func (t *blockTracker) filePieces(files []string, rs []roots, m *splitter.CarPiecesAndMetadata, minSize int) ([]metadata.FilePieces, error) {
+	var fps []metadata.FilePieces
+	for i, r := range rs {
+		if r.Payload <= minSize {
+			continue
+		}
+		fp, err := t.fileRanges(files[i], r.Cid, m)
+		if err != nil {
+			return nil, err
+		}
+		fps = append(fps, fp)
+	}
+	return fps, nil
+}
@@ -0,0 +1,115 @@
+package dataprep
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"testing"
+	"time"
+)
+
+// generatedFile is size bytes of data that doesn't repeat within a leaf block, so that no block gets deduplicated.
+type generatedFile struct {
+	pattern []byte
+	size    int64
+	off     int64
+}
+
+func newGeneratedFile(size int64) *generatedFile {
+	// not a multiple of the chunk size, every chunk starts elsewhere in the pattern
+	pattern := make([]byte, 1<<20+13)
+	rand.New(rand.NewSource(size)).Read(pattern)
+	return &generatedFile{pattern: pattern, size: size}
+}
+
+func (g *generatedFile) Read(p []byte) (int, error) {
+	if g.off >= g.size {
+		return 0, io.EOF
+	}
+	if rest := g.size - g.off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n := copy(p, g.pattern[g.off%int64(len(g.pattern)):])
+	g.off += int64(n)
+	return n, nil
+}
+
+func (g *generatedFile) Close() error { return nil }
+
+// peakHeapOfPrep dry-runs a single generated file of the given size through the whole pipeline, dag building, block
+// framing and splitting, and returns the peak of the live heap meanwhile.
+func peakHeapOfPrep(t *testing.T, size int64) uint64 {
+	t.Helper()
+
+	opts := Options{TargetSize: 32 << 20, DryRun: true, PipeBuffer: 16 << 20, LargeFiles: LargeFilesRecord, BlockOrder: blockOrderDFS, FlattenCollisions: "suffix"}
+	in := &input{paths: []string{"big"}, files: []string{"big"}}
+	in.frs = []io.Reader{newMultipartReader("big", size, func() (io.ReadCloser, error) {
+		return newGeneratedFile(size), nil
+	})}
+	in.inputs = [][]io.Reader{in.frs}
+	if err := in.nameFiles(opts); err != nil {
+		t.Fatal(err)
+	}
+	dag, err := opts.Dag.format()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the heap marked live by the last collection, leaving out the garbage that piles up until the next one
+	live := []metrics.Sample{{Name: "/gc/heap/live:bytes"}}
+	if metrics.Read(live); live[0].Value.Kind() != metrics.KindUint64 {
+		t.Skip("the Go runtime doesn't report the live heap")
+	}
+	runtime.GC()
+	var peak uint64
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			metrics.Read(live)
+			if v := live[0].Value.Uint64(); v > peak {
+				peak = v
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	res, err := prepStream(context.Background(), opts, dag, in, "", true)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Payload != uint64(size) {
+		t.Fatalf("dag holds %d bytes of the %d byte file", res.Payload, size)
+	}
+	if want := int(size / int64(opts.TargetSize)); len(res.Pieces.CarPieces) < want {
+		t.Fatalf("got %d pieces, want at least %d", len(res.Pieces.CarPieces), want)
+	}
+	return peak
+}
+
+// TestLargeFileBoundedMemory checks that the live heap while a single large file is prepped doesn't grow with the
+// size of the file: all stages stream, nothing holds on to the file or to its car stream.
+func TestLargeFileBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("preps over 1GiB of data")
+	}
+
+	small := peakHeapOfPrep(t, 128<<20)
+	large := peakHeapOfPrep(t, 1<<30)
+	t.Logf("peak live heap: %dMiB for 128MiB, %dMiB for 1GiB", small>>20, large>>20)
+	// the buffers are the same for both, what little grows is the bookkeeping of every block
+	if large > small+32<<20 {
+		t.Fatalf("peak live heap grew from %dMiB to %dMiB with 8 times the input", small>>20, large>>20)
+	}
+}
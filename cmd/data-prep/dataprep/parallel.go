@@ -0,0 +1,148 @@
+package dataprep
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/ipfs/go-cid"
+)
+
+// buildParallel builds the dags of the given inputs (the file readers of every top-level path) concurrently, running
+// up to workers anelace instances, each writing the car stream of its input to a temporary file in tmpDir. Once all
+// are done, the car streams are concatenated in input order into wout, followed by the roots into werr. This is
+// exactly what a single anelace run over all inputs produces (blocks already emitted for an earlier input are dropped,
+// just like anelace does within a single run), so the root cid and the pieces do not depend on scheduling. Once ctx is
+// done, the inputs stop being read.
+func buildParallel(ctx context.Context, inputs [][]io.Reader, workers int, tmpDir string, dag dagFormat, werr, wout io.Writer) error {
+	dir, err := os.MkdirTemp(tmpDir, "data-prep-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cars := make([]string, len(inputs))
+	rootsStreams := make([][]byte, len(inputs))
+	errs := make([]error, len(inputs))
+
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+	for i, frs := range inputs {
+		wg.Add(1)
+		go func(i int, frs []io.Reader) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			cars[i] = filepath.Join(dir, fmt.Sprintf("%d.car", i))
+			rootsStreams[i], errs[i] = buildCar(&ctxReader{ctx: ctx, r: io.MultiReader(frs...)}, cars[i], dag)
+		}(i, frs)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to build the dag of input %d: %s", i+1, err)
+		}
+	}
+
+	stream, _, err := splitter.ConcatCars(cars)
+	if err != nil {
+		return err
+	}
+	if err := copyDedup(wout, stream); err != nil {
+		return fmt.Errorf("failed to write car stream: %s", err)
+	}
+	// every anelace run numbers its streams on its own, renumber them as if all inputs went through a single run
+	var streams int
+	enc := json.NewEncoder(werr)
+	for i, rootsStream := range rootsStreams {
+		rs, err := getRoots(bytes.NewReader(rootsStream), true)
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			r.Stream += streams
+			if err := enc.Encode(r); err != nil {
+				return fmt.Errorf("failed to write roots: %s", err)
+			}
+		}
+		// an input has a stream for every file read, whether anelace emitted a root for it or not
+		streams += len(inputs[i]) - len(skippedFiles(inputs[i]))
+	}
+	return nil
+}
+
+// buildCar runs anelace over a single input, writing the car stream to path, and returns the roots stream.
+func buildCar(r io.Reader, path string, dag dagFormat) ([]byte, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fw := bufio.NewWriterSize(f, 4<<20)
+
+	anl, err := newAnelace(dag, fw)
+	if err != nil {
+		return nil, err
+	}
+	anl.SetMultipart(true)
+
+	var rootsStream bytes.Buffer
+	if err := processReader(anl, r, &rootsStream); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %s", path, err)
+	}
+	return rootsStream.Bytes(), f.Close()
+}
+
+// copyDedup copies a car stream, dropping every block whose cid was already copied before.
+func copyDedup(w io.Writer, r io.Reader) error {
+	br := bufio.NewReaderSize(r, 4<<20)
+	bw := bufio.NewWriterSize(w, 4<<20)
+	seen := make(map[string]struct{})
+
+	// the header is copied as is, it is framed just like a block
+	for first := true; ; first = false {
+		frameLen, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		frame := make([]byte, frameLen)
+		if _, err := io.ReadFull(br, frame); err != nil {
+			return err
+		}
+
+		if !first {
+			_, c, err := cid.CidFromBytes(frame)
+			if err != nil {
+				return fmt.Errorf("failed to decode block cid: %s", err)
+			}
+			if _, ok := seen[c.KeyString()]; ok {
+				continue
+			}
+			seen[c.KeyString()] = struct{}{}
+		}
+
+		if _, err := bw.Write(binary.AppendUvarint(nil, frameLen)); err != nil {
+			return err
+		}
+		if _, err := bw.Write(frame); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
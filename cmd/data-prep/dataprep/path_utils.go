@@ -0,0 +1,394 @@
+package dataprep
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/progress"
+)
+
+// how much of a file is read ahead before its size prefix goes into the stream
+const startReadSize = 64 << 10
+
+func getFileReader(path string, pathInfo os.FileInfo) (io.Reader, error) {
+	if pathInfo.IsDir() {
+		return nil, fmt.Errorf("expect file got directory: %s", path)
+	}
+
+	return newMultipartReader(path, pathInfo.Size(), func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}), nil
+}
+
+// newMultipartReader returns a reader of a single multipart stream for anelace: the size as 8 byte big endian prefix,
+// followed by exactly that many bytes of content.
+func newMultipartReader(name string, size int64, open func() (io.ReadCloser, error)) io.Reader {
+	sizeBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(sizeBytes, uint64(size))
+
+	return &multipartReader{
+		prefix:  bytes.NewReader(sizeBytes),
+		content: &sizedReader{name: name, remaining: size, open: open},
+		size:    size,
+	}
+}
+
+// multipartReader only emits the size prefix once the file could be opened and read from, so that with skipErrors a
+// file that can't be read is left out of the stream altogether instead of breaking it.
+type multipartReader struct {
+	prefix     io.Reader
+	content    *sizedReader
+	size       int64
+	started    bool
+	skipErrors bool
+	skipped    bool
+	progress   *progress.Progress
+	done       bool
+}
+
+func (r *multipartReader) Read(p []byte) (int, error) {
+	if !r.started {
+		r.started = true
+		r.progress.StartFile(r.content.name)
+		if err := r.content.start(); err != nil {
+			if !r.skipErrors {
+				return 0, err
+			}
+			logging.Warn("skipping unreadable file", "path", r.content.name, "err", err)
+			r.skipped = true
+			r.progress.FileDone()
+		}
+	}
+	if r.skipped {
+		return 0, io.EOF
+	}
+	if n, err := r.prefix.Read(p); err != io.EOF {
+		return n, err
+	}
+	n, err := r.content.Read(p)
+	r.progress.Read(n)
+	if err == io.EOF && !r.done {
+		r.done = true
+		r.progress.FileDone()
+	}
+	return n, err
+}
+
+// setReadOptions sets a timeout for opening and every read of the files behind the given multipart readers, and
+// whether files that fail to open or to read from the start are skipped instead of failing the run. A file that fails
+// later on always fails the run, as its size prefix is already part of the stream. The reads are counted by p.
+func setReadOptions(frs []io.Reader, timeout time.Duration, skipErrors bool, p *progress.Progress) {
+	for _, fr := range frs {
+		if mr, ok := fr.(*multipartReader); ok {
+			mr.content.timeout = timeout
+			mr.skipErrors = skipErrors
+			mr.progress = p
+		}
+	}
+}
+
+// skippedFiles returns the indexes of the files that were skipped, once all multipart readers have been read.
+func skippedFiles(frs []io.Reader) map[int]bool {
+	skipped := make(map[int]bool)
+	for i, fr := range frs {
+		if mr, ok := fr.(*multipartReader); ok && mr.skipped {
+			skipped[i] = true
+		}
+	}
+	return skipped
+}
+
+// withoutSkipped drops the skipped files from files and their dag names.
+func withoutSkipped(frs []io.Reader, files, names []string) ([]string, []string) {
+	skipped := skippedFiles(frs)
+	if len(skipped) == 0 {
+		return files, names
+	}
+	var keptFiles, keptNames []string
+	for i := range files {
+		if !skipped[i] {
+			keptFiles = append(keptFiles, files[i])
+			keptNames = append(keptNames, names[i])
+		}
+	}
+	return keptFiles, keptNames
+}
+
+// checkMaxFileSize fails on the first file larger than maxSize bytes.
+func checkMaxFileSize(files []string, frs []io.Reader, maxSize int64) error {
+	for i, fr := range frs {
+		if mr, ok := fr.(*multipartReader); ok && mr.size > maxSize {
+			return fmt.Errorf("%s is %d bytes, more than the --max-file-size of %d bytes", files[i], mr.size, maxSize)
+		}
+	}
+	return nil
+}
+
+// inputSize is the total size of the files behind the given multipart readers, leaving out skipped files, and of a
+// stream on stdin, once read.
+func inputSize(frs []io.Reader) uint64 {
+	var total uint64
+	for _, fr := range frs {
+		if mr, ok := fr.(*multipartReader); ok && !mr.skipped {
+			total += uint64(mr.size)
+		}
+		if s, ok := fr.(*stdinStream); ok {
+			total += uint64(s.size)
+		}
+	}
+	return total
+}
+
+// sizedReader reads exactly the number of bytes announced in the multipart size prefix of a file. anelace
+// relies on the prefix to find the boundary between files, so a file that shrinks or grows after it was stat-ed must
+// not shift the boundary: growth is cut off, and shrinking is reported as an error instead of silently consuming the
+// next file.
+// Files are only opened once they are read from, and closed once fully read, so large datasets don't exhaust the
+// open file limit.
+type sizedReader struct {
+	name      string
+	remaining int64
+	open      func() (io.ReadCloser, error)
+	rc        io.ReadCloser
+	timeout   time.Duration
+	// read ahead by start
+	pending []byte
+}
+
+// start opens the file and reads its first bytes, so that a file that can't be read is noticed before anything of it
+// went into the stream.
+func (r *sizedReader) start() error {
+	if r.remaining <= 0 {
+		return nil
+	}
+	size := r.remaining
+	if size > startReadSize {
+		size = startReadSize
+	}
+	buf := make([]byte, size)
+	n, err := r.Read(buf)
+	r.pending = buf[:n]
+	return err
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	if len(r.pending) > 0 {
+		n := copy(p, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+
+	if r.remaining <= 0 {
+		r.close()
+		return 0, io.EOF
+	}
+
+	if r.rc == nil {
+		rc, err := openWithTimeout(r.open, r.timeout)
+		if err != nil {
+			return 0, err
+		}
+		if r.timeout > 0 {
+			rc = &timeoutReadCloser{rc: rc, timeout: r.timeout}
+		}
+		r.rc = rc
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.rc.Read(p)
+	r.remaining -= int64(n)
+
+	if err == io.EOF {
+		if r.remaining > 0 {
+			r.close()
+			return n, fmt.Errorf("file %s shrank while being read: %d bytes missing", r.name, r.remaining)
+		}
+		err = nil
+	}
+	if err != nil {
+		r.close()
+		return n, fmt.Errorf("failed to read %s: %s", r.name, err)
+	}
+	if r.remaining == 0 {
+		r.close()
+	}
+	return n, err
+}
+
+func (r *sizedReader) close() {
+	if r.rc != nil {
+		r.rc.Close()
+		r.rc = nil
+	}
+}
+
+// openWithTimeout opens a file, giving up after timeout (if set). A file that opens after all is closed right away.
+func openWithTimeout(open func() (io.ReadCloser, error), timeout time.Duration) (io.ReadCloser, error) {
+	if timeout <= 0 {
+		return open()
+	}
+	type result struct {
+		rc  io.ReadCloser
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		rc, err := open()
+		done <- result{rc, err}
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case res := <-done:
+		return res.rc, res.err
+	case <-t.C:
+		go func() {
+			if res := <-done; res.rc != nil {
+				res.rc.Close()
+			}
+		}()
+		return nil, fmt.Errorf("open timed out after %s", timeout)
+	}
+}
+
+// timeoutReadCloser fails a read that doesn't return within timeout. The stalled read is left behind, so the reader
+// is unusable afterwards.
+type timeoutReadCloser struct {
+	rc      io.ReadCloser
+	timeout time.Duration
+	buf     []byte
+	stalled bool
+}
+
+func (t *timeoutReadCloser) Read(p []byte) (int, error) {
+	if t.stalled {
+		return 0, fmt.Errorf("a previous read timed out")
+	}
+	// read into a buffer of our own, which a stalled read may still write to after we returned
+	if cap(t.buf) < len(p) {
+		t.buf = make([]byte, len(p))
+	}
+	buf := t.buf[:len(p)]
+
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := t.rc.Read(buf)
+		done <- result{n, err}
+	}()
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return copy(p, buf[:res.n]), res.err
+	case <-timer.C:
+		t.stalled = true
+		t.buf = nil
+		return 0, fmt.Errorf("read timed out after %s", t.timeout)
+	}
+}
+
+func (t *timeoutReadCloser) Close() error {
+	return t.rc.Close()
+}
+
+// getAllFileReadersFromPath returns the files of path, a file or a directory, along with their readers, leaving out
+// those that filter doesn't keep. Symlinks in a directory are handled as set by symlinks (see Options.Symlinks), and the
+// preserved ones are returned apart from the files. path itself is always followed.
+func getAllFileReadersFromPath(path string, filter *pathFilter, symlinks string) ([]string, []io.Reader, []symlink, error) {
+
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !pathInfo.IsDir() {
+
+		if !filter.keep(relativePath(path, path)) {
+			return nil, nil, nil, nil
+		}
+		r, err := getFileReader(path, pathInfo)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return []string{path}, []io.Reader{r}, nil, nil
+	}
+
+	w := &fileWalker{root: path, filter: filter, symlinks: symlinks}
+	if err := w.walk(path, []os.FileInfo{pathInfo}); err != nil {
+		return nil, nil, nil, err
+	}
+	return w.files, w.frs, w.links, nil
+}
+
+// InputFile is a file of the input paths, as listed by ListFiles.
+type InputFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ListFiles lists the files of the local input paths that Prep would read with the given options, without reading
+// them. Only Paths, Include, Exclude, IgnoreFile and Symlinks are looked at. A file removed while the paths are walked
+// is left out.
+func ListFiles(opts Options) ([]InputFile, error) {
+	if err := validateSymlinks(opts.Symlinks); err != nil {
+		return nil, err
+	}
+	filter, err := newPathFilter(opts.Include, opts.Exclude, opts.IgnoreFile)
+	if err != nil {
+		return nil, err
+	}
+	var files []InputFile
+	for _, path := range opts.Paths {
+		if isS3URL(path) {
+			return nil, fmt.Errorf("only local paths can be listed, got %s", path)
+		}
+		fs, _, _, err := getAllFileReadersFromPath(path, filter, opts.Symlinks)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fs {
+			info, err := os.Stat(f)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, InputFile{Path: f, Size: info.Size(), ModTime: info.ModTime()})
+		}
+	}
+	return files, nil
+}
+
+// onlyFiles drops the files not in only, along with their readers. Paths are compared cleaned, so that ./a and a are
+// the same file.
+func onlyFiles(only []string, files []string, frs []io.Reader) ([]string, []io.Reader) {
+	picked := make(map[string]bool, len(only))
+	for _, f := range only {
+		picked[filepath.Clean(f)] = true
+	}
+	var keptFiles []string
+	var keptFrs []io.Reader
+	for i, file := range files {
+		if picked[filepath.Clean(file)] {
+			keptFiles = append(keptFiles, file)
+			keptFrs = append(keptFrs, frs[i])
+		}
+	}
+	return keptFiles, keptFrs
+}
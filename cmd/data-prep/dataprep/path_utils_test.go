@@ -0,0 +1,144 @@
+package dataprep
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// zeroReads returns (0, nil) before every read of r.
+type zeroReads struct {
+	r    io.Reader
+	zero bool
+}
+
+func (z *zeroReads) Read(p []byte) (int, error) {
+	z.zero = !z.zero
+	if z.zero {
+		return 0, nil
+	}
+	return z.r.Read(p)
+}
+
+// zeroLengthReads reads from r with a zero-length read before every read.
+type zeroLengthReads struct{ r io.Reader }
+
+func (z zeroLengthReads) Read(p []byte) (int, error) {
+	if n, err := z.r.Read(p[:0]); n != 0 || err != nil {
+		return n, err
+	}
+	return z.r.Read(p)
+}
+
+func opener(wrap func(io.Reader) io.Reader, content []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(wrap(bytes.NewReader(content))), nil
+	}
+}
+
+func multipartFrame(content []byte) []byte {
+	out := binary.BigEndian.AppendUint64(nil, uint64(len(content)))
+	return append(out, content...)
+}
+
+func TestMultipartReader(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	noWrap := func(r io.Reader) io.Reader { return r }
+
+	cases := []struct {
+		name    string
+		size    int64
+		content []byte
+		wrap    func(io.Reader) io.Reader
+		// read the stream through this, defaults to reading it as is
+		readWrap func(io.Reader) io.Reader
+		wantErr  string
+	}{
+		{name: "whole reads", size: int64(len(content)), content: content, wrap: noWrap},
+		{name: "one byte reads", size: int64(len(content)), content: content, wrap: iotest.OneByteReader},
+		{name: "half reads", size: int64(len(content)), content: content, wrap: iotest.HalfReader},
+		{name: "reads returning (0, nil)", size: int64(len(content)), content: content, wrap: func(r io.Reader) io.Reader { return &zeroReads{r: r} }},
+		{name: "data with EOF", size: int64(len(content)), content: content, wrap: iotest.DataErrReader},
+		{name: "zero-length reads", size: int64(len(content)), content: content, wrap: noWrap, readWrap: func(r io.Reader) io.Reader { return zeroLengthReads{r} }},
+		{name: "one byte reads of the stream", size: int64(len(content)), content: content, wrap: noWrap, readWrap: iotest.OneByteReader},
+		{name: "empty file", size: 0, content: nil, wrap: noWrap},
+		{name: "file grew", size: 1000, content: content, wrap: noWrap},
+		{name: "file shrank", size: int64(len(content)) + 1, content: content, wrap: noWrap, wantErr: "shrank while being read: 1 bytes missing"},
+		{name: "read error", size: int64(len(content)), content: content, wrap: iotest.TimeoutReader, wantErr: "failed to read"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var r io.Reader = newMultipartReader("f", tc.size, opener(tc.wrap, tc.content))
+			if tc.readWrap != nil {
+				r = tc.readWrap(r)
+			}
+			got, err := io.ReadAll(r)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := multipartFrame(tc.content[:tc.size]); !bytes.Equal(got, want) {
+				t.Fatalf("got %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+// TestMultipartBoundaries reads several files of awkward readers as one stream, as anelace does, and checks that
+// splitting the stream on the size prefixes gives back exactly the files.
+func TestMultipartBoundaries(t *testing.T) {
+	files := [][]byte{
+		[]byte("first"),
+		nil,
+		bytes.Repeat([]byte{1}, startReadSize+1),
+		nil,
+		[]byte("x"),
+		bytes.Repeat([]byte{2}, 3*startReadSize),
+	}
+	wraps := []func(io.Reader) io.Reader{
+		iotest.OneByteReader,
+		iotest.HalfReader,
+		func(r io.Reader) io.Reader { return &zeroReads{r: r} },
+		iotest.DataErrReader,
+	}
+
+	var frs []io.Reader
+	for i, f := range files {
+		frs = append(frs, newMultipartReader("f", int64(len(f)), opener(wraps[i%len(wraps)], f)))
+	}
+	stream, err := io.ReadAll(iotest.HalfReader(io.MultiReader(frs...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][]byte
+	for len(stream) > 0 {
+		if len(stream) < 8 {
+			t.Fatalf("%d bytes left after %d files, too short for a size prefix", len(stream), len(got))
+		}
+		size := binary.BigEndian.Uint64(stream)
+		stream = stream[8:]
+		if uint64(len(stream)) < size {
+			t.Fatalf("file %d announces %d bytes, only %d left", len(got), size, len(stream))
+		}
+		got = append(got, stream[:size])
+		stream = stream[size:]
+	}
+	if len(got) != len(files) {
+		t.Fatalf("got %d files, want %d", len(got), len(files))
+	}
+	for i := range files {
+		if !bytes.Equal(got[i], files[i]) {
+			t.Errorf("file %d: got %d bytes, want %d", i, len(got[i]), len(files[i]))
+		}
+	}
+}
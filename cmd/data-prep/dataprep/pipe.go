@@ -0,0 +1,127 @@
+package dataprep
+
+import (
+	"io"
+	"sync"
+)
+
+// pipeWriteCloser is the write side of a pipe, which can be closed with an error that is then returned to the reader.
+type pipeWriteCloser interface {
+	io.WriteCloser
+	CloseWithError(err error) error
+}
+
+// newPipe returns an in-memory pipe between two pipeline stages. Unlike io.Pipe, which hands every write over to the
+// reader in lock-step, up to bufSize bytes get buffered, letting the producer run ahead of the consumer. A bufSize of
+// 0 falls back to an unbuffered io.Pipe.
+func newPipe(bufSize int) (io.ReadCloser, pipeWriteCloser) {
+	if bufSize <= 0 {
+		return io.Pipe()
+	}
+	p := &bufferedPipe{buf: make([]byte, bufSize)}
+	p.cond = sync.NewCond(&p.mu)
+	return &pipeReader{p}, &pipeWriter{p}
+}
+
+type bufferedPipe struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// ring buffer, holding n bytes starting at start
+	buf   []byte
+	start int
+	n     int
+
+	werr error // set once the write side is closed, io.EOF for a regular close
+	rerr error // set once the read side is closed
+}
+
+func (p *bufferedPipe) read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.n == 0 && p.werr == nil && p.rerr == nil {
+		p.cond.Wait()
+	}
+	if p.rerr != nil {
+		return 0, io.ErrClosedPipe
+	}
+	if p.n == 0 {
+		return 0, p.werr
+	}
+
+	var read int
+	for read < len(b) && p.n > 0 {
+		end := p.start + p.n
+		if end > len(p.buf) {
+			end = len(p.buf)
+		}
+		c := copy(b[read:], p.buf[p.start:end])
+		read += c
+		p.n -= c
+		p.start = (p.start + c) % len(p.buf)
+	}
+	p.cond.Broadcast()
+	return read, nil
+}
+
+func (p *bufferedPipe) write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var written int
+	for written < len(b) {
+		for p.n == len(p.buf) && p.werr == nil && p.rerr == nil {
+			p.cond.Wait()
+		}
+		if p.rerr != nil || p.werr != nil {
+			return written, io.ErrClosedPipe
+		}
+
+		end := (p.start + p.n) % len(p.buf)
+		free := len(p.buf) - p.n
+		if end+free > len(p.buf) {
+			free = len(p.buf) - end
+		}
+		c := copy(p.buf[end:end+free], b[written:])
+		written += c
+		p.n += c
+		p.cond.Broadcast()
+	}
+	return written, nil
+}
+
+func (p *bufferedPipe) closeWrite(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		err = io.EOF
+	}
+	if p.werr == nil {
+		p.werr = err
+	}
+	p.cond.Broadcast()
+}
+
+func (p *bufferedPipe) closeRead() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rerr == nil {
+		p.rerr = io.ErrClosedPipe
+	}
+	p.cond.Broadcast()
+}
+
+type pipeReader struct{ p *bufferedPipe }
+
+func (r *pipeReader) Read(b []byte) (int, error) { return r.p.read(b) }
+func (r *pipeReader) Close() error               { r.p.closeRead(); return nil }
+
+type pipeWriter struct{ p *bufferedPipe }
+
+func (w *pipeWriter) Write(b []byte) (int, error) { return w.p.write(b) }
+func (w *pipeWriter) Close() error                { w.p.closeWrite(nil); return nil }
+func (w *pipeWriter) CloseWithError(err error) error {
+	w.p.closeWrite(err)
+	return nil
+}
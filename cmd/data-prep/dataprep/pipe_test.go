@@ -0,0 +1,141 @@
+package dataprep
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestPipe(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, bufSize := range []int{0, 1, 7, 4096, 64 << 10, 2 << 20} {
+		t.Run(fmt.Sprintf("buffer %d", bufSize), func(t *testing.T) {
+			r, w := newPipe(bufSize)
+			go func() {
+				rnd := rand.New(rand.NewSource(2))
+				for rest := data; len(rest) > 0; {
+					n := rnd.Intn(10000) + 1
+					if n > len(rest) {
+						n = len(rest)
+					}
+					if _, err := w.Write(rest[:n]); err != nil {
+						w.CloseWithError(err)
+						return
+					}
+					rest = rest[n:]
+				}
+				w.Close()
+			}()
+
+			var got bytes.Buffer
+			buf := make([]byte, 9000)
+			rnd := rand.New(rand.NewSource(3))
+			for {
+				n, err := r.Read(buf[:rnd.Intn(len(buf))+1])
+				got.Write(buf[:n])
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(got.Bytes(), data) {
+				t.Fatalf("read %d bytes that differ from the %d written", got.Len(), len(data))
+			}
+		})
+	}
+}
+
+func TestPipeCloseWithError(t *testing.T) {
+	for _, bufSize := range []int{0, 64} {
+		t.Run(fmt.Sprintf("buffer %d", bufSize), func(t *testing.T) {
+			r, w := newPipe(bufSize)
+			failed := errors.New("stage failed")
+			go func() {
+				w.Write([]byte("abc"))
+				w.CloseWithError(failed)
+			}()
+
+			got, err := io.ReadAll(r)
+			if err != failed {
+				t.Fatalf("got error %v, want %v", err, failed)
+			}
+			// whatever was written before the error is still read
+			if string(got) != "abc" {
+				t.Fatalf("read %q, want %q", got, "abc")
+			}
+		})
+	}
+}
+
+func TestPipeReaderClosed(t *testing.T) {
+	r, w := newPipe(4)
+	done := make(chan error)
+	go func() {
+		// more than fits into the buffer, blocks until the reader goes away
+		_, err := w.Write(make([]byte, 100))
+		done <- err
+	}()
+	r.Close()
+	if err := <-done; err != io.ErrClosedPipe {
+		t.Fatalf("got error %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+// BenchmarkPipe moves a car stream of 256KiB blocks from a producer to a consumer hashing it, as the splitter does
+// with commP, for several buffer sizes. Both sides stall now and then, the producer at the end of a file and the
+// consumer at the end of a piece, which a buffer lets the other side run through.
+func BenchmarkPipe(b *testing.B) {
+	const (
+		streamSize = 64 << 20
+		stallEvery = 8 << 20
+	)
+	block := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(block)
+	stall := func() {
+		for i := 0; i < stallEvery/len(block)/2; i++ {
+			sha256.Sum256(block)
+		}
+	}
+
+	for _, bufSize := range []int{0, 64 << 10, 1 << 20, 16 << 20} {
+		b.Run(fmt.Sprintf("buffer %d", bufSize), func(b *testing.B) {
+			b.SetBytes(streamSize)
+			for i := 0; i < b.N; i++ {
+				r, w := newPipe(bufSize)
+				go func() {
+					for written := 0; written < streamSize; written += len(block) {
+						if written%stallEvery == stallEvery/2 {
+							stall()
+						}
+						if _, err := w.Write(block); err != nil {
+							w.CloseWithError(err)
+							return
+						}
+					}
+					w.Close()
+				}()
+				h := sha256.New()
+				buf := make([]byte, len(block))
+				for read := 0; ; read += len(buf) {
+					if read%stallEvery == 0 {
+						stall()
+					}
+					if _, err := io.ReadFull(r, buf); err == io.EOF {
+						break
+					} else if err != nil {
+						b.Fatal(err)
+					}
+					h.Write(buf)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package dataprep
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/multiformats/go-multihash"
+)
+
+// maxRootDiagnostics caps the number of unmatched files and roots listed when reconciling fails.
+const maxRootDiagnostics = 10
+
+// fileSizes returns the sizes of the files behind the given multipart readers, leaving out skipped files, so that
+// they line up with the files returned by withoutSkipped. The size of a stream on stdin is the size read so far. The
+// size of any other reader that is not a multipart reader is unknown, and given as -1.
+func fileSizes(frs []io.Reader) []int64 {
+	var sizes []int64
+	for _, fr := range frs {
+		if s, ok := fr.(*stdinStream); ok {
+			sizes = append(sizes, s.size)
+			continue
+		}
+		mr, ok := fr.(*multipartReader)
+		if !ok {
+			sizes = append(sizes, -1)
+			continue
+		}
+		if !mr.skipped {
+			sizes = append(sizes, mr.size)
+		}
+	}
+	return sizes
+}
+
+// reconcileRoots matches the roots emitted by anelace to the files, returning one root per file, in the order of the
+// files. anelace numbers the multipart streams, i.e. the files, from 1 up and records the number in every root, so a
+// root is matched to the file of its stream, and its payload has to be the size of that file. anelace doesn't emit a
+// root for an empty file: such a file gets the cid of an empty file in the format of the dags (see emptyFileCid).
+// Anything else that doesn't match up fails, listing the files and roots that didn't.
+func reconcileRoots(files []string, sizes []int64, rs []roots, dag dagFormat) ([]roots, error) {
+	matched := make([]roots, len(files))
+	found := make([]bool, len(files))
+	var problems []string
+	for _, r := range rs {
+		i := r.Stream - 1
+		switch {
+		case i < 0 || i >= len(files):
+			problems = append(problems, fmt.Sprintf("root %s of stream %d (%d bytes) matches none of the %d files", r.Cid, r.Stream, r.Payload, len(files)))
+		case found[i]:
+			problems = append(problems, fmt.Sprintf("roots %s and %s both are of stream %d (%s)", matched[i].Cid, r.Cid, r.Stream, files[i]))
+		case sizes[i] >= 0 && int64(r.Payload) != sizes[i]:
+			problems = append(problems, fmt.Sprintf("root %s of stream %d holds %d bytes, but %s is %d bytes", r.Cid, r.Stream, r.Payload, files[i], sizes[i]))
+		default:
+			matched[i] = r
+			found[i] = true
+		}
+	}
+	for i := range files {
+		if found[i] {
+			continue
+		}
+		if sizes[i] == 0 {
+			empty, err := emptyFileCid(dag)
+			if err != nil {
+				return nil, err
+			}
+			matched[i] = roots{Event: "root", Stream: i + 1, Cid: empty.String()}
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("no root for %s (stream %d, %d bytes)", files[i], i+1, sizes[i]))
+	}
+	if len(problems) == 0 {
+		return matched, nil
+	}
+
+	more := ""
+	if len(problems) > maxRootDiagnostics {
+		more = fmt.Sprintf("\n  ... and %d more", len(problems)-maxRootDiagnostics)
+		problems = problems[:maxRootDiagnostics]
+	}
+	return nil, fmt.Errorf("failed to match the %d roots from anelace to the %d files:\n  %s%s", len(rs), len(files), strings.Join(problems, "\n  "), more)
+}
+
+// emptyFileCid returns the cid of an empty file in the format of the dags, as ipfs add builds it: an empty raw block
+// with raw leaves, otherwise a unixfs file node without data. It is inlined into an identity cid if small enough.
+func emptyFileCid(dag dagFormat) (cid.Cid, error) {
+	codec, block := uint64(cid.Raw), []byte(nil)
+	if !dag.rawLeaves {
+		codec, block = cid.DagProtobuf, merkledag.NodeWithData(unixfs.FilePBData(nil, 0)).RawData()
+	}
+	if dag.inlineMaxSize > 0 && len(block) <= dag.inlineMaxSize {
+		mh, err := multihash.Sum(block, multihash.IDENTITY, -1)
+		if err != nil {
+			return cid.Undef, err
+		}
+		return cid.NewCidV1(codec, mh), nil
+	}
+	if codec == cid.DagProtobuf {
+		return dag.builder().Sum(block)
+	}
+	return cid.V1Builder{Codec: codec, MhType: dag.mhType}.Sum(block)
+}
@@ -0,0 +1,178 @@
+package dataprep
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReconcileRoots(t *testing.T) {
+	files := []string{"a", "empty", "b"}
+	sizes := []int64{10, 0, 20}
+	dag, err := DagOptions{}.format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := emptyFileCid(dag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		rs       []roots
+		wantCids []string
+		wantErr  string
+		// the unmatched roots and files the error has to list besides
+		wantListed []string
+	}{
+		{
+			name:     "one root per file",
+			rs:       []roots{{Stream: 1, Payload: 10, Cid: "a"}, {Stream: 2, Payload: 0, Cid: "e"}, {Stream: 3, Payload: 20, Cid: "b"}},
+			wantCids: []string{"a", "e", "b"},
+		},
+		{
+			name:     "out of order",
+			rs:       []roots{{Stream: 3, Payload: 20, Cid: "b"}, {Stream: 1, Payload: 10, Cid: "a"}},
+			wantCids: []string{"a", empty.String(), "b"},
+		},
+		{
+			name:    "two roots for a file",
+			rs:      []roots{{Stream: 1, Payload: 10, Cid: "a"}, {Stream: 1, Payload: 10, Cid: "a2"}, {Stream: 3, Payload: 20, Cid: "b"}},
+			wantErr: "both are of stream 1",
+		},
+		{
+			name:    "no root for a file",
+			rs:      []roots{{Stream: 1, Payload: 10, Cid: "a"}},
+			wantErr: "no root for b",
+		},
+		{
+			name:    "root of a file's neighbour",
+			rs:      []roots{{Stream: 1, Payload: 20, Cid: "a"}, {Stream: 3, Payload: 20, Cid: "b"}},
+			wantErr: "holds 20 bytes, but a is 10 bytes",
+		},
+		{
+			name:    "root of no file",
+			rs:      []roots{{Stream: 1, Payload: 10, Cid: "a"}, {Stream: 3, Payload: 20, Cid: "b"}, {Stream: 4, Payload: 1, Cid: "c"}},
+			wantErr: "matches none of the 3 files",
+		},
+		{
+			name:    "root of stream 0",
+			rs:      []roots{{Stream: 0, Payload: 10, Cid: "z"}, {Stream: 1, Payload: 10, Cid: "a"}, {Stream: 3, Payload: 20, Cid: "b"}},
+			wantErr: "root z of stream 0 (10 bytes) matches none of the 3 files",
+		},
+		{
+			name:       "more roots than files",
+			rs:         []roots{{Stream: 1, Payload: 10, Cid: "a"}, {Stream: 2, Payload: 0, Cid: "e"}, {Stream: 3, Payload: 20, Cid: "b"}, {Stream: 4, Payload: 5, Cid: "c"}, {Stream: 5, Payload: 6, Cid: "d"}},
+			wantErr:    "failed to match the 5 roots from anelace to the 3 files",
+			wantListed: []string{"root c of stream 4", "root d of stream 5"},
+		},
+		{
+			name:    "fewer roots than files",
+			rs:      []roots{{Stream: 3, Payload: 20, Cid: "b"}},
+			wantErr: "failed to match the 1 roots from anelace to the 3 files:\n  no root for a (stream 1, 10 bytes)",
+		},
+		{
+			name:    "no roots",
+			rs:      nil,
+			wantErr: "no root for b (stream 3, 20 bytes)",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := reconcileRoots(files, sizes, tc.rs, dag)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				for _, want := range tc.wantListed {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q doesn't list %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(files) {
+				t.Fatalf("got %d roots for %d files", len(got), len(files))
+			}
+			for i, r := range got {
+				if r.Cid != tc.wantCids[i] {
+					t.Errorf("file %s: root %s, want %s", files[i], r.Cid, tc.wantCids[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileRootsUnknownSizes(t *testing.T) {
+	dag, err := DagOptions{}.format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the size of a file of a reader other than a multipart reader is not known, any payload is taken for it
+	got, err := reconcileRoots([]string{"a", "b"}, []int64{-1, -1}, []roots{{Stream: 2, Payload: 7, Cid: "b"}, {Stream: 1, Payload: 0, Cid: "a"}}, dag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].Cid != "a" || got[1].Cid != "b" {
+		t.Fatalf("got roots %s, %s, want a, b", got[0].Cid, got[1].Cid)
+	}
+
+	// a file of unknown size without a root is not taken to be empty
+	if _, err := reconcileRoots([]string{"a", "b"}, []int64{-1, -1}, []roots{{Stream: 2, Payload: 7, Cid: "b"}}, dag); err == nil || !strings.Contains(err.Error(), "no root for a") {
+		t.Fatalf("got error %v, want a missing root", err)
+	}
+}
+
+func TestReconcileRootsDiagnosticsCapped(t *testing.T) {
+	var files []string
+	var sizes []int64
+	for i := 0; i < maxRootDiagnostics+5; i++ {
+		files = append(files, fmt.Sprintf("f%d", i))
+		sizes = append(sizes, 1)
+	}
+	_, err := reconcileRoots(files, sizes, nil, dagFormat{})
+	if err == nil {
+		t.Fatal("matched no roots to files")
+	}
+	if got := strings.Count(err.Error(), "no root for"); got != maxRootDiagnostics {
+		t.Errorf("listed %d unmatched files, want %d", got, maxRootDiagnostics)
+	}
+	if !strings.Contains(err.Error(), "... and 5 more") {
+		t.Errorf("error %q doesn't count the files left out", err)
+	}
+}
+
+func TestEmptyFileCid(t *testing.T) {
+	// the cids ipfs add gives an empty file
+	cases := []struct {
+		name string
+		dag  DagOptions
+		want string
+	}{
+		{name: "defaults", want: "bafkqaaa"},
+		{name: "cidv0", dag: DagOptions{CidV0: true, NoRawLeaves: true}, want: "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"},
+		{name: "ipfs add", dag: DagOptions{IpfsAddCommand: "ipfs add"}, want: "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"},
+		{name: "ipfs add cidv1", dag: DagOptions{IpfsAddCommand: "ipfs add --cid-version=1"}, want: "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"},
+		{name: "ipfs add cidv1 wrapped leaves", dag: DagOptions{IpfsAddCommand: "ipfs add --cid-version=1 --raw-leaves=false"}, want: "bafybeif7ztnhq65lumvvtr4ekcwd2ifwgm3awq4zfr3srh462rwyinlb4y"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dag, err := tc.dag.format()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := emptyFileCid(dag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
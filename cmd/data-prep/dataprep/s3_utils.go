@@ -0,0 +1,142 @@
+package dataprep
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+)
+
+const s3Scheme = "s3://"
+
+// isS3URL reports whether an input path is an s3://bucket/prefix url rather than a path on disk.
+func isS3URL(p string) bool {
+	return strings.HasPrefix(p, s3Scheme)
+}
+
+// parseS3URL splits an s3://bucket/prefix url into its bucket and prefix, without the slashes around the prefix.
+func parseS3URL(u string) (string, string, error) {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(u, s3Scheme), "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("invalid s3 url %q: expected s3://bucket/prefix", u)
+	}
+	return bucket, strings.Trim(prefix, "/"), nil
+}
+
+// s3DagPath is the path in the dag of the objects under an s3 url: the bucket and the prefix, as if the bucket was a
+// directory on disk.
+func s3DagPath(u string) (string, error) {
+	bucket, prefix, err := parseS3URL(u)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(bucket, prefix), nil
+}
+
+// getAllFileReadersFromS3 enumerates the objects of a bucket under the prefix of an s3://bucket/prefix url, with the
+// aws command line tool, which picks up credentials from the usual environment variables and config files. The prefix
+// is a directory, unless it is the key of an object, which is then prepped as a single file. Paths are prefixed with
+// the bucket, so the bucket becomes the root directory of the dag. Object bodies are streamed as they are read, and
+// empty objects with a key ending in a slash, which stand for directories, are skipped.
+func getAllFileReadersFromS3(u, endpointURL string) ([]string, []io.Reader, error) {
+	bucket, prefix, err := parseS3URL(u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	args := []string{"s3api", "list-objects-v2", "--bucket", bucket, "--output", "json"}
+	if prefix != "" {
+		args = append(args, "--prefix", prefix)
+	}
+	out, err := runAws(endpointURL, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	var listing struct {
+		Contents []struct {
+			Key  string
+			Size int64
+		}
+	}
+	if len(bytes.TrimSpace(out)) > 0 {
+		if err := json.Unmarshal(out, &listing); err != nil {
+			return nil, nil, fmt.Errorf("unexpected aws s3api list-objects-v2 output for %s: %s", u, err)
+		}
+	}
+
+	var files []string
+	var frs []io.Reader
+	for _, obj := range listing.Contents {
+		var rel string
+		switch {
+		case obj.Key == prefix:
+			// the url is the object itself
+			name := path.Join(bucket, prefix)
+			return []string{name}, []io.Reader{newMultipartReader(name, obj.Size, s3ObjectOpener(bucket, obj.Key, endpointURL))}, nil
+		case prefix == "":
+			rel = obj.Key
+		case strings.HasPrefix(obj.Key, prefix+"/"):
+			rel = strings.TrimPrefix(obj.Key, prefix+"/")
+		default:
+			// a sibling sharing the beginning of its name with the prefix
+			continue
+		}
+		if strings.HasSuffix(rel, "/") {
+			if obj.Size != 0 {
+				logging.Warn("skipping object, its key ends in a slash", "key", obj.Key)
+			}
+			continue
+		}
+		if err := validateExternalName(rel); err != nil {
+			return nil, nil, fmt.Errorf("unsafe object key in %s: %s", u, err)
+		}
+
+		name := path.Join(bucket, prefix, rel)
+		files = append(files, name)
+		frs = append(frs, newMultipartReader(name, obj.Size, s3ObjectOpener(bucket, obj.Key, endpointURL)))
+	}
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("no objects under %s", u)
+	}
+
+	return files, frs, nil
+}
+
+func s3ObjectOpener(bucket, key, endpointURL string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		cmd := exec.Command("aws", awsArgs(endpointURL, "s3", "cp", "--quiet", s3Scheme+bucket+"/"+key, "-")...)
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("failed to run aws s3 cp for s3://%s/%s: %s", bucket, key, err)
+		}
+		return &cmdReadCloser{ReadCloser: stdout, cmd: cmd}, nil
+	}
+}
+
+func awsArgs(endpointURL string, args ...string) []string {
+	if endpointURL != "" {
+		args = append([]string{"--endpoint-url", endpointURL}, args...)
+	}
+	return args
+}
+
+func runAws(endpointURL string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("aws", awsArgs(endpointURL, args...)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("aws %s failed: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,58 @@
+package dataprep
+
+import (
+	"fmt"
+	"sync"
+)
+
+// The stages of the pipeline, as reported by StageError. Prep doesn't write metadata, StageMetadataWrite is for callers
+// writing it to report their failures the same way.
+const (
+	StageDagBuild      = "dag build"
+	StageTreeConstruct = "tree construct"
+	StageSplit         = "split/commp"
+	StageMetadataWrite = "metadata write"
+)
+
+// StageError is the error of the pipeline stage that failed a run first. The other stages fail in turn, their errors
+// are only a consequence of it and are not reported.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// stageGroup runs the stages of the pipeline concurrently, like an errgroup, keeping the error of the first stage to
+// fail. It can't stop the other stages itself: a failing stage fails the pipes it shares with them instead.
+type stageGroup struct {
+	wg   sync.WaitGroup
+	once sync.Once
+	err  error
+}
+
+// Go runs a stage. Once it returns, closePipes is called with its error, if any. The error is recorded before, so that
+// the stages failing in turn on the closed pipes can't be mistaken for the cause.
+func (g *stageGroup) Go(stage string, run func() error, closePipes func(error)) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		err := run()
+		if err != nil {
+			g.once.Do(func() { g.err = &StageError{Stage: stage, Err: err} })
+		}
+		closePipes(err)
+	}()
+}
+
+// Wait waits for all stages to return, and returns the error of the first one to fail.
+func (g *stageGroup) Wait() error {
+	g.wg.Wait()
+	return g.err
+}
@@ -0,0 +1,164 @@
+package dataprep
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	"github.com/multiformats/go-multihash"
+)
+
+// Handling of symlinks found walking input directories, see Options.Symlinks.
+const (
+	SymlinksFollow   = "follow"
+	SymlinksPreserve = "preserve"
+	SymlinksSkip     = "skip"
+)
+
+// symlink is a symlink preserved as a unixfs symlink node, at path on disk and name in the dag.
+type symlink struct {
+	path string
+	name string
+	node *merkledag.ProtoNode
+}
+
+func validateSymlinks(symlinks string) error {
+	switch symlinks {
+	case "", SymlinksFollow, SymlinksPreserve, SymlinksSkip:
+		return nil
+	default:
+		return fmt.Errorf("unknown symlink handling %q, expected one of: %s, %s, %s", symlinks, SymlinksFollow, SymlinksPreserve, SymlinksSkip)
+	}
+}
+
+// newSymlink reads the target of the symlink at path, and builds its unixfs node.
+func newSymlink(path string) (symlink, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return symlink{}, err
+	}
+	return newSymlinkTo(path, target)
+}
+
+// newSymlinkTo builds the unixfs node of a symlink at path pointing to target.
+func newSymlinkTo(path, target string) (symlink, error) {
+	data, err := unixfs.SymlinkData(target)
+	if err != nil {
+		return symlink{}, err
+	}
+	nd := merkledag.NodeWithData(data)
+	nd.SetCidBuilder(cid.V1Builder{Codec: cid.DagProtobuf, MhType: multihash.SHA2_256})
+	return symlink{path: path, node: nd}, nil
+}
+
+// fileWalker walks an input directory in lexical order, like filepath.WalkDir, collecting the files to prep along with
+// their readers, and the preserved symlinks.
+type fileWalker struct {
+	root     string
+	filter   *pathFilter
+	symlinks string
+
+	files []string
+	frs   []io.Reader
+	links []symlink
+}
+
+// walk walks dir, which is in the directories of ancestors (dir itself included), to tell symlink cycles.
+func (w *fileWalker) walk(dir string, ancestors []os.FileInfo) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range entries {
+		p := filepath.Join(dir, d.Name())
+		rel := relativePath(w.root, p)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			switch w.symlinks {
+			case SymlinksSkip:
+				logging.Info("skipping symlink", "path", p)
+				continue
+			case SymlinksPreserve:
+				if !w.filter.keep(rel) {
+					continue
+				}
+				l, err := newSymlink(p)
+				if err != nil {
+					return err
+				}
+				w.links = append(w.links, l)
+				continue
+			}
+			if info, err = os.Stat(p); err != nil {
+				return fmt.Errorf("failed to follow symlink %s: %s", p, err)
+			}
+		}
+
+		if info.IsDir() {
+			// excluded subtrees aren't walked at all
+			if w.filter.excluded(rel, true) {
+				continue
+			}
+			for _, a := range ancestors {
+				if os.SameFile(a, info) {
+					return fmt.Errorf("symlink cycle: %s points to a directory it is in", p)
+				}
+			}
+			if err := w.walk(p, append(ancestors, info)); err != nil {
+				return err
+			}
+			continue
+		}
+		if !w.filter.keep(rel) {
+			continue
+		}
+		r, err := getFileReader(p, info)
+		if err != nil {
+			return err
+		}
+		w.files = append(w.files, p)
+		w.frs = append(w.frs, r)
+	}
+	return nil
+}
+
+// insertSymlinks adds the preserved symlinks to the tree, each among its siblings in the order of their names, which
+// puts it where the walk found it. Their nodes are rebuilt with builder, for the cids of the dags of the files.
+func insertSymlinks(root *node, links []symlink, builder cid.Builder) {
+	for _, l := range links {
+		l.node.SetCidBuilder(builder)
+		parts := strings.Split(l.name, "/")
+		parent := root
+		for _, part := range parts[:len(parts)-1] {
+			child := parent.child(part)
+			if child == nil {
+				child = newNode(part)
+				parent.addChild(child)
+			}
+			parent = child
+		}
+
+		n := &node{name: parts[len(parts)-1], cid: l.node.Cid(), size: uint64(len(l.node.RawData()))}
+		i := len(parent.children)
+		for j, c := range parent.children {
+			if c.name > n.name {
+				i = j
+				break
+			}
+		}
+		parent.children = append(parent.children, nil)
+		copy(parent.children[i+1:], parent.children[i:])
+		parent.children[i] = n
+	}
+}
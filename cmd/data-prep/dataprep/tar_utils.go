@@ -0,0 +1,266 @@
+package dataprep
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/progress"
+)
+
+const inputFormatTar = "tar"
+
+// tarStream reads tar archives, or a tar archive on stdin for "-", as the multipart stream of their files for anelace,
+// entry by entry as the archives are read, so nothing is extracted to disk or buffered. Gzip compressed archives are
+// decompressed on the fly. As the files of the archives are only known once they have been read, they are collected
+// along the way, like the other inputs prefixed with the archive path, and picked up by finish once the stream is done.
+// Directory entries are implied by the files in them, symlinks are preserved with SymlinksPreserve and skipped
+// otherwise, as they can't be followed in a stream, and other entries that aren't regular files are skipped.
+type tarStream struct {
+	paths       []string
+	filter      *pathFilter
+	symlinks    string
+	maxFileSize int64
+	targetSize  int
+	largeFiles  string
+	timeout     time.Duration
+	progress    *progress.Progress
+
+	// the archive being read, its index in paths, and the entry being read
+	cur   int
+	rc    io.ReadCloser
+	tr    *tar.Reader
+	entry io.Reader
+	seen  map[string]bool
+
+	files []string
+	frs   []io.Reader
+	links []symlink
+}
+
+func newTarStream(opts Options, paths []string, filter *pathFilter) (*tarStream, error) {
+	if len(opts.Fds) > 0 {
+		return nil, fmt.Errorf("--fd is not supported with tar archives")
+	}
+	switch {
+	case opts.CarPerFile:
+		return nil, fmt.Errorf("--car-per-file is not supported with tar archives, their files are only known as they are read")
+	case opts.Parallel > 1:
+		return nil, fmt.Errorf("--parallel is not supported with tar archives, they are read in order")
+	case opts.BlockOrder == blockOrderBFS:
+		return nil, fmt.Errorf("--block-order %s is not supported with tar archives, they are read in order", opts.BlockOrder)
+	case opts.Split.CheckpointInterval > 0 || opts.Split.Resume != nil:
+		return nil, fmt.Errorf("--checkpoint-interval and --resume are not supported with tar archives")
+	case opts.SkipErrors:
+		return nil, fmt.Errorf("--skip-errors is not supported with tar archives, a failing read breaks the archive stream")
+	}
+	return &tarStream{
+		paths:       paths,
+		filter:      filter,
+		symlinks:    opts.Symlinks,
+		maxFileSize: opts.MaxFileSize,
+		targetSize:  opts.TargetSize,
+		largeFiles:  opts.LargeFiles,
+		timeout:     opts.ReadTimeout,
+		progress:    opts.Progress,
+		seen:        make(map[string]bool),
+	}, nil
+}
+
+func (s *tarStream) Read(p []byte) (int, error) {
+	for {
+		if s.entry != nil {
+			n, err := s.entry.Read(p)
+			if n > 0 || err != io.EOF {
+				return n, err
+			}
+			s.entry = nil
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// next moves on to the next file of the archives, opening the next archive once one is done. It returns io.EOF once
+// all archives are read.
+func (s *tarStream) next() error {
+	for {
+		if s.tr == nil {
+			if s.cur == len(s.paths) {
+				return io.EOF
+			}
+			if err := s.open(s.paths[s.cur]); err != nil {
+				return err
+			}
+		}
+		path := s.paths[s.cur]
+		hdr, err := s.tr.Next()
+		if err == io.EOF {
+			// drain the padding after the end of the archive, so that a writer piping it in doesn't fail on a closed pipe
+			io.Copy(io.Discard, s.rc)
+			s.rc.Close()
+			s.tr, s.rc = nil, nil
+			s.cur++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar archive %s: %s", path, err)
+		}
+
+		name := strings.TrimSuffix(strings.TrimPrefix(hdr.Name, "./"), "/")
+		if hdr.Typeflag == tar.TypeDir || name == "" || name == "." {
+			continue
+		}
+		if err := validateExternalName(name); err != nil {
+			return fmt.Errorf("unsafe path in tar archive %s: %s", path, err)
+		}
+		if !s.filter.keep(name) {
+			continue
+		}
+		p := filepath.Join(path, name)
+
+		switch {
+		case hdr.Typeflag == tar.TypeSymlink && s.symlinks == SymlinksPreserve:
+			if err := s.add(path, name); err != nil {
+				return err
+			}
+			l, err := newSymlinkTo(p, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			s.links = append(s.links, l)
+			continue
+		case hdr.Typeflag == tar.TypeSymlink:
+			logging.Info("skipping symlink", "path", p)
+			continue
+		case !hdr.FileInfo().Mode().IsRegular():
+			logging.Warn("skipping unsupported tar entry", "path", p, "type", string(hdr.Typeflag))
+			continue
+		}
+
+		if err := s.add(path, name); err != nil {
+			return err
+		}
+		if s.maxFileSize > 0 && hdr.Size > s.maxFileSize {
+			return fmt.Errorf("%s is %d bytes, more than the --max-file-size of %d bytes", p, hdr.Size, s.maxFileSize)
+		}
+		if hdr.Size > int64(s.targetSize) {
+			if s.largeFiles == LargeFilesFail {
+				return fmt.Errorf("%s is %d bytes, more than the target piece size of %d bytes", p, hdr.Size, s.targetSize)
+			}
+			logging.Warn("file larger than the target piece size, its data will be spread over several pieces", "path", p, "size", hdr.Size, "targetSize", s.targetSize)
+		}
+
+		// the entry is read right away, while the archive is positioned at it
+		tr := s.tr
+		r := newMultipartReader(p, hdr.Size, func() (io.ReadCloser, error) { return io.NopCloser(tr), nil })
+		setReadOptions([]io.Reader{r}, s.timeout, false, s.progress)
+		s.files = append(s.files, p)
+		s.frs = append(s.frs, r)
+		s.entry = r
+		return nil
+	}
+}
+
+// add records the name of an entry, failing on an archive holding it more than once.
+func (s *tarStream) add(path, name string) error {
+	key := path + "\x00" + name
+	if s.seen[key] {
+		return fmt.Errorf("tar archive %s holds %s more than once", path, name)
+	}
+	s.seen[key] = true
+	return nil
+}
+
+// open opens the archive at path, or stdin for "-", decompressing it if it is gzip compressed.
+func (s *tarStream) open(path string) error {
+	var rc io.ReadCloser = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to read tar archive %s: %s", path, err)
+		}
+		rc = f
+	}
+	br := bufio.NewReaderSize(rc, 1<<20)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			rc.Close()
+			return fmt.Errorf("failed to read tar archive %s: %s", path, err)
+		}
+		r = zr
+	}
+	s.rc, s.tr = rc, tar.NewReader(r)
+	return nil
+}
+
+// size returns the size of the files of the archives as far as it is known before they are read: the size of a plain
+// archive, or of a gzip compressed one the uncompressed size recorded in its trailer. The trailer holds the size modulo
+// 4GiB, so larger ones count for at least their compressed size. An archive on stdin counts for nothing.
+func (s *tarStream) size() (uint64, error) {
+	var total uint64
+	for _, path := range s.paths {
+		if path == "-" {
+			continue
+		}
+		size, err := archiveSize(path)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read tar archive %s: %s", path, err)
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// archiveSize returns the size of the archive at path, uncompressed if it is gzip compressed.
+func archiveSize(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := uint64(info.Size())
+	// a gzip member is at least a 10 byte header and an 8 byte trailer
+	var magic [2]byte
+	if info.Size() < 18 {
+		return size, nil
+	}
+	if _, err := f.ReadAt(magic[:], 0); err != nil {
+		return 0, err
+	}
+	if magic[0] != 0x1f || magic[1] != 0x8b {
+		return size, nil
+	}
+	var isize [4]byte
+	if _, err := f.ReadAt(isize[:], info.Size()-4); err != nil {
+		return 0, err
+	}
+	if u := uint64(binary.LittleEndian.Uint32(isize[:])); u > size {
+		return u, nil
+	}
+	return size, nil
+}
+
+// finish hands the files and symlinks read from the archives to in, and names them, once the stream has been read.
+func (s *tarStream) finish(in *input, opts Options) error {
+	if len(s.files) == 0 && len(s.links) == 0 {
+		return fmt.Errorf("no files in tar archives %s", strings.Join(s.paths, ", "))
+	}
+	in.files, in.frs, in.links = s.files, s.frs, s.links
+	return in.nameFiles(opts)
+}
@@ -0,0 +1,78 @@
+package dataprep
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveSize(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	content := make([]byte, 1<<20)
+	if err := tw.WriteHeader(&tar.Header{Name: "zeros", Mode: 0o644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(archive.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		content []byte
+		want    uint64
+	}{
+		{name: "plain", content: archive.Bytes(), want: uint64(archive.Len())},
+		// the zeros compress to a fraction of their size, the pieces hold all of them
+		{name: "gzip", content: compressed.Bytes(), want: uint64(archive.Len())},
+		{name: "shorter than a gzip header", content: []byte{0x1f, 0x8b, 8}, want: 3},
+	}
+	dir := t.TempDir()
+	var paths []string
+	var total uint64
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name)
+			if err := os.WriteFile(path, tc.content, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := archiveSize(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %d bytes, want %d", got, tc.want)
+			}
+			paths = append(paths, path)
+			total += tc.want
+		})
+	}
+
+	// an archive on stdin is only known as it is read
+	s := &tarStream{paths: append(paths, "-")}
+	got, err := s.size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != total {
+		t.Errorf("got %d bytes for all archives, want %d", got, total)
+	}
+	s.paths = []string{filepath.Join(dir, "missing")}
+	if _, err := s.size(); err == nil {
+		t.Error("got the size of a missing archive")
+	}
+}
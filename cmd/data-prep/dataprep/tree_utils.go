@@ -0,0 +1,422 @@
+package dataprep
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	unixfspb "github.com/ipfs/go-unixfs/pb"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestName is the name of the manifest file added to the root directory with Options.EmbedManifest.
+const ManifestName = "__manifest.json"
+
+const manifestChunkSize = 1 << 20
+
+type roots struct {
+	Event    string `json:"event"`
+	Payload  int    `json:"payload"`
+	Stream   int    `json:"stream"`
+	Cid      string `json:"cid"`
+	Wiresize uint64 `json:"wiresize"`
+}
+
+type node struct {
+	name     string
+	children []*node
+	cid      cid.Cid
+	pbn      *merkledag.ProtoNode
+	// shards are the shard nodes below pbn of a sharded directory
+	shards []*merkledag.ProtoNode
+	size   uint64
+}
+
+func newNode(name string) *node {
+	return &node{name: name}
+}
+
+func (n *node) addChild(child *node) {
+	n.children = append(n.children, child)
+}
+
+func (n *node) child(name string) *node {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// constructNode builds the directory nodes of n and the directories below it. A directory is sharded if it has more
+// entries than shardThreshold, or if shardThreshold is 0, once its node would get too large (see shouldShard). The
+// nodes are built with the cid builder of the dags of the files.
+func (n *node) constructNode(shardThreshold int, builder cid.Builder) error {
+	if len(n.children) == 0 {
+		return nil
+	}
+	for _, child := range n.children {
+		if err := child.constructNode(shardThreshold, builder); err != nil {
+			return err
+		}
+	}
+	if shouldShard(n.children, shardThreshold) {
+		nd, shards, size, err := shardDirectory(n.children, builder)
+		if err != nil {
+			return fmt.Errorf("failed to shard directory %s: %s", n.name, err)
+		}
+		n.pbn, n.shards, n.cid, n.size = nd, shards, nd.Cid(), size
+		return nil
+	}
+	n.shards = nil
+
+	ndbs, err := unixfs.NewFSNode(unixfspb.Data_Directory).GetBytes()
+	if err != nil {
+		return err
+	}
+	nd := merkledag.NodeWithData(ndbs)
+	nd.SetCidBuilder(builder)
+
+	var size uint64
+	for _, child := range n.children {
+		err := nd.AddRawLink(child.name, &format.Link{
+			Cid:  child.cid,
+			Size: child.size,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to link %s into directory %s: %s", child.name, n.name, err)
+		}
+		size += child.size
+
+	}
+	n.pbn = nd
+	n.cid = nd.Cid()
+	n.size = size
+	return nil
+}
+
+// dagNames returns the paths files get in the dag. These are their paths on disk, except for a single file given as
+// input, which goes into the root directory under its base name, or under renameRoot if set.
+func dagNames(paths []string, files []string, renameRoot string) ([]string, error) {
+	single := len(paths) == 1 && len(files) == 1 && files[0] == paths[0]
+	if renameRoot != "" {
+		if !single {
+			return nil, fmt.Errorf("--rename-root is only supported for a single file input")
+		}
+		if strings.Contains(renameRoot, "/") || renameRoot == "." || renameRoot == ".." {
+			return nil, fmt.Errorf("invalid root name %q: expected a plain file name", renameRoot)
+		}
+		return []string{renameRoot}, nil
+	}
+	if single {
+		return []string{filepath.Base(files[0])}, nil
+	}
+	return files, nil
+}
+
+// deepestPath returns the depth of the directory tree the files end up in, counted in links from the root directory
+// to a file (a file in the root directory is at depth 1), and the path of the deepest file. A single input path is the
+// root directory itself, so it doesn't count towards the depth of the files below it.
+func deepestPath(paths []string, names []string) (int, string) {
+	var depth int
+	var deepest string
+	for _, name := range names {
+		rel := name
+		if len(paths) == 1 {
+			rel = strings.TrimPrefix(strings.TrimPrefix(name, filepath.Clean(paths[0])), "/")
+		}
+		if d := len(strings.Split(strings.Trim(rel, "/"), "/")); d > depth {
+			depth, deepest = d, name
+		}
+	}
+	return depth, deepest
+}
+
+// validateExternalName checks a dag path that doesn't come from walking the filesystem, like the name of an fd stream
+// or a path in a git tree. It must be relative and must not have empty, "." or ".." components, so that it can't
+// point outside of the directory it is supposed to be in, or into a directory of its own making.
+func validateExternalName(name string) error {
+	if name == "" {
+		return fmt.Errorf("invalid path %q: empty", name)
+	}
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(name) {
+		return fmt.Errorf("invalid path %q: absolute paths are not allowed", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "":
+			return fmt.Errorf("invalid path %q: empty path component", name)
+		case ".", "..":
+			return fmt.Errorf("invalid path %q: %q path components are not allowed", name, part)
+		}
+	}
+	return nil
+}
+
+// flattenNames puts all files directly into the root directory, under their base names. Files with the same base
+// name are told apart according to collisions: "suffix" numbers the later ones (a.txt, a-1.txt, ...), "path" names
+// the later ones after their whole path (dir_a.txt), and "error" fails.
+func flattenNames(names []string, collisions string) ([]string, error) {
+	switch collisions {
+	case "suffix", "path", "error":
+	default:
+		return nil, fmt.Errorf("unknown flatten collision strategy %q, expected one of: suffix, path, error", collisions)
+	}
+
+	taken := make(map[string]bool, len(names))
+	flat := make([]string, len(names))
+	for i, name := range names {
+		base := filepath.Base(name)
+		if taken[base] {
+			switch collisions {
+			case "suffix":
+				ext := filepath.Ext(base)
+				stem := strings.TrimSuffix(base, ext)
+				for n := 1; taken[base]; n++ {
+					base = fmt.Sprintf("%s-%d%s", stem, n, ext)
+				}
+			case "path":
+				base = strings.ReplaceAll(strings.TrimPrefix(filepath.Clean(name), "/"), "/", "_")
+				if taken[base] {
+					return nil, fmt.Errorf("can't flatten %s: %s is taken", name, base)
+				}
+			case "error":
+				return nil, fmt.Errorf("can't flatten %s: there is another file named %s", name, base)
+			}
+		}
+		taken[base] = true
+		flat[i] = base
+	}
+	return flat, nil
+}
+
+// payloadSize is the total size of the file data behind the roots.
+func payloadSize(rs []roots) uint64 {
+	var total uint64
+	for _, r := range rs {
+		total += uint64(r.Payload)
+	}
+	return total
+}
+
+func constructTree(files []string, rs []roots, links []symlink, shardThreshold int, builder cid.Builder) (*node, error) {
+	root := newNode("root")
+
+	for i, file := range files {
+		parts := strings.Split(file, "/")
+		currentNode := root
+
+		for _, part := range parts {
+			var foundChild *node
+			for _, child := range currentNode.children {
+				if child.name == part {
+					foundChild = child
+					break
+				}
+			}
+
+			if foundChild == nil {
+				foundChild = newNode(part)
+				currentNode.addChild(foundChild)
+			}
+
+			currentNode = foundChild
+		}
+
+		c, err := cid.Decode(rs[i].Cid)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root %q of %s: %s", rs[i].Cid, file, err)
+		}
+		currentNode.cid = c
+		currentNode.size = rs[i].Wiresize
+	}
+	insertSymlinks(root, links, builder)
+
+	if err := root.constructNode(shardThreshold, builder); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// Orders in which the blocks of the dag are emitted.
+const (
+	blockOrderDFS = "dfs"
+	blockOrderBFS = "bfs"
+)
+
+// getDirectoryNodes returns the directory nodes of the tree in the given order: depth first (every directory before
+// its subdirectories, one subtree after the other), or breadth first (level by level). The root comes first either
+// way, followed by the chain of directories wrapping a single nested input. The shard nodes of a sharded directory
+// follow its root shard node.
+func getDirectoryNodes(root *node, order string) []*merkledag.ProtoNode {
+	if order == blockOrderBFS {
+		var nodes []*merkledag.ProtoNode
+		for level := []*node{root}; len(level) > 0; {
+			var next []*node
+			for _, n := range level {
+				nodes = append(nodes, n.pbn)
+				nodes = append(nodes, n.shards...)
+				for _, child := range n.children {
+					if len(child.children) != 0 {
+						next = append(next, child)
+					}
+				}
+			}
+			level = next
+		}
+		return nodes
+	}
+
+	var nodes []*merkledag.ProtoNode
+	nodes = append(nodes, root.pbn)
+	nodes = append(nodes, root.shards...)
+	for _, child := range root.children {
+		if len(child.children) != 0 {
+			nodes = append(nodes, getDirectoryNodes(child, order)...)
+		}
+	}
+	return nodes
+}
+
+// breadthFirst reorders the files, their dag names and readers so that the files are emitted level by level: all
+// files of a directory before the files of its subdirectories. The files come in walk order, i.e. sorted by path, so a
+// stable sort by depth keeps the files of every level in the order of their directories.
+func breadthFirst(files, names []string, frs []io.Reader) ([]string, []string, []io.Reader) {
+	idx := make([]int, len(names))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		return strings.Count(names[idx[a]], "/") < strings.Count(names[idx[b]], "/")
+	})
+	sortedFiles := make([]string, len(idx))
+	sortedNames := make([]string, len(idx))
+	sortedFrs := make([]io.Reader, len(idx))
+	for i, j := range idx {
+		sortedFiles[i], sortedNames[i], sortedFrs[i] = files[j], names[j], frs[j]
+	}
+	return sortedFiles, sortedNames, sortedFrs
+}
+
+type manifestEntry struct {
+	Path string `json:"path"`
+	Size int    `json:"size"`
+	Cid  string `json:"cid"`
+}
+
+// addManifest adds a json manifest listing every file (with its path relative to the root directory), its size and
+// its cid to the directory at dir, and rebuilds the directory nodes. It returns the blocks of the manifest file, which
+// need to be written to the car stream.
+func addManifest(root *node, dir []string, files []string, rs []roots, shardThreshold int, f dagFormat) ([]format.Node, error) {
+	target := root
+	for _, part := range dir {
+		target = target.child(part)
+		if target == nil {
+			return nil, fmt.Errorf("failed to find directory %s in the tree", strings.Join(dir, "/"))
+		}
+	}
+	if target.child(ManifestName) != nil {
+		return nil, fmt.Errorf("can't embed manifest: %s already exists in the root directory", ManifestName)
+	}
+
+	entries := make([]manifestEntry, len(files))
+	for i, file := range files {
+		entries[i] = manifestEntry{
+			Path: strings.Join(strings.Split(file, "/")[len(dir):], "/"),
+			Size: rs[i].Payload,
+			Cid:  rs[i].Cid,
+		}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, fileNode, size, err := fileNodes(data, f)
+	if err != nil {
+		return nil, err
+	}
+
+	target.addChild(&node{name: ManifestName, cid: fileNode.Cid(), size: size})
+	if err := root.constructNode(shardThreshold, f.builder()); err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+// fileNodes turns data into a unixfs file in the format of the dags of the files: made of raw leaves, or of leaves
+// wrapped into unixfs nodes, linked from a single dag-pb node if there is more than one. It returns all the blocks, the
+// root node of the file and the cumulative size of its dag.
+func fileNodes(data []byte, f dagFormat) ([]format.Node, format.Node, uint64, error) {
+	var leaves []format.Node
+	for len(data) > 0 || len(leaves) == 0 {
+		n := manifestChunkSize
+		if len(data) < n {
+			n = len(data)
+		}
+		leaf, err := f.leaf(data[:n])
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		leaves = append(leaves, leaf)
+		data = data[n:]
+	}
+	if len(leaves) == 1 {
+		return leaves, leaves[0], uint64(len(leaves[0].RawData())), nil
+	}
+
+	fsn := unixfs.NewFSNode(unixfspb.Data_File)
+	for _, l := range leaves {
+		size, err := leafDataSize(l)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		fsn.AddBlockSize(size)
+	}
+	ndbs, err := fsn.GetBytes()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	nd := merkledag.NodeWithData(ndbs)
+	nd.SetCidBuilder(f.builder())
+
+	size := uint64(0)
+	for _, l := range leaves {
+		leafSize := uint64(len(l.RawData()))
+		if err := nd.AddRawLink("", &format.Link{Cid: l.Cid(), Size: leafSize}); err != nil {
+			return nil, nil, 0, err
+		}
+		size += leafSize
+	}
+	size += uint64(len(nd.RawData()))
+
+	return append(leaves, nd), nd, size, nil
+}
+
+// leafDataSize is the size of the file data held by a leaf built by dagFormat.leaf.
+func leafDataSize(l format.Node) (uint64, error) {
+	pn, ok := l.(*merkledag.ProtoNode)
+	if !ok {
+		return uint64(len(l.RawData())), nil
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(fsn.Data())), nil
+}
+
+func appendVarint(tgt []byte, v uint64) []byte {
+	for v > 127 {
+		tgt = append(tgt, byte(v|128))
+		v >>= 7
+	}
+	return append(tgt, byte(v))
+}
@@ -0,0 +1,84 @@
+package dataprep
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateExternalName(t *testing.T) {
+	cases := []struct {
+		name    string
+		wantErr string
+	}{
+		{name: "a.txt"},
+		{name: "dir/sub/a.txt"},
+		{name: "..a"},
+		{name: "a.."},
+		{name: "dir/..."},
+		{name: ".hidden/.a"},
+		{name: "", wantErr: "empty"},
+		{name: "/etc/passwd", wantErr: "absolute paths are not allowed"},
+		{name: "/", wantErr: "absolute paths are not allowed"},
+		{name: "..", wantErr: `".." path components are not allowed`},
+		{name: "../a", wantErr: `".." path components are not allowed`},
+		{name: "../../etc/passwd", wantErr: `".." path components are not allowed`},
+		{name: "dir/../../a", wantErr: `".." path components are not allowed`},
+		{name: "dir/..", wantErr: `".." path components are not allowed`},
+		{name: "dir/../a", wantErr: `".." path components are not allowed`},
+		{name: ".", wantErr: `"." path components are not allowed`},
+		{name: "./a", wantErr: `"." path components are not allowed`},
+		{name: "dir/./a", wantErr: `"." path components are not allowed`},
+		{name: "dir//a", wantErr: "empty path component"},
+		{name: "dir/", wantErr: "empty path component"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateExternalName(tc.name)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("got error %v for a valid name", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestDirectoryBlocksErrors checks that failures building the directory nodes fail the tree, instead of leaving
+// directories without a node.
+func TestDirectoryBlocksErrors(t *testing.T) {
+	dag, err := DagOptions{}.format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := roots{Cid: "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku", Payload: 1, Wiresize: 1}
+	// a symlink named like a file puts the same name twice into its directory, which can't be sharded
+	link, err := newSymlinkTo("data/sub/a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link.name = "data/sub/a"
+
+	cases := []struct {
+		name           string
+		rs             []roots
+		links          []symlink
+		shardThreshold int
+		wantErr        string
+	}{
+		{name: "invalid root", rs: []roots{{Cid: "not a cid"}}, wantErr: "invalid root"},
+		{name: "unshardable directory", rs: []roots{root}, links: []symlink{link}, shardThreshold: 1, wantErr: "failed to shard directory sub"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := directoryBlocks([]string{"data"}, []string{"data/sub/a"}, tc.rs, tc.links, false, blockOrderDFS, tc.shardThreshold, dag)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package dataprep
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+)
+
+// Formats of the input paths.
+const (
+	inputFormatFiles = "files"
+	inputFormatZip   = "zip"
+)
+
+// getAllFileReadersFromZip returns the files in a zip archive, or in a zip archive read from stdin if path is "-".
+// Paths are prefixed with the archive path, just like the files of a directory given as input, so the archive becomes
+// the root directory of the dag. Entries are decompressed as they are read, nothing is extracted to disk. Directory
+// entries are implied by the files in them, other entries that aren't regular files are skipped.
+func getAllFileReadersFromZip(path string) ([]string, []io.Reader, error) {
+	var zr *zip.Reader
+	if path == "-" {
+		f, size, err := spoolStdin()
+		if err != nil {
+			return nil, nil, err
+		}
+		if zr, err = zip.NewReader(f, size); err != nil {
+			return nil, nil, fmt.Errorf("failed to read zip archive from stdin: %s", err)
+		}
+	} else {
+		rc, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read zip archive %s: %s", path, err)
+		}
+		// the entries are read throughout the run, the archive stays open until the process exits
+		zr = &rc.Reader
+	}
+
+	var files []string
+	var frs []io.Reader
+	seen := make(map[string]bool)
+	for _, zf := range zr.File {
+		name := strings.TrimSuffix(zf.Name, "/")
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if !zf.Mode().IsRegular() {
+			logging.Warn("skipping unsupported zip entry", "path", zf.Name, "mode", zf.Mode())
+			continue
+		}
+		if zf.Method != zip.Store && zf.Method != zip.Deflate {
+			logging.Warn("skipping zip entry of unsupported compression method", "path", zf.Name, "method", zf.Method)
+			continue
+		}
+		if err := validateExternalName(name); err != nil {
+			return nil, nil, fmt.Errorf("unsafe path in zip archive %s: %s", path, err)
+		}
+		if seen[name] {
+			return nil, nil, fmt.Errorf("zip archive %s holds %s more than once", path, name)
+		}
+		seen[name] = true
+
+		p := filepath.Join(path, name)
+		files = append(files, p)
+		frs = append(frs, newMultipartReader(p, int64(zf.UncompressedSize64), zf.Open))
+	}
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("no files in zip archive %s", path)
+	}
+
+	return files, frs, nil
+}
+
+// spoolStdin copies stdin to an unlinked temporary file, as the directory of a zip archive is at its end and the
+// entries need random access.
+func spoolStdin() (*os.File, int64, error) {
+	f, err := os.CreateTemp("", "data-prep-stdin-*.zip")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create temporary file for stdin: %s", err)
+	}
+	// the data stays around until the file is closed
+	os.Remove(f.Name())
+	size, err := io.Copy(f, os.Stdin)
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("failed to read stdin: %s", err)
+	}
+	return f, size, nil
+}
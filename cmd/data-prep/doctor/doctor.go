@@ -0,0 +1,117 @@
+package doctor
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/preflight"
+	"github.com/urfave/cli/v2"
+)
+
+var Cmd = &cli.Command{
+	Name:      "doctor",
+	Usage:     "check the environment before a big run",
+	ArgsUsage: "[paths to prep...]",
+	Action:    doctor,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "output",
+			Aliases:  []string{"o"},
+			Required: false,
+			Usage:    "output filename prefix the run will use, the directory it is in is checked.",
+		},
+		&cli.GenericFlag{
+			Name:     "size",
+			Aliases:  []string{"s"},
+			Required: false,
+			Value:    preflight.NewByteSize(2 << 20),
+			Usage:    "target size the run will use, in bytes or with a unit like GiB or GB.",
+		},
+	},
+}
+
+type checker struct {
+	failed bool
+}
+
+func (c *checker) ok(format string, args ...interface{}) {
+	fmt.Printf("ok    "+format+"\n", args...)
+}
+
+func (c *checker) warn(format string, args ...interface{}) {
+	fmt.Printf("warn  "+format+"\n", args...)
+}
+
+func (c *checker) fail(format string, args ...interface{}) {
+	c.failed = true
+	fmt.Printf("FAIL  "+format+"\n", args...)
+}
+
+// doctor runs all preflight checks, reporting every one of them, and fails if any check failed.
+func doctor(c *cli.Context) error {
+	var chk checker
+
+	size := preflight.Size(c, "size")
+	if err := preflight.ValidateTargetSize(size, preflight.DefaultBlocks); err != nil {
+		chk.fail("%s", err)
+	} else if warning := preflight.TargetSizeWarning(size); warning != "" {
+		chk.warn("%s", warning)
+	} else {
+		chk.ok("target size %d", size)
+	}
+
+	outDir := filepath.Dir(c.String("output"))
+	if err := preflight.CheckWritable(outDir); err != nil {
+		chk.fail("%s", err)
+	} else {
+		chk.ok("output directory %s is writable", outDir)
+	}
+
+	if err := preflight.RoundTrip(); err != nil {
+		chk.fail("pipeline round trip: %s", err)
+	} else {
+		chk.ok("pipeline round trip (dag building, splitting and commP)")
+	}
+
+	var inputSize uint64
+	for _, path := range c.Args().Slice() {
+		err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			inputSize += uint64(fi.Size())
+			return nil
+		})
+		if err != nil {
+			chk.fail("can't read input %s: %s", path, err)
+		}
+	}
+
+	if c.Args().Present() {
+		estimate := preflight.EstimateOutputSize(inputSize, preflight.DefaultBlocks)
+		free, err := preflight.FreeSpace(outDir)
+		switch {
+		case err != nil:
+			chk.warn("can't check free disk space in %s: %s", outDir, err)
+		case free < estimate:
+			chk.fail("%d bytes free in %s, but the pieces of %d bytes of input are estimated to take %d bytes", free, outDir, inputSize, estimate)
+		default:
+			chk.ok("%d bytes free in %s, pieces are estimated to take %d bytes", free, outDir, estimate)
+		}
+	} else {
+		chk.warn("no input paths given, skipping the disk space check")
+	}
+
+	if chk.failed {
+		return fmt.Errorf("some checks failed")
+	}
+	return nil
+}
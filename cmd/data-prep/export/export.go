@@ -0,0 +1,179 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/urfave/cli/v2"
+)
+
+const FormatSingularity = "singularity"
+
+var Cmd = &cli.Command{
+	Name:      "export",
+	Usage:     "Export the metadata of a run in the format of another data preparation tool",
+	ArgsUsage: "<metadata.yaml|metadata.csv>",
+	Action:    exportAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "format",
+			Required: false,
+			Value:    FormatSingularity,
+			Usage:    "format to export to, singularity is the only one so far.",
+		},
+		&cli.StringFlag{
+			Name:     "file-manifest",
+			Required: false,
+			Usage:    "optional --file-manifest of the run (json or csv), to export every file and its ranges. Without it, only the files spread over several pieces recorded in the yaml metadata are.",
+		},
+		&cli.StringFlag{
+			Name:     "name",
+			Required: false,
+			Usage:    "name of the preparation. Defaults to the metadata file name.",
+		},
+		&cli.StringFlag{
+			Name:     "output",
+			Aliases:  []string{"o"},
+			Required: false,
+			Usage:    "optional file to write the export to, instead of stdout.",
+		},
+	},
+}
+
+// singularityExport is a preparation in the layout of the models of singularity (github.com/data-preparation-tool/
+// singularity, v2): the cars and files of the preparation, with the file ranges of every file. Singularity ties file
+// ranges to cars through the packing job that wrote them, every piece is exported as the car of a job of its own.
+type singularityExport struct {
+	Preparation singularityPreparation `json:"preparation"`
+	// RootCid is the root of the dag of the run, the directory of the preparation.
+	RootCid string            `json:"rootCid"`
+	Cars    []singularityCar  `json:"cars"`
+	Files   []singularityFile `json:"files"`
+}
+
+type singularityPreparation struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name"`
+}
+
+type singularityCar struct {
+	ID            uint64 `json:"id"`
+	PieceType     string `json:"pieceType"`
+	PieceCID      string `json:"pieceCid"`
+	PieceSize     uint64 `json:"pieceSize"`
+	RootCID       string `json:"rootCid"`
+	FileSize      uint64 `json:"fileSize"`
+	StoragePath   string `json:"storagePath"`
+	NumOfFiles    uint64 `json:"numOfFiles"`
+	PreparationID uint64 `json:"preparationId"`
+	JobID         uint64 `json:"jobId"`
+}
+
+type singularityFile struct {
+	ID         uint64                 `json:"id"`
+	CID        string                 `json:"cid"`
+	Path       string                 `json:"path"`
+	Size       uint64                 `json:"size"`
+	FileRanges []singularityFileRange `json:"fileRanges"`
+}
+
+type singularityFileRange struct {
+	ID     uint64 `json:"id"`
+	FileID uint64 `json:"fileId"`
+	Offset uint64 `json:"offset"`
+	Length uint64 `json:"length"`
+	JobID  uint64 `json:"jobId,omitempty"`
+}
+
+// exportAction converts the metadata of a run, and optionally its file manifest, to the given format.
+func exportAction(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		return fmt.Errorf("expected a metadata file")
+	}
+	if format := c.String("format"); format != FormatSingularity {
+		return fmt.Errorf("unknown export format %q, expected %s", format, FormatSingularity)
+	}
+	path := c.Args().First()
+	m, err := metadata.Read(path)
+	if err != nil {
+		return err
+	}
+	files := m.SpanningFiles
+	if manifest := c.String("file-manifest"); manifest != "" {
+		if files, err = metadata.ReadFileManifest(manifest); err != nil {
+			return err
+		}
+	}
+	name := c.String("name")
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	out := io.Writer(os.Stdout)
+	if output := c.String("output"); output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %s", output, err)
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(toSingularity(name, m, files))
+}
+
+// toSingularity converts the metadata of a run to a singularity preparation. Ids are assigned in order, starting at 1.
+func toSingularity(name string, m *metadata.Metadata, files []metadata.FilePieces) singularityExport {
+	exp := singularityExport{
+		Preparation: singularityPreparation{ID: 1, Name: name},
+		RootCid:     m.RootCid,
+		Cars:        []singularityCar{},
+		Files:       []singularityFile{},
+	}
+	// pieces are looked up by the base name of their file, as file manifests may have been written elsewhere
+	jobs := make(map[string]int)
+	for i, cf := range m.CarPiecesMeta.CarPieces {
+		root := cf.HeaderRoot
+		if root == "" {
+			root = m.RootCid
+		}
+		exp.Cars = append(exp.Cars, singularityCar{
+			ID:            uint64(i + 1),
+			PieceType:     "data",
+			PieceCID:      cf.CommP.String(),
+			PieceSize:     cf.PaddedSize,
+			RootCID:       root,
+			FileSize:      cf.HeaderSize + cf.ContentSize + cf.IndexSize,
+			StoragePath:   filepath.Base(cf.Name),
+			PreparationID: 1,
+			JobID:         uint64(i + 1),
+		})
+		jobs[filepath.Base(cf.Name)] = i
+	}
+
+	var rangeID uint64
+	for i, fp := range files {
+		f := singularityFile{ID: uint64(i + 1), CID: fp.Cid, Path: fp.File, Size: fp.Size, FileRanges: []singularityFileRange{}}
+		counted := make(map[int]bool)
+		for _, r := range fp.Ranges {
+			rangeID++
+			fr := singularityFileRange{ID: rangeID, FileID: f.ID, Offset: r.Offset, Length: r.Length}
+			if j, ok := jobs[filepath.Base(r.Piece)]; ok {
+				fr.JobID = exp.Cars[j].JobID
+				if !counted[j] {
+					counted[j] = true
+					exp.Cars[j].NumOfFiles++
+				}
+			}
+			f.FileRanges = append(f.FileRanges, fr)
+		}
+		exp.Files = append(exp.Files, f)
+	}
+	return exp
+}
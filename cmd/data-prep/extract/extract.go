@@ -0,0 +1,433 @@
+package extract
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+	unixfspb "github.com/ipfs/go-unixfs/pb"
+	"github.com/multiformats/go-multihash"
+	"github.com/urfave/cli/v2"
+)
+
+var Cmd = &cli.Command{
+	Name:      "extract",
+	Usage:     "unpack the unixfs dag in car files or the pieces of a run back into files",
+	ArgsUsage: "<car files...>",
+	Action:    extractAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "output",
+			Aliases:  []string{"o"},
+			Required: true,
+			Usage:    "directory to write the files to, created if it doesn't exist.",
+		},
+		&cli.StringFlag{
+			Name:     "root",
+			Required: false,
+			Usage:    "optional cid of the dag to extract. Defaults to the root cid in --metadata, or the roots in the car headers.",
+		},
+		&cli.StringFlag{
+			Name:     "metadata",
+			Aliases:  []string{"m"},
+			Required: false,
+			Usage:    "optional metadata file (csv or yaml) of a run, to extract from its pieces instead of car files given as arguments.",
+		},
+		&cli.StringFlag{
+			Name:     "pieces-dir",
+			Required: false,
+			Usage:    "optional directory to find the pieces of --metadata in, by the base name of their file, instead of at the paths recorded in the metadata.",
+		},
+	},
+}
+
+// location is where the data of a block is in a car file.
+type location struct {
+	file   string
+	offset int64
+	length int64
+}
+
+// blockstore reads the blocks of a set of car files, by their location found while indexing the files.
+type blockstore struct {
+	blocks map[string]location
+	files  map[string]*os.File
+}
+
+func extractAction(c *cli.Context) error {
+	cars := c.Args().Slice()
+	var roots []cid.Cid
+	if path := c.String("metadata"); path != "" {
+		if len(cars) > 0 {
+			return fmt.Errorf("expected either car files or --metadata, found both")
+		}
+		m, err := metadata.Read(path)
+		if err != nil {
+			return err
+		}
+		for _, cf := range m.CarPiecesMeta.CarPieces {
+			cars = append(cars, splitter.PiecePath(cf, c.String("pieces-dir")))
+		}
+		if m.RootCid != "" {
+			root, err := cid.Decode(m.RootCid)
+			if err != nil {
+				return fmt.Errorf("invalid root cid in the metadata: %s", err)
+			}
+			roots = append(roots, root)
+		}
+	}
+	if len(cars) == 0 {
+		return fmt.Errorf("expected car files or --metadata, found none")
+	}
+
+	bs := &blockstore{blocks: make(map[string]location), files: make(map[string]*os.File)}
+	defer bs.close()
+	var headerRoots []cid.Cid
+	for _, car := range cars {
+		rs, err := bs.index(car)
+		if err != nil {
+			return err
+		}
+		headerRoots = append(headerRoots, rs...)
+	}
+
+	if s := c.String("root"); s != "" {
+		root, err := cid.Decode(s)
+		if err != nil {
+			return fmt.Errorf("invalid root cid: %s", err)
+		}
+		roots = []cid.Cid{root}
+	} else if len(roots) == 0 {
+		// the roots of a car split into pieces are in the header of every piece, only take each one once
+		seen := make(map[string]bool)
+		for _, r := range headerRoots {
+			if !seen[r.KeyString()] {
+				seen[r.KeyString()] = true
+				roots = append(roots, r)
+			}
+		}
+	}
+	if len(roots) == 0 {
+		return fmt.Errorf("no root cid in the car headers or the metadata, pass --root")
+	}
+
+	output := c.String("output")
+	if err := os.MkdirAll(output, 0o755); err != nil {
+		return err
+	}
+	for _, root := range roots {
+		// a directory is extracted into the output directory, a single file goes into it, named after its cid
+		path := output
+		isDir, err := bs.isDirectory(root)
+		if err != nil {
+			return err
+		}
+		if !isDir {
+			path = filepath.Join(output, root.String())
+		}
+		var files int
+		n, err := bs.extract(root, path, root.String(), &files)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("extracted %s to %s: %d files, %d bytes\n", root, path, files, n)
+	}
+	return nil
+}
+
+// index reads the frames of a car file, and records where the data of every block is. It returns the roots in the car
+// header, leaving out nul roots. Padding after the last block, as in padded pieces, ends the car, as does the end of the
+// data of a CARv2 file.
+func (bs *blockstore) index(path string) ([]cid.Cid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReaderSize(f, 1<<20)
+
+	// the blocks of a CARv2 file end with its data, the index is behind them
+	isV2, dataOffset, dataSize, _, err := splitter.ReadCarV2Header(br)
+	if err != nil {
+		return nil, fmt.Errorf("invalid car file %s: %s", path, err)
+	}
+	offset, end := int64(dataOffset), int64(-1)
+	if isV2 {
+		end = int64(dataOffset + dataSize)
+	}
+	readFrameLen := func() (uint64, error) {
+		l, err := binary.ReadUvarint(br)
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(len(binary.AppendUvarint(nil, l)))
+		return l, nil
+	}
+
+	hdrLen, err := readFrameLen()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the car header of %s: %s", path, err)
+	}
+	hdr := make([]byte, hdrLen)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, fmt.Errorf("failed to read the car header of %s: %s", path, err)
+	}
+	offset += int64(hdrLen)
+	m := &splitter.CarPiecesAndMetadata{OriginalCarHeader: base64.StdEncoding.EncodeToString(hdr)}
+	roots, err := m.HeaderRoots()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the car header of %s: %s", path, err)
+	}
+
+	for {
+		start := offset
+		if end >= 0 && start >= end {
+			return roots, nil
+		}
+		l, err := readFrameLen()
+		if err == io.EOF || (err == nil && l == 0) {
+			return roots, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the block at offset %d of %s: %s", start, path, err)
+		}
+		// the cid is at most a few dozen bytes, peek at enough of the frame to decode it
+		peek := 128
+		if l < uint64(peek) {
+			peek = int(l)
+		}
+		head, err := br.Peek(peek)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read the block at offset %d of %s: %s", start, path, err)
+		}
+		n, c, err := cid.CidFromBytes(head)
+		if err != nil {
+			return nil, fmt.Errorf("undecodeable cid of the block at offset %d of %s: %s", start, path, err)
+		}
+		if _, err := br.Discard(int(l)); err != nil {
+			return nil, fmt.Errorf("unexpected end of %s in the block at offset %d: %s", path, start, err)
+		}
+		bs.blocks[c.KeyString()] = location{file: path, offset: offset + int64(n), length: int64(l) - int64(n)}
+		offset += int64(l)
+	}
+}
+
+// get reads the data of a block, and checks it against its cid.
+func (bs *blockstore) get(c cid.Cid) ([]byte, error) {
+	if c.Prefix().MhType == multihash.IDENTITY {
+		dmh, err := multihash.Decode(c.Hash())
+		if err != nil {
+			return nil, err
+		}
+		return dmh.Digest, nil
+	}
+	loc, ok := bs.blocks[c.KeyString()]
+	if !ok {
+		return nil, fmt.Errorf("block %s is not in the car files", c)
+	}
+	f, ok := bs.files[loc.file]
+	if !ok {
+		var err error
+		if f, err = os.Open(loc.file); err != nil {
+			return nil, err
+		}
+		bs.files[loc.file] = f
+	}
+	data := make([]byte, loc.length)
+	if _, err := f.ReadAt(data, loc.offset); err != nil {
+		return nil, fmt.Errorf("failed to read block %s from %s: %s", c, loc.file, err)
+	}
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash block %s: %s", c, err)
+	}
+	if !sum.Equals(c) {
+		return nil, fmt.Errorf("the data of block %s in %s doesn't match its cid", c, loc.file)
+	}
+	return data, nil
+}
+
+// isDirectory reports whether c is a unixfs directory.
+func (bs *blockstore) isDirectory(c cid.Cid) (bool, error) {
+	if c.Type() != cid.DagProtobuf {
+		return false, nil
+	}
+	data, err := bs.get(c)
+	if err != nil {
+		return false, err
+	}
+	pn, err := merkledag.DecodeProtobuf(data)
+	if err != nil {
+		return false, fmt.Errorf("undecodeable block %s: %s", c, err)
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return false, nil
+	}
+	return fsn.Type() == unixfspb.Data_Directory || fsn.Type() == unixfspb.Data_HAMTShard, nil
+}
+
+func (bs *blockstore) close() {
+	for _, f := range bs.files {
+		f.Close()
+	}
+}
+
+// extract writes the unixfs node c to path, a directory with its entries, a file or a symlink. name is the node's path
+// in the dag, for error messages. It returns the number of bytes written, and counts the files written in files.
+func (bs *blockstore) extract(c cid.Cid, path string, name string, files *int) (uint64, error) {
+	data, err := bs.get(c)
+	if err != nil {
+		return 0, err
+	}
+	if c.Type() == cid.Raw {
+		*files++
+		return uint64(len(data)), os.WriteFile(path, data, 0o644)
+	}
+	if c.Type() != cid.DagProtobuf {
+		return 0, fmt.Errorf("%s: unsupported codec of block %s, expected dag-pb or raw", name, c)
+	}
+	pn, err := merkledag.DecodeProtobuf(data)
+	if err != nil {
+		return 0, fmt.Errorf("%s: undecodeable block %s: %s", name, c, err)
+	}
+	fsn, err := unixfs.FSNodeFromBytes(pn.Data())
+	if err != nil {
+		return 0, fmt.Errorf("%s: block %s is not a unixfs node: %s", name, c, err)
+	}
+
+	switch fsn.Type() {
+	case unixfspb.Data_Directory, unixfspb.Data_HAMTShard:
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			return 0, err
+		}
+		links := pn.Links()
+		if fsn.Type() == unixfspb.Data_HAMTShard {
+			if links, err = bs.shardEntries(pn, fsn, name); err != nil {
+				return 0, err
+			}
+		}
+		var total uint64
+		for _, l := range links {
+			if l.Name == "" || l.Name == "." || l.Name == ".." || strings.Contains(l.Name, "/") {
+				return 0, fmt.Errorf("%s: unsafe directory entry name %q", name, l.Name)
+			}
+			n, err := bs.extract(l.Cid, filepath.Join(path, l.Name), name+"/"+l.Name, files)
+			if err != nil {
+				return 0, err
+			}
+			total += n
+		}
+		return total, nil
+	case unixfspb.Data_File, unixfspb.Data_Raw:
+		f, err := os.Create(path)
+		if err != nil {
+			return 0, err
+		}
+		w := bufio.NewWriterSize(f, 1<<20)
+		n, err := bs.writeFile(w, c, pn, fsn)
+		if err == nil {
+			err = w.Flush()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s", name, err)
+		}
+		*files++
+		return n, nil
+	case unixfspb.Data_Symlink:
+		*files++
+		return 0, os.Symlink(string(fsn.Data()), path)
+	default:
+		return 0, fmt.Errorf("%s: unsupported unixfs node type %s of block %s", name, fsn.Type(), c)
+	}
+}
+
+// shardEntries returns the entries of a sharded directory, a unixfs HAMT, with their names as in a plain directory.
+// Every link of a shard node is named by the hex slot it is in, followed by the entry name for an entry, or by nothing
+// for a shard node one level down, whose entries are collected as well.
+func (bs *blockstore) shardEntries(pn *merkledag.ProtoNode, fsn *unixfs.FSNode, name string) ([]*format.Link, error) {
+	if fsn.Fanout() == 0 {
+		return nil, fmt.Errorf("%s: sharded directory without fanout", name)
+	}
+	prefixLen := len(fmt.Sprintf("%X", fsn.Fanout()-1))
+	var entries []*format.Link
+	for _, l := range pn.Links() {
+		if len(l.Name) < prefixLen {
+			return nil, fmt.Errorf("%s: invalid shard link name %q", name, l.Name)
+		}
+		if len(l.Name) > prefixLen {
+			entries = append(entries, &format.Link{Name: l.Name[prefixLen:], Size: l.Size, Cid: l.Cid})
+			continue
+		}
+		data, err := bs.get(l.Cid)
+		if err != nil {
+			return nil, err
+		}
+		sub, err := merkledag.DecodeProtobuf(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: undecodeable block %s: %s", name, l.Cid, err)
+		}
+		subFsn, err := unixfs.FSNodeFromBytes(sub.Data())
+		if err != nil || subFsn.Type() != unixfspb.Data_HAMTShard {
+			return nil, fmt.Errorf("%s: block %s is not a shard node", name, l.Cid)
+		}
+		subEntries, err := bs.shardEntries(sub, subFsn, name)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, subEntries...)
+	}
+	return entries, nil
+}
+
+// writeFile writes the data of a unixfs file node: its own data, followed by the data of its children in order.
+func (bs *blockstore) writeFile(w io.Writer, c cid.Cid, pn *merkledag.ProtoNode, fsn *unixfs.FSNode) (uint64, error) {
+	if _, err := w.Write(fsn.Data()); err != nil {
+		return 0, err
+	}
+	total := uint64(len(fsn.Data()))
+	for _, l := range pn.Links() {
+		data, err := bs.get(l.Cid)
+		if err != nil {
+			return 0, err
+		}
+		if l.Cid.Type() == cid.Raw {
+			if _, err := w.Write(data); err != nil {
+				return 0, err
+			}
+			total += uint64(len(data))
+			continue
+		}
+		child, err := merkledag.DecodeProtobuf(data)
+		if err != nil {
+			return 0, fmt.Errorf("undecodeable block %s: %s", l.Cid, err)
+		}
+		childFsn, err := unixfs.FSNodeFromBytes(child.Data())
+		if err != nil {
+			return 0, fmt.Errorf("block %s is not a unixfs node: %s", l.Cid, err)
+		}
+		n, err := bs.writeFile(w, l.Cid, child, childFsn)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	if size := fsn.FileSize(); size != 0 && total != size {
+		return 0, fmt.Errorf("file node %s holds %d bytes, expected %d", c, total, size)
+	}
+	return total, nil
+}
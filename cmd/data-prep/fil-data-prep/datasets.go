@@ -0,0 +1,203 @@
+package fil_data_prep
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/urfave/cli/v2"
+)
+
+// flags that are set per dataset, and therefore not passed on as they are
+var perDatasetFlags = map[string]bool{
+	"output":           true,
+	"metadata":         true,
+	"dataset-per-path": true,
+	"jobs":             true,
+	"help":             true,
+	// the piece index is updated once all datasets are done, concurrent updates would overwrite each other
+	"piece-index":       true,
+	"merge-piece-index": true,
+	"run-id":            true,
+	// the size is looked up once and passed on, along with the padding of --piece-size
+	"miner":      true,
+	"api":        true,
+	"piece-size": true,
+}
+
+type datasetResult struct {
+	name     string
+	path     string
+	metadata string
+	rootCid  string
+	meta     *metadata.Metadata
+	pieces   int
+	padded   uint64
+	err      error
+}
+
+// prepDatasets preps every path as an independent dataset, with its own root, pieces and metadata files. Every
+// dataset runs in a pipeline of its own, in a separate process, so that a failing dataset doesn't take the others
+// down, and up to jobs of them run at the same time. A summary of all datasets is written next to the metadata.
+func prepDatasets(c *cli.Context, jobs int) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the data-prep executable: %s", err)
+	}
+
+	meta := c.String("metadata")
+	metaExt := filepath.Ext(meta)
+	metaBase := strings.TrimSuffix(meta, metaExt)
+
+	// the options shared by all datasets, as set on the command line
+	var common []string
+	for _, f := range c.Command.Flags {
+		name := f.Names()[0]
+		if perDatasetFlags[name] || !c.IsSet(name) {
+			continue
+		}
+		if _, ok := f.(*cli.StringSliceFlag); ok {
+			for _, v := range c.StringSlice(name) {
+				common = append(common, fmt.Sprintf("--%s=%s", name, v))
+			}
+			continue
+		}
+		common = append(common, fmt.Sprintf("--%s=%v", name, c.Value(name)))
+	}
+
+	paths := c.Args().Slice()
+	results := make([]datasetResult, len(paths))
+	seen := make(map[string]bool)
+	for i, path := range paths {
+		name := filepath.Base(filepath.Clean(path))
+		if seen[name] {
+			return fmt.Errorf("datasets need distinct names, but there are several named %q", name)
+		}
+		seen[name] = true
+		results[i] = datasetResult{name: name, path: path, metadata: metaBase + "-" + name + metaExt}
+	}
+
+	sem := make(chan struct{}, jobs)
+	wg := sync.WaitGroup{}
+	for i := range results {
+		wg.Add(1)
+		go func(r *datasetResult) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			output := r.name
+			if o := c.String("output"); o != "" {
+				prefix, _ := splitter.NamePrefix(o, false)
+				output = prefix + r.name
+			}
+			args := append([]string{c.Command.Name}, common...)
+			args = append(args, "--metadata="+r.metadata, "--output="+output)
+			if id := c.String("run-id"); id != "" {
+				// named like the runs in the piece index
+				args = append(args, "--run-id="+id+"-"+r.name)
+			}
+			args = append(args, r.path)
+
+			var stdout bytes.Buffer
+			cmd := exec.Command(self, args...)
+			cmd.Stdout = &stdout
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				r.err = fmt.Errorf("%s: %s", err, strings.TrimSpace(stdout.String()))
+				return
+			}
+
+			// the yaml is written whatever the format of the piece table
+			m, err := metadata.Read(strings.TrimSuffix(r.metadata, filepath.Ext(r.metadata)) + ".yaml")
+			if err != nil {
+				r.err = err
+				return
+			}
+			r.meta = m
+			r.rootCid = m.RootCid
+			r.pieces = len(m.CarPiecesMeta.CarPieces)
+			for _, cf := range m.CarPiecesMeta.CarPieces {
+				r.padded += cf.PaddedSize
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	if path := c.String("piece-index"); path != "" {
+		merge := c.Bool("merge-piece-index")
+		for _, r := range results {
+			if r.err != nil {
+				continue
+			}
+			run := r.metadata
+			if id := c.String("run-id"); id != "" {
+				run = id + "-" + r.name
+			}
+			if err := metadata.UpdatePieceIndex(path, merge, run, r.rootCid, r.meta.CarPiecesMeta); err != nil {
+				return err
+			}
+			merge = true
+		}
+	}
+
+	summary := metaBase + "-summary.csv"
+	if err := writeDatasetSummary(summary, results); err != nil {
+		return err
+	}
+
+	var failed int
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			fmt.Printf("dataset %s failed: %s\n", r.name, r.err)
+			continue
+		}
+		fmt.Printf("dataset %s: root cid = %s, %d pieces\n", r.name, r.rootCid, r.pieces)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d datasets failed, see %s", failed, len(results), summary)
+	}
+	return nil
+}
+
+func writeDatasetSummary(path string, results []datasetResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create dataset summary: %s", err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	rows := [][]string{{"dataset", "path", "metadata", "root_cid", "pieces", "padded size", "error"}}
+	for _, r := range results {
+		var errMsg string
+		if r.err != nil {
+			errMsg = r.err.Error()
+		}
+		rows = append(rows, []string{
+			r.name,
+			r.path,
+			r.metadata,
+			r.rootCid,
+			strconv.Itoa(r.pieces),
+			strconv.FormatUint(r.padded, 10),
+			errMsg,
+		})
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return fmt.Errorf("failed to write dataset summary: %s", err)
+	}
+	return f.Close()
+}
@@ -1,25 +1,29 @@
 package fil_data_prep
 
 import (
-	"encoding/csv"
-	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/anjor/anelace"
-	"github.com/anjor/carlet"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/dataprep"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/hooks"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metrics"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/preflight"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/progress"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/trace"
 	"github.com/ipfs/go-cid"
-	"github.com/ipfs/go-merkledag"
 	"github.com/urfave/cli/v2"
-	"gopkg.in/yaml.v2"
 )
 
+// defaultCheckpointInterval is the interval at which --checkpoint saves the progress, unless given otherwise.
+const defaultCheckpointInterval = time.Minute
+
 var Cmd = &cli.Command{
 	Name:    "fil-data-prep",
 	Usage:   "end to end data prep",
@@ -32,12 +36,40 @@ var Cmd = &cli.Command{
 			Required: false,
 			Usage:    "optional output filename prefix for car filename.",
 		},
-		&cli.IntFlag{
+		&cli.StringFlag{
+			Name:     "name-template",
+			Required: false,
+			Usage:    "optional template of the piece file names, with the placeholders {prefix} (the --output prefix), {index} (or e.g. {index:05d}) and {piececid}, e.g. {piececid}.car. Defaults to {prefix}{piececid}.car.",
+		},
+		&cli.BoolFlag{
+			Name:     "rename-to-commp",
+			Required: false,
+			Usage:    "once the run completed, rename every piece file with a commP to <piececid>.car, without the --output prefix, and record the new names in the metadata. Existing files are never replaced. Not supported with --exec, --webhook, --push, --upload and --emit-retrieval-index, which see the names during the run.",
+			Value:    false,
+		},
+		&cli.GenericFlag{
 			Name:     "size",
 			Aliases:  []string{"s"},
 			Required: false,
-			Value:    2 << 20,
-			Usage:    "Target size in bytes to chunk CARs to.",
+			Value:    preflight.NewByteSize(2 << 20),
+			Usage:    "Target size to chunk CARs to, in bytes or with a unit like GiB or GB.",
+		},
+		&cli.GenericFlag{
+			Name:     "piece-size",
+			Required: false,
+			Value:    preflight.NewByteSize(0),
+			Usage:    "optional padded piece size (a power of two like 16GiB or 32GiB) every piece is padded to exactly, with --size set to fill it. Replaces --size and --pad-to.",
+		},
+		&cli.StringFlag{
+			Name:     "miner",
+			Required: false,
+			Usage:    "optional miner id (e.g. f01234) to pick --size from: the target size is set to fill the miner's sectors. An explicit --size is only used if the sector size can't be looked up.",
+		},
+		&cli.StringFlag{
+			Name:     "api",
+			Required: false,
+			Value:    preflight.DefaultAPI,
+			Usage:    "lotus compatible api endpoint to look up the --miner sector size with. Sector sizes are cached in the user cache directory.",
 		},
 		&cli.StringFlag{
 			Name:     "metadata",
@@ -53,200 +85,1076 @@ var Cmd = &cli.Command{
 			Usage:    "optional dry run. Do not write split CARs to disk (but still write metadata).",
 			Value:    false,
 		},
+		&cli.Float64Flag{
+			Name:     "commp-sample",
+			Required: false,
+			Usage:    "optional fraction (0-1) of pieces to calculate commP for, for quick spot checks. Pieces without commP keep their index based name and have an empty piece cid in the metadata.",
+		},
+		&cli.IntFlag{
+			Name:     "commp-every",
+			Required: false,
+			Usage:    "optional, only calculate commP for every n-th piece. Takes precedence over --commp-sample.",
+		},
+		&cli.Uint64Flag{
+			Name:     "pad-to",
+			Required: false,
+			Usage:    "optional, pad every piece to this padded piece size (a power of two, e.g. 34359738368 for 32GiB sectors) and calculate commP over the padded piece. The padded size of the content alone is recorded as naturalPaddedSize.",
+		},
+		&cli.BoolFlag{
+			Name:     "pad-last",
+			Required: false,
+			Usage:    "pad the last piece, usually much smaller than the others, to the padded piece size of a piece holding --size, and calculate commP over the padded piece. The padded size of the content alone is recorded as naturalPaddedSize. Has no effect with --pad-to.",
+			Value:    false,
+		},
+		&cli.BoolFlag{
+			Name:     "content-defined-pieces",
+			Required: false,
+			Usage:    "cut pieces at content defined boundaries: after a block picked by its cid, once a piece holds at least half of --size, instead of at --size. The same content then makes for the same pieces across runs and datasets, for deduplication at the piece level.",
+			Value:    false,
+		},
+		&cli.StringFlag{
+			Name:     "commp-cache",
+			Required: false,
+			Usage:    "optional directory to cache the commP of pieces in, keyed by their blocks. Pieces found in the cache on a later run skip the commP calculation, others are read back from disk once written to calculate it.",
+		},
+		&cli.BoolFlag{
+			Name:     "commp-skip-zeros",
+			Required: false,
+			Usage:    "optional, short-circuit commP over all-zero regions instead of hashing them. Gives the same commP, but is much faster on sparse inputs like disk images.",
+		},
+		&cli.IntFlag{
+			Name:     "commp-workers",
+			Required: false,
+			Usage:    "optional number of pieces to calculate commP of at the same time, from the piece files, while the next pieces are written. Pieces are still recorded in the order of the car stream. Ignored with --dry-run.",
+			Value:    1,
+		},
+		&cli.IntFlag{
+			Name:     "car-version",
+			Required: false,
+			Usage:    "car format of the pieces, 1 or 2. CARv2 pieces wrap the CARv1 piece with a CARv2 header and an index of its blocks, for fast random access. Their commP is calculated from the piece files, so they can't be combined with --dry-run.",
+			Value:    1,
+		},
+		&cli.StringFlag{
+			Name:     "commp-algorithm",
+			Required: false,
+			Value:    splitter.FilCommitmentUnsealed.Name(),
+			Usage:    "piece commitment algorithm, one of: " + strings.Join(splitter.CommPAlgorithmNames(), ", ") + ". Recorded in the metadata.",
+		},
+		&cli.BoolFlag{
+			Name:     "car-per-file",
+			Required: false,
+			Usage:    "put every file into cars of its own instead of splitting all files by size. Files larger than --size are still split. The directory nodes go into a final piece.",
+			Value:    false,
+		},
+		&cli.BoolFlag{
+			Name:     "group-dir-nodes",
+			Required: false,
+			Usage:    "put the directory nodes into pieces of their own at the end, instead of after the last file blocks in the last piece, so that the tree can be listed without fetching content pieces. The tree pieces are marked in the yaml metadata. Always the case with --car-per-file.",
+			Value:    false,
+		},
+		&cli.StringFlag{
+			Name:     "block-order",
+			Required: false,
+			Value:    "dfs",
+			Usage:    "order of the blocks in the car stream: dfs (depth first, every directory's subtree at a time) or bfs (breadth first, the files of a directory before those of its subdirectories). Changes the piece boundaries, not the root cid.",
+		},
+		&cli.StringFlag{
+			Name:     "chunker",
+			Required: false,
+			Usage:    "how files are cut into leaves: fixed:<size> with a size of up to 1MiB, or the content defined rabin or buzhash, with the parameters of kubo. Defaults to fixed:1048576.",
+		},
+		&cli.StringFlag{
+			Name:     "layout",
+			Required: false,
+			Usage:    "shape of the dags of the files: trickle or balanced. Defaults to trickle.",
+		},
+		&cli.IntFlag{
+			Name:     "max-links",
+			Required: false,
+			Usage:    "optional maximum number of links of a node of the dag of a file: the direct leaves of a trickle node, 2048 by default, or the children of a balanced node, 174 by default as in kubo.",
+		},
+		&cli.IntFlag{
+			Name:     "cid-version",
+			Required: false,
+			Value:    1,
+			Usage:    "cid version of the dag-pb nodes: 1, or 0 for pinsets of CIDv0 cids. CIDv0 needs sha2-256, and inlines no blocks.",
+		},
+		&cli.StringFlag{
+			Name:     "hash",
+			Required: false,
+			Usage:    "hash function of the blocks: sha2-256, sha3-512 or blake2b-256. Defaults to sha2-256.",
+		},
+		&cli.BoolFlag{
+			Name:     "raw-leaves",
+			Required: false,
+			Usage:    "store the leaves as raw blocks instead of unixfs nodes. Defaults to true with --cid-version 1 and false with --cid-version 0, as ipfs add does.",
+		},
+		&cli.StringFlag{
+			Name:     "ipfs-add-compatible-command",
+			Required: false,
+			Usage:    "build the dags like this ipfs add command, e.g. \"ipfs add --cid-version=1\", instead of by --chunker, --layout, --max-links, --cid-version, --hash and --raw-leaves. It takes the --cid-version, --hash, --raw-leaves, --chunker, --trickle, --inline and --inline-limit options of ipfs add.",
+		},
+		&cli.IntFlag{
+			Name:     "dir-sharding",
+			Required: false,
+			Usage:    "optional number of entries above which a directory is sharded as a unixfs HAMT. By default directories are sharded once their node would get larger than 256KiB, like kubo does.",
+		},
+		&cli.BoolFlag{
+			Name:     "dataset-per-path",
+			Required: false,
+			Usage:    "prep every path as an independent dataset with its own root, pieces (prefixed with the dataset name) and metadata files (suffixed with the dataset name), plus a summary of all datasets.",
+			Value:    false,
+		},
+		&cli.IntFlag{
+			Name:     "jobs",
+			Required: false,
+			Value:    1,
+			Usage:    "number of datasets prepped concurrently with --dataset-per-path.",
+		},
+		&cli.IntFlag{
+			Name:     "parallel",
+			Required: false,
+			Usage:    "number of input paths to build dags for concurrently. The resulting root cid and pieces are the same as when building sequentially. Needs temporary space for the car streams of all inputs.",
+		},
+		&cli.StringFlag{
+			Name:     "parallel-tmp-dir",
+			Required: false,
+			Usage:    "directory for the temporary car streams of --parallel. Defaults to the system temporary directory.",
+		},
+		&cli.StringFlag{
+			Name:     "input-format",
+			Required: false,
+			Value:    "files",
+			Usage:    "format of the input paths: files (files and directories, or - for a tar archive on stdin), zip (zip archives, or - for a zip archive on stdin, whose files are prepped as if the archive was a directory) or tar (tar archives, optionally gzip compressed, or - for one on stdin, streamed without extracting them).",
+		},
+		&cli.BoolFlag{
+			Name:     "stdin",
+			Required: false,
+			Usage:    "prep a single file streamed on stdin, of any size, instead of paths. It is named by --name in the dag.",
+		},
+		&cli.StringFlag{
+			Name:     "name",
+			Required: false,
+			Value:    "stdin",
+			Usage:    "name of the file streamed on stdin with --stdin.",
+		},
+		&cli.StringSliceFlag{
+			Name:     "fd",
+			Required: false,
+			Usage:    "optional, read an input from an open file descriptor instead of a path, given as fd[:name[:size]]. The name (default fd-<fd>) is its path in the dag. Streams that aren't regular files, like pipes, need their size. Can be repeated.",
+		},
+		&cli.StringSliceFlag{
+			Name:     "include",
+			Required: false,
+			Usage:    "optional, only prep the files matching this glob (gitignore syntax, e.g. '*.parquet' or 'data/**/*.csv'), or in a directory matching it. Can be repeated. Note that this changes the root cid.",
+		},
+		&cli.StringSliceFlag{
+			Name:     "exclude",
+			Required: false,
+			Usage:    "optional, leave out the files and directories matching this glob (gitignore syntax, e.g. '*.tmp', '.*' or 'build/'). Can be repeated. Note that this changes the root cid.",
+		},
+		&cli.StringFlag{
+			Name:     "ignore-file",
+			Required: false,
+			Usage:    "optional file of patterns of files and directories to leave out, in gitignore syntax (including ! to re-include), e.g. a .gitignore. Note that this changes the root cid.",
+		},
+		&cli.BoolFlag{
+			Name:     "watch",
+			Required: false,
+			Usage:    "keep watching the input directories for new files until interrupted, and prep the files that arrived every --watch-interval as a batch with its own root cid. The pieces of every batch are added to the --metadata csv, the yaml metadata of batch n goes next to it, suffixed with -n.",
+			Value:    false,
+		},
+		&cli.DurationFlag{
+			Name:     "watch-interval",
+			Required: false,
+			Usage:    "how often --watch looks for new files. A file is only prepped once it is unchanged since the previous look.",
+			Value:    time.Minute,
+		},
+		&cli.StringFlag{
+			Name:     "symlinks",
+			Required: false,
+			Value:    dataprep.SymlinksFollow,
+			Usage:    "handling of symlinks in input directories: follow (prep what they point to, failing on symlink cycles), preserve (add them as unixfs symlinks, changing the root cid) or skip (leave them out, with a warning). Input paths that are symlinks are always followed.",
+		},
+		&cli.DurationFlag{
+			Name:     "read-timeout",
+			Required: false,
+			Usage:    "optional timeout (e.g. 30s) for opening an input file and every read from it, so that a stalled source (like a hung network mount) fails the run instead of hanging it.",
+		},
+		&cli.BoolFlag{
+			Name:     "skip-errors",
+			Required: false,
+			Usage:    "skip input files that can't be opened or read from the start (including --read-timeout), instead of failing the run. Skipped files are left out of the dag and reported on stderr.",
+			Value:    false,
+		},
+		&cli.IntFlag{
+			Name:     "pipe-buffer",
+			Required: false,
+			Value:    16 << 20,
+			Usage:    "size in bytes of the buffer between the dag building and splitting stages. 0 disables buffering.",
+		},
+		&cli.StringFlag{
+			Name:     "git-ref",
+			Required: false,
+			Usage:    "optional git ref (commit, tag or branch). When set, every path must be a git repository, and the tree at that ref is prepped instead of the files on disk.",
+		},
+		&cli.StringFlag{
+			Name:     "s3-endpoint-url",
+			Required: false,
+			Usage:    "optional endpoint of an S3 compatible object store to read s3://bucket/prefix paths from and --upload s3:// urls to, instead of AWS.",
+		},
+		&cli.BoolFlag{
+			Name:     "embed-manifest",
+			Required: false,
+			Usage:    "add a " + dataprep.ManifestName + " file listing all paths, sizes and cids to the root directory. Note that this changes the root cid.",
+			Value:    false,
+		},
+		&cli.StringFlag{
+			Name:     "rename-root",
+			Required: false,
+			Usage:    "optional name of a single input file in the root directory of the dag, instead of its name on disk. Note that this changes the root cid.",
+		},
+		&cli.Int64Flag{
+			Name:     "max-file-size",
+			Required: false,
+			Usage:    "optional, fail before anything is read if any input file is larger than this many bytes, naming the file.",
+		},
+		&cli.StringFlag{
+			Name:     "large-files",
+			Required: false,
+			Value:    dataprep.LargeFilesRecord,
+			Usage:    "handling of input files larger than --size, whose data is spread over several pieces: record (warn, and record the pieces holding every byte range of them in the yaml metadata), warn (only warn) or fail.",
+		},
+		&cli.IntFlag{
+			Name:     "max-dag-depth",
+			Required: false,
+			Usage:    "optional, fail if the directory tree of the dag would be deeper than this many levels (a file in the root directory is at level 1), naming the deepest path. Catches accidentally deep inputs before anything is written.",
+		},
+		&cli.BoolFlag{
+			Name:     "flatten",
+			Required: false,
+			Usage:    "put all files directly into the root directory of the dag, regardless of their nesting on disk. Note that this changes the root cid.",
+			Value:    false,
+		},
+		&cli.StringFlag{
+			Name:     "flatten-collisions",
+			Required: false,
+			Value:    "suffix",
+			Usage:    "how --flatten tells apart files with the same name, one of: suffix (a-1.txt), path (dir_a.txt), error.",
+		},
+		&cli.BoolFlag{
+			Name:     "strict-roots",
+			Required: false,
+			Usage:    "fail on any unparseable line in the roots stream, as a dropped root corrupts the file to cid mapping. Set to false to only log such lines.",
+			Value:    true,
+		},
+		&cli.StringFlag{
+			Name:     "piece-root-mode",
+			Required: false,
+			Value:    "null",
+			Usage:    "root to put in the car header of every piece, one of: null, first-block.",
+		},
+		&cli.DurationFlag{
+			Name:     "checkpoint-interval",
+			Required: false,
+			Usage:    "optional interval (e.g. 10m) at which the progress (stream offset and completed pieces) is saved to a checkpoint file next to the metadata file, so that a crashed run can be continued with --resume.",
+		},
+		&cli.BoolFlag{
+			Name:     "resume",
+			Required: false,
+			Usage:    "continue a previous run from its checkpoint file. The inputs and options must be the same as for the original run.",
+			Value:    false,
+		},
+		&cli.StringFlag{
+			Name:     "checkpoint",
+			Required: false,
+			Usage:    "optional checkpoint file to save the progress (input files, stream offset and completed pieces) to, every --checkpoint-interval or every minute. If the file exists, the run continues from it instead of starting over. The inputs and options must be the same as for the original run.",
+		},
+		&cli.BoolFlag{
+			Name:     "deterministic",
+			Required: false,
+			Usage:    "make the run reproducible: the input paths are prepped in sorted order, timestamps are left out of the metadata (or set to --source-date-epoch), and options whose outcome depends on timing, like --skip-errors, are refused. The same input and options then give the same root cid, pieces and metadata files.",
+			Value:    false,
+		},
+		&cli.Int64Flag{
+			Name:     "source-date-epoch",
+			Required: false,
+			EnvVars:  []string{"SOURCE_DATE_EPOCH"},
+			Usage:    "with --deterministic, the time (in seconds since the epoch) to record as the timestamp of every piece in the metadata. Taken from SOURCE_DATE_EPOCH if set.",
+		},
+		&cli.StringFlag{
+			Name:     "timestamp-format",
+			Required: false,
+			Value:    "rfc3339",
+			Usage:    "format of the csv metadata timestamps: rfc3339, unix (epoch seconds), unix-ms (epoch milliseconds) or a Go time layout like \"2006-01-02 15:04:05\".",
+		},
+		&cli.StringFlag{
+			Name:     "timezone",
+			Required: false,
+			Value:    "UTC",
+			Usage:    "timezone of the csv metadata timestamps: UTC, Local or an IANA name like Europe/Berlin.",
+		},
+		&cli.StringFlag{
+			Name:     "format",
+			Required: false,
+			Value:    metadata.FormatCSV,
+			Usage:    "format of the piece table: csv, parquet or ndjson (written next to the metadata file, with a .parquet or .ndjson extension, instead of the csv). ndjson rows are written as the pieces complete, followed by a summary record. The yaml metadata is written either way.",
+		},
+		&cli.StringFlag{
+			Name:     "metadata-format",
+			Required: false,
+			Value:    metadata.DefaultDocuments,
+			Usage:    "metadata documents to write, a comma separated list of: csv (the piece table, in the --format), yaml, json (a single document with the root cid, the pieces with their commP, sizes and stream offsets, and the original car header, next to the metadata file with a .json extension), or all.",
+		},
+		&cli.StringFlag{
+			Name:     "metadata-db",
+			Required: false,
+			Usage:    "optional sqlite database to record the run in, along with its pieces and which pieces hold which files, alongside the metadata files (or instead of them, with --no-metadata). Runs are appended to the database.",
+		},
+		&cli.BoolFlag{
+			Name:     "no-metadata",
+			Required: false,
+			Usage:    "don't write the csv and yaml metadata files, only the pieces.",
+			Value:    false,
+		},
+		&cli.BoolFlag{
+			Name:     "audit-total",
+			Required: false,
+			Usage:    "check once the run is done that the file data in the dag adds up to the bytes of the input files, and that the pieces hold all of it, and fail on any discrepancy.",
+			Value:    false,
+		},
+		&cli.BoolFlag{
+			Name:     "sort-pieces-by-size",
+			Required: false,
+			Usage:    "record a hint for packing the pieces into sectors in the yaml metadata: the pieces sorted by padded size, largest first, and grouped into as few sectors of --sector-size as possible. The pieces and their order in the metadata don't change.",
+			Value:    false,
+		},
+		&cli.Uint64Flag{
+			Name:     "sector-size",
+			Required: false,
+			Value:    32 << 30,
+			Usage:    "padded sector size to group the pieces into with --sort-pieces-by-size, 32GiB by default.",
+		},
+		&cli.BoolFlag{
+			Name:     "quiet",
+			Required: false,
+			Usage:    "don't print the summary of the run (input size, pieces, padded size, padding overhead, elapsed time) at the end.",
+			Value:    false,
+		},
+		&cli.StringFlag{
+			Name:     "emit-retrieval-index",
+			Required: false,
+			Usage:    "optional file to write a binary index to, locating every block cid in the pieces (piece file, offset and length of the block data), for gateways serving single blocks. See the README for the format.",
+		},
+		&cli.StringFlag{
+			Name:     "file-manifest",
+			Required: false,
+			Usage:    "optional file to write a manifest of every input file to: its cid, size, the pieces holding it, and the offsets of its byte ranges in the file and in the piece files, for partial retrievals. Written as json with a .json extension, as csv otherwise.",
+		},
+		&cli.BoolFlag{
+			Name:     "audit",
+			Required: false,
+			Usage:    "check the size invariants of every piece once the run is done (header plus content size matches the piece file, padded size matches the piece length) and fail on any violation.",
+			Value:    false,
+		},
+		&cli.BoolFlag{
+			Name:     "ignore-disk-space",
+			Required: false,
+			Usage:    "don't abort when the estimated size of the pieces exceeds the free space of the output filesystem.",
+			Value:    false,
+		},
+		&cli.StringFlag{
+			Name:     "piece-index",
+			Required: false,
+			Usage:    "optional file to write a json index keyed by piece cid to, listing the run and car file of every piece.",
+		},
+		&cli.BoolFlag{
+			Name:     "merge-piece-index",
+			Required: false,
+			Usage:    "add the pieces of this run to an existing --piece-index instead of replacing it.",
+			Value:    false,
+		},
+		&cli.StringFlag{
+			Name:     "run-id",
+			Required: false,
+			Usage:    "name of this run in the --piece-index and --webhook posts. Defaults to the metadata file name.",
+		},
+		&cli.StringFlag{
+			Name:     "exec",
+			Required: false,
+			Usage:    "optional command to run for every completed piece. Placeholders {file}, {commp}, {padded_size}, {header_size} and {content_size} are substituted.",
+		},
+		&cli.BoolFlag{
+			Name:     "exec-continue-on-error",
+			Required: false,
+			Usage:    "keep going when the --exec command exits with a non-zero code instead of failing the run.",
+			Value:    false,
+		},
+		&cli.StringFlag{
+			Name:     "webhook",
+			Required: false,
+			Usage:    "optional http(s) url to post the metadata of every completed piece to as a line of ndjson, with the run id, followed by a summary with the root cid once the run is done.",
+		},
+		&cli.IntFlag{
+			Name:     "webhook-retries",
+			Required: false,
+			Value:    3,
+			Usage:    "number of times a failed --webhook post is retried, with an increasing delay.",
+		},
+		&cli.BoolFlag{
+			Name:     "webhook-continue-on-error",
+			Required: false,
+			Usage:    "keep going when a --webhook post still fails after all retries instead of failing the run.",
+			Value:    false,
+		},
+		&cli.StringFlag{
+			Name:     "upload",
+			Required: false,
+			Usage:    "optional s3://bucket/prefix or gs://bucket/prefix (or gcs://) url to upload every piece to as soon as it is complete, with the aws or gcloud command line tool. The local piece file is removed once uploaded, and the metadata records the url of every piece.",
+		},
+		&cli.IntFlag{
+			Name:     "upload-concurrency",
+			Required: false,
+			Usage:    "number of pieces uploaded at the same time with --upload. The split waits for a free upload slot before going on.",
+			Value:    4,
+		},
+		&cli.IntFlag{
+			Name:     "upload-retries",
+			Required: false,
+			Usage:    "number of times a failed --upload is retried, with an increasing delay.",
+			Value:    3,
+		},
+		&cli.BoolFlag{
+			Name:     "upload-keep-local",
+			Required: false,
+			Usage:    "keep the local piece files after uploading them with --upload.",
+		},
+		&cli.StringFlag{
+			Name:     "push",
+			Required: false,
+			Usage:    "optional http(s) url of a storage provider endpoint (e.g. a boost http server) to push every piece to with a PUT as soon as it is complete. The placeholders {file} and {commp} are substituted, without any the name of the piece file is appended. The metadata records the push status of every piece.",
+		},
+		&cli.StringFlag{
+			Name:     "push-token",
+			Required: false,
+			EnvVars:  []string{"PUSH_TOKEN"},
+			Usage:    "optional token sent as bearer token with every --push.",
+		},
+		&cli.IntFlag{
+			Name:     "push-concurrency",
+			Required: false,
+			Usage:    "number of pieces pushed at the same time with --push. The split waits for a free push slot before going on.",
+			Value:    2,
+		},
+		&cli.IntFlag{
+			Name:     "push-retries",
+			Required: false,
+			Usage:    "number of times a failed --push is retried, with an increasing delay.",
+			Value:    3,
+		},
+		&cli.BoolFlag{
+			Name:     "push-continue-on-error",
+			Required: false,
+			Usage:    "keep going when a --push still fails after all retries instead of failing the run. The piece is recorded with a failed push status.",
+			Value:    false,
+		},
+		&cli.StringFlag{
+			Name:     "trace",
+			Required: false,
+			Usage:    "optional file to write a timeline of the run to, in the Chrome trace event format (chrome://tracing, Perfetto): spans for the stages and every piece, and for the stalls between the stages.",
+		},
+		&cli.StringFlag{
+			Name:     "progress",
+			Required: false,
+			Usage:    "optional progress reporting on stderr, of the files processed, bytes read, pieces written and estimated time remaining: bar (a progress bar) or json (a json object per line, for other tools to follow the run).",
+		},
+		&cli.DurationFlag{
+			Name:     "progress-interval",
+			Required: false,
+			Usage:    "how often the progress is reported with --progress.",
+			Value:    time.Second,
+		},
+		&cli.StringFlag{
+			Name:     "metrics-addr",
+			Required: false,
+			Usage:    "optional address (e.g. :9090) to serve Prometheus metrics of the run on, at /metrics, while it is in progress: bytes read, files processed, pieces completed, commP throughput and the file being read.",
+		},
+		&cli.StringFlag{
+			Name:     "log-level",
+			Required: false,
+			Usage:    "minimum level of the log entries written to stderr: debug (which includes every piece written), info, warn or error.",
+			Value:    "info",
+		},
+		&cli.StringFlag{
+			Name:     "log-format",
+			Required: false,
+			Usage:    "format of the log entries written to stderr: text, or json for a json object per line, for log aggregation.",
+			Value:    logging.FormatText,
+		},
 	},
 }
 
 func filDataPrep(c *cli.Context) error {
-	if !c.Args().Present() {
+	start := time.Now()
+	if err := logging.Configure(c.String("log-level"), c.String("log-format")); err != nil {
+		return err
+	}
+	fds := c.StringSlice("fd")
+	if !c.Args().Present() && len(fds) == 0 && !c.Bool("stdin") {
 		return fmt.Errorf("expected some data to be processed, found none")
 	}
+	if c.IsSet("name") && !c.Bool("stdin") {
+		return fmt.Errorf("--name is only supported with --stdin")
+	}
 
-	var fileReaders []io.Reader
-	var files []string
-	paths := c.Args().Slice()
+	if err := preflight.SetPieceSize(c); err != nil {
+		return err
+	}
+	if err := preflight.SetMinerSize(c); err != nil {
+		return err
+	}
+	docs, err := metadata.ParseDocuments(c.String("metadata-format"))
+	if err != nil {
+		return err
+	}
+	dag, err := dagOptions(c)
+	if err != nil {
+		return err
+	}
+	blocks, err := dag.Blocks()
+	if err != nil {
+		return err
+	}
+	if err := preflight.ValidateTargetSize(preflight.Size(c, "size"), blocks); err != nil {
+		return err
+	}
+	opts := runOptions{docs: docs, dag: dag}
 
-	for _, path := range paths {
-		fs, frs, err := getAllFileReadersFromPath(path)
-		if err != nil {
-			return err
+	if c.Bool("dataset-per-path") {
+		if c.Bool("no-metadata") || !docs.YAML {
+			// the datasets are summarized from their yaml metadata
+			return fmt.Errorf("--no-metadata and --metadata-format without yaml are not supported with --dataset-per-path")
+		}
+		if c.IsSet("emit-retrieval-index") || c.IsSet("file-manifest") {
+			return fmt.Errorf("--emit-retrieval-index and --file-manifest are not supported with --dataset-per-path")
+		}
+		if len(fds) > 0 || c.Bool("stdin") {
+			// the datasets are prepped in processes of their own, which don't inherit the fds
+			return fmt.Errorf("--fd and --stdin are not supported with --dataset-per-path")
 		}
+		return prepDatasets(c, c.Int("jobs"))
+	}
+	if c.Bool("watch") {
+		return watch(c, opts)
+	}
 
-		files = append(files, fs...)
-		fileReaders = append(fileReaders, frs...)
+	res, err := prepRun(c, opts, run{paths: c.Args().Slice(), metadata: c.String("metadata"), id: runID(c)})
+	if err != nil {
+		return err
 	}
+	fmt.Printf("root cid = %s\n", res.RootCid)
+	if !c.Bool("quiet") {
+		metadata.Report{RootCid: res.RootCid.String(), InputSize: res.InputSize, Payload: res.Payload, Pieces: res.Pieces.CarPieces, Elapsed: time.Since(start)}.Print(os.Stdout)
+	}
+	return nil
+}
 
-	wg := sync.WaitGroup{}
-	wg.Add(3)
+// runOptions are the options of the command line that all of its runs share, parsed once.
+type runOptions struct {
+	docs metadata.Documents
+	dag  dataprep.DagOptions
+}
 
-	rerr, werr := io.Pipe()
-	rout, wout := io.Pipe()
+// run is what sets a run apart from the other runs of a command line: its inputs, its metadata and its name. --watch
+// preps every batch of new files as a run of its own.
+type run struct {
+	paths []string
+	// onlyFiles, if set, are the files of paths to prep, see dataprep.Options.OnlyFiles
+	onlyFiles []string
+	metadata  string
+	id        string
+}
 
-	anl, errs := anelace.NewAnelaceWithWriters(werr, wout)
-	if errs != nil {
-		return fmt.Errorf("unexpected error: %s", errs)
+// prepRun preps the inputs of r with the options of the command line, runs the hooks and writes the metadata, and
+// returns the result.
+func prepRun(c *cli.Context, opts runOptions, r run) (*dataprep.Result, error) {
+	docs := opts.docs
+	fds := c.StringSlice("fd")
+	var stdinName string
+	if c.Bool("stdin") {
+		stdinName = c.String("name")
 	}
-	anl.SetMultipart(true)
+	o := c.String("output")
+	meta := r.metadata
+	dryRun := c.Bool("dry-run")
+	carPerFile := c.Bool("car-per-file")
 
-	go func() {
-		defer wg.Done()
-		defer werr.Close()
-		if err := anl.ProcessReader(io.MultiReader(fileReaders...), nil); err != nil {
-			fmt.Printf("process reader error: %s", err)
+	ts, err := metadata.NewTimestamps(c.String("timestamp-format"), c.String("timezone"))
+	if err != nil {
+		return nil, err
+	}
+	paths := r.paths
+	if c.Bool("deterministic") {
+		if paths, ts, err = deterministic(c, paths, ts); err != nil {
+			return nil, err
 		}
-	}()
+	} else if c.IsSet("source-date-epoch") {
+		return nil, fmt.Errorf("--source-date-epoch is only supported with --deterministic")
+	}
+	if err := metadata.ValidateFormat(c.String("format")); err != nil {
+		return nil, err
+	}
+	filenamePrefix, err := splitter.NamePrefix(o, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := preflight.CheckMetadataPaths(meta, c.String("format"), filenamePrefix); err != nil {
+		return nil, err
+	}
 
-	var rs []roots
-	var rcid cid.Cid
-	go func() {
-		defer wg.Done()
-		defer wout.Close()
+	splitOpts := splitter.Options{
+		DryRun:         dryRun,
+		CommPEvery:     c.Int("commp-every"),
+		CommPSample:    c.Float64("commp-sample"),
+		CommPSkipZeros: c.Bool("commp-skip-zeros"),
+		CommPWorkers:   c.Int("commp-workers"),
+		CarVersion:     c.Int("car-version"),
+		PadTo:          c.Uint64("pad-to"),
+		PadLast:        c.Bool("pad-last"),
 
-		rs = getRoots(rerr)
+		ContentDefinedBoundaries: c.Bool("content-defined-pieces"),
+	}
+	if splitOpts.NameTemplate, err = splitter.ParseNameTemplate(c.String("name-template")); err != nil {
+		return nil, err
+	}
+	renameToCommP := c.Bool("rename-to-commp")
+	if renameToCommP {
+		if err := splitter.ValidateRenameToCommP(dryRun, c.IsSet); err != nil {
+			return nil, err
+		}
+	}
+	if splitOpts.PieceRootMode, err = splitter.ParsePieceRootMode(c.String("piece-root-mode")); err != nil {
+		return nil, err
+	}
+	if splitOpts.CommPAlgorithm, err = splitter.ParseCommPAlgorithm(c.String("commp-algorithm")); err != nil {
+		return nil, err
+	}
+	sortPieces := c.Bool("sort-pieces-by-size")
+	if sortPieces {
+		if err := splitter.ValidateSectorSize(c.Uint64("sector-size")); err != nil {
+			return nil, err
+		}
+	}
+	if dir := c.String("commp-cache"); dir != "" {
+		if splitOpts.CommPCache, err = splitter.OpenCommPCache(dir); err != nil {
+			return nil, err
+		}
+	}
+	checkpointFile := strings.TrimSuffix(meta, filepath.Ext(meta)) + ".checkpoint.yaml"
+	interval := c.Duration("checkpoint-interval")
+	resume := c.Bool("resume")
+	if path := c.String("checkpoint"); path != "" {
+		checkpointFile = path
+		if interval == 0 {
+			interval = defaultCheckpointInterval
+		}
+		// a checkpoint left behind by a previous run is picked up where it left off
+		if _, err := os.Stat(path); err == nil {
+			resume = true
+		}
+	}
+	if interval > 0 {
+		splitOpts.CheckpointInterval = interval
+		splitOpts.OnCheckpoint = func(cp splitter.Checkpoint) error {
+			return splitter.WriteCheckpoint(checkpointFile, cp)
+		}
+	}
+	if resume {
+		if splitOpts.Resume, err = splitter.ReadCheckpoint(checkpointFile); err != nil {
+			return nil, err
+		}
+		logging.Info("resuming from checkpoint", "checkpoint", checkpointFile, "pieces", len(splitOpts.Resume.CarPieces))
+	}
+	if path := c.String("emit-retrieval-index"); path != "" {
+		if splitOpts.Resume != nil {
+			// the blocks of the pieces written before the checkpoint are not known anymore
+			return nil, fmt.Errorf("--emit-retrieval-index is not supported with --resume")
+		}
+		if splitOpts.RetrievalIndex, err = splitter.CreateRetrievalIndex(path); err != nil {
+			return nil, err
+		}
+	}
+	if cmdline := c.String("exec"); cmdline != "" {
+		hook, err := hooks.NewExecHook(cmdline, c.Bool("exec-continue-on-error"))
+		if err != nil {
+			return nil, err
+		}
+		splitOpts.OnPiece = hook.Run
+	}
+	var webhook *hooks.WebhookHook
+	if u := c.String("webhook"); u != "" {
+		// the root cid is only known once the dag is complete, it is posted with the summary
+		if webhook, err = hooks.NewWebhookHook(u, r.id, "", c.Int("webhook-retries"), c.Bool("webhook-continue-on-error")); err != nil {
+			return nil, err
+		}
+		splitOpts.OnPiece = hooks.Chain(splitOpts.OnPiece, webhook.Run)
+	}
+	var push *hooks.PushHook
+	if u := c.String("push"); u != "" {
+		if dryRun {
+			return nil, fmt.Errorf("--push is not supported with --dry-run")
+		}
+		if c.String("upload") != "" && !c.Bool("upload-keep-local") {
+			// the upload would remove piece files still being pushed
+			return nil, fmt.Errorf("--push needs --upload-keep-local with --upload")
+		}
+		if push, err = hooks.NewPushHook(u, c.String("push-token"), c.Int("push-concurrency"), c.Int("push-retries"), c.Bool("push-continue-on-error")); err != nil {
+			return nil, err
+		}
+		splitOpts.OnPiece = hooks.Chain(splitOpts.OnPiece, push.Run)
+	}
+	var upload *hooks.UploadHook
+	if u := c.String("upload"); u != "" {
+		if dryRun {
+			return nil, fmt.Errorf("--upload is not supported with --dry-run")
+		}
+		if upload, err = hooks.NewUploadHook(u, c.String("s3-endpoint-url"), c.Int("upload-concurrency"), c.Int("upload-retries"), c.Bool("upload-keep-local")); err != nil {
+			return nil, err
+		}
+		// last, so that the hooks before it still find the piece file
+		splitOpts.OnPiece = hooks.Chain(splitOpts.OnPiece, upload.Run)
+		splitOpts.UploadURL, _ = hooks.UploadURL(u)
+	}
+	var tracer *trace.Tracer
+	if c.String("trace") != "" {
+		tracer = trace.New()
+		splitOpts.Tracer = tracer
+	}
+	var prog *progress.Progress
+	if c.String("progress") != "" || c.String("metrics-addr") != "" {
+		// with --metrics-addr alone, the progress is only counted
+		if prog, err = progress.New(c.String("progress"), c.Duration("progress-interval")); err != nil {
+			return nil, err
+		}
+		prog.Start()
+		defer prog.Stop()
+	}
+	if addr := c.String("metrics-addr"); addr != "" {
+		srv, err := metrics.Serve(addr, prog)
+		if err != nil {
+			return nil, err
+		}
+		defer srv.Close()
+	}
 
-		tr := constructTree(files, rs)
-		nodes := getDirectoryNodes(tr)
+	noMetadata := c.Bool("no-metadata")
+	var dbSink *metadata.SqliteSink
+	if path := c.String("metadata-db"); path != "" {
+		if dbSink, err = metadata.NewSqliteSink(path, r.id); err != nil {
+			return nil, err
+		}
+	}
+	var sink metadata.MetadataSink
+	if !noMetadata && !carPerFile && docs.Table && c.String("format") == metadata.FormatNDJSON && push == nil && !renameToCommP {
+		// the rows are written as the pieces complete, so they are of use even if the run doesn't. Not with --push, the
+		// push status of a piece is only known later, nor with --rename-to-commp, which renames the pieces at the end.
+		if sink, err = newMetadataSink(meta, c.String("format"), docs, false, upload != nil, push != nil, c.Int("car-version") == 2, ts); err != nil {
+			return nil, err
+		}
+		splitOpts.OnPiece = metadata.StreamPieces(sink, splitOpts.OnPiece)
+	}
 
-		if len(nodes) == 1 || len(paths) > 1 { // len(nodes) = 1 means a file was passed as input
-			// use fake root directory if multiple args.
-			// If there are nested paths it will wrap all the intermediate directories up in the fake root
-			rcid = nodes[0].Cid()
-			writeNode(nodes, wout)
-		} else {
-			path := paths[0]
+	// uploaded pieces are removed as they complete, the output directory only holds the ones being uploaded
+	ignoreDiskSpace := c.Bool("ignore-disk-space") || (upload != nil && !c.Bool("upload-keep-local"))
+	res, err := dataprep.Prep(c.Context, dataprep.Options{
+		Paths:           paths,
+		Fds:             fds,
+		StdinName:       stdinName,
+		InputFormat:     c.String("input-format"),
+		GitRef:          c.String("git-ref"),
+		S3EndpointURL:   c.String("s3-endpoint-url"),
+		Include:         c.StringSlice("include"),
+		Exclude:         c.StringSlice("exclude"),
+		IgnoreFile:      c.String("ignore-file"),
+		Symlinks:        c.String("symlinks"),
+		OnlyFiles:       r.onlyFiles,
+		TargetSize:      preflight.Size(c, "size"),
+		Output:          o,
+		DryRun:          dryRun,
+		IgnoreDiskSpace: ignoreDiskSpace,
 
-			// Need to do this to handle nested paths, where the root cid should be the actual final directory
-			// for example, if the input is /opt/data/data_dir, the root cid should correspond to data_dir and not to /
-			splitPath := strings.Split(path, "/")
-			idx := len(splitPath)
-			rcid = nodes[idx].Cid()
+		MaxFileSize: c.Int64("max-file-size"),
+		LargeFiles:  c.String("large-files"),
+		SkipErrors:  c.Bool("skip-errors"),
+		ReadTimeout: c.Duration("read-timeout"),
 
-			writeNode(nodes[idx:], wout)
-		}
-	}()
+		RenameRoot:        c.String("rename-root"),
+		Flatten:           c.Bool("flatten"),
+		FlattenCollisions: c.String("flatten-collisions"),
+		MaxDagDepth:       c.Int("max-dag-depth"),
+		BlockOrder:        c.String("block-order"),
+		Dag:               opts.dag,
+		EmbedManifest:     c.Bool("embed-manifest"),
+		DirSharding:       c.Int("dir-sharding"),
+		GroupDirNodes:     c.Bool("group-dir-nodes"),
+		CarPerFile:        carPerFile,
+		StrictRoots:       c.Bool("strict-roots"),
+		FileManifest:      c.IsSet("file-manifest") || dbSink != nil,
 
-	o := c.String("output")
-	meta := c.String("metadata")
-	s := c.Int("size")
-	dryRun := c.Bool("dry-run")
+		Parallel:       c.Int("parallel"),
+		ParallelTmpDir: c.String("parallel-tmp-dir"),
+		PipeBuffer:     c.Int("pipe-buffer"),
 
-	var filenamePrefix string
-	if o != "" {
-		// Add a dash to separate prefix from filename
-		// note: we only do this when prefix specified, otherwise filename will begin with "-", which can cause problem with some fs operations as it is interpreted as a flag
-		filenamePrefix = fmt.Sprintf("%s-", o)
+		Split:    splitOpts,
+		Progress: prog,
+	})
+	// the last report goes before anything else is printed
+	prog.Stop()
+	if err != nil {
+		if upload != nil {
+			// the pieces completed so far are recorded as uploaded
+			upload.Wait()
+		}
+		if push != nil {
+			push.Wait()
+			if res != nil && res.Pieces != nil {
+				push.Record(res.Pieces.CarPieces)
+			}
+		}
+		if c.Context.Err() != nil && res != nil && !noMetadata {
+			// interrupted, keep the metadata of the pieces completed so far; with --checkpoint-interval, the checkpoint
+			// is kept as well for --resume
+			var merr error
+			if sink == nil {
+				sink, merr = newMetadataSink(meta, c.String("format"), docs, carPerFile, upload != nil, push != nil, c.Int("car-version") == 2, ts)
+			}
+			if merr == nil {
+				merr = metadata.Write(sink, metadata.Summary{CarPiecesMeta: res.Pieces, Tool: metadata.NewTool(c)})
+			}
+			if merr != nil {
+				return nil, fmt.Errorf("%s, and failed to write the metadata of the completed pieces: %s", err, merr)
+			}
+		}
+		return nil, err
 	}
-
-	go func() {
-		defer wg.Done()
-
-		var carPieceFilesMeta *carlet.CarPiecesAndMetadata
-		var err error
-		if dryRun {
-			carPieceFilesMeta, err = carlet.SplitAndCommpDryRun(rout, s, filenamePrefix)
-		} else {
-			carPieceFilesMeta, err = carlet.SplitAndCommp(rout, s, filenamePrefix)
+	carPieceFilesMeta := res.Pieces
+	if upload != nil {
+		if err := upload.Wait(); err != nil {
+			return nil, err
 		}
-		if err != nil {
-			panic(fmt.Errorf("split and commp failed : %s", err))
+	}
+	if push != nil {
+		if err := push.Wait(); err != nil {
+			return nil, err
 		}
+		push.Record(carPieceFilesMeta.CarPieces)
+	}
 
-		metaFile, err := os.Create(meta)
-		if err != nil {
-			panic(fmt.Errorf("failed to create metadata file: %s", err))
-		}
-		defer metaFile.Close()
-
-		csvWriter := csv.NewWriter(metaFile)
-		err = csvWriter.Write([]string{
-			"timestamp",
-			"car file",
-			"root_cid",
-			"piece cid",
-			"padded piece size",
-			"header size",
-			"content size",
-		})
+	if splitOpts.RetrievalIndex != nil {
+		if err := splitOpts.RetrievalIndex.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if renameToCommP {
+		renamed, err := splitter.RenameToCommP(carPieceFilesMeta.CarPieces)
 		if err != nil {
-			panic(fmt.Errorf("failed to write csv header: %s", err))
-		}
-		defer csvWriter.Flush()
-		for _, cf := range carPieceFilesMeta.CarPieces {
-			err = csvWriter.Write([]string{
-				time.Now().UTC().Format(time.RFC3339),
-				cf.Name,
-				rcid.String(),
-				cf.CommP.String(),
-				strconv.FormatUint(cf.PaddedSize, 10),
-				strconv.FormatUint(cf.HeaderSize, 10),
-				strconv.FormatUint(cf.ContentSize, 10),
-			})
-			if err != nil {
-				panic(fmt.Errorf("failed to write csv row: %s", err))
-			}
+			return nil, err
 		}
-		{
-			// save also as yaml, which will include the whole car pieces metadata (including the original car header)
-			yamlFilename := strings.TrimSuffix(meta, filepath.Ext(meta)) + ".yaml"
-			yamlFile, err := os.Create(yamlFilename)
-			if err != nil {
-				panic(fmt.Errorf("failed to create yaml metadata file: %s", err))
-			}
-			defer yamlFile.Close()
-
-			yamlWriter := yaml.NewEncoder(yamlFile)
-			var carFilesYaml struct {
-				RootCid       string                       `yaml:"root_cid"`
-				CarPiecesMeta *carlet.CarPiecesAndMetadata `yaml:"car_pieces_meta"`
-			}
-			carFilesYaml.RootCid = rcid.String()
-			carFilesYaml.CarPiecesMeta = carPieceFilesMeta
-			err = yamlWriter.Encode(carFilesYaml)
-			if err != nil {
-				panic(fmt.Errorf("failed to write yaml: %s", err))
+		metadata.RenamePieces(res.SpanningFiles, renamed)
+		metadata.RenamePieces(res.Files, renamed)
+	}
+	if sortPieces {
+		if carPieceFilesMeta.Packing, err = splitter.PackSectors(carPieceFilesMeta.CarPieces, c.Uint64("sector-size")); err != nil {
+			return nil, err
+		}
+	}
+	if !noMetadata {
+		if sink == nil {
+			if sink, err = newMetadataSink(meta, c.String("format"), docs, carPerFile, upload != nil, push != nil, c.Int("car-version") == 2, ts); err != nil {
+				return nil, &dataprep.StageError{Stage: dataprep.StageMetadataWrite, Err: err}
 			}
 		}
-	}()
+		if err := writeMetadata(sink, res.RootCid, carPieceFilesMeta, res.SpanningFiles, metadata.NewTool(c)); err != nil {
+			return nil, &dataprep.StageError{Stage: dataprep.StageMetadataWrite, Err: err}
+		}
+	}
+	if dbSink != nil {
+		if err := metadata.Write(dbSink, metadata.Summary{RootCid: res.RootCid.String(), CarPiecesMeta: carPieceFilesMeta, Files: res.Files, Tool: metadata.NewTool(c)}); err != nil {
+			return nil, &dataprep.StageError{Stage: dataprep.StageMetadataWrite, Err: err}
+		}
+	}
+	if err := updatePieceIndex(c, r.id, res.RootCid.String(), carPieceFilesMeta); err != nil {
+		return nil, err
+	}
+	if path := c.String("file-manifest"); path != "" {
+		if err := metadata.WriteFileManifest(path, res.Files); err != nil {
+			return nil, err
+		}
+	}
+	if interval > 0 || resume {
+		// the run completed and its metadata is written, the checkpoint is of no use anymore
+		os.Remove(checkpointFile)
+	}
+	if webhook != nil {
+		if err := webhook.Finish(res.RootCid.String(), len(carPieceFilesMeta.CarPieces)); err != nil {
+			return nil, err
+		}
+	}
+	if c.Bool("audit") {
+		// uploaded pieces are not on disk anymore, their sizes are checked like those of a dry run
+		if err := audit(carPieceFilesMeta, dryRun || (upload != nil && !c.Bool("upload-keep-local"))); err != nil {
+			return nil, err
+		}
+	}
+	if c.Bool("audit-total") {
+		if err := auditTotal(res.InputSize, res.Payload, carPieceFilesMeta.CarPieces); err != nil {
+			return nil, err
+		}
+	}
+	if err := tracer.WriteFile(c.String("trace")); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
 
-	wg.Wait()
+// deterministic returns the input paths in sorted order and the timestamps of the metadata for a --deterministic run,
+// fixed at --source-date-epoch if given and left out otherwise. Files are already walked in lexical order, sorting the
+// paths makes the order of the car stream, and with it the pieces, independent of the order the paths were given in.
+// Streams on --fd are still prepped in the order given.
+func deterministic(c *cli.Context, paths []string, ts metadata.Timestamps) ([]string, metadata.Timestamps, error) {
+	if c.Bool("skip-errors") {
+		// whether a file is skipped may depend on a --read-timeout, or on a source that is only sometimes unreadable
+		return nil, ts, fmt.Errorf("--skip-errors is not supported with --deterministic")
+	}
+	sorted := append([]string(nil), paths...)
+	sort.Strings(sorted)
+	return sorted, ts.Fixed(sourceDateEpoch(c)), nil
+}
 
-	fmt.Printf("root cid = %s\n", rcid)
+// sourceDateEpoch returns the time of --source-date-epoch, or nil if not set.
+func sourceDateEpoch(c *cli.Context) *time.Time {
+	if !c.IsSet("source-date-epoch") {
+		return nil
+	}
+	t := time.Unix(c.Int64("source-date-epoch"), 0)
+	return &t
+}
 
+// audit reports every violation of the piece size invariants, and fails if there are any.
+func audit(m *splitter.CarPiecesAndMetadata, dryRun bool) error {
+	violations := splitter.Audit(m.CarPieces, dryRun)
+	for _, v := range violations {
+		fmt.Printf("audit: %s\n", v)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("audit found %d violations of the piece size invariants", len(violations))
+	}
 	return nil
 }
 
-func writeNode(nodes []*merkledag.ProtoNode, wout *io.PipeWriter) {
-	var c, sizeVi []byte
-	for _, nd := range nodes {
-		c = []byte(nd.Cid().KeyString())
-		d := nd.RawData()
+// auditTotal checks the byte accounting of the whole run: the file data in the dag must add up to the bytes of the
+// input files, which catches dropped files and truncated reads, and the blocks in the pieces must hold at least all of
+// that file data.
+func auditTotal(input, payload uint64, pieces []splitter.CarFile) error {
+	content := splitter.ContentSize(pieces)
+	var violations []string
+	if payload != input {
+		violations = append(violations, fmt.Sprintf("the dag holds %d bytes of file data, but the input files are %d bytes", payload, input))
+	}
+	if content < payload {
+		violations = append(violations, fmt.Sprintf("the pieces hold %d bytes of blocks, less than the %d bytes of file data", content, payload))
+	}
+	for _, v := range violations {
+		fmt.Printf("audit-total: %s\n", v)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("audit found %d discrepancies between the input and the pieces", len(violations))
+	}
+	return nil
+}
 
-		sizeVi = appendVarint(sizeVi[:0], uint64(len(c))+uint64(len(d)))
+// updatePieceIndex adds the pieces of the run to the --piece-index, if set.
+func updatePieceIndex(c *cli.Context, run string, rootCid string, m *splitter.CarPiecesAndMetadata) error {
+	path := c.String("piece-index")
+	if path == "" {
+		return nil
+	}
+	return metadata.UpdatePieceIndex(path, c.Bool("merge-piece-index"), run, rootCid, m)
+}
 
-		if _, err := wout.Write(sizeVi); err == nil {
-			if _, err := wout.Write(c); err == nil {
-				if _, err := wout.Write(d); err != nil {
-					fmt.Printf("failed to write car: %s\n", err)
-				}
+// dagOptions returns the options of the dags of the files, set either by an ipfs add command or by the other dag
+// flags.
+func dagOptions(c *cli.Context) (dataprep.DagOptions, error) {
+	if cmd := c.String("ipfs-add-compatible-command"); cmd != "" {
+		for _, flag := range []string{"chunker", "layout", "max-links", "cid-version", "hash", "raw-leaves"} {
+			if c.IsSet(flag) {
+				return dataprep.DagOptions{}, fmt.Errorf("--%s can't be combined with --ipfs-add-compatible-command, pass it as an option of ipfs add", flag)
 			}
 		}
+		return dataprep.DagOptions{IpfsAddCommand: cmd}, nil
+	}
+	cidVersion := c.Int("cid-version")
+	if cidVersion != 0 && cidVersion != 1 {
+		return dataprep.DagOptions{}, fmt.Errorf("--cid-version must be 0 or 1, got %d", cidVersion)
+	}
+	rawLeaves := cidVersion == 1
+	if c.IsSet("raw-leaves") {
+		rawLeaves = c.Bool("raw-leaves")
 	}
+	return dataprep.DagOptions{
+		Chunker:     c.String("chunker"),
+		Layout:      c.String("layout"),
+		MaxLinks:    c.Int("max-links"),
+		CidV0:       cidVersion == 0,
+		Hash:        c.String("hash"),
+		NoRawLeaves: !rawLeaves,
+	}, nil
 }
 
-func getRoots(rerr *io.PipeReader) []roots {
-	var rs []roots
-	bs, _ := io.ReadAll(rerr)
-	e := string(bs)
-	els := strings.Split(e, "\n")
-	for _, el := range els {
-		if el == "" {
-			continue
-		}
-		var r roots
-		err := json.Unmarshal([]byte(el), &r)
-		if err != nil {
-			fmt.Printf("failed to unmarshal json: %s\n", el)
-		}
-		rs = append(rs, r)
+// runID returns the name of the run, which defaults to the metadata file name.
+func runID(c *cli.Context) string {
+	if run := c.String("run-id"); run != "" {
+		return run
+	}
+	return c.String("metadata")
+}
+
+// newMetadataSink returns the sink for the piece table (csv, or parquet or ndjson next to the metadata path), and next
+// to it the yaml file with the full car pieces metadata. With one car per file, the csv gets additional columns for the
+// file each piece belongs to and its root cid, with uploaded pieces one for their url, with pushed pieces one for their
+// push status, and with CARv2 pieces one for the size of their index.
+func newMetadataSink(meta string, tableFormat string, docs metadata.Documents, perFile bool, uploaded bool, pushed bool, carV2 bool, ts metadata.Timestamps) (metadata.MetadataSink, error) {
+	return metadata.NewDocumentsSink(meta, tableFormat, docs, tableColumns(perFile, uploaded, pushed, carV2), ts)
+}
+
+// tableColumns returns the columns of the piece table, see newMetadataSink.
+func tableColumns(perFile bool, uploaded bool, pushed bool, carV2 bool) []string {
+	columns := []string{
+		metadata.ColumnTimestamp,
+		metadata.ColumnCarFile,
+		metadata.ColumnRootCid,
+		metadata.ColumnPieceCid,
+		metadata.ColumnPaddedSize,
+		metadata.ColumnHeaderSize,
+		metadata.ColumnContentSize,
 	}
-	return rs
+	if perFile {
+		columns = append(columns, metadata.ColumnFile, metadata.ColumnFileRootCid)
+	}
+	if uploaded {
+		columns = append(columns, metadata.ColumnURL)
+	}
+	if pushed {
+		columns = append(columns, metadata.ColumnPushStatus)
+	}
+	if carV2 {
+		columns = append(columns, metadata.ColumnIndexSize)
+	}
+	return columns
+}
+
+// writeMetadata writes the metadata of a run to the sink. The yaml also records the pieces holding the files spread
+// over several of them, and the tool version and options.
+func writeMetadata(sink metadata.MetadataSink, rcid cid.Cid, carPieceFilesMeta *splitter.CarPiecesAndMetadata, spanning []metadata.FilePieces, tool metadata.Tool) error {
+	return metadata.Write(sink, metadata.Summary{RootCid: rcid.String(), CarPiecesMeta: carPieceFilesMeta, SpanningFiles: spanning, Tool: tool})
 }
@@ -0,0 +1,232 @@
+package fil_data_prep
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/dataprep"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// flags writing a file of their own, which every batch would overwrite
+var unbatchedFlags = []string{"checkpoint", "checkpoint-interval", "resume", "emit-retrieval-index", "file-manifest", "trace", "metadata-db"}
+
+// watchState is what --watch keeps track of across restarts: the files prepped so far, and the number of batches.
+type watchState struct {
+	Batches int                  `yaml:"batches"`
+	Files   map[string]watchFile `yaml:"files"`
+}
+
+type watchFile struct {
+	Size    int64     `yaml:"size"`
+	ModTime time.Time `yaml:"mod_time"`
+	Batch   int       `yaml:"batch"`
+}
+
+// watch keeps preparing the files arriving in the input paths, until interrupted. Every interval, the files that are
+// new since the previous batch, and haven't changed since the previous look (so that files still being written are
+// left for later), are prepped as a batch of their own, with its own root. A batch is a run with the options of the
+// command line, with its metadata in files suffixed with the batch number, and its pieces are added to the csv of
+// --metadata. The prepped files are recorded in a state file next to it, so that a restarted watch carries on with the
+// files that arrived in the meantime.
+func watch(c *cli.Context, opts runOptions) error {
+	interval := c.Duration("watch-interval")
+	if interval <= 0 {
+		return fmt.Errorf("--watch-interval must be positive, got %s", interval)
+	}
+	if err := validateWatch(c, opts.docs); err != nil {
+		return err
+	}
+	ts, err := metadata.NewTimestamps(c.String("timestamp-format"), c.String("timezone"))
+	if err != nil {
+		return err
+	}
+
+	meta := c.String("metadata")
+	metaBase := strings.TrimSuffix(meta, filepath.Ext(meta))
+	statePath := metaBase + ".watch.yaml"
+	state, err := readWatchState(statePath)
+	if err != nil {
+		return err
+	}
+	columns := tableColumns(c.Bool("car-per-file"), c.IsSet("upload"), c.IsSet("push"), c.Int("car-version") == 2)
+
+	listOpts := dataprep.Options{
+		Paths:      c.Args().Slice(),
+		Include:    c.StringSlice("include"),
+		Exclude:    c.StringSlice("exclude"),
+		IgnoreFile: c.String("ignore-file"),
+		Symlinks:   c.String("symlinks"),
+	}
+	// the new files as seen by the previous look, a file is only prepped once it looks the same twice
+	pending := make(map[string]dataprep.InputFile)
+	fmt.Printf("watching %s for new files every %s, %d files prepped so far\n", strings.Join(listOpts.Paths, ", "), interval, len(state.Files))
+	for {
+		files, err := dataprep.ListFiles(listOpts)
+		if err != nil {
+			return err
+		}
+		var batch []string
+		seen := make(map[string]dataprep.InputFile)
+		for _, f := range files {
+			if prepped, ok := state.Files[f.Path]; ok {
+				if prepped.Size != f.Size || !prepped.ModTime.Equal(f.ModTime) {
+					// the dag of the batch can't change anymore
+					logging.Warn("file changed after it was prepped, ignoring the change", "path", f.Path, "batch", prepped.Batch)
+				}
+				continue
+			}
+			seen[f.Path] = f
+			if p, ok := pending[f.Path]; ok && p.Size == f.Size && p.ModTime.Equal(f.ModTime) {
+				batch = append(batch, f.Path)
+			}
+		}
+		pending = seen
+
+		if len(batch) > 0 {
+			n := state.Batches + 1
+			res, err := prepRun(c, opts, batchRun(c, n, batch))
+			if err != nil {
+				return fmt.Errorf("batch %d failed: %s", n, err)
+			}
+			if err := appendBatchPieces(meta, columns, ts, res.RootCid.String(), res.Pieces); err != nil {
+				return err
+			}
+			state.Batches = n
+			for _, path := range batch {
+				f := pending[path]
+				state.Files[path] = watchFile{Size: f.Size, ModTime: f.ModTime, Batch: n}
+				delete(pending, path)
+			}
+			if err := writeWatchState(statePath, state); err != nil {
+				return err
+			}
+			fmt.Printf("batch %d: %d files, root cid = %s, %d pieces\n", n, len(batch), res.RootCid, len(res.Pieces.CarPieces))
+		}
+
+		select {
+		case <-c.Context.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// validateWatch checks that the options of the run make sense for batches of new files.
+func validateWatch(c *cli.Context, docs metadata.Documents) error {
+	if !c.Args().Present() {
+		return fmt.Errorf("--watch needs input directories to watch")
+	}
+	if len(c.StringSlice("fd")) > 0 || c.Bool("stdin") || c.Bool("dataset-per-path") {
+		return fmt.Errorf("--fd, --stdin and --dataset-per-path are not supported with --watch")
+	}
+	if c.String("input-format") != "files" || c.String("git-ref") != "" {
+		return fmt.Errorf("--input-format and --git-ref are not supported with --watch")
+	}
+	if c.String("symlinks") == dataprep.SymlinksPreserve {
+		return fmt.Errorf("--symlinks %s is not supported with --watch", dataprep.SymlinksPreserve)
+	}
+	for _, path := range c.Args().Slice() {
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			return fmt.Errorf("--watch needs directories to watch, %s is not one", path)
+		}
+	}
+	if c.Bool("no-metadata") || c.String("format") != metadata.FormatCSV {
+		// the pieces of every batch are added to the csv
+		return fmt.Errorf("--watch needs the metadata in the csv format")
+	}
+	if !docs.Table {
+		return fmt.Errorf("--watch needs the csv metadata document")
+	}
+	if c.Int("commp-every") > 1 || (c.Float64("commp-sample") > 0 && c.Float64("commp-sample") < 1) {
+		// pieces without commP are named by their index, which is not unique across batches
+		return fmt.Errorf("--commp-every and --commp-sample are not supported with --watch")
+	}
+	for _, name := range unbatchedFlags {
+		if c.IsSet(name) {
+			return fmt.Errorf("--%s is not supported with --watch", name)
+		}
+	}
+	return nil
+}
+
+// batchRun returns the run of batch n, prepping files: its metadata is suffixed with the batch number, and so is the
+// run id, if set.
+func batchRun(c *cli.Context, n int, files []string) run {
+	meta := c.String("metadata")
+	ext := filepath.Ext(meta)
+	r := run{
+		// only the paths holding files of the batch, the others would be empty directories in its dag
+		paths:     batchPaths(c.Args().Slice(), files),
+		onlyFiles: files,
+		metadata:  fmt.Sprintf("%s-%d%s", strings.TrimSuffix(meta, ext), n, ext),
+	}
+	r.id = r.metadata
+	if id := c.String("run-id"); id != "" {
+		r.id = fmt.Sprintf("%s-%d", id, n)
+	}
+	return r
+}
+
+// batchPaths returns the input paths holding any of files, in order.
+func batchPaths(paths []string, files []string) []string {
+	var holding []string
+	for _, path := range paths {
+		for _, f := range files {
+			if rel, err := filepath.Rel(path, f); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				holding = append(holding, path)
+				break
+			}
+		}
+	}
+	return holding
+}
+
+// appendBatchPieces adds the pieces of a batch to the csv at meta, with the root cid of the batch.
+func appendBatchPieces(meta string, columns []string, ts metadata.Timestamps, rootCid string, pieces *splitter.CarPiecesAndMetadata) error {
+	sink, err := metadata.NewAppendCsvSink(meta, columns, ts)
+	if err != nil {
+		return err
+	}
+	return metadata.Write(sink, metadata.Summary{RootCid: rootCid, CarPiecesMeta: pieces})
+}
+
+func readWatchState(path string) (*watchState, error) {
+	state := &watchState{}
+	bs, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read watch state: %s", err)
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(bs, state); err != nil {
+			return nil, fmt.Errorf("failed to parse watch state %s: %s", path, err)
+		}
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]watchFile)
+	}
+	return state, nil
+}
+
+// writeWatchState writes the state to a temporary file first, so that a crash doesn't leave a truncated one behind.
+func writeWatchState(path string, state *watchState) error {
+	bs, err := yaml.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode watch state: %s", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0644); err != nil {
+		return fmt.Errorf("failed to write watch state: %s", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write watch state: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package hooks
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+)
+
+// ExecHook runs an external command for every completed piece. The command line is split into arguments like a shell
+// does, honouring single and double quotes and backslash escapes, and the placeholders {file}, {commp}, {padded_size},
+// {header_size} and {content_size} are substituted in each argument. The command is not run through a shell, so a
+// substituted file name is always a single argument.
+type ExecHook struct {
+	args            []string
+	continueOnError bool
+}
+
+func NewExecHook(cmdline string, continueOnError bool) (*ExecHook, error) {
+	args, err := splitArgs(cmdline)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty exec command")
+	}
+	return &ExecHook{args: args, continueOnError: continueOnError}, nil
+}
+
+// splitArgs splits a command line into arguments on unquoted whitespace, like a shell would. Single quotes keep
+// everything up to the next single quote, double quotes everything up to the next unescaped double quote. A backslash
+// escapes the next character outside of quotes, and a double quote or backslash inside double quotes.
+func splitArgs(cmdline string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	rs := []rune(cmdline)
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		switch {
+		case r == '\\' && quote != '\'':
+			if i+1 == len(rs) {
+				return nil, fmt.Errorf("exec command %q ends with a backslash", cmdline)
+			}
+			if quote == '"' && rs[i+1] != '"' && rs[i+1] != '\\' {
+				arg.WriteRune(r)
+				continue
+			}
+			i++
+			arg.WriteRune(rs[i])
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in exec command %q", quote, cmdline)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// Run runs the command for the given piece. A non-zero exit code is reported as an error unless the hook was
+// configured to continue on errors, in which case it is only printed.
+func (h *ExecHook) Run(cf splitter.CarFile) error {
+	r := strings.NewReplacer(
+		"{file}", cf.Name,
+		"{commp}", cf.CommP.String(),
+		"{padded_size}", strconv.FormatUint(cf.PaddedSize, 10),
+		"{header_size}", strconv.FormatUint(cf.HeaderSize, 10),
+		"{content_size}", strconv.FormatUint(cf.ContentSize, 10),
+	)
+
+	args := make([]string, len(h.args))
+	for i, a := range h.args {
+		args[i] = r.Replace(a)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		err = fmt.Errorf("exec for piece %s failed: %s", cf.Name, err)
+		if h.continueOnError {
+			logging.Error("exec hook failed, continuing", "err", err)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package hooks
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+)
+
+func TestSplitArgs(t *testing.T) {
+	cases := []struct {
+		name    string
+		cmdline string
+		want    []string
+		wantErr string
+	}{
+		{name: "plain", cmdline: "upload {file} {commp}", want: []string{"upload", "{file}", "{commp}"}},
+		{name: "extra whitespace", cmdline: "  upload\t{file}  \n", want: []string{"upload", "{file}"}},
+		{name: "double quotes", cmdline: `cp "a b" dest`, want: []string{"cp", "a b", "dest"}},
+		{name: "single quotes", cmdline: `echo 'a "b" \c'`, want: []string{"echo", `a "b" \c`}},
+		{name: "escapes in double quotes", cmdline: `echo "a \"b\" \\ \c"`, want: []string{"echo", `a "b" \ \c`}},
+		{name: "escaped space", cmdline: `cp a\ b dest`, want: []string{"cp", "a b", "dest"}},
+		{name: "quotes within an argument", cmdline: `--out="x y"/{file}`, want: []string{"--out=x y/{file}"}},
+		{name: "empty quoted argument", cmdline: `cmd "" x`, want: []string{"cmd", "", "x"}},
+		{name: "unterminated quote", cmdline: `cp "a b dest`, wantErr: "unterminated"},
+		{name: "trailing backslash", cmdline: `cp a \`, wantErr: "ends with a backslash"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := splitArgs(tc.cmdline)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestExecHookQuotedArgument runs a command with a quoted argument holding a space, and a piece file name holding one
+// too, and checks that each reached the command as a single argument.
+func TestExecHookQuotedArgument(t *testing.T) {
+	dir := t.TempDir()
+	piece := filepath.Join(dir, "piece 0.car")
+	if err := os.WriteFile(piece, []byte("piece"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "a b")
+
+	hook, err := NewExecHook(`cp {file} "`+dest+`"`, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hook.Run(splitter.CarFile{Name: piece}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "piece" {
+		t.Fatalf("got %q in %s, want the piece", got, dest)
+	}
+}
@@ -0,0 +1,179 @@
+package hooks
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+)
+
+// Push statuses recorded for every piece.
+const (
+	PushStatusPushed = "pushed"
+	PushStatusFailed = "failed"
+)
+
+// PushHook pushes every completed piece to the http endpoint of a storage provider (e.g. a boost http server taking
+// piece data), with a PUT of the piece file. Pushes run in the background, up to a number at a time, while the next
+// pieces are written. Failed pushes are retried with an increasing delay, and the outcome for every piece is kept to
+// be recorded in the metadata. The piece files are kept.
+type PushHook struct {
+	target          string
+	token           string
+	retries         int
+	continueOnError bool
+	client          http.Client
+	sem             chan struct{}
+	wg              sync.WaitGroup
+
+	mu     sync.Mutex
+	status map[string]string
+	err    error
+}
+
+// NewPushHook returns a hook pushing to rawURL, with up to concurrency pushes at the same time. The placeholders
+// {file} (the base name of the piece file) and {commp} are substituted in rawURL, without any the base name of the
+// piece file is appended. token, if set, is sent as a bearer token.
+func NewPushHook(rawURL, token string, concurrency, retries int, continueOnError bool) (*PushHook, error) {
+	u, err := url.Parse(strings.NewReplacer("{file}", "file", "{commp}", "commp").Replace(rawURL))
+	if err != nil {
+		return nil, fmt.Errorf("invalid push url: %s", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid push url %q, expected an http or https url", rawURL)
+	}
+	if concurrency < 1 {
+		return nil, fmt.Errorf("push concurrency must be at least 1")
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("push retries must not be negative")
+	}
+	return &PushHook{
+		target:          rawURL,
+		token:           token,
+		retries:         retries,
+		continueOnError: continueOnError,
+		sem:             make(chan struct{}, concurrency),
+		status:          make(map[string]string),
+	}, nil
+}
+
+// URL returns the url a piece is pushed to.
+func (h *PushHook) URL(cf splitter.CarFile) string {
+	base := filepath.Base(cf.Name)
+	if !strings.Contains(h.target, "{file}") && !strings.Contains(h.target, "{commp}") {
+		return strings.TrimSuffix(h.target, "/") + "/" + url.PathEscape(base)
+	}
+	return strings.NewReplacer("{file}", url.PathEscape(base), "{commp}", cf.CommP.String()).Replace(h.target)
+}
+
+// Run starts pushing the given piece, waiting for a free push slot first. It returns the error of an earlier push
+// that failed, so that the run stops at the first failed push unless it continues on errors.
+func (h *PushHook) Run(cf splitter.CarFile) error {
+	if err := h.Err(); err != nil {
+		return err
+	}
+	h.sem <- struct{}{}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer func() { <-h.sem }()
+		err := h.push(cf)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if err == nil {
+			h.status[cf.Name] = PushStatusPushed
+			return
+		}
+		h.status[cf.Name] = PushStatusFailed
+		if h.continueOnError {
+			logging.Error("push failed, continuing", "err", err)
+		} else if h.err == nil {
+			h.err = err
+		}
+	}()
+	return nil
+}
+
+// Err returns the error of the first failed push, if any.
+func (h *PushHook) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// Wait waits for the pushes in progress to complete, and returns the error of the first failed push, if any.
+func (h *PushHook) Wait() error {
+	h.wg.Wait()
+	return h.Err()
+}
+
+// Record sets the push status of the given pieces, once the pushes are complete. Pieces that were not pushed (yet)
+// are left without one.
+func (h *PushHook) Record(pieces []splitter.CarFile) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range pieces {
+		pieces[i].PushStatus = h.status[pieces[i].Name]
+	}
+}
+
+// push sends a piece file to its url, retrying on errors and non-2xx responses.
+func (h *PushHook) push(cf splitter.CarFile) error {
+	dest := h.URL(cf)
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := h.send(cf.Name, dest)
+		if err == nil {
+			return nil
+		}
+		if attempt >= h.retries {
+			return fmt.Errorf("push of piece %s to %s failed after %d attempts: %s", cf.Name, dest, h.retries+1, err)
+		}
+		logging.Warn("push failed, retrying", "piece", cf.Name, "delay", delay, "err", err)
+		time.Sleep(delay)
+		if delay < time.Minute {
+			delay *= 2
+		}
+	}
+}
+
+func (h *PushHook) send(name, dest string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, dest, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/vnd.ipld.car")
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drained, so that the connection is reused for the next push
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("provider returned %s", resp.Status)
+	}
+	return nil
+}
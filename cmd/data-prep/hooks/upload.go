@@ -0,0 +1,161 @@
+package hooks
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+)
+
+// UploadHook uploads every completed piece to object storage, an s3://bucket/prefix or gs://bucket/prefix url (gcs://
+// is taken for gs://), with the aws or gcloud command line tool, which pick up credentials the usual way. Uploads run
+// in the background, up to a number at a time, while the next pieces are written. Once uploaded, the local piece file
+// is removed unless it is to be kept, so only the pieces being uploaded take up local disk. Failed uploads are retried
+// with an increasing delay.
+type UploadHook struct {
+	url         string
+	endpointURL string
+	retries     int
+	keepLocal   bool
+	sem         chan struct{}
+	wg          sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewUploadHook returns a hook uploading to rawURL, with up to concurrency uploads at the same time. endpointURL, if
+// set, is the endpoint of an S3 compatible object store to upload s3:// urls to.
+func NewUploadHook(rawURL, endpointURL string, concurrency, retries int, keepLocal bool) (*UploadHook, error) {
+	u, err := UploadURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if concurrency < 1 {
+		return nil, fmt.Errorf("upload concurrency must be at least 1")
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("upload retries must not be negative")
+	}
+	tool := "aws"
+	if strings.HasPrefix(u, "gs://") {
+		tool = "gcloud"
+	}
+	if _, err := exec.LookPath(tool); err != nil {
+		return nil, fmt.Errorf("uploading to %s needs the %s command line tool: %s", u, tool, err)
+	}
+	return &UploadHook{
+		url:         u,
+		endpointURL: endpointURL,
+		retries:     retries,
+		keepLocal:   keepLocal,
+		sem:         make(chan struct{}, concurrency),
+	}, nil
+}
+
+// UploadURL checks an upload url, and returns it in the form recorded in the metadata: with gs:// for gcs://, and
+// without a trailing slash.
+func UploadURL(rawURL string) (string, error) {
+	u := strings.TrimSuffix(rawURL, "/")
+	if rest, ok := strings.CutPrefix(u, "gcs://"); ok {
+		u = "gs://" + rest
+	}
+	scheme, rest, _ := strings.Cut(u, "://")
+	if bucket, _, _ := strings.Cut(rest, "/"); (scheme != "s3" && scheme != "gs") || bucket == "" {
+		return "", fmt.Errorf("invalid upload url %q, expected s3://bucket/prefix or gs://bucket/prefix", rawURL)
+	}
+	return u, nil
+}
+
+// URL returns the url of the remote copy of a piece.
+func (h *UploadHook) URL(name string) string {
+	return h.url + "/" + filepath.Base(name)
+}
+
+// Run starts uploading the given piece, waiting for a free upload slot first. It returns the error of an earlier
+// upload that failed, so that the run stops at the first failed upload.
+func (h *UploadHook) Run(cf splitter.CarFile) error {
+	if err := h.Err(); err != nil {
+		return err
+	}
+	h.sem <- struct{}{}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer func() { <-h.sem }()
+		if err := h.upload(cf.Name); err != nil {
+			h.mu.Lock()
+			if h.err == nil {
+				h.err = err
+			}
+			h.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// Err returns the error of the first failed upload, if any.
+func (h *UploadHook) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// Wait waits for the uploads in progress to complete, and returns the error of the first failed upload, if any.
+func (h *UploadHook) Wait() error {
+	h.wg.Wait()
+	return h.Err()
+}
+
+// upload copies a piece file to its url, retrying on errors, and removes it once uploaded.
+func (h *UploadHook) upload(name string) error {
+	dest := h.URL(name)
+	delay := time.Second
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = h.copy(name, dest)
+		if err == nil {
+			break
+		}
+		if attempt >= h.retries {
+			return fmt.Errorf("upload of piece %s to %s failed after %d attempts: %s", name, dest, h.retries+1, err)
+		}
+		logging.Warn("upload failed, retrying", "piece", name, "delay", delay, "err", err)
+		time.Sleep(delay)
+		if delay < time.Minute {
+			delay *= 2
+		}
+	}
+	if !h.keepLocal {
+		if err := os.Remove(name); err != nil {
+			return fmt.Errorf("failed to remove uploaded piece %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func (h *UploadHook) copy(name, dest string) error {
+	var cmd *exec.Cmd
+	if strings.HasPrefix(dest, "gs://") {
+		cmd = exec.Command("gcloud", "storage", "cp", "--no-user-output-enabled", name, dest)
+	} else {
+		args := []string{"s3", "cp", "--only-show-errors", name, dest}
+		if h.endpointURL != "" {
+			args = append([]string{"--endpoint-url", h.endpointURL}, args...)
+		}
+		cmd = exec.Command("aws", args...)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package hooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+)
+
+// WebhookHook posts the metadata of every completed piece to a url, and a summary once the run is done. Every post
+// is a single line of ndjson, with a "type" of "piece" or "summary", the run id and, once known, the root cid. Failed
+// posts are retried with an increasing delay.
+type WebhookHook struct {
+	url             string
+	runID           string
+	rootCid         string
+	retries         int
+	continueOnError bool
+	client          http.Client
+}
+
+type webhookPiece struct {
+	Type    string `json:"type"`
+	RunID   string `json:"runId"`
+	RootCid string `json:"rootCid,omitempty"`
+	splitter.CarFile
+}
+
+type webhookSummary struct {
+	Type    string `json:"type"`
+	RunID   string `json:"runId"`
+	RootCid string `json:"rootCid,omitempty"`
+	Pieces  int    `json:"pieces"`
+}
+
+// NewWebhookHook returns a hook posting to rawURL. The root cid is included in the piece posts if it is known before
+// the run, pass an empty string otherwise.
+func NewWebhookHook(rawURL, runID, rootCid string, retries int, continueOnError bool) (*WebhookHook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook url: %s", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webhook url %q, expected an http or https url", rawURL)
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("webhook retries must not be negative")
+	}
+	return &WebhookHook{
+		url:             rawURL,
+		runID:           runID,
+		rootCid:         rootCid,
+		retries:         retries,
+		continueOnError: continueOnError,
+		client:          http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Run posts the metadata of the given piece.
+func (h *WebhookHook) Run(cf splitter.CarFile) error {
+	return h.post(fmt.Sprintf("piece %s", cf.Name), webhookPiece{Type: "piece", RunID: h.runID, RootCid: h.rootCid, CarFile: cf})
+}
+
+// Finish posts the summary of a completed run.
+func (h *WebhookHook) Finish(rootCid string, pieces int) error {
+	return h.post("summary", webhookSummary{Type: "summary", RunID: h.runID, RootCid: rootCid, Pieces: pieces})
+}
+
+// post sends a record, retrying on errors and non-2xx responses. A failure after all retries is reported as an error
+// unless the hook was configured to continue on errors, in which case it is only printed.
+func (h *WebhookHook) post(what string, record interface{}) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err = h.send(body)
+		if err == nil {
+			return nil
+		}
+		if attempt >= h.retries {
+			break
+		}
+		logging.Warn("webhook failed, retrying", "for", what, "delay", delay, "err", err)
+		time.Sleep(delay)
+		if delay < time.Minute {
+			delay *= 2
+		}
+	}
+
+	err = fmt.Errorf("webhook for %s failed after %d attempts: %s", what, h.retries+1, err)
+	if h.continueOnError {
+		logging.Error("webhook failed, continuing", "err", err)
+		return nil
+	}
+	return err
+}
+
+func (h *WebhookHook) send(body []byte) error {
+	resp, err := h.client.Post(h.url, "application/x-ndjson", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drained, so that the connection is reused for the next post
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Chain returns a piece callback running all the given ones in order, skipping nil ones, and stopping at the first
+// error.
+func Chain(fns ...func(splitter.CarFile) error) func(splitter.CarFile) error {
+	var chained []func(splitter.CarFile) error
+	for _, fn := range fns {
+		if fn != nil {
+			chained = append(chained, fn)
+		}
+	}
+	if len(chained) == 0 {
+		return nil
+	}
+	return func(cf splitter.CarFile) error {
+		for _, fn := range chained {
+			if err := fn(cf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,114 @@
+package list_pieces
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/urfave/cli/v2"
+)
+
+var Cmd = &cli.Command{
+	Name:      "list-pieces",
+	Usage:     "Print the pieces recorded in a metadata file as a table",
+	Aliases:   []string{"lp"},
+	ArgsUsage: "<metadata.csv|metadata.yaml>",
+	Action:    listPiecesAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "sort",
+			Required: false,
+			Usage:    "optional sort order, one of: name, padded-size, content-size, padding. Sizes and padding sort descending.",
+		},
+		&cli.Float64Flag{
+			Name:     "min-padding",
+			Required: false,
+			Usage:    "only list pieces whose padding ratio (fraction of the padded piece size that is padding) is at least this value, e.g. 0.5",
+		},
+		&cli.BoolFlag{
+			Name:     "json",
+			Required: false,
+			Usage:    "print pieces as json instead of a table.",
+			Value:    false,
+		},
+	},
+}
+
+type pieceRow struct {
+	Name         string  `json:"name"`
+	PieceCid     string  `json:"pieceCid"`
+	PaddedSize   uint64  `json:"paddedSize"`
+	HeaderSize   uint64  `json:"headerSize"`
+	ContentSize  uint64  `json:"contentSize"`
+	PaddingRatio float64 `json:"paddingRatio"`
+}
+
+func listPiecesAction(c *cli.Context) error {
+	if !c.Args().Present() {
+		return fmt.Errorf("expected a metadata file, found none")
+	}
+
+	m, err := metadata.Read(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	minPadding := c.Float64("min-padding")
+	var rows []pieceRow
+	for _, cf := range m.CarPiecesMeta.CarPieces {
+		r := pieceRow{
+			Name:        cf.Name,
+			PieceCid:    cf.CommP.String(),
+			PaddedSize:  cf.PaddedSize,
+			HeaderSize:  cf.HeaderSize,
+			ContentSize: cf.ContentSize,
+		}
+		if cf.PaddedSize > 0 {
+			r.PaddingRatio = 1 - float64(cf.HeaderSize+cf.ContentSize+cf.IndexSize)/float64(cf.PaddedSize)
+		}
+		if r.PaddingRatio < minPadding {
+			continue
+		}
+		rows = append(rows, r)
+	}
+
+	if err := sortRows(rows, c.String("sort")); err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "piece cid\tpadded size\theader size\tcontent size\tpadding\tcar file\t")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.2f%%\t%s\t\n", r.PieceCid, r.PaddedSize, r.HeaderSize, r.ContentSize, r.PaddingRatio*100, r.Name)
+	}
+	return tw.Flush()
+}
+
+func sortRows(rows []pieceRow, by string) error {
+	var less func(a, b pieceRow) bool
+	switch by {
+	case "":
+		return nil
+	case "name":
+		less = func(a, b pieceRow) bool { return a.Name < b.Name }
+	case "padded-size":
+		less = func(a, b pieceRow) bool { return a.PaddedSize > b.PaddedSize }
+	case "content-size":
+		less = func(a, b pieceRow) bool { return a.ContentSize > b.ContentSize }
+	case "padding":
+		less = func(a, b pieceRow) bool { return a.PaddingRatio > b.PaddingRatio }
+	default:
+		return fmt.Errorf("unknown sort order %q, expected one of: name, padded-size, content-size, padding", by)
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return less(rows[i], rows[j]) })
+	return nil
+}
@@ -0,0 +1,144 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Log formats, see Configure.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseLevel parses a level by its name: debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelError; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of: debug, info, warn, error", s)
+}
+
+// logger writes the log entries of the process to stderr. The diagnostics of a run (warnings, skipped files, retries,
+// failures in background goroutines) go through it, separate from the results printed on stdout, and every entry is
+// written as a whole, so that entries logged concurrently don't interleave.
+var logger = struct {
+	mu     sync.Mutex
+	w      io.Writer
+	level  Level
+	format string
+}{w: os.Stderr, level: LevelInfo, format: FormatText}
+
+// Configure sets the minimum level of the entries logged and their format: FormatText writes a line of the time, level
+// and message followed by key=value pairs, FormatJSON a json object per line, for log aggregation.
+func Configure(level, format string) error {
+	l := LevelInfo
+	if level != "" {
+		var err error
+		if l, err = ParseLevel(level); err != nil {
+			return err
+		}
+	}
+	switch format {
+	case "":
+		format = FormatText
+	case FormatText, FormatJSON:
+	default:
+		return fmt.Errorf("unknown log format %q, expected one of: %s, %s", format, FormatText, FormatJSON)
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.level, logger.format = l, format
+	return nil
+}
+
+// Debug, Info, Warn and Error log msg at their level, along with key value pairs of context, e.g.
+// Warn("skipping file", "path", p, "err", err).
+func Debug(msg string, kvs ...interface{}) { log(LevelDebug, msg, kvs) }
+func Info(msg string, kvs ...interface{})  { log(LevelInfo, msg, kvs) }
+func Warn(msg string, kvs ...interface{})  { log(LevelWarn, msg, kvs) }
+func Error(msg string, kvs ...interface{}) { log(LevelError, msg, kvs) }
+
+func log(level Level, msg string, kvs []interface{}) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if level < logger.level {
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if logger.format == FormatJSON {
+		entry := map[string]interface{}{"time": now, "level": level.String(), "msg": msg}
+		for i := 0; i < len(kvs); i += 2 {
+			key, value := pair(kvs, i)
+			if err, ok := value.(error); ok {
+				value = err.Error()
+			}
+			entry[key] = value
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			line, _ = json.Marshal(map[string]interface{}{"time": now, "level": level.String(), "msg": msg, "logError": err.Error()})
+		}
+		fmt.Fprintf(logger.w, "%s\n", line)
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %s", now, strings.ToUpper(level.String()), msg)
+	for i := 0; i < len(kvs); i += 2 {
+		key, value := pair(kvs, i)
+		fmt.Fprintf(&b, " %s=%s", key, textValue(value))
+	}
+	fmt.Fprintf(logger.w, "%s\n", b.String())
+}
+
+// pair returns the key value pair at i, with a missing value logged as such rather than dropped.
+func pair(kvs []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(kvs[i])
+	if i+1 == len(kvs) {
+		return key, "(missing)"
+	}
+	return key, kvs[i+1]
+}
+
+// textValue formats a value of the text format, quoting it if it is empty or has spaces, quotes or an equal sign.
+func textValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
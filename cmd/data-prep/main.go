@@ -1,11 +1,26 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/advertise"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/aggregate"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/commp"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/commp-dir"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/doctor"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/export"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/extract"
 	"github.com/anjor/go-fil-dataprep/cmd/data-prep/fil-data-prep"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/list-pieces"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/make-deals"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/serve"
 	"github.com/anjor/go-fil-dataprep/cmd/data-prep/split-and-commp"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/unsplit"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/verify"
 	"github.com/urfave/cli/v2"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var (
@@ -27,8 +42,32 @@ func main() {
 	app.Commands = []*cli.Command{
 		split_and_commp.Cmd,
 		fil_data_prep.Cmd,
+		list_pieces.Cmd,
+		commp_dir.Cmd,
+		doctor.Cmd,
+		serve.Cmd,
+		aggregate.Cmd,
+		make_deals.Cmd,
+		export.Cmd,
+		advertise.Cmd,
+		unsplit.Cmd,
+		extract.Cmd,
+		commp.Cmd,
+		verify.Cmd,
 	}
-	err := app.Run(os.Args)
+
+	// the first signal cancels the running command, which stops it cleanly, a second one kills it right away
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		fmt.Fprintln(os.Stderr, "interrupted, stopping after cleaning up (interrupt again to exit right away)")
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		cancel()
+	}()
+
+	err := app.RunContext(ctx, os.Args)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
@@ -0,0 +1,344 @@
+package make_deals
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// mainnetGenesis is the time of the first epoch of the Filecoin mainnet, which has an epoch every 30 seconds.
+	mainnetGenesis = 1598306400
+	epochDuration  = 30 * time.Second
+	gib            = 1 << 30
+)
+
+var Cmd = &cli.Command{
+	Name:      "make-deals",
+	Usage:     "Make boost deal proposals for the pieces recorded in a metadata file",
+	ArgsUsage: "<metadata.yaml|metadata.csv>",
+	Action:    makeDeals,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "provider",
+			Required: true,
+			Usage:    "address of the storage provider to make the deals with, e.g. f01234.",
+		},
+		&cli.StringFlag{
+			Name:     "client",
+			Required: false,
+			Usage:    "address of the client wallet making the deals. Required for --format json, passed as --wallet to boost otherwise.",
+		},
+		&cli.StringFlag{
+			Name:     "format",
+			Required: false,
+			Value:    "json",
+			Usage:    "json for an array of unsigned boost deal proposals, or script for a boost deal (or boost offline-deal) command per piece, which boost signs with the client wallet.",
+		},
+		&cli.StringFlag{
+			Name:     "output",
+			Aliases:  []string{"o"},
+			Required: false,
+			Usage:    "optional file to write the proposals to, instead of stdout.",
+		},
+		&cli.Int64Flag{
+			Name:     "duration",
+			Required: false,
+			Value:    518400,
+			Usage:    "duration of the deals in epochs (of 30 seconds), 518400 is 180 days.",
+		},
+		&cli.Int64Flag{
+			Name:     "start-epoch",
+			Required: false,
+			Usage:    "optional epoch the deals start at. Defaults to the mainnet epoch --start-delay from now.",
+		},
+		&cli.DurationFlag{
+			Name:     "start-delay",
+			Required: false,
+			Value:    72 * time.Hour,
+			Usage:    "time from now for the deals to start in, unless --start-epoch is set.",
+		},
+		&cli.StringFlag{
+			Name:     "storage-price",
+			Required: false,
+			Value:    "0",
+			Usage:    "storage price in attoFIL per GiB per epoch.",
+		},
+		&cli.BoolFlag{
+			Name:     "verified",
+			Required: false,
+			Value:    true,
+			Usage:    "make verified (Filecoin Plus) deals.",
+		},
+		&cli.StringFlag{
+			Name:     "url-prefix",
+			Required: false,
+			Usage:    "optional http url the pieces are served at, followed by the base name of the piece file. Deals are offline deals without it.",
+		},
+		&cli.BoolFlag{
+			Name:     "remove-unsealed-copy",
+			Required: false,
+			Usage:    "ask the provider not to keep an unsealed copy of the data.",
+		},
+		&cli.BoolFlag{
+			Name:     "skip-ipni-announce",
+			Required: false,
+			Usage:    "ask the provider not to announce the deals to IPNI.",
+		},
+	},
+}
+
+// dealParams is a deal proposal as boost takes it, see DealParams of github.com/filecoin-project/boost/storagemarket/types.
+type dealParams struct {
+	DealUUID           string
+	IsOffline          bool
+	ClientDealProposal clientDealProposal
+	DealDataRoot       cidLink
+	Transfer           transfer
+	RemoveUnsealedCopy bool
+	SkipIPNIAnnounce   bool
+}
+
+type clientDealProposal struct {
+	Proposal dealProposal
+	// ClientSignature is left empty, the proposal is signed with the client wallet when submitted
+	ClientSignature interface{}
+}
+
+type dealProposal struct {
+	PieceCID             cidLink
+	PieceSize            uint64
+	VerifiedDeal         bool
+	Client               string
+	Provider             string
+	Label                string
+	StartEpoch           int64
+	EndEpoch             int64
+	StoragePricePerEpoch string
+	ProviderCollateral   string
+	ClientCollateral     string
+}
+
+type transfer struct {
+	Type     string
+	ClientID string
+	// Params is the json encoded httpParams of an http transfer, encoded as base64 like any []byte
+	Params []byte
+	Size   uint64
+}
+
+type httpParams struct {
+	URL string
+}
+
+type cidLink struct {
+	Root string `json:"/"`
+}
+
+// deal is what a proposal is made from.
+type deal struct {
+	piece   splitter.CarFile
+	rootCid string
+	url     string
+}
+
+// makeDeals writes a deal proposal for every piece of a metadata file, with the root cid of the run as label.
+func makeDeals(c *cli.Context) error {
+	if !c.Args().Present() {
+		return fmt.Errorf("expected a metadata file, found none")
+	}
+	format := c.String("format")
+	if format != "json" && format != "script" {
+		return fmt.Errorf("unknown format %q, expected json or script", format)
+	}
+	if format == "json" && c.String("client") == "" {
+		return fmt.Errorf("--client is required for --format json")
+	}
+	if c.Int64("duration") <= 0 {
+		return fmt.Errorf("--duration must be positive")
+	}
+	price, ok := new(big.Int).SetString(c.String("storage-price"), 10)
+	if !ok || price.Sign() < 0 {
+		return fmt.Errorf("invalid storage price %q, expected a number of attoFIL", c.String("storage-price"))
+	}
+	urlPrefix := strings.TrimSuffix(c.String("url-prefix"), "/")
+	if urlPrefix != "" && !strings.HasPrefix(urlPrefix, "http://") && !strings.HasPrefix(urlPrefix, "https://") {
+		return fmt.Errorf("invalid url prefix %q, expected an http or https url", urlPrefix)
+	}
+
+	m, err := metadata.Read(c.Args().First())
+	if err != nil {
+		return err
+	}
+	if m.RootCid == "" {
+		return fmt.Errorf("the metadata records no root cid to label the deals with")
+	}
+	var deals []deal
+	for _, cf := range m.CarPiecesMeta.CarPieces {
+		if !cf.CommP.Defined() {
+			logging.Warn("skipping piece without commP", "piece", cf.Name)
+			continue
+		}
+		d := deal{piece: cf, rootCid: m.RootCid}
+		if urlPrefix != "" {
+			d.url = urlPrefix + "/" + filepath.Base(cf.Name)
+		}
+		deals = append(deals, d)
+	}
+	if len(deals) == 0 {
+		return fmt.Errorf("no pieces with a commP to make deals for")
+	}
+
+	startEpoch := c.Int64("start-epoch")
+	if !c.IsSet("start-epoch") {
+		startEpoch = epochAt(time.Now().Add(c.Duration("start-delay")))
+	}
+
+	out := io.Writer(os.Stdout)
+	if path := c.String("output"); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %s", path, err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if format == "script" {
+		for _, d := range deals {
+			if _, err := fmt.Fprintln(out, boostCommand(c, d, startEpoch)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	proposals := make([]dealParams, len(deals))
+	for i, d := range deals {
+		if proposals[i], err = proposal(c, d, startEpoch, price); err != nil {
+			return err
+		}
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(proposals)
+}
+
+// proposal returns the unsigned boost deal proposal of a deal.
+func proposal(c *cli.Context, d deal, startEpoch int64, price *big.Int) (dealParams, error) {
+	id, err := newUUID()
+	if err != nil {
+		return dealParams{}, err
+	}
+	carSize := d.piece.HeaderSize + d.piece.ContentSize + d.piece.IndexSize
+	p := dealParams{
+		DealUUID:  id,
+		IsOffline: d.url == "",
+		ClientDealProposal: clientDealProposal{
+			Proposal: dealProposal{
+				PieceCID:             cidLink{d.piece.CommP.String()},
+				PieceSize:            d.piece.PaddedSize,
+				VerifiedDeal:         c.Bool("verified"),
+				Client:               c.String("client"),
+				Provider:             c.String("provider"),
+				Label:                d.rootCid,
+				StartEpoch:           startEpoch,
+				EndEpoch:             startEpoch + c.Int64("duration"),
+				StoragePricePerEpoch: pricePerEpoch(price, d.piece.PaddedSize).String(),
+				ProviderCollateral:   "0",
+				ClientCollateral:     "0",
+			},
+		},
+		DealDataRoot:       cidLink{dataRoot(d)},
+		Transfer:           transfer{Size: carSize},
+		RemoveUnsealedCopy: c.Bool("remove-unsealed-copy"),
+		SkipIPNIAnnounce:   c.Bool("skip-ipni-announce"),
+	}
+	if d.url != "" {
+		if p.Transfer.Params, err = json.Marshal(httpParams{URL: d.url}); err != nil {
+			return dealParams{}, err
+		}
+		p.Transfer.Type = "http"
+	}
+	return p, nil
+}
+
+// boostCommand returns the boost command line making a deal, boost deal for online deals and boost offline-deal for
+// offline ones.
+func boostCommand(c *cli.Context, d deal, startEpoch int64) string {
+	args := []string{"boost", "offline-deal"}
+	if d.url != "" {
+		args = []string{"boost", "deal", "--http-url=" + shellQuote(d.url)}
+	}
+	args = append(args,
+		"--provider="+shellQuote(c.String("provider")),
+		"--commp="+d.piece.CommP.String(),
+		fmt.Sprintf("--car-size=%d", d.piece.HeaderSize+d.piece.ContentSize+d.piece.IndexSize),
+		fmt.Sprintf("--piece-size=%d", d.piece.PaddedSize),
+		"--payload-cid="+dataRoot(d),
+		fmt.Sprintf("--start-epoch=%d", startEpoch),
+		fmt.Sprintf("--duration=%d", c.Int64("duration")),
+		"--storage-price="+shellQuote(c.String("storage-price")),
+		fmt.Sprintf("--verified=%t", c.Bool("verified")),
+	)
+	if client := c.String("client"); client != "" {
+		args = append(args, "--wallet="+shellQuote(client))
+	}
+	if c.Bool("remove-unsealed-copy") {
+		args = append(args, "--remove-unsealed-copy")
+	}
+	if c.Bool("skip-ipni-announce") {
+		args = append(args, "--skip-ipni-announce")
+	}
+	return strings.Join(args, " ")
+}
+
+// dataRoot returns the root of the data of a deal: the root in the car header of its piece, if any, else the root cid
+// of the run.
+func dataRoot(d deal) string {
+	if d.piece.HeaderRoot != "" {
+		return d.piece.HeaderRoot
+	}
+	return d.rootCid
+}
+
+// pricePerEpoch returns the price of a piece of the given padded size per epoch, from a price per GiB per epoch.
+func pricePerEpoch(pricePerGiB *big.Int, paddedSize uint64) *big.Int {
+	p := new(big.Int).Mul(pricePerGiB, new(big.Int).SetUint64(paddedSize))
+	return p.Quo(p, big.NewInt(gib))
+}
+
+// epochAt returns the mainnet epoch at the given time.
+func epochAt(t time.Time) int64 {
+	return int64(t.Sub(time.Unix(mainnetGenesis, 0)) / epochDuration)
+}
+
+// newUUID returns a random (version 4) uuid, as boost identifies deals by.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to create deal uuid: %s", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// shellQuote quotes s for a posix shell, unless it is made of characters that are safe as they are.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
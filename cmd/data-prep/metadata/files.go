@@ -0,0 +1,133 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// FilePieces records where the data of a file ended up, for a file spread over several pieces to be reassembled from
+// the pieces of several deals, or for parts of a file to be retrieved: its byte ranges in order, and the piece holding
+// each of them.
+type FilePieces struct {
+	File   string       `json:"file" yaml:"file"`
+	Cid    string       `json:"cid" yaml:"cid"`
+	Size   uint64       `json:"size" yaml:"size"`
+	Ranges []PieceRange `json:"ranges" yaml:"ranges"`
+}
+
+// PieceRange is a range of the bytes of a file whose blocks are in a single piece. Offset is where the range starts in
+// the file. PieceOffset and PieceLength are the bytes of the piece file holding the blocks of the range, for a ranged
+// retrieval of the piece; the nodes linking these blocks may be elsewhere, and unrelated blocks may be in between.
+type PieceRange struct {
+	Piece       string `json:"piece" yaml:"piece"`
+	PieceCid    string `json:"pieceCid,omitempty" yaml:"pieceCid,omitempty"`
+	Offset      uint64 `json:"offset" yaml:"offset"`
+	Length      uint64 `json:"length" yaml:"length"`
+	PieceOffset uint64 `json:"pieceOffset" yaml:"pieceOffset"`
+	PieceLength uint64 `json:"pieceLength" yaml:"pieceLength"`
+}
+
+// WriteFileManifest writes where every file ended up: as json if path has a .json extension, a list of the files with
+// their ranges, and as csv otherwise, with a row for every range of every file, and a row without a piece for an empty
+// file.
+func WriteFileManifest(path string, files []FilePieces) error {
+	var data []byte
+	if filepath.Ext(path) == ".json" {
+		if files == nil {
+			files = []FilePieces{}
+		}
+		var err error
+		if data, err = json.MarshalIndent(files, "", "  "); err != nil {
+			return fmt.Errorf("failed to encode the file manifest: %s", err)
+		}
+		data = append(data, '\n')
+	} else {
+		var b bytes.Buffer
+		w := csv.NewWriter(&b)
+		w.Write([]string{"file", "cid", "size", "piece", "piece cid", "offset", "length", "piece offset", "piece length"})
+		for _, fp := range files {
+			size := strconv.FormatUint(fp.Size, 10)
+			if len(fp.Ranges) == 0 {
+				w.Write([]string{fp.File, fp.Cid, size, "", "", "", "", "", ""})
+			}
+			for _, r := range fp.Ranges {
+				w.Write([]string{fp.File, fp.Cid, size, r.Piece, r.PieceCid,
+					strconv.FormatUint(r.Offset, 10), strconv.FormatUint(r.Length, 10),
+					strconv.FormatUint(r.PieceOffset, 10), strconv.FormatUint(r.PieceLength, 10)})
+			}
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("failed to encode the file manifest: %s", err)
+		}
+		data = b.Bytes()
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write the file manifest: %s", err)
+	}
+	return nil
+}
+
+// ReadFileManifest reads a manifest written by WriteFileManifest, json if path has a .json extension and csv otherwise.
+func ReadFileManifest(path string) ([]FilePieces, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the file manifest: %s", err)
+	}
+	var files []FilePieces
+	if filepath.Ext(path) == ".json" {
+		if err := json.Unmarshal(data, &files); err != nil {
+			return nil, fmt.Errorf("failed to parse the file manifest %s: %s", path, err)
+		}
+		return files, nil
+	}
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the file manifest %s: %s", path, err)
+	}
+	for i, row := range rows {
+		if i == 0 {
+			// header
+			continue
+		}
+		if len(row) != 9 {
+			return nil, fmt.Errorf("line %d of the file manifest %s: expected 9 columns, got %d", i+1, path, len(row))
+		}
+		var nums [5]uint64
+		for j, col := range []int{2, 5, 6, 7, 8} {
+			if row[col] == "" && col != 2 {
+				continue
+			}
+			if nums[j], err = strconv.ParseUint(row[col], 10, 64); err != nil {
+				return nil, fmt.Errorf("line %d of the file manifest %s: invalid number %q", i+1, path, row[col])
+			}
+		}
+		// the rows of the ranges of a file follow each other
+		if len(files) == 0 || files[len(files)-1].File != row[0] {
+			files = append(files, FilePieces{File: row[0], Cid: row[1], Size: nums[0]})
+		}
+		if row[3] == "" {
+			continue
+		}
+		fp := &files[len(files)-1]
+		fp.Ranges = append(fp.Ranges, PieceRange{Piece: row[3], PieceCid: row[4], Offset: nums[1], Length: nums[2], PieceOffset: nums[3], PieceLength: nums[4]})
+	}
+	return files, nil
+}
+
+// RenamePieces updates the pieces the ranges of files are in, after the pieces were renamed: renamed holds the new name
+// of every renamed piece by its old one.
+func RenamePieces(files []FilePieces, renamed map[string]string) {
+	for i := range files {
+		for j, r := range files[i].Ranges {
+			if n, ok := renamed[r.Piece]; ok {
+				files[i].Ranges[j].Piece = n
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package metadata
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Formats of the piece table written along with the yaml metadata.
+const (
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+	FormatNDJSON  = "ndjson"
+)
+
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatCSV, FormatParquet, FormatNDJSON:
+		return nil
+	default:
+		return fmt.Errorf("unknown metadata format %q, expected one of: %s, %s, %s", format, FormatCSV, FormatParquet, FormatNDJSON)
+	}
+}
+
+// TablePath returns where the piece table of the given format goes for a --metadata path: the path itself for csv,
+// and the path with a .parquet or .ndjson extension for the other formats.
+func TablePath(meta, format string) string {
+	switch format {
+	case FormatParquet, FormatNDJSON:
+		return strings.TrimSuffix(meta, filepath.Ext(meta)) + "." + format
+	}
+	return meta
+}
+
+// Metadata documents written for a --metadata path, as listed by --metadata-format. DocumentTable is the piece table,
+// in the format given by --format (csv unless given otherwise).
+const (
+	DocumentTable = "csv"
+	DocumentYAML  = "yaml"
+	DocumentJSON  = "json"
+	DocumentAll   = "all"
+)
+
+// DefaultDocuments are the documents written unless --metadata-format says otherwise.
+const DefaultDocuments = DocumentTable + "," + DocumentYAML
+
+// Documents is the set of metadata documents to write.
+type Documents struct {
+	Table bool
+	YAML  bool
+	JSON  bool
+}
+
+// ParseDocuments parses a comma separated list of metadata documents.
+func ParseDocuments(s string) (Documents, error) {
+	var docs Documents
+	for _, d := range strings.Split(s, ",") {
+		switch strings.TrimSpace(d) {
+		case DocumentTable:
+			docs.Table = true
+		case DocumentYAML:
+			docs.YAML = true
+		case DocumentJSON:
+			docs.JSON = true
+		case DocumentAll:
+			docs = Documents{Table: true, YAML: true, JSON: true}
+		default:
+			return Documents{}, fmt.Errorf("unknown metadata document %q, expected a comma separated list of: %s, %s, %s, %s", d, DocumentTable, DocumentYAML, DocumentJSON, DocumentAll)
+		}
+	}
+	return docs, nil
+}
+
+// JSONPath returns where the json metadata document goes for a --metadata path.
+func JSONPath(meta string) string {
+	return strings.TrimSuffix(meta, filepath.Ext(meta)) + ".json"
+}
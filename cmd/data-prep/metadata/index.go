@@ -0,0 +1,113 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+)
+
+// PieceIndex is the metadata of one or more runs keyed by piece cid, listing every place a piece was written to. This
+// is what stores deduplicating by commP ingest, instead of one row per run and piece.
+type PieceIndex struct {
+	Pieces map[string]*IndexedPiece `json:"pieces"`
+}
+
+type IndexedPiece struct {
+	PaddedSize uint64          `json:"paddedSize"`
+	Locations  []PieceLocation `json:"locations"`
+}
+
+type PieceLocation struct {
+	Run     string `json:"run"`
+	CarFile string `json:"carFile"`
+	RootCid string `json:"rootCid,omitempty"`
+}
+
+// ReadPieceIndex reads a piece index written by PieceIndex.Write.
+func ReadPieceIndex(path string) (*PieceIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ix PieceIndex
+	if err := json.NewDecoder(f).Decode(&ix); err != nil {
+		return nil, fmt.Errorf("failed to read piece index %s: %s", path, err)
+	}
+	if ix.Pieces == nil {
+		ix.Pieces = make(map[string]*IndexedPiece)
+	}
+	return &ix, nil
+}
+
+// Add adds the pieces of a run. Pieces without commP can't be keyed and are skipped, locations already in the index
+// are not added twice.
+func (ix *PieceIndex) Add(run string, rootCid string, m *splitter.CarPiecesAndMetadata) {
+	if ix.Pieces == nil {
+		ix.Pieces = make(map[string]*IndexedPiece)
+	}
+	for _, cf := range m.CarPieces {
+		if !cf.CommP.Defined() {
+			continue
+		}
+		p, ok := ix.Pieces[cf.CommP.String()]
+		if !ok {
+			p = &IndexedPiece{PaddedSize: cf.PaddedSize}
+			ix.Pieces[cf.CommP.String()] = p
+		}
+		loc := PieceLocation{Run: run, CarFile: cf.Name, RootCid: rootCid}
+		if !containsLocation(p.Locations, loc) {
+			p.Locations = append(p.Locations, loc)
+		}
+	}
+}
+
+func containsLocation(locs []PieceLocation, loc PieceLocation) bool {
+	for _, l := range locs {
+		if l == loc {
+			return true
+		}
+	}
+	return false
+}
+
+// Write atomically replaces the piece index at path.
+func (ix *PieceIndex) Write(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create piece index: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	enc := json.NewEncoder(tmp)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(ix); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write piece index: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write piece index: %s", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// UpdatePieceIndex adds the pieces of a run to the piece index at path. With merge, the pieces of the existing index
+// (if any) are kept, otherwise the index is replaced.
+func UpdatePieceIndex(path string, merge bool, run string, rootCid string, m *splitter.CarPiecesAndMetadata) error {
+	ix := &PieceIndex{}
+	if merge {
+		existing, err := ReadPieceIndex(path)
+		switch {
+		case err == nil:
+			ix = existing
+		case !os.IsNotExist(err):
+			return err
+		}
+	}
+	ix.Add(run, rootCid, m)
+	return ix.Write(path)
+}
@@ -0,0 +1,80 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+)
+
+// JsonDocument is the metadata of a run as a single json document, for tooling that doesn't read csv or yaml.
+type JsonDocument struct {
+	RootCid               string            `json:"rootCid,omitempty"`
+	OriginalCarHeaderSize uint64            `json:"originalCarHeaderSize"`
+	OriginalCarHeader     string            `json:"originalCarHeader"`
+	CommPAlgorithm        string            `json:"commPAlgorithm,omitempty"`
+	Pieces                []JsonPiece       `json:"pieces"`
+	SpanningFiles         []FilePieces      `json:"spanningFiles,omitempty"`
+	Packing               *splitter.Packing `json:"packing,omitempty"`
+	Tool                  Tool              `json:"tool"`
+}
+
+// JsonPiece is a piece, along with the offset of its blocks in the car stream it was split from. Every file has a
+// stream of its own with --car-per-file, and so do the directory nodes split on their own.
+type JsonPiece struct {
+	splitter.CarFile
+	StreamOffset uint64 `json:"streamOffset"`
+}
+
+// NewJsonDocument turns the summary of a run into its json document.
+func NewJsonDocument(sum Summary) JsonDocument {
+	m := sum.CarPiecesMeta
+	doc := JsonDocument{
+		RootCid:               sum.RootCid,
+		OriginalCarHeaderSize: m.OriginalCarHeaderSize,
+		OriginalCarHeader:     m.OriginalCarHeader,
+		CommPAlgorithm:        m.CommPAlgorithm,
+		Pieces:                make([]JsonPiece, 0, len(m.CarPieces)),
+		SpanningFiles:         sum.SpanningFiles,
+		Packing:               m.Packing,
+		Tool:                  sum.Tool,
+	}
+	offset := m.OriginalCarHeaderSize
+	for i, cf := range m.CarPieces {
+		if i > 0 && (cf.File != m.CarPieces[i-1].File || cf.TreeNodes != m.CarPieces[i-1].TreeNodes) {
+			// the first piece of another stream, which starts with the same header
+			offset = m.OriginalCarHeaderSize
+		}
+		doc.Pieces = append(doc.Pieces, JsonPiece{CarFile: cf, StreamOffset: offset})
+		offset += cf.ContentSize
+	}
+	return doc
+}
+
+// JsonSink writes the json document of a run with the summary. Rows are not written on their own.
+type JsonSink struct {
+	path string
+}
+
+func NewJsonSink(path string) *JsonSink {
+	return &JsonSink{path: path}
+}
+
+func (s *JsonSink) WriteRow(PieceMeta) error {
+	return nil
+}
+
+func (s *JsonSink) WriteSummary(sum Summary) error {
+	f, err := os.Create(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to create json metadata file: %s", err)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(NewJsonDocument(sum)); err != nil {
+		return fmt.Errorf("failed to write json metadata: %s", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,250 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+)
+
+// parquet physical and converted types, and the other enum values used
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+	parquetNoConversion    = -1
+
+	parquetRequired     = 0
+	parquetPlain        = 0
+	parquetRLE          = 3
+	parquetUncompressed = 0
+	parquetDataPage     = 0
+)
+
+// WriteParquet writes the pieces as a parquet table, with one row per piece and typed columns: sizes as integers and
+// the timestamp as a timestamp. All columns are always present, fields that don't apply to a run are empty strings.
+// The file is written as a single row group of uncompressed, plain encoded columns, which every parquet reader
+// understands.
+func WriteParquet(path string, rootCid string, m *splitter.CarPiecesAndMetadata, now time.Time) error {
+	cols := []*parquetColumn{
+		{name: "timestamp", physical: parquetInt64, converted: parquetTimestampMillis},
+		{name: "car_file", physical: parquetByteArray, converted: parquetUTF8},
+		{name: "piece_cid", physical: parquetByteArray, converted: parquetUTF8},
+		{name: "padded_piece_size", physical: parquetInt64, converted: parquetNoConversion},
+		{name: "header_size", physical: parquetInt64, converted: parquetNoConversion},
+		{name: "content_size", physical: parquetInt64, converted: parquetNoConversion},
+		{name: "root_cid", physical: parquetByteArray, converted: parquetUTF8},
+		{name: "file", physical: parquetByteArray, converted: parquetUTF8},
+		{name: "file_root_cid", physical: parquetByteArray, converted: parquetUTF8},
+		{name: "source_roots", physical: parquetByteArray, converted: parquetUTF8},
+		{name: "url", physical: parquetByteArray, converted: parquetUTF8},
+		{name: "index_size", physical: parquetInt64, converted: parquetNoConversion},
+	}
+	for _, cf := range m.CarPieces {
+		cols[0].addInt64(now.UnixMilli())
+		cols[1].addString(cf.Name)
+		cols[2].addString(cf.CommP.String())
+		cols[3].addInt64(int64(cf.PaddedSize))
+		cols[4].addInt64(int64(cf.HeaderSize))
+		cols[5].addInt64(int64(cf.ContentSize))
+		cols[6].addString(rootCid)
+		cols[7].addString(cf.File)
+		cols[8].addString(cf.FileRoot)
+		cols[9].addString(strings.Join(cf.SourceRoots, " "))
+		cols[10].addString(cf.URL)
+		cols[11].addInt64(int64(cf.IndexSize))
+	}
+
+	if err := os.WriteFile(path, encodeParquet(cols, len(m.CarPieces)), 0o644); err != nil {
+		return fmt.Errorf("failed to write parquet metadata: %s", err)
+	}
+	return nil
+}
+
+// parquetColumn holds the plain encoded values of a required column.
+type parquetColumn struct {
+	name      string
+	physical  int32
+	converted int32
+	data      bytes.Buffer
+}
+
+func (c *parquetColumn) addInt64(v int64) {
+	c.data.Write(binary.LittleEndian.AppendUint64(nil, uint64(v)))
+}
+
+func (c *parquetColumn) addString(s string) {
+	c.data.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(s))))
+	c.data.WriteString(s)
+}
+
+// encodeParquet lays out the file: magic, a single data page per column, the footer and its length, magic again.
+// Required columns have no definition or repetition levels, so the pages hold just the values.
+func encodeParquet(cols []*parquetColumn, rows int) []byte {
+	var out bytes.Buffer
+	out.WriteString("PAR1")
+
+	offsets := make([]int64, len(cols))
+	sizes := make([]int64, len(cols))
+	var total int64
+	for i, col := range cols {
+		offsets[i] = int64(out.Len())
+
+		var ph thriftWriter
+		ph.begin()
+		ph.i32(1, parquetDataPage)
+		ph.i32(2, int32(col.data.Len()))
+		ph.i32(3, int32(col.data.Len()))
+		ph.beginStruct(5)
+		ph.i32(1, int32(rows))
+		ph.i32(2, parquetPlain)
+		ph.i32(3, parquetRLE)
+		ph.i32(4, parquetRLE)
+		ph.end()
+		ph.end()
+
+		out.Write(ph.buf.Bytes())
+		out.Write(col.data.Bytes())
+		sizes[i] = int64(out.Len()) - offsets[i]
+		total += sizes[i]
+	}
+
+	var fm thriftWriter
+	fm.begin()
+	fm.i32(1, 1)
+	fm.beginList(2, thriftStruct, len(cols)+1)
+	fm.begin()
+	fm.binary(4, "schema")
+	fm.i32(5, int32(len(cols)))
+	fm.end()
+	for _, col := range cols {
+		fm.begin()
+		fm.i32(1, col.physical)
+		fm.i32(3, parquetRequired)
+		fm.binary(4, col.name)
+		if col.converted != parquetNoConversion {
+			fm.i32(6, col.converted)
+		}
+		fm.end()
+	}
+	fm.i64(3, int64(rows))
+	fm.beginList(4, thriftStruct, 1)
+	fm.begin()
+	fm.beginList(1, thriftStruct, len(cols))
+	for i, col := range cols {
+		fm.begin()
+		fm.i64(2, offsets[i])
+		fm.beginStruct(3)
+		fm.i32(1, col.physical)
+		fm.beginList(2, thriftI32, 2)
+		fm.listI32(parquetPlain)
+		fm.listI32(parquetRLE)
+		fm.beginList(3, thriftBinary, 1)
+		fm.listBinary(col.name)
+		fm.i32(4, parquetUncompressed)
+		fm.i64(5, int64(rows))
+		fm.i64(6, sizes[i])
+		fm.i64(7, sizes[i])
+		fm.i64(9, offsets[i])
+		fm.end()
+		fm.end()
+	}
+	fm.i64(2, total)
+	fm.i64(3, int64(rows))
+	fm.end()
+	fm.binary(6, "go-fil-dataprep")
+	fm.end()
+
+	out.Write(fm.buf.Bytes())
+	out.Write(binary.LittleEndian.AppendUint32(nil, uint32(fm.buf.Len())))
+	out.WriteString("PAR1")
+	return out.Bytes()
+}
+
+// thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs in the thrift compact protocol, which parquet uses for its page headers and footer.
+// Fields must be written in increasing id order within a struct.
+type thriftWriter struct {
+	buf bytes.Buffer
+	// id of the last field written, for every struct being written
+	lastIDs []int16
+}
+
+// begin starts a top-level struct or a struct element of a list.
+func (t *thriftWriter) begin() {
+	t.lastIDs = append(t.lastIDs, 0)
+}
+
+func (t *thriftWriter) end() {
+	t.buf.WriteByte(0)
+	t.lastIDs = t.lastIDs[:len(t.lastIDs)-1]
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.lastIDs[len(t.lastIDs)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) varint(v int64) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64(v<<1)^uint64(v>>63)))
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.listBinary(s)
+}
+
+func (t *thriftWriter) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.begin()
+}
+
+// beginList starts a list of n elements, which are written right after with listI32, listBinary or begin/end.
+func (t *thriftWriter) beginList(id int16, elemType byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elemType)
+		return
+	}
+	t.buf.WriteByte(0xF0 | elemType)
+	t.buf.Write(binary.AppendUvarint(nil, uint64(n)))
+}
+
+func (t *thriftWriter) listI32(v int32) {
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) listBinary(s string) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64(len(s))))
+	t.buf.WriteString(s)
+}
@@ -0,0 +1,114 @@
+package metadata
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+)
+
+// TestWriteParquetReadBack reads a written table back with an independent parquet reader and checks the schema,
+// including the column types, and the values of every row.
+func TestWriteParquetReadBack(t *testing.T) {
+	commP, err := cid.Decode("baga6ea4seaqjtovkwk4myyzj56eztkh5pzsk5upksan6f5outesy62bsvl4dsha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &splitter.CarPiecesAndMetadata{CarPieces: []splitter.CarFile{
+		{Name: "out/piece-0.car", CommP: splitter.PieceCid{Cid: commP}, PaddedSize: 1 << 20, HeaderSize: 59, ContentSize: 900000},
+		// a piece without commP and the optional fields set
+		{Name: "out/piece-1.car", PaddedSize: 2 << 20, HeaderSize: 100, ContentSize: 1, File: "a/b.txt", FileRoot: "bafyfile",
+			SourceRoots: []string{"bafyx", "bafyy"}, URL: "https://example.com/piece-1.car", IndexSize: 1234},
+		{Name: "out/piece-2.car", CommP: splitter.PieceCid{Cid: commP}, PaddedSize: 1 << 35, HeaderSize: 59, ContentSize: 1<<34 + 3},
+	}}
+	now := time.Date(2023, 5, 17, 10, 11, 12, 345e6, time.UTC)
+	path := filepath.Join(t.TempDir(), "pieces.parquet")
+	if err := WriteParquet(path, "bafyroot", m, now); err != nil {
+		t.Fatal(err)
+	}
+
+	fr, err := local.NewLocalFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, nil, 1)
+	if err != nil {
+		t.Fatalf("parquet reader can't open the table: %s", err)
+	}
+	defer pr.ReadStop()
+	if got := pr.GetNumRows(); got != int64(len(m.CarPieces)) {
+		t.Fatalf("got %d rows, want %d", got, len(m.CarPieces))
+	}
+
+	int64Type := parquet.Type_INT64
+	byteArrayType := parquet.Type_BYTE_ARRAY
+	timestamp := parquet.ConvertedType_TIMESTAMP_MILLIS
+	utf8 := parquet.ConvertedType_UTF8
+	want := []struct {
+		name      string
+		physical  parquet.Type
+		converted *parquet.ConvertedType
+		values    []interface{}
+	}{
+		{"timestamp", int64Type, &timestamp, []interface{}{now.UnixMilli(), now.UnixMilli(), now.UnixMilli()}},
+		{"car_file", byteArrayType, &utf8, []interface{}{"out/piece-0.car", "out/piece-1.car", "out/piece-2.car"}},
+		{"piece_cid", byteArrayType, &utf8, []interface{}{commP.String(), "", commP.String()}},
+		{"padded_piece_size", int64Type, nil, []interface{}{int64(1 << 20), int64(2 << 20), int64(1 << 35)}},
+		{"header_size", int64Type, nil, []interface{}{int64(59), int64(100), int64(59)}},
+		{"content_size", int64Type, nil, []interface{}{int64(900000), int64(1), int64(1<<34 + 3)}},
+		{"root_cid", byteArrayType, &utf8, []interface{}{"bafyroot", "bafyroot", "bafyroot"}},
+		{"file", byteArrayType, &utf8, []interface{}{"", "a/b.txt", ""}},
+		{"file_root_cid", byteArrayType, &utf8, []interface{}{"", "bafyfile", ""}},
+		{"source_roots", byteArrayType, &utf8, []interface{}{"", "bafyx bafyy", ""}},
+		{"url", byteArrayType, &utf8, []interface{}{"", "https://example.com/piece-1.car", ""}},
+		{"index_size", int64Type, nil, []interface{}{int64(0), int64(1234), int64(0)}},
+	}
+
+	schema := pr.Footer.Schema
+	if len(schema) != len(want)+1 {
+		t.Fatalf("got %d schema elements, want the root and %d columns", len(schema), len(want))
+	}
+	for i, w := range want {
+		// the reader renames the schema elements to go field names, the names in the file are kept as external names
+		el := schema[i+1]
+		if name := pr.SchemaHandler.Infos[i+1].ExName; name != w.name {
+			t.Errorf("column %d: name %q, want %q", i, name, w.name)
+			continue
+		}
+		if el.Type == nil || *el.Type != w.physical {
+			t.Errorf("column %s: type %v, want %v", w.name, el.Type, w.physical)
+		}
+		if el.RepetitionType == nil || *el.RepetitionType != parquet.FieldRepetitionType_REQUIRED {
+			t.Errorf("column %s: repetition %v, want REQUIRED", w.name, el.RepetitionType)
+		}
+		switch {
+		case w.converted == nil && el.ConvertedType != nil:
+			t.Errorf("column %s: converted type %v, want none", w.name, *el.ConvertedType)
+		case w.converted != nil && (el.ConvertedType == nil || *el.ConvertedType != *w.converted):
+			t.Errorf("column %s: converted type %v, want %v", w.name, el.ConvertedType, *w.converted)
+		}
+
+		values, _, _, err := pr.ReadColumnByPath(common.ReformPathStr("schema."+w.name), int64(len(m.CarPieces)))
+		if err != nil {
+			t.Errorf("column %s: %s", w.name, err)
+			continue
+		}
+		if len(values) != len(w.values) {
+			t.Errorf("column %s: got %d values, want %d", w.name, len(values), len(w.values))
+			continue
+		}
+		for row, v := range values {
+			if v != w.values[row] {
+				t.Errorf("column %s, row %d: got %#v, want %#v", w.name, row, v, w.values[row])
+			}
+		}
+	}
+}
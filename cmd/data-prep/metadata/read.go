@@ -0,0 +1,123 @@
+package metadata
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/ipfs/go-cid"
+	"gopkg.in/yaml.v2"
+)
+
+// Metadata is what gets read back from a metadata file written by fil-data-prep or split-and-commp.
+type Metadata struct {
+	RootCid       string                         `yaml:"root_cid"`
+	CarPiecesMeta *splitter.CarPiecesAndMetadata `yaml:"car_pieces_meta"`
+	SpanningFiles []FilePieces                   `yaml:"spanning_files,omitempty"` // Only recorded in yaml metadata.
+	Tool          *Tool                          `yaml:"tool,omitempty"`           // Only recorded in yaml metadata.
+}
+
+// Read reads a csv or yaml metadata file, picking the format based on the file extension.
+func Read(path string) (*Metadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return readYaml(f)
+	case ".csv":
+		return readCsv(f)
+	default:
+		return nil, fmt.Errorf("unsupported metadata file %q: expected a .csv or .yaml file", path)
+	}
+}
+
+func readYaml(r io.Reader) (*Metadata, error) {
+	var m Metadata
+	if err := yaml.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to read yaml metadata: %s", err)
+	}
+	if m.CarPiecesMeta == nil {
+		m.CarPiecesMeta = &splitter.CarPiecesAndMetadata{}
+	}
+	return &m, nil
+}
+
+func readCsv(r io.Reader) (*Metadata, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read csv metadata: %s", err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("empty csv metadata, expected a header row")
+	}
+
+	cols := make(map[string]int, len(rows[0]))
+	for i, name := range rows[0] {
+		cols[name] = i
+	}
+	for _, name := range []string{"car file", "piece cid", "padded piece size", "header size", "content size"} {
+		if _, ok := cols[name]; !ok {
+			return nil, fmt.Errorf("csv metadata is missing the %q column", name)
+		}
+	}
+
+	m := &Metadata{CarPiecesMeta: &splitter.CarPiecesAndMetadata{}}
+	for i, row := range rows[1:] {
+		line := i + 2
+
+		cf := splitter.CarFile{Name: row[cols["car file"]]}
+		// an empty piece cid means commP was not calculated for the piece
+		if s := row[cols["piece cid"]]; s != "" {
+			commP, err := cid.Decode(s)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid piece cid: %s", line, err)
+			}
+			cf.CommP = splitter.PieceCid{Cid: commP}
+		}
+		var err error
+		for name, v := range map[string]*uint64{
+			"padded piece size": &cf.PaddedSize,
+			"header size":       &cf.HeaderSize,
+			"content size":      &cf.ContentSize,
+		} {
+			if *v, err = strconv.ParseUint(row[cols[name]], 10, 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid %s: %s", line, name, err)
+			}
+		}
+		if idx, ok := cols["index size"]; ok {
+			if cf.IndexSize, err = strconv.ParseUint(row[idx], 10, 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid index size: %s", line, err)
+			}
+		}
+		if idx, ok := cols["file"]; ok {
+			cf.File = row[idx]
+		}
+		if idx, ok := cols["file_root_cid"]; ok {
+			cf.FileRoot = row[idx]
+		}
+		if idx, ok := cols["source roots"]; ok {
+			cf.SourceRoots = strings.Fields(row[idx])
+		}
+		if idx, ok := cols["url"]; ok {
+			cf.URL = row[idx]
+		}
+		if idx, ok := cols["push status"]; ok {
+			cf.PushStatus = row[idx]
+		}
+		if idx, ok := cols["root_cid"]; ok && m.RootCid == "" {
+			m.RootCid = row[idx]
+		}
+		m.CarPiecesMeta.CarPieces = append(m.CarPiecesMeta.CarPieces, cf)
+	}
+
+	return m, nil
+}
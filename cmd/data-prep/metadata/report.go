@@ -0,0 +1,61 @@
+package metadata
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+)
+
+// Report is the human readable summary of a run, printed at its end to give a quick idea whether its shape looks
+// right.
+type Report struct {
+	RootCid   string
+	InputSize uint64
+	// Payload is the size of the file data in the dag, if known.
+	Payload uint64
+	Pieces  []splitter.CarFile
+	Elapsed time.Duration
+}
+
+// Print writes the report: the root cid, the input size, the file data and block bytes accounted for, the number of
+// pieces, their total size on disk and padded, and how much of the padded size is padding.
+func (r Report) Print(w io.Writer) {
+	var onDisk, padded uint64
+	for _, cf := range r.Pieces {
+		onDisk += cf.HeaderSize + cf.ContentSize + cf.IndexSize
+		padded += cf.PaddedSize
+	}
+
+	fmt.Fprintf(w, "summary:\n")
+	if r.RootCid != "" {
+		fmt.Fprintf(w, "  root cid:          %s\n", r.RootCid)
+	}
+	fmt.Fprintf(w, "  input:             %s\n", formatBytes(r.InputSize))
+	if r.Payload > 0 {
+		fmt.Fprintf(w, "  file data in dag:  %s\n", formatBytes(r.Payload))
+	}
+	fmt.Fprintf(w, "  block content:     %s\n", formatBytes(splitter.ContentSize(r.Pieces)))
+	fmt.Fprintf(w, "  pieces:            %d\n", len(r.Pieces))
+	fmt.Fprintf(w, "  size on disk:      %s\n", formatBytes(onDisk))
+	fmt.Fprintf(w, "  padded size:       %s\n", formatBytes(padded))
+	if padded > 0 && padded >= onDisk {
+		fmt.Fprintf(w, "  padding overhead:  %.1f%%\n", float64(padded-onDisk)/float64(padded)*100)
+	}
+	fmt.Fprintf(w, "  elapsed:           %s\n", r.Elapsed.Round(time.Millisecond))
+}
+
+// formatBytes formats a size in binary units, along with the exact number of bytes.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB (%d bytes)", float64(n)/float64(div), "KMGTPE"[exp], n)
+}
@@ -0,0 +1,354 @@
+package metadata
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"gopkg.in/yaml.v2"
+)
+
+// PieceMeta is a row of the piece table: a piece, and the root cid of the dataset it belongs to, if known.
+type PieceMeta struct {
+	RootCid string
+	splitter.CarFile
+}
+
+// Summary is the metadata of a whole run, written once all pieces are done.
+type Summary struct {
+	RootCid       string                         `yaml:"root_cid,omitempty"`
+	CarPiecesMeta *splitter.CarPiecesAndMetadata `yaml:"car_pieces_meta"`
+	SpanningFiles []FilePieces                   `yaml:"spanning_files,omitempty"`
+	// Files are the pieces holding every file of the run, if known. Only the metadata database records them.
+	Files []FilePieces `yaml:"-"`
+	Tool  Tool         `yaml:"tool"`
+}
+
+// MetadataSink receives the metadata of a run: a row for every piece, followed by the summary. The file based sinks
+// below write the usual metadata files, an embedding app can implement its own to store the metadata elsewhere.
+type MetadataSink interface {
+	WriteRow(PieceMeta) error
+	WriteSummary(Summary) error
+}
+
+// Write passes the pieces of a run to the sink, and then its summary.
+func Write(sink MetadataSink, s Summary) error {
+	for _, cf := range s.CarPiecesMeta.CarPieces {
+		if err := sink.WriteRow(PieceMeta{RootCid: s.RootCid, CarFile: cf}); err != nil {
+			return err
+		}
+	}
+	return sink.WriteSummary(s)
+}
+
+// Csv columns of the piece table.
+const (
+	ColumnTimestamp   = "timestamp"
+	ColumnCarFile     = "car file"
+	ColumnRootCid     = "root_cid"
+	ColumnPieceCid    = "piece cid"
+	ColumnPaddedSize  = "padded piece size"
+	ColumnHeaderSize  = "header size"
+	ColumnContentSize = "content size"
+	ColumnFile        = "file"
+	ColumnFileRootCid = "file_root_cid"
+	ColumnSourceRoots = "source roots"
+	ColumnURL         = "url"
+	ColumnIndexSize   = "index size"
+	ColumnPushStatus  = "push status"
+)
+
+// CsvSink writes the rows to a csv file with the given columns, and closes it with the summary.
+type CsvSink struct {
+	f       *os.File
+	w       *csv.Writer
+	columns []string
+	ts      Timestamps
+}
+
+func NewCsvSink(path string, columns []string, ts Timestamps) (*CsvSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metadata file: %s", err)
+	}
+	s := &CsvSink{f: f, w: csv.NewWriter(f), columns: columns, ts: ts}
+	if err := s.w.Write(columns); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write csv header: %s", err)
+	}
+	return s, nil
+}
+
+// NewAppendCsvSink returns a csv sink adding rows to the end of the csv file at path, which is created (with a header)
+// if missing, e.g. to collect the pieces of several runs in one table. An existing file must have the same columns.
+func NewAppendCsvSink(path string, columns []string, ts Timestamps) (*CsvSink, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata file: %s", err)
+	}
+	s := &CsvSink{f: f, w: csv.NewWriter(f), columns: columns, ts: ts}
+	header, err := csv.NewReader(f).Read()
+	switch {
+	case err == io.EOF:
+		if err := s.w.Write(columns); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to write csv header: %s", err)
+		}
+	case err != nil:
+		f.Close()
+		return nil, fmt.Errorf("failed to read csv header of %s: %s", path, err)
+	case strings.Join(header, ",") != strings.Join(columns, ","):
+		f.Close()
+		return nil, fmt.Errorf("the columns of %s (%s) don't match the columns to add (%s)", path, strings.Join(header, ","), strings.Join(columns, ","))
+	}
+	return s, nil
+}
+
+func (s *CsvSink) WriteRow(p PieceMeta) error {
+	row := make([]string, len(s.columns))
+	for i, col := range s.columns {
+		switch col {
+		case ColumnTimestamp:
+			row[i] = s.ts.Now()
+		case ColumnCarFile:
+			row[i] = p.Name
+		case ColumnRootCid:
+			row[i] = p.RootCid
+		case ColumnPieceCid:
+			row[i] = p.CommP.String()
+		case ColumnPaddedSize:
+			row[i] = strconv.FormatUint(p.PaddedSize, 10)
+		case ColumnHeaderSize:
+			row[i] = strconv.FormatUint(p.HeaderSize, 10)
+		case ColumnContentSize:
+			row[i] = strconv.FormatUint(p.ContentSize, 10)
+		case ColumnFile:
+			row[i] = p.File
+		case ColumnFileRootCid:
+			row[i] = p.FileRoot
+		case ColumnSourceRoots:
+			row[i] = strings.Join(p.SourceRoots, " ")
+		case ColumnURL:
+			row[i] = p.URL
+		case ColumnIndexSize:
+			row[i] = strconv.FormatUint(p.IndexSize, 10)
+		case ColumnPushStatus:
+			row[i] = p.PushStatus
+		default:
+			return fmt.Errorf("unknown csv column %q", col)
+		}
+	}
+	if err := s.w.Write(row); err != nil {
+		return fmt.Errorf("failed to write csv row: %s", err)
+	}
+	return nil
+}
+
+func (s *CsvSink) WriteSummary(Summary) error {
+	s.w.Flush()
+	if err := s.w.Error(); err != nil {
+		s.f.Close()
+		return fmt.Errorf("failed to write csv: %s", err)
+	}
+	return s.f.Close()
+}
+
+// ParquetSink collects the rows and writes them as a parquet table with the summary.
+type ParquetSink struct {
+	path   string
+	now    time.Time
+	pieces []splitter.CarFile
+}
+
+func NewParquetSink(path string, now time.Time) *ParquetSink {
+	return &ParquetSink{path: path, now: now}
+}
+
+func (s *ParquetSink) WriteRow(p PieceMeta) error {
+	s.pieces = append(s.pieces, p.CarFile)
+	return nil
+}
+
+func (s *ParquetSink) WriteSummary(sum Summary) error {
+	return WriteParquet(s.path, sum.RootCid, &splitter.CarPiecesAndMetadata{CarPieces: s.pieces}, s.now)
+}
+
+// YamlSink writes the summary, which holds the full car pieces metadata (including the original car header) and the
+// tool version and options, to a yaml file. Rows are not written on their own.
+type YamlSink struct {
+	path string
+}
+
+func NewYamlSink(path string) *YamlSink {
+	return &YamlSink{path: path}
+}
+
+func (s *YamlSink) WriteRow(PieceMeta) error {
+	return nil
+}
+
+func (s *YamlSink) WriteSummary(sum Summary) error {
+	f, err := os.Create(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to create yaml metadata file: %s", err)
+	}
+	defer f.Close()
+	if err := yaml.NewEncoder(f).Encode(sum); err != nil {
+		return fmt.Errorf("failed to write yaml: %s", err)
+	}
+	return f.Close()
+}
+
+// NdjsonSink writes every row as a json object on a line of its own as soon as it gets it, and the summary as the last
+// line. Every line has a "type" of "piece" or "summary". Rows of pieces that were already written are skipped, so that
+// pieces streamed while the run progresses (see StreamPieces) aren't written again with the final metadata.
+type NdjsonSink struct {
+	f       *os.File
+	enc     *json.Encoder
+	written map[string]bool
+}
+
+type ndjsonPiece struct {
+	Type    string `json:"type"`
+	RootCid string `json:"rootCid,omitempty"`
+	splitter.CarFile
+}
+
+type ndjsonSummary struct {
+	Type                  string            `json:"type"`
+	RootCid               string            `json:"rootCid,omitempty"`
+	Pieces                int               `json:"pieces"`
+	OriginalCarHeaderSize uint64            `json:"originalCarHeaderSize"`
+	OriginalCarHeader     string            `json:"originalCarHeader"`
+	CommPAlgorithm        string            `json:"commPAlgorithm,omitempty"`
+	SpanningFiles         []FilePieces      `json:"spanningFiles,omitempty"`
+	Packing               *splitter.Packing `json:"packing,omitempty"`
+	Tool                  Tool              `json:"tool"`
+}
+
+func NewNdjsonSink(path string) (*NdjsonSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metadata file: %s", err)
+	}
+	return &NdjsonSink{f: f, enc: json.NewEncoder(f), written: make(map[string]bool)}, nil
+}
+
+func (s *NdjsonSink) WriteRow(p PieceMeta) error {
+	if s.written[p.Name] {
+		return nil
+	}
+	s.written[p.Name] = true
+	if err := s.enc.Encode(ndjsonPiece{Type: "piece", RootCid: p.RootCid, CarFile: p.CarFile}); err != nil {
+		return fmt.Errorf("failed to write ndjson metadata: %s", err)
+	}
+	return nil
+}
+
+func (s *NdjsonSink) WriteSummary(sum Summary) error {
+	err := s.enc.Encode(ndjsonSummary{
+		Type:                  "summary",
+		RootCid:               sum.RootCid,
+		Pieces:                len(sum.CarPiecesMeta.CarPieces),
+		OriginalCarHeaderSize: sum.CarPiecesMeta.OriginalCarHeaderSize,
+		OriginalCarHeader:     sum.CarPiecesMeta.OriginalCarHeader,
+		CommPAlgorithm:        sum.CarPiecesMeta.CommPAlgorithm,
+		SpanningFiles:         sum.SpanningFiles,
+		Packing:               sum.CarPiecesMeta.Packing,
+		Tool:                  sum.Tool,
+	})
+	if err != nil {
+		s.f.Close()
+		return fmt.Errorf("failed to write ndjson metadata: %s", err)
+	}
+	return s.f.Close()
+}
+
+// StreamPieces returns a piece callback that writes the row of every completed piece to the sink right away, before
+// calling next (if set). The rows don't have a root cid, which is only known at the end and recorded in the summary.
+func StreamPieces(sink MetadataSink, next func(splitter.CarFile) error) func(splitter.CarFile) error {
+	return func(cf splitter.CarFile) error {
+		if err := sink.WriteRow(PieceMeta{CarFile: cf}); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(cf)
+		}
+		return nil
+	}
+}
+
+// MultiSink passes everything on to all of its sinks, in order.
+type MultiSink []MetadataSink
+
+func (m MultiSink) WriteRow(p PieceMeta) error {
+	for _, s := range m {
+		if err := s.WriteRow(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m MultiSink) WriteSummary(sum Summary) error {
+	for _, s := range m {
+		if err := s.WriteSummary(sum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewFileSink returns the default sink for a --metadata path: the piece table (csv with the given columns, or parquet
+// or ndjson next to the metadata path), and next to it the yaml file.
+func NewFileSink(meta string, tableFormat string, columns []string, ts Timestamps) (MetadataSink, error) {
+	return NewDocumentsSink(meta, tableFormat, Documents{Table: true, YAML: true}, columns, ts)
+}
+
+// NewDocumentsSink returns the sink for a --metadata path writing the given documents: the piece table as with
+// NewFileSink, the yaml file, and the json document next to the metadata path.
+func NewDocumentsSink(meta string, tableFormat string, docs Documents, columns []string, ts Timestamps) (MetadataSink, error) {
+	var sinks MultiSink
+	if docs.Table {
+		table, err := newTableSink(meta, tableFormat, columns, ts)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, table)
+	}
+	if docs.YAML {
+		sinks = append(sinks, NewYamlSink(strings.TrimSuffix(meta, filepath.Ext(meta))+".yaml"))
+	}
+	if docs.JSON {
+		sinks = append(sinks, NewJsonSink(JSONPath(meta)))
+	}
+	return sinks, nil
+}
+
+func newTableSink(meta string, tableFormat string, columns []string, ts Timestamps) (MetadataSink, error) {
+	var table MetadataSink
+	switch tableFormat {
+	case FormatParquet:
+		table = NewParquetSink(TablePath(meta, tableFormat), ts.Time())
+	case FormatNDJSON:
+		ndjsonSink, err := NewNdjsonSink(TablePath(meta, tableFormat))
+		if err != nil {
+			return nil, err
+		}
+		table = ndjsonSink
+	default:
+		csvSink, err := NewCsvSink(meta, columns, ts)
+		if err != nil {
+			return nil, err
+		}
+		table = csvSink
+	}
+	return table, nil
+}
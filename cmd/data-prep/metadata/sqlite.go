@@ -0,0 +1,164 @@
+package metadata
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchemaVersion is stored as the user_version of the database. It only changes with incompatible changes to
+// the schema below, columns and tables are only ever added.
+const sqliteSchemaVersion = 1
+
+// sqliteSchema creates the tables of a metadata database, unless they exist already: every run appends to it.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY,
+	run_id TEXT NOT NULL,
+	root_cid TEXT NOT NULL,
+	original_car_header TEXT NOT NULL,
+	original_car_header_size INTEGER NOT NULL,
+	commp_algorithm TEXT NOT NULL,
+	tool_version TEXT NOT NULL,
+	command TEXT NOT NULL,
+	options TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS pieces (
+	run INTEGER NOT NULL REFERENCES runs(id),
+	name TEXT NOT NULL,
+	piece_cid TEXT NOT NULL,
+	padded_size INTEGER NOT NULL,
+	header_size INTEGER NOT NULL,
+	content_size INTEGER NOT NULL,
+	header_root TEXT NOT NULL,
+	tree_nodes INTEGER NOT NULL,
+	source_roots TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS pieces_piece_cid ON pieces(piece_cid);
+CREATE TABLE IF NOT EXISTS file_pieces (
+	run INTEGER NOT NULL REFERENCES runs(id),
+	file TEXT NOT NULL,
+	file_cid TEXT NOT NULL,
+	piece TEXT NOT NULL,
+	piece_cid TEXT NOT NULL,
+	range_offset INTEGER,
+	range_length INTEGER
+);
+CREATE INDEX IF NOT EXISTS file_pieces_file ON file_pieces(file);
+`
+
+// SqliteSink records a run in a sqlite database: a row in runs, its pieces, and which pieces hold which files, a row
+// for every byte range of every file of the run. The database is written in a single transaction once the run is
+// complete, so a failed run leaves no trace in it.
+type SqliteSink struct {
+	path   string
+	runID  string
+	now    time.Time
+	pieces []PieceMeta
+}
+
+// NewSqliteSink returns a sink appending to the database at path. The database and its tables are created up front
+// if they don't exist, so a database that can't be written fails the run before any work is done.
+func NewSqliteSink(path string, runID string) (*SqliteSink, error) {
+	db, err := openSqlite(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close the metadata database %s: %s", path, err)
+	}
+	return &SqliteSink{path: path, runID: runID, now: time.Now()}, nil
+}
+
+// openSqlite opens the database at path and creates its tables. Runs writing to the same database at the same time
+// wait up to a minute for each other.
+func openSqlite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=60000&_txlock=immediate")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the metadata database %s: %s", path, err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create the tables of the metadata database %s: %s", path, err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", sqliteSchemaVersion)); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to set the schema version of the metadata database %s: %s", path, err)
+	}
+	return db, nil
+}
+
+func (s *SqliteSink) WriteRow(p PieceMeta) error {
+	s.pieces = append(s.pieces, p)
+	return nil
+}
+
+func (s *SqliteSink) WriteSummary(sum Summary) error {
+	options, err := json.Marshal(sum.Tool.Options)
+	if err != nil {
+		return fmt.Errorf("failed to encode the tool options: %s", err)
+	}
+	m := sum.CarPiecesMeta
+
+	db, err := openSqlite(s.path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to write the metadata database %s: %s", s.path, err)
+	}
+	if err := s.insertRun(tx, sum, m, string(options)); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to write the metadata database %s: %s", s.path, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to write the metadata database %s: %s", s.path, err)
+	}
+	return nil
+}
+
+// insertRun inserts the run, its pieces and the ranges of its files.
+func (s *SqliteSink) insertRun(tx *sql.Tx, sum Summary, m *splitter.CarPiecesAndMetadata, options string) error {
+	res, err := tx.Exec(`INSERT INTO runs (run_id, root_cid, original_car_header, original_car_header_size, commp_algorithm, tool_version, command, options, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.runID, sum.RootCid, m.OriginalCarHeader, m.OriginalCarHeaderSize, m.CommPAlgorithm, sum.Tool.Version, sum.Tool.Command, options, s.now.UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	run, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	pieces, err := tx.Prepare(`INSERT INTO pieces (run, name, piece_cid, padded_size, header_size, content_size, header_root, tree_nodes, source_roots) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer pieces.Close()
+	for _, p := range s.pieces {
+		if _, err := pieces.Exec(run, p.Name, p.CommP.String(), p.PaddedSize, p.HeaderSize, p.ContentSize, p.HeaderRoot, p.TreeNodes, strings.Join(p.SourceRoots, " ")); err != nil {
+			return err
+		}
+	}
+
+	files, err := tx.Prepare(`INSERT INTO file_pieces (run, file, file_cid, piece, piece_cid, range_offset, range_length) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer files.Close()
+	for _, fp := range sum.Files {
+		for _, r := range fp.Ranges {
+			if _, err := files.Exec(run, fp.File, fp.Cid, r.Piece, r.PieceCid, r.Offset, r.Length); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
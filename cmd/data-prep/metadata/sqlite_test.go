@@ -0,0 +1,110 @@
+package metadata
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+)
+
+// TestSqliteSink writes two runs, the second with values that would break a hand quoted statement, and reads them back.
+func TestSqliteSink(t *testing.T) {
+	commP, err := cid.Decode("baga6ea4seaqjtovkwk4myyzj56eztkh5pzsk5upksan6f5outesy62bsvl4dsha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "runs.db")
+	runs := []struct {
+		runID string
+		name  string
+		files []FilePieces
+	}{
+		{runID: "first", name: "out/piece-0.car", files: []FilePieces{
+			{File: "a.txt", Cid: "bafya", Size: 10, Ranges: []PieceRange{{Piece: "out/piece-0.car", PieceCid: commP.String(), Length: 10}}},
+			{File: "empty.txt", Cid: "bafyempty"},
+		}},
+		{runID: "it's; DROP TABLE runs; --", name: "out/o'brien.car", files: []FilePieces{
+			{File: "dir/it's.txt", Cid: "bafyb", Size: 300, Ranges: []PieceRange{
+				{Piece: "out/o'brien.car", PieceCid: commP.String(), Length: 100},
+				{Piece: "out/o'brien.car", PieceCid: commP.String(), Offset: 100, Length: 200},
+			}},
+		}},
+	}
+	for _, r := range runs {
+		sink, err := NewSqliteSink(path, r.runID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &splitter.CarPiecesAndMetadata{CarPieces: []splitter.CarFile{
+			{Name: r.name, CommP: splitter.PieceCid{Cid: commP}, PaddedSize: 1 << 20, HeaderSize: 59, ContentSize: 1000, TreeNodes: true},
+		}}
+		tool := Tool{Version: "v1", Command: "fil-data-prep", Options: map[string]string{"target-size": "1MiB"}}
+		if err := Write(sink, Summary{RootCid: "bafyroot", CarPiecesMeta: m, Files: r.files, Tool: tool}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != sqliteSchemaVersion {
+		t.Errorf("schema version %d, want %d", version, sqliteSchemaVersion)
+	}
+	for i, r := range runs {
+		var run int64
+		if err := db.QueryRow("SELECT id FROM runs WHERE run_id = ?", r.runID).Scan(&run); err != nil {
+			t.Fatalf("run %q: %s", r.runID, err)
+		}
+		var name string
+		var treeNodes int
+		if err := db.QueryRow("SELECT name, tree_nodes FROM pieces WHERE run = ?", run).Scan(&name, &treeNodes); err != nil {
+			t.Fatalf("run %d: %s", i, err)
+		}
+		if name != r.name || treeNodes != 1 {
+			t.Errorf("run %d: piece %q with tree nodes %d, want %q with 1", i, name, treeNodes, r.name)
+		}
+
+		rows, err := db.Query("SELECT file, file_cid, piece, range_offset, range_length FROM file_pieces WHERE run = ? ORDER BY rowid", run)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []PieceRange
+		var wantFiles []string
+		for _, fp := range r.files {
+			for _, pr := range fp.Ranges {
+				want = append(want, pr)
+				wantFiles = append(wantFiles, fp.File)
+			}
+		}
+		n := 0
+		for ; rows.Next(); n++ {
+			var file, fileCid, piece string
+			var offset, length uint64
+			if err := rows.Scan(&file, &fileCid, &piece, &offset, &length); err != nil {
+				t.Fatal(err)
+			}
+			if n >= len(want) {
+				continue
+			}
+			if file != wantFiles[n] || piece != want[n].Piece || offset != want[n].Offset || length != want[n].Length {
+				t.Errorf("run %d, range %d: %s in %s at %d of %d bytes, want %s in %s at %d of %d bytes", i, n, file, piece, offset, length, wantFiles[n], want[n].Piece, want[n].Offset, want[n].Length)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+		if n != len(want) {
+			t.Errorf("run %d: got %d file ranges, want %d", i, n, len(want))
+		}
+	}
+}
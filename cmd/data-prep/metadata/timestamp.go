@@ -0,0 +1,72 @@
+package metadata
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Timestamps formats the timestamps of the csv metadata, in the same way for all commands.
+type Timestamps struct {
+	format string
+	loc    *time.Location
+	// fixed, if set, is the time of every timestamp instead of the current time, and with omit timestamps are left
+	// empty, for metadata that is the same for every run
+	fixed *time.Time
+	omit  bool
+}
+
+// NewTimestamps returns timestamps in the given format, one of rfc3339, unix (epoch seconds), unix-ms (epoch
+// milliseconds) or a Go time layout (e.g. "2006-01-02 15:04:05"), and in the given timezone: UTC, Local or an IANA
+// name like Europe/Berlin. The defaults are rfc3339 and UTC.
+func NewTimestamps(format, timezone string) (Timestamps, error) {
+	if format == "" {
+		format = "rfc3339"
+	}
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return Timestamps{}, fmt.Errorf("invalid timezone %q: %s", timezone, err)
+	}
+	return Timestamps{format: format, loc: loc}, nil
+}
+
+func (ts Timestamps) Format(t time.Time) string {
+	switch ts.format {
+	case "rfc3339":
+		return t.In(ts.loc).Format(time.RFC3339)
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "unix-ms":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	default:
+		return t.In(ts.loc).Format(ts.format)
+	}
+}
+
+// Fixed returns the timestamps of reproducible metadata: every timestamp is at, or left empty if at is nil.
+func (ts Timestamps) Fixed(at *time.Time) Timestamps {
+	ts.fixed, ts.omit = at, at == nil
+	return ts
+}
+
+// Now is the formatted current time, or the fixed one.
+func (ts Timestamps) Now() string {
+	if ts.omit {
+		return ""
+	}
+	return ts.Format(ts.Time())
+}
+
+// Time is the current time, or the fixed one. Left empty timestamps are at the epoch.
+func (ts Timestamps) Time() time.Time {
+	switch {
+	case ts.omit:
+		return time.Unix(0, 0)
+	case ts.fixed != nil:
+		return *ts.fixed
+	}
+	return time.Now()
+}
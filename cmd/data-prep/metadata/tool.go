@@ -0,0 +1,61 @@
+package metadata
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/urfave/cli/v2"
+)
+
+// modules whose versions influence the produced dag and pieces, and are therefore worth recording
+var recordedDeps = []string{
+	"github.com/anjor/anelace",
+	"github.com/filecoin-project/go-fil-commp-hashhash",
+	"github.com/ipfs/go-unixfs",
+	"github.com/ipfs/go-merkledag",
+}
+
+// Tool records the build of the tool and the effective options a set of pieces was produced with, so that a run can
+// be reproduced later on, and discrepancies between runs can be traced back to version or option differences.
+type Tool struct {
+	Version   string            `json:"version" yaml:"version"`
+	GoVersion string            `json:"goVersion" yaml:"goVersion"`
+	Deps      map[string]string `json:"deps,omitempty" yaml:"deps,omitempty"`
+	Command   string            `json:"command" yaml:"command"`
+	Options   map[string]string `json:"options" yaml:"options"`
+	Args      []string          `json:"args,omitempty" yaml:"args,omitempty"`
+}
+
+// NewTool collects the build info of the running binary, and the value of every flag of the running command,
+// including the ones left at their default, keyed by the flag's primary name.
+func NewTool(c *cli.Context) Tool {
+	t := Tool{
+		Version: "unknown",
+		Command: c.Command.Name,
+		Options: make(map[string]string),
+		Args:    c.Args().Slice(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		t.Version = bi.Main.Version
+		t.GoVersion = bi.GoVersion
+		t.Deps = make(map[string]string)
+		for _, dep := range bi.Deps {
+			for _, path := range recordedDeps {
+				if dep.Path == path {
+					t.Deps[path] = dep.Version
+				}
+			}
+		}
+	}
+
+	for _, f := range c.Command.Flags {
+		name := f.Names()[0]
+		if name == "help" {
+			continue
+		}
+		t.Options[name] = fmt.Sprint(c.Value(name))
+	}
+
+	return t
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/progress"
+)
+
+// Server exposes the progress of a run as metrics in the Prometheus text format on /metrics, for monitoring long runs.
+type Server struct {
+	p   *progress.Progress
+	srv *http.Server
+}
+
+// Serve starts serving the metrics of p on addr, e.g. ":9090", until Close. It fails right away if addr can't be
+// listened on.
+func Serve(addr string, p *progress.Progress) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on metrics address: %s", err)
+	}
+	s := &Server{p: p}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.metrics)
+	s.srv = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			logging.Error("metrics server failed", "addr", addr, "err", err)
+		}
+	}()
+	logging.Info("serving metrics", "addr", l.Addr().String())
+	return s, nil
+}
+
+// Close stops serving the metrics, letting scrapes in flight finish.
+func (s *Server) Close() error {
+	if s == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	snap := s.p.Snapshot()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	write(w, "dataprep_input_read_bytes_total", "counter", "Bytes of file data read so far.", float64(snap.Bytes))
+	write(w, "dataprep_input_bytes", "gauge", "Total bytes of file data to read, 0 if not known up front.", float64(snap.TotalBytes))
+	write(w, "dataprep_files_processed_total", "counter", "Files read or skipped so far.", float64(snap.Files))
+	write(w, "dataprep_input_files", "gauge", "Total number of files to read, 0 if not known up front.", float64(snap.TotalFiles))
+	write(w, "dataprep_pieces_completed_total", "counter", "Pieces written so far, along with their commP.", float64(snap.Pieces))
+	write(w, "dataprep_piece_bytes_total", "counter", "Bytes of the pieces written so far, i.e. run through commP.", float64(snap.PieceBytes))
+	var commPRate float64
+	if snap.Elapsed > 0 {
+		commPRate = float64(snap.PieceBytes) / snap.Elapsed
+	}
+	write(w, "dataprep_commp_bytes_per_second", "gauge", "Average commP throughput of the run so far.", commPRate)
+	write(w, "dataprep_read_bytes_per_second", "gauge", "Average read throughput of the run so far.", snap.Rate)
+	write(w, "dataprep_elapsed_seconds", "gauge", "Time since the run started.", snap.Elapsed)
+	write(w, "dataprep_eta_seconds", "gauge", "Estimated time remaining, 0 if not known.", snap.ETA)
+	if f := snap.File; f != "" {
+		fmt.Fprintf(w, "# HELP dataprep_current_file The file being read.\n# TYPE dataprep_current_file gauge\n")
+		fmt.Fprintf(w, "dataprep_current_file{path=\"%s\"} 1\n", escapeLabel(f))
+	}
+}
+
+func write(w io.Writer, name, typ, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, typ, name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// escapeLabel escapes a label value of the text format: backslashes, double quotes and line feeds.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
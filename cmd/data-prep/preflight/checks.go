@@ -0,0 +1,79 @@
+package preflight
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/anjor/anelace"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+)
+
+// CheckWritable makes sure files can be created in dir, by creating and removing a temporary file.
+func CheckWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".data-prep-write-check")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %s", dir, err)
+	}
+	name := f.Name()
+	_, werr := f.WriteString("ok")
+	cerr := f.Close()
+	os.Remove(name)
+	if werr != nil {
+		return fmt.Errorf("%s is not writable: %s", dir, werr)
+	}
+	if cerr != nil {
+		return fmt.Errorf("%s is not writable: %s", dir, cerr)
+	}
+	return nil
+}
+
+// RoundTrip runs a small in-memory file through the whole pipeline, dag building with anelace and splitting with
+// commP, without writing anything to disk, to make sure both work in this environment.
+func RoundTrip() error {
+	payload := bytes.Repeat([]byte("fil-data-prep round trip "), 4096)
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(payload)))
+
+	rerr, werr := io.Pipe()
+	rout, wout := io.Pipe()
+	anl, errs := anelace.NewAnelaceWithWriters(werr, wout)
+	if errs != nil {
+		return fmt.Errorf("failed to set up anelace: %s", errs)
+	}
+	anl.SetMultipart(true)
+
+	go func() {
+		err := anl.ProcessReader(io.MultiReader(bytes.NewReader(size), bytes.NewReader(payload)), nil)
+		werr.CloseWithError(err)
+		wout.CloseWithError(err)
+	}()
+
+	rootsDone := make(chan struct{})
+	var roots []byte
+	var rootsErr error
+	go func() {
+		defer close(rootsDone)
+		roots, rootsErr = io.ReadAll(rerr)
+	}()
+
+	meta, err := splitter.SplitAndCommp(rout, 1<<20, "", splitter.Options{DryRun: true})
+	rout.Close()
+	<-rootsDone
+	if err != nil {
+		return fmt.Errorf("splitting the round trip car stream failed: %s", err)
+	}
+	if rootsErr != nil {
+		return fmt.Errorf("reading the round trip roots failed: %s", rootsErr)
+	}
+	if !strings.Contains(string(roots), `"event":"root"`) {
+		return fmt.Errorf("anelace did not emit a root for the round trip file")
+	}
+	if len(meta.CarPieces) == 0 || !meta.CarPieces[0].CommP.Defined() {
+		return fmt.Errorf("no commP was calculated for the round trip piece")
+	}
+	return nil
+}
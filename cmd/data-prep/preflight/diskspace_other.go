@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package preflight
+
+import "fmt"
+
+// FreeSpace is not supported on this platform.
+func FreeSpace(dir string) (uint64, error) {
+	return 0, fmt.Errorf("checking free disk space is not supported on this platform")
+}
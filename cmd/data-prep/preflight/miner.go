@@ -0,0 +1,149 @@
+package preflight
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// a piece may overshoot the target size by one frame of up to 2MiB, and it starts with a car header, which has
+	// a root cid instead of a nul root with some piece root modes
+	maxPieceOvershoot = 2<<20 + binary.MaxVarintLen64 + 128
+
+	DefaultAPI = "https://api.node.glif.io/rpc/v1"
+)
+
+// TargetSizeForSector returns the largest target size whose pieces still fit into a sector of the given size. A
+// sector holds sectorSize/128*127 bytes of unpadded data, the rest is taken by fr32 padding.
+func TargetSizeForSector(sectorSize uint64) (int, error) {
+	capacity := sectorSize / 128 * 127
+	if capacity <= maxPieceOvershoot {
+		return 0, fmt.Errorf("sector size %d is too small to hold a piece", sectorSize)
+	}
+	return int(capacity - maxPieceOvershoot), nil
+}
+
+// MinerTargetSize looks up the sector size of a miner and returns the target size for pieces filling its sectors.
+// If the lookup fails and a fallback size was given, the fallback is used and the failure returned as a warning.
+func MinerTargetSize(api, miner string, fallback int) (size int, warning string, err error) {
+	sectorSize, err := MinerSectorSize(api, miner, sectorSizeCacheFile())
+	if err != nil {
+		if fallback > 0 {
+			return fallback, fmt.Sprintf("%s, using --size %d instead", err, fallback), nil
+		}
+		return 0, "", fmt.Errorf("%s, pass --size instead", err)
+	}
+	size, err = TargetSizeForSector(sectorSize)
+	return size, "", err
+}
+
+// MinerSectorSize looks up the sector size of a miner with the StateMinerInfo method of a lotus compatible api.
+// Sector sizes of a miner don't change, so they are cached in cacheFile (if not empty), keyed by api and miner.
+func MinerSectorSize(api, miner, cacheFile string) (uint64, error) {
+	cache := make(map[string]uint64)
+	key := api + " " + miner
+	if cacheFile != "" {
+		if b, err := os.ReadFile(cacheFile); err == nil {
+			// a broken cache is as good as no cache
+			_ = json.Unmarshal(b, &cache)
+		}
+		if size, ok := cache[key]; ok {
+			return size, nil
+		}
+	}
+
+	size, err := queryMinerSectorSize(api, miner)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up the sector size of miner %s: %s", miner, err)
+	}
+
+	if cacheFile != "" {
+		cache[key] = size
+		if b, err := json.Marshal(cache); err == nil {
+			if err := os.MkdirAll(filepath.Dir(cacheFile), 0o755); err == nil {
+				_ = os.WriteFile(cacheFile, b, 0o644)
+			}
+		}
+	}
+	return size, nil
+}
+
+func queryMinerSectorSize(api, miner string) (uint64, error) {
+	req, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "Filecoin.StateMinerInfo",
+		"params":  []interface{}{miner, nil},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(api, "application/json", bytes.NewReader(req))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("api returned %s", resp.Status)
+	}
+
+	var res struct {
+		Result *struct {
+			SectorSize uint64
+		}
+		Error *struct {
+			Message string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return 0, fmt.Errorf("failed to decode api response: %s", err)
+	}
+	if res.Error != nil {
+		return 0, fmt.Errorf("api error: %s", res.Error.Message)
+	}
+	if res.Result == nil || res.Result.SectorSize == 0 {
+		return 0, fmt.Errorf("api returned no sector size")
+	}
+	return res.Result.SectorSize, nil
+}
+
+func sectorSizeCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "go-fil-dataprep", "sector-sizes.json")
+}
+
+// SetMinerSize sets the --size flag from the sector size of --miner, if given. An explicitly set --size is only used
+// if the sector size can't be looked up.
+func SetMinerSize(c *cli.Context) error {
+	miner := c.String("miner")
+	if miner == "" {
+		return nil
+	}
+	var fallback int
+	if c.IsSet("size") {
+		fallback = Size(c, "size")
+	}
+	size, warning, err := MinerTargetSize(c.String("api"), miner, fallback)
+	if err != nil {
+		return err
+	}
+	if warning != "" {
+		logging.Warn(warning)
+	}
+	return c.Set("size", strconv.Itoa(size))
+}
@@ -0,0 +1,29 @@
+package preflight
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+)
+
+// CheckMetadataPaths makes sure that none of the files written next to the pieces of a run, i.e. the piece table, the
+// yaml and json metadata and the checkpoint, has a name a piece file could get with the given name prefix. Either would
+// silently overwrite the other.
+func CheckMetadataPaths(meta, tableFormat, namePrefix string) error {
+	base := strings.TrimSuffix(meta, filepath.Ext(meta))
+	paths := []string{
+		metadata.TablePath(meta, tableFormat),
+		base + ".yaml",
+		metadata.JSONPath(meta),
+		base + ".checkpoint.yaml",
+	}
+	for _, p := range paths {
+		if splitter.IsPieceName(p, namePrefix) {
+			return fmt.Errorf("metadata file %s would collide with the name of a piece file, pick another --metadata or --output", p)
+		}
+	}
+	return nil
+}
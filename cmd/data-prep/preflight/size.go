@@ -0,0 +1,210 @@
+package preflight
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// upper bound of what gets added around a block once it is framed in the car stream, besides its cid: the frame
+	// length varint and the unixfs/dag-pb wrapping of the leaf data.
+	blockFrameOverhead = binary.MaxVarintLen64 + 64
+
+	// upper bound of the bytes a link to a block takes in its parent node, besides its cid: the dag-pb link fields
+	// and the unixfs block size.
+	linkOverhead = 32
+
+	// every piece starts with a nul-root car header (varint prefix + 25 bytes of CBOR)
+	pieceCarHeaderSize = 26
+
+	// below this, pieces are too small to be worth a deal for most storage providers
+	recommendedMinSize = 1 << 30
+)
+
+// Blocks bounds the blocks of the dags of the files, which the framing of the car stream depends on.
+type Blocks struct {
+	// MaxSize is the most bytes a block takes: a leaf of file data, or a node linking to the blocks below it.
+	MaxSize int
+	// MinLeafSize is the fewest bytes of file data a leaf holds, but for the last one of a file.
+	MinLeafSize int
+	// MaxCidLen is the longest cid of a block.
+	MaxCidLen int
+}
+
+// DefaultBlocks are the blocks of the default dags: leaves of 1MiB, with CIDv1 sha2-256 cids.
+var DefaultBlocks = Blocks{MaxSize: 1 << 20, MinLeafSize: 1 << 20, MaxCidLen: 36}
+
+// NodeSize bounds the size of a dag-pb node with the given number of links to blocks of cids of up to cidLen bytes.
+func NodeSize(links, cidLen int) int {
+	return links * (cidLen + linkOverhead)
+}
+
+// frameOverhead is the most bytes framing a block in the car stream takes.
+func (b Blocks) frameOverhead() int {
+	return blockFrameOverhead + b.MaxCidLen
+}
+
+// MinTargetSize is the smallest target size that holds any single block, framed, after the piece car header.
+func (b Blocks) MinTargetSize() int {
+	return b.MaxSize + b.frameOverhead() + pieceCarHeaderSize
+}
+
+// ValidateTargetSize checks that the largest block (plus framing and the piece car header) fits in the target piece
+// size. Pieces are cut at block boundaries, so anything smaller would result in every piece overshooting the target.
+func ValidateTargetSize(size int, b Blocks) error {
+	if size <= 0 {
+		return fmt.Errorf("target size must be positive, got %d", size)
+	}
+
+	minSize := b.MinTargetSize()
+	if size < minSize {
+		return fmt.Errorf(
+			"target size %d is too small: a single %d byte block plus up to %d bytes of cid/car framing and a %d byte piece car header can take up to %d bytes, so every piece would exceed the target size. Use --size %d or larger",
+			size, b.MaxSize, b.frameOverhead(), pieceCarHeaderSize, minSize, minSize,
+		)
+	}
+
+	return nil
+}
+
+// TargetSizeWarning returns a warning for target sizes that are valid, but smaller than what makes sense for deals,
+// or an empty string.
+func TargetSizeWarning(size int) string {
+	if size < recommendedMinSize {
+		return fmt.Sprintf("target size %d is below %d bytes: this results in many small pieces, which most storage providers don't accept deals for", size, recommendedMinSize)
+	}
+	return ""
+}
+
+// EstimateOutputSize estimates the size of the pieces written for inputSize bytes of files: the data itself, the
+// framing of its leaf blocks and the links to them, plus a 1% margin for the directory nodes.
+func EstimateOutputSize(inputSize uint64, b Blocks) uint64 {
+	leaves := inputSize/uint64(b.MinLeafSize) + 1
+	return inputSize + leaves*uint64(b.frameOverhead()+NodeSize(1, b.MaxCidLen)) + inputSize/100
+}
+
+// CheckDiskSpace fails if the filesystem holding dir has less than needed bytes available.
+func CheckDiskSpace(dir string, needed uint64) error {
+	free, err := FreeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check free disk space in %s: %s", dir, err)
+	}
+	if free < needed {
+		return fmt.Errorf("not enough disk space in %s: the pieces are estimated to take %d bytes, but only %d bytes are available. Free up space, write the pieces elsewhere with --output, or pass --ignore-disk-space", dir, needed, free)
+	}
+	return nil
+}
+
+// units of the sizes taken by ByteSize, matched case insensitively
+var byteUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+	"pib": 1 << 50,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"pb":  1e15,
+}
+
+// ParseByteSize parses a size in bytes, given as a plain number of bytes (17179869184) or with a binary (16GiB) or
+// decimal (500MB) unit. Fractions are rounded down to whole bytes.
+func ParseByteSize(s string) (int64, error) {
+	t := strings.TrimSpace(s)
+	end := strings.IndexFunc(t, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if end < 0 {
+		end = len(t)
+	}
+	unit, ok := byteUnits[strings.ToLower(strings.TrimSpace(t[end:]))]
+	if !ok || end == 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes, optionally with a unit like KiB, MiB, GiB, TiB, MB or GB", s)
+	}
+	if n, err := strconv.ParseInt(t[:end], 10, 64); err == nil {
+		if n > math.MaxInt64/unit {
+			return 0, fmt.Errorf("size %q is too large", s)
+		}
+		return n * unit, nil
+	}
+	f, err := strconv.ParseFloat(t[:end], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %s", s, err)
+	}
+	if f*float64(unit) >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return int64(f * float64(unit)), nil
+}
+
+// ByteSize is the value of a size flag, parsed by ParseByteSize. It prints as a plain number of bytes, so that it can be
+// passed on to another run as it is.
+type ByteSize int64
+
+func NewByteSize(size int64) *ByteSize {
+	s := ByteSize(size)
+	return &s
+}
+
+func (s *ByteSize) Set(v string) error {
+	n, err := ParseByteSize(v)
+	if err != nil {
+		return err
+	}
+	*s = ByteSize(n)
+	return nil
+}
+
+// Get returns the size in bytes, it makes ByteSize a flag.Getter, as cli.Context.Value expects of every flag.
+func (s *ByteSize) Get() interface{} {
+	return int64(*s)
+}
+
+func (s *ByteSize) String() string {
+	if s == nil {
+		return "0"
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+// Size returns the value of the size flag name, see ByteSize.
+func Size(c *cli.Context, name string) int {
+	if s, ok := c.Generic(name).(*ByteSize); ok && s != nil {
+		return int(*s)
+	}
+	return 0
+}
+
+// SetPieceSize sets --size and --pad-to from --piece-size, if given: the target size is the largest whose pieces still
+// fit into that padded piece size, and every piece is padded to exactly that size, as a deal for a whole sector
+// expects it.
+func SetPieceSize(c *cli.Context) error {
+	if !c.IsSet("piece-size") {
+		return nil
+	}
+	for _, name := range []string{"size", "miner", "pad-to"} {
+		if c.IsSet(name) {
+			return fmt.Errorf("--piece-size can't be combined with --%s", name)
+		}
+	}
+	pieceSize := uint64(Size(c, "piece-size"))
+	if pieceSize < 128 || bits.OnesCount64(pieceSize) != 1 {
+		return fmt.Errorf("piece size %d is not a valid padded piece size, expected a power of two like 16GiB or 32GiB", pieceSize)
+	}
+	size, err := TargetSizeForSector(pieceSize)
+	if err != nil {
+		return err
+	}
+	if err := c.Set("size", strconv.Itoa(size)); err != nil {
+		return err
+	}
+	return c.Set("pad-to", strconv.FormatUint(pieceSize, 10))
+}
@@ -0,0 +1,255 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Report modes, see New.
+const (
+	ModeBar  = "bar"
+	ModeJSON = "json"
+)
+
+// barWidth is the number of characters of the progress bar itself.
+const barWidth = 30
+
+// Progress counts the files and bytes read and the pieces written by a run, and reports them, along with the estimated
+// time remaining, every interval while it runs. All methods are safe for concurrent use, and do nothing on a nil
+// Progress, so that callers don't have to check whether progress is reported.
+type Progress struct {
+	mode     string
+	interval time.Duration
+	w        io.Writer
+	terminal bool
+	start    time.Time
+
+	files      atomic.Int64
+	bytes      atomic.Int64
+	pieces     atomic.Int64
+	pieceBytes atomic.Int64
+	// totals, if known, i.e. greater than 0
+	totalFiles atomic.Int64
+	totalBytes atomic.Int64
+	// the file being read
+	file atomic.Value
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Snapshot is the progress of a run at some point, as reported in json mode.
+type Snapshot struct {
+	Elapsed    float64 `json:"elapsed"` // seconds
+	Files      int64   `json:"files"`
+	TotalFiles int64   `json:"totalFiles,omitempty"`
+	Bytes      int64   `json:"bytes"`
+	TotalBytes int64   `json:"totalBytes,omitempty"`
+	Pieces     int64   `json:"pieces"`
+	PieceBytes int64   `json:"pieceBytes"`
+	Rate       float64 `json:"rate"`          // bytes read per second
+	ETA        float64 `json:"eta,omitempty"` // seconds, only set once the total size is known and some of it was read
+	Done       bool    `json:"done,omitempty"`
+	File       string  `json:"file,omitempty"` // the file being read
+}
+
+// New returns a progress reporting to stderr in the given mode: ModeBar draws a progress bar, redrawn in place on a
+// terminal and written as a line every interval otherwise, and ModeJSON writes a Snapshot as a json line every
+// interval. With an empty mode nothing is reported, the progress is only counted, e.g. for metrics.
+func New(mode string, interval time.Duration) (*Progress, error) {
+	switch mode {
+	case "", ModeBar, ModeJSON:
+	default:
+		return nil, fmt.Errorf("unknown progress mode %q, expected one of: %s, %s", mode, ModeBar, ModeJSON)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("progress interval must be positive, got %s", interval)
+	}
+	terminal := false
+	if fi, err := os.Stderr.Stat(); err == nil {
+		terminal = fi.Mode()&os.ModeCharDevice != 0
+	}
+	return &Progress{mode: mode, interval: interval, w: os.Stderr, terminal: terminal, start: time.Now()}, nil
+}
+
+// SetTotal sets the total size and number of the files to read, if they are known up front.
+func (p *Progress) SetTotal(bytes uint64, files int) {
+	if p == nil {
+		return
+	}
+	p.totalBytes.Store(int64(bytes))
+	p.totalFiles.Store(int64(files))
+}
+
+// Read counts n bytes of file data read.
+func (p *Progress) Read(n int) {
+	if p == nil || n <= 0 {
+		return
+	}
+	p.bytes.Add(int64(n))
+}
+
+// StartFile records name as the file being read.
+func (p *Progress) StartFile(name string) {
+	if p == nil {
+		return
+	}
+	p.file.Store(name)
+}
+
+// File returns the name of the file being read, if any.
+func (p *Progress) File() string {
+	if p == nil {
+		return ""
+	}
+	name, _ := p.file.Load().(string)
+	return name
+}
+
+// FileDone counts a file as processed, once it has been read or was skipped.
+func (p *Progress) FileDone() {
+	if p == nil {
+		return
+	}
+	p.files.Add(1)
+}
+
+// Piece counts a piece of size bytes as written.
+func (p *Progress) Piece(size uint64) {
+	if p == nil {
+		return
+	}
+	p.pieces.Add(1)
+	p.pieceBytes.Add(int64(size))
+}
+
+// Start starts reporting every interval, until Stop.
+func (p *Progress) Start() {
+	if p == nil {
+		return
+	}
+	p.start = time.Now()
+	if p.mode == "" {
+		return
+	}
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report(false)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops reporting, and reports the progress a last time.
+func (p *Progress) Stop() {
+	if p == nil || p.stop == nil {
+		return
+	}
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		<-p.done
+		p.report(true)
+	})
+}
+
+// Snapshot returns the progress so far.
+func (p *Progress) Snapshot() Snapshot {
+	elapsed := time.Since(p.start).Seconds()
+	s := Snapshot{
+		Elapsed:    elapsed,
+		Files:      p.files.Load(),
+		TotalFiles: p.totalFiles.Load(),
+		Bytes:      p.bytes.Load(),
+		TotalBytes: p.totalBytes.Load(),
+		Pieces:     p.pieces.Load(),
+		PieceBytes: p.pieceBytes.Load(),
+		File:       p.File(),
+	}
+	if elapsed > 0 {
+		s.Rate = float64(s.Bytes) / elapsed
+	}
+	if s.TotalBytes > 0 && s.Bytes > 0 && s.Bytes < s.TotalBytes {
+		s.ETA = elapsed * float64(s.TotalBytes-s.Bytes) / float64(s.Bytes)
+	}
+	return s
+}
+
+func (p *Progress) report(done bool) {
+	s := p.Snapshot()
+	s.Done = done
+	if p.mode == ModeJSON {
+		line, _ := json.Marshal(s)
+		fmt.Fprintf(p.w, "%s\n", line)
+		return
+	}
+	if !p.terminal {
+		fmt.Fprintf(p.w, "%s\n", s.bar())
+		return
+	}
+	// redraw the line in place, clearing what is left of a longer previous one
+	end := ""
+	if done {
+		end = "\n"
+	}
+	fmt.Fprintf(p.w, "\r%s\x1b[K%s", s.bar(), end)
+}
+
+// bar formats the snapshot as a progress bar, if the total size is known, followed by the counts.
+func (s Snapshot) bar() string {
+	var b strings.Builder
+	if s.TotalBytes > 0 {
+		frac := float64(s.Bytes) / float64(s.TotalBytes)
+		if frac > 1 {
+			frac = 1
+		}
+		filled := int(frac * barWidth)
+		fmt.Fprintf(&b, "[%s%s] %5.1f%% ", strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), frac*100)
+		fmt.Fprintf(&b, "%s / %s", formatBytes(s.Bytes), formatBytes(s.TotalBytes))
+	} else {
+		b.WriteString(formatBytes(s.Bytes))
+	}
+	if s.TotalFiles > 0 {
+		fmt.Fprintf(&b, ", %d/%d files", s.Files, s.TotalFiles)
+	} else {
+		fmt.Fprintf(&b, ", %d files", s.Files)
+	}
+	fmt.Fprintf(&b, ", %d pieces (%s)", s.Pieces, formatBytes(s.PieceBytes))
+	fmt.Fprintf(&b, ", %s/s", formatBytes(int64(s.Rate)))
+	switch {
+	case s.Done:
+		fmt.Fprintf(&b, ", done in %s", time.Duration(s.Elapsed*float64(time.Second)).Round(time.Millisecond))
+	case s.ETA > 0:
+		fmt.Fprintf(&b, ", ETA %s", time.Duration(s.ETA*float64(time.Second)).Round(time.Second))
+	}
+	return b.String()
+}
+
+// formatBytes formats a size in binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,227 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/preflight"
+)
+
+// States of a job.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// jobRequest is the body of POST /jobs: the paths to prep, which are read by the service, the target size, and
+// optionally the directory to write the pieces to instead of the job directory.
+type jobRequest struct {
+	Paths  []string `json:"paths"`
+	Size   int      `json:"size,omitempty"`
+	Output string   `json:"output,omitempty"`
+}
+
+// job is the status of a job, and once it is done, its results, as returned by GET /jobs/<job>.
+type job struct {
+	ID       string     `json:"id"`
+	State    string     `json:"state"`
+	Paths    []string   `json:"paths"`
+	Size     int        `json:"size"`
+	Output   string     `json:"output,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Pieces   []piece    `json:"pieces"`
+	RootCid  string     `json:"rootCid,omitempty"`
+	Metadata string     `json:"metadata,omitempty"` // url of the metadata file
+	Error    string     `json:"error,omitempty"`
+}
+
+// piece is a piece written by a job.
+type piece struct {
+	Name       string `json:"name"`
+	CommP      string `json:"commP"`
+	PaddedSize uint64 `json:"paddedSize"`
+	URL        string `json:"url,omitempty"` // only set for pieces written to the job directory
+}
+
+// jobs creates a job with POST, running it in the background, and lists all jobs with GET.
+func (s *server) jobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.createJob(w, r)
+	case http.MethodGet, http.MethodHead:
+		s.mu.Lock()
+		list := make([]job, 0, len(s.jobList))
+		for _, j := range s.jobList {
+			list = append(list, snapshot(j))
+		}
+		s.mu.Unlock()
+		sort.Slice(list, func(i, k int) bool { return list[i].Created.Before(list[k].Created) })
+		writeJSON(w, http.StatusOK, list)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) createJob(w http.ResponseWriter, r *http.Request) {
+	var req jobRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid job: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.validateJob(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid job: %s", err), http.StatusBadRequest)
+		return
+	}
+	id, err := newJobID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.MkdirAll(filepath.Join(s.dir, id), 0o755); err != nil {
+		http.Error(w, fmt.Sprintf("failed to create job directory: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	j := &job{ID: id, State: jobQueued, Paths: req.Paths, Size: req.Size, Output: req.Output, Created: time.Now().UTC(), Pieces: []piece{}}
+	s.mu.Lock()
+	s.jobList[id] = j
+	status := snapshot(j)
+	s.mu.Unlock()
+	go s.runJob(j)
+
+	w.Header().Set("Location", "/jobs/"+id)
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// validateJob checks the paths and output of a job, and fills in the default size. With --root, the paths and the
+// output have to be in it.
+func (s *server) validateJob(req *jobRequest) error {
+	if len(req.Paths) == 0 {
+		return fmt.Errorf("expected some paths to prep, found none")
+	}
+	if req.Size == 0 {
+		req.Size = s.size
+	}
+	if err := preflight.ValidateTargetSize(req.Size, preflight.DefaultBlocks); err != nil {
+		return err
+	}
+	for i, p := range req.Paths {
+		if strings.HasPrefix(p, "s3://") && s.root == "" {
+			continue
+		}
+		abs, err := s.checkInRoot(p)
+		if err != nil {
+			return fmt.Errorf("path %s: %s", p, err)
+		}
+		req.Paths[i] = abs
+	}
+	if req.Output != "" {
+		if err := os.MkdirAll(req.Output, 0o755); err != nil {
+			return fmt.Errorf("failed to create output directory: %s", err)
+		}
+		abs, err := s.checkInRoot(req.Output)
+		if err != nil {
+			return fmt.Errorf("output %s: %s", req.Output, err)
+		}
+		req.Output = abs
+	}
+	return nil
+}
+
+// checkInRoot returns the absolute path of an existing path, failing if it is not in --root, if set, once symlinks are
+// resolved. The path itself is kept as it is, as its name goes into the dag.
+func (s *server) checkInRoot(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", err
+	}
+	if s.root == "" {
+		return abs, nil
+	}
+	rel, err := filepath.Rel(s.root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("not in %s", s.root)
+	}
+	return abs, nil
+}
+
+// runJob runs a job once one of the --max-jobs slots is free, recording its pieces as they are written.
+func (s *server) runJob(j *job) {
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+
+	s.mu.Lock()
+	started := time.Now().UTC()
+	j.State, j.Started = jobRunning, &started
+	s.mu.Unlock()
+	logging.Info("job started", "job", j.ID, "paths", strings.Join(j.Paths, ","))
+
+	err := s.run(j.ID, j.Paths, j.Size, j.Output, func(e event) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		switch e.Event {
+		case "piece":
+			j.Pieces = append(j.Pieces, piece{Name: e.Name, CommP: e.CommP, PaddedSize: e.PaddedSize, URL: e.URL})
+		case "done":
+			j.RootCid, j.Metadata = e.RootCid, e.URL
+		}
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := time.Now().UTC()
+	j.Finished = &finished
+	if err != nil {
+		j.State, j.Error = jobFailed, err.Error()
+		logging.Error("job failed", "job", j.ID, "err", err)
+		return
+	}
+	j.State = jobDone
+	logging.Info("job done", "job", j.ID, "rootCid", j.RootCid, "pieces", len(j.Pieces))
+}
+
+// status returns the status of a job, along with its results once done.
+func (s *server) status(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	j, ok := s.jobList[id]
+	var status job
+	if ok {
+		status = snapshot(j)
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// snapshot copies a job, so that it can be encoded without holding the lock, which must be held to copy it.
+func snapshot(j *job) job {
+	c := *j
+	c.Pieces = append([]piece{}, j.Pieces...)
+	return c
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
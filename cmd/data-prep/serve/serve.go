@@ -0,0 +1,369 @@
+package serve
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/preflight"
+	"github.com/urfave/cli/v2"
+)
+
+var Cmd = &cli.Command{
+	Name:   "serve",
+	Usage:  "run data prep as an http service",
+	Action: serve,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "listen",
+			Required: false,
+			Value:    ":8080",
+			Usage:    "address to listen on.",
+		},
+		&cli.StringFlag{
+			Name:     "dir",
+			Required: true,
+			Usage:    "directory to keep the uploads, pieces and metadata of all jobs in.",
+		},
+		&cli.GenericFlag{
+			Name:     "size",
+			Aliases:  []string{"s"},
+			Required: false,
+			Value:    preflight.NewByteSize(2 << 20),
+			Usage:    "default target size to chunk CARs to, in bytes or with a unit like GiB or GB, can be overridden per upload with ?size=.",
+		},
+		&cli.Int64Flag{
+			Name:     "max-upload",
+			Required: false,
+			Usage:    "optional maximum size in bytes of an upload.",
+		},
+		&cli.StringFlag{
+			Name:     "root",
+			Required: false,
+			Usage:    "optional directory that the paths and outputs of jobs created with POST /jobs have to be in, as they are read and written by the service.",
+		},
+		&cli.IntFlag{
+			Name:     "max-jobs",
+			Required: false,
+			Value:    1,
+			Usage:    "number of jobs created with POST /jobs that run at the same time, the others are queued.",
+		},
+	},
+}
+
+const (
+	inputDir     = "input"
+	piecesDir    = "pieces"
+	metadataFile = "metadata.yaml"
+	// marks the lines of the per piece --exec hook in the output of the prep process
+	pieceLine = "serve-piece"
+)
+
+type server struct {
+	self      string
+	dir       string
+	size      int
+	maxUpload int64
+	root      string
+
+	// the jobs created with POST /jobs, and the slots of the ones running
+	mu      sync.Mutex
+	jobList map[string]*job
+	slots   chan struct{}
+}
+
+// event is a line of the ndjson stream sent back for an upload.
+type event struct {
+	Event      string `json:"event"`
+	Job        string `json:"job,omitempty"`
+	Name       string `json:"name,omitempty"`
+	CommP      string `json:"commP,omitempty"`
+	PaddedSize uint64 `json:"paddedSize,omitempty"`
+	URL        string `json:"url,omitempty"`
+	RootCid    string `json:"rootCid,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func serve(c *cli.Context) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the data-prep executable: %s", err)
+	}
+	if err := preflight.ValidateTargetSize(preflight.Size(c, "size"), preflight.DefaultBlocks); err != nil {
+		return err
+	}
+	dir := c.String("dir")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create jobs directory: %s", err)
+	}
+
+	if c.Int("max-jobs") < 1 {
+		return fmt.Errorf("--max-jobs must be at least 1, got %d", c.Int("max-jobs"))
+	}
+	var root string
+	if c.String("root") != "" {
+		if root, err = filepath.Abs(c.String("root")); err == nil {
+			root, err = filepath.EvalSymlinks(root)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid --root: %s", err)
+		}
+	}
+
+	s := &server{
+		self:      self,
+		dir:       dir,
+		size:      preflight.Size(c, "size"),
+		maxUpload: c.Int64("max-upload"),
+		root:      root,
+		jobList:   make(map[string]*job),
+		slots:     make(chan struct{}, c.Int("max-jobs")),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prep", s.prep)
+	mux.HandleFunc("/jobs", s.jobs)
+	mux.HandleFunc("/jobs/", s.download)
+
+	fmt.Printf("serving on %s\n", c.String("listen"))
+	return http.ListenAndServe(c.String("listen"), mux)
+}
+
+// prep takes an upload, either a tarball (Content-Type application/x-tar) or a single file named by ?name=, and runs
+// it through fil-data-prep. Progress is streamed back as ndjson: a job event, an event for every piece as soon as it
+// is written, and finally a done event with the root cid, or an error event.
+func (s *server) prep(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	size := s.size
+	if v := r.URL.Query().Get("size"); v != "" {
+		n, err := preflight.ParseByteSize(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		size = int(n)
+		if err := preflight.ValidateTargetSize(size, preflight.DefaultBlocks); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jobDir := filepath.Join(s.dir, id)
+	body := io.Reader(r.Body)
+	if s.maxUpload > 0 {
+		body = http.MaxBytesReader(w, r.Body, s.maxUpload)
+	}
+	var input string
+	if r.Header.Get("Content-Type") == "application/x-tar" {
+		input, err = extractTar(body, filepath.Join(jobDir, inputDir))
+	} else {
+		input, err = saveFile(body, filepath.Join(jobDir, inputDir), r.URL.Query().Get("name"))
+	}
+	if err != nil {
+		os.RemoveAll(jobDir)
+		http.Error(w, fmt.Sprintf("failed to receive upload: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	send := newEventWriter(w)
+	send(event{Event: "job", Job: id})
+	if err := s.run(id, []string{input}, size, "", send); err != nil {
+		send(event{Event: "error", Job: id, Error: err.Error()})
+	}
+}
+
+// run preps the inputs of a job in a separate process, so that a failing job doesn't take the service down. The
+// pieces are written to output, if set, and otherwise to the job directory, from where they are served.
+func (s *server) run(id string, inputs []string, size int, output string, send func(event)) error {
+	jobDir := filepath.Join(s.dir, id)
+	pieces := filepath.Join(jobDir, piecesDir)
+	if output != "" {
+		pieces = output
+	}
+	args := []string{"fil-data-prep",
+		"--size=" + strconv.Itoa(size),
+		"--output=" + pieces + string(filepath.Separator),
+		"--metadata=" + filepath.Join(jobDir, metadataFile),
+		"--exec=echo " + pieceLine + " {commp} {padded_size} {file}",
+		"--",
+	}
+	cmd := exec.Command(s.self, append(args, inputs...)...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start prep: %s", err)
+	}
+
+	var lines []string
+	sc := bufio.NewScanner(stdout)
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), " ", 4)
+		if len(fields) != 4 || fields[0] != pieceLine {
+			lines = append(lines, sc.Text())
+			continue
+		}
+		padded, _ := strconv.ParseUint(fields[2], 10, 64)
+		e := event{Event: "piece", Job: id, Name: filepath.Base(fields[3]), CommP: fields[1], PaddedSize: padded}
+		if output == "" {
+			e.URL = "/jobs/" + id + "/" + piecesDir + "/" + e.Name
+		}
+		send(e)
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("prep failed: %s: %s", err, strings.Join(lines, "\n"))
+	}
+
+	m, err := metadata.Read(filepath.Join(jobDir, metadataFile))
+	if err != nil {
+		return err
+	}
+	send(event{Event: "done", Job: id, RootCid: m.RootCid, URL: "/jobs/" + id + "/" + metadataFile})
+	return nil
+}
+
+// download serves the status of a job created with POST /jobs, and the pieces and metadata of all jobs. Uploads are not
+// served back.
+func (s *server) download(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	if len(parts) == 1 {
+		s.status(w, parts[0])
+		return
+	}
+	var rel string
+	switch {
+	case len(parts) == 2 && parts[1] == metadataFile:
+		rel = metadataFile
+	case len(parts) == 3 && parts[1] == piecesDir && validName(parts[2]):
+		rel = filepath.Join(piecesDir, parts[2])
+	}
+	if rel == "" || !validName(parts[0]) {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(s.dir, parts[0], rel))
+}
+
+func newEventWriter(w http.ResponseWriter) func(event) {
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	return func(e event) {
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to create job id: %s", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// saveFile writes a single uploaded file into dir and returns its path.
+func saveFile(r io.Reader, dir, name string) (string, error) {
+	if name == "" {
+		name = "data"
+	}
+	if !validName(name) {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// extractTar unpacks the regular files and directories of a tarball into dir and returns dir. Entries pointing
+// outside of dir are rejected, other entry types (links, devices) are skipped.
+func extractTar(r io.Reader, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	tr := tar.NewReader(r)
+	var files int
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("tar entry %q points outside of the upload", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				return "", err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return "", err
+			}
+			f, err := os.Create(path)
+			if err != nil {
+				return "", err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return "", err
+			}
+			files++
+		}
+	}
+	if files == 0 {
+		return "", fmt.Errorf("no files in tarball")
+	}
+	return dir, nil
+}
@@ -1,34 +1,58 @@
 package split_and_commp
 
 import (
-	"encoding/csv"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/anjor/carlet"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/hooks"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/preflight"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/trace"
+	"github.com/ipfs/go-cid"
 	"github.com/urfave/cli/v2"
-	"gopkg.in/yaml.v2"
 )
 
 var Cmd = &cli.Command{
 	Name:    "split-and-commp",
 	Usage:   "Split CAR and calculate commp",
 	Aliases: []string{"sac"},
-	Action:  splitAndCommpAction,
-	Flags:   splitAndCommpFlags,
+	// several cars, or a directory of cars, get concatenated and re-split uniformly
+	ArgsUsage: "[car file or directory of car files...]",
+	Action:    splitAndCommpAction,
+	Flags:     splitAndCommpFlags,
 }
 
 var splitAndCommpFlags = []cli.Flag{
-	&cli.IntFlag{
+	&cli.GenericFlag{
 		Name:     "size",
 		Aliases:  []string{"s"},
-		Required: true,
-		Usage:    "Target size in bytes to chunk CARs to.",
+		Required: false,
+		Value:    preflight.NewByteSize(0),
+		Usage:    "Target size to chunk CARs to, in bytes or with a unit like GiB or GB. Required unless --miner or --piece-size is given.",
+	},
+	&cli.GenericFlag{
+		Name:     "piece-size",
+		Required: false,
+		Value:    preflight.NewByteSize(0),
+		Usage:    "optional padded piece size (a power of two like 16GiB or 32GiB) every piece is padded to exactly, with --size set to fill it. Replaces --size and --pad-to.",
+	},
+	&cli.StringFlag{
+		Name:     "miner",
+		Required: false,
+		Usage:    "optional miner id (e.g. f01234) to pick --size from: the target size is set to fill the miner's sectors. An explicit --size is only used if the sector size can't be looked up.",
+	},
+	&cli.StringFlag{
+		Name:     "api",
+		Required: false,
+		Value:    preflight.DefaultAPI,
+		Usage:    "lotus compatible api endpoint to look up the --miner sector size with. Sector sizes are cached in the user cache directory.",
 	},
 	&cli.StringFlag{
 		Name:     "output",
@@ -36,6 +60,17 @@ var splitAndCommpFlags = []cli.Flag{
 		Required: true,
 		Usage:    "optional output filename prefix for car files.",
 	},
+	&cli.StringFlag{
+		Name:     "name-template",
+		Required: false,
+		Usage:    "optional template of the piece file names, with the placeholders {prefix} (the --output prefix), {index} (or e.g. {index:05d}), {piececid} and {rootcid} (--payload-cid, or the first root of the car header), e.g. {piececid}.car. Defaults to {prefix}{piececid}.car.",
+	},
+	&cli.BoolFlag{
+		Name:     "rename-to-commp",
+		Required: false,
+		Usage:    "once the run completed, rename every piece file with a commP to <piececid>.car, without the --output prefix, and record the new names in the metadata. Existing files are never replaced. Not supported with --exec, --webhook, --push, --upload and --emit-retrieval-index, which see the names during the run.",
+		Value:    false,
+	},
 	&cli.StringFlag{
 		Name:     "metadata",
 		Aliases:  []string{"m"},
@@ -50,97 +85,753 @@ var splitAndCommpFlags = []cli.Flag{
 		Usage:    "optional dry run. Do not write split CARs to disk (but still write metadata).",
 		Value:    false,
 	},
+	&cli.Float64Flag{
+		Name:     "commp-sample",
+		Required: false,
+		Usage:    "optional fraction (0-1) of pieces to calculate commP for, for quick spot checks. Pieces without commP keep their index based name and have an empty piece cid in the metadata.",
+	},
+	&cli.IntFlag{
+		Name:     "commp-every",
+		Required: false,
+		Usage:    "optional, only calculate commP for every n-th piece. Takes precedence over --commp-sample.",
+	},
+	&cli.Uint64Flag{
+		Name:     "pad-to",
+		Required: false,
+		Usage:    "optional, pad every piece to this padded piece size (a power of two, e.g. 34359738368 for 32GiB sectors) and calculate commP over the padded piece. The padded size of the content alone is recorded as naturalPaddedSize.",
+	},
+	&cli.BoolFlag{
+		Name:     "pad-last",
+		Required: false,
+		Usage:    "pad the last piece, usually much smaller than the others, to the padded piece size of a piece holding --size, and calculate commP over the padded piece. The padded size of the content alone is recorded as naturalPaddedSize. Has no effect with --pad-to.",
+		Value:    false,
+	},
+	&cli.BoolFlag{
+		Name:     "content-defined-pieces",
+		Required: false,
+		Usage:    "cut pieces at content defined boundaries: after a block picked by its cid, once a piece holds at least half of --size, instead of at --size. The same content then makes for the same pieces across runs and datasets, for deduplication at the piece level.",
+		Value:    false,
+	},
+	&cli.StringFlag{
+		Name:     "commp-cache",
+		Required: false,
+		Usage:    "optional directory to cache the commP of pieces in, keyed by their blocks. Pieces found in the cache on a later run skip the commP calculation, others are read back from disk once written to calculate it.",
+	},
+	&cli.BoolFlag{
+		Name:     "commp-skip-zeros",
+		Required: false,
+		Usage:    "optional, short-circuit commP over all-zero regions instead of hashing them. Gives the same commP, but is much faster on sparse inputs like disk images.",
+	},
+	&cli.BoolFlag{
+		Name:     "aggregate-proofs",
+		Required: false,
+		Usage:    "add the FRC-0058 inclusion proofs of the pieces in an aggregate of all of them to the yaml metadata.",
+		Value:    false,
+	},
+	&cli.Uint64Flag{
+		Name:     "aggregate-deal-size",
+		Required: false,
+		Usage:    "optional padded size of the aggregate for --aggregate-proofs. Defaults to the smallest size holding all pieces and the index.",
+	},
+	&cli.IntFlag{
+		Name:     "commp-workers",
+		Required: false,
+		Usage:    "optional number of pieces to calculate commP of at the same time, from the piece files, while the next pieces are written. Pieces are still recorded in the order of the car stream. Ignored with --dry-run.",
+		Value:    1,
+	},
+	&cli.IntFlag{
+		Name:     "car-version",
+		Required: false,
+		Usage:    "car format of the pieces, 1 or 2. CARv2 pieces wrap the CARv1 piece with a CARv2 header and an index of its blocks, for fast random access. Their commP is calculated from the piece files, so they can't be combined with --dry-run.",
+		Value:    1,
+	},
+	&cli.StringFlag{
+		Name:     "commp-algorithm",
+		Required: false,
+		Value:    splitter.FilCommitmentUnsealed.Name(),
+		Usage:    "piece commitment algorithm, one of: " + strings.Join(splitter.CommPAlgorithmNames(), ", ") + ". Recorded in the metadata.",
+	},
+	&cli.StringFlag{
+		Name:     "framing",
+		Required: false,
+		Value:    "carv1",
+		Usage:    "length prefix framing of the input stream, one of: " + strings.Join(splitter.FramingNames(), ", ") + ". Pieces are always written as CARv1.",
+	},
+	&cli.StringFlag{
+		Name:     "payload-cid",
+		Required: false,
+		Usage:    "optional root cid of the dag in the car, recorded in the metadata and used by --piece-root-mode dataset. Defaults to the first root of the car header, use this for cars with a nul or placeholder root.",
+	},
+	&cli.StringFlag{
+		Name:     "piece-root-mode",
+		Required: false,
+		Value:    "null",
+		Usage:    "root to put in the car header of every piece, one of: null, first-block, dataset. dataset uses --payload-cid, or the first root of the input car header.",
+	},
+	&cli.DurationFlag{
+		Name:     "checkpoint-interval",
+		Required: false,
+		Usage:    "optional interval (e.g. 10m) at which the progress (stream offset and completed pieces) is saved to a checkpoint file next to the metadata file, so that a crashed run can be continued with --resume.",
+	},
+	&cli.BoolFlag{
+		Name:     "resume",
+		Required: false,
+		Usage:    "continue a previous run from its checkpoint file. The inputs and options must be the same as for the original run.",
+		Value:    false,
+	},
+	&cli.StringFlag{
+		Name:     "timestamp-format",
+		Required: false,
+		Value:    "rfc3339",
+		Usage:    "format of the csv metadata timestamps: rfc3339, unix (epoch seconds), unix-ms (epoch milliseconds) or a Go time layout like \"2006-01-02 15:04:05\".",
+	},
+	&cli.StringFlag{
+		Name:     "timezone",
+		Required: false,
+		Value:    "UTC",
+		Usage:    "timezone of the csv metadata timestamps: UTC, Local or an IANA name like Europe/Berlin.",
+	},
+	&cli.StringFlag{
+		Name:     "format",
+		Required: false,
+		Value:    metadata.FormatCSV,
+		Usage:    "format of the piece table: csv, parquet or ndjson (written next to the metadata file, with a .parquet or .ndjson extension, instead of the csv). ndjson rows are written as the pieces complete, followed by a summary record. The yaml metadata is written either way.",
+	},
+	&cli.StringFlag{
+		Name:     "metadata-format",
+		Required: false,
+		Value:    metadata.DefaultDocuments,
+		Usage:    "metadata documents to write, a comma separated list of: csv (the piece table, in the --format), yaml, json (a single document with the root cid, the pieces with their commP, sizes and stream offsets, and the original car header, next to the metadata file with a .json extension), or all.",
+	},
+	&cli.StringFlag{
+		Name:     "metadata-db",
+		Required: false,
+		Usage:    "optional sqlite database to record the run in, along with its pieces and which pieces hold which files, alongside the metadata files (or instead of them, with --no-metadata). Runs are appended to the database.",
+	},
+	&cli.BoolFlag{
+		Name:     "no-metadata",
+		Required: false,
+		Usage:    "don't write the csv and yaml metadata files, only the pieces.",
+		Value:    false,
+	},
+	&cli.BoolFlag{
+		Name:     "audit-total",
+		Required: false,
+		Usage:    "check once the run is done that the blocks in the pieces add up to the input car less its header, and fail on any discrepancy.",
+		Value:    false,
+	},
+	&cli.BoolFlag{
+		Name:     "sort-pieces-by-size",
+		Required: false,
+		Usage:    "record a hint for packing the pieces into sectors in the yaml metadata: the pieces sorted by padded size, largest first, and grouped into as few sectors of --sector-size as possible. The pieces and their order in the metadata don't change.",
+		Value:    false,
+	},
+	&cli.Uint64Flag{
+		Name:     "sector-size",
+		Required: false,
+		Value:    32 << 30,
+		Usage:    "padded sector size to group the pieces into with --sort-pieces-by-size, 32GiB by default.",
+	},
+	&cli.BoolFlag{
+		Name:     "quiet",
+		Required: false,
+		Usage:    "don't print the summary of the run (input size, pieces, padded size, padding overhead, elapsed time) at the end.",
+		Value:    false,
+	},
+	&cli.StringFlag{
+		Name:     "emit-retrieval-index",
+		Required: false,
+		Usage:    "optional file to write a binary index to, locating every block cid in the pieces (piece file, offset and length of the block data), for gateways serving single blocks. See the README for the format.",
+	},
+	&cli.BoolFlag{
+		Name:     "audit",
+		Required: false,
+		Usage:    "check the size invariants of every piece once the run is done (header plus content size matches the piece file, padded size matches the piece length) and fail on any violation.",
+		Value:    false,
+	},
+	&cli.BoolFlag{
+		Name:     "ignore-disk-space",
+		Required: false,
+		Usage:    "don't abort when the estimated size of the pieces exceeds the free space of the output filesystem.",
+		Value:    false,
+	},
+	&cli.StringFlag{
+		Name:     "piece-index",
+		Required: false,
+		Usage:    "optional file to write a json index keyed by piece cid to, listing the run and car file of every piece.",
+	},
+	&cli.BoolFlag{
+		Name:     "merge-piece-index",
+		Required: false,
+		Usage:    "add the pieces of this run to an existing --piece-index instead of replacing it.",
+		Value:    false,
+	},
+	&cli.StringFlag{
+		Name:     "run-id",
+		Required: false,
+		Usage:    "name of this run in the --piece-index and --webhook posts. Defaults to the metadata file name.",
+	},
+	&cli.StringFlag{
+		Name:     "exec",
+		Required: false,
+		Usage:    "optional command to run for every completed piece. Placeholders {file}, {commp}, {padded_size}, {header_size} and {content_size} are substituted.",
+	},
+	&cli.BoolFlag{
+		Name:     "exec-continue-on-error",
+		Required: false,
+		Usage:    "keep going when the --exec command exits with a non-zero code instead of failing the run.",
+		Value:    false,
+	},
+	&cli.StringFlag{
+		Name:     "webhook",
+		Required: false,
+		Usage:    "optional http(s) url to post the metadata of every completed piece to as a line of ndjson, with the run id, followed by a summary with the root cid once the run is done.",
+	},
+	&cli.IntFlag{
+		Name:     "webhook-retries",
+		Required: false,
+		Value:    3,
+		Usage:    "number of times a failed --webhook post is retried, with an increasing delay.",
+	},
+	&cli.BoolFlag{
+		Name:     "webhook-continue-on-error",
+		Required: false,
+		Usage:    "keep going when a --webhook post still fails after all retries instead of failing the run.",
+		Value:    false,
+	},
+	&cli.StringFlag{
+		Name:     "upload",
+		Required: false,
+		Usage:    "optional s3://bucket/prefix or gs://bucket/prefix (or gcs://) url to upload every piece to as soon as it is complete, with the aws or gcloud command line tool. The local piece file is removed once uploaded, and the metadata records the url of every piece.",
+	},
+	&cli.IntFlag{
+		Name:     "upload-concurrency",
+		Required: false,
+		Usage:    "number of pieces uploaded at the same time with --upload. The split waits for a free upload slot before going on.",
+		Value:    4,
+	},
+	&cli.IntFlag{
+		Name:     "upload-retries",
+		Required: false,
+		Usage:    "number of times a failed --upload is retried, with an increasing delay.",
+		Value:    3,
+	},
+	&cli.BoolFlag{
+		Name:     "upload-keep-local",
+		Required: false,
+		Usage:    "keep the local piece files after uploading them with --upload.",
+	},
+	&cli.StringFlag{
+		Name:     "push",
+		Required: false,
+		Usage:    "optional http(s) url of a storage provider endpoint (e.g. a boost http server) to push every piece to with a PUT as soon as it is complete. The placeholders {file} and {commp} are substituted, without any the name of the piece file is appended. The metadata records the push status of every piece.",
+	},
+	&cli.StringFlag{
+		Name:     "push-token",
+		Required: false,
+		EnvVars:  []string{"PUSH_TOKEN"},
+		Usage:    "optional token sent as bearer token with every --push.",
+	},
+	&cli.IntFlag{
+		Name:     "push-concurrency",
+		Required: false,
+		Usage:    "number of pieces pushed at the same time with --push. The split waits for a free push slot before going on.",
+		Value:    2,
+	},
+	&cli.IntFlag{
+		Name:     "push-retries",
+		Required: false,
+		Usage:    "number of times a failed --push is retried, with an increasing delay.",
+		Value:    3,
+	},
+	&cli.BoolFlag{
+		Name:     "push-continue-on-error",
+		Required: false,
+		Usage:    "keep going when a --push still fails after all retries instead of failing the run. The piece is recorded with a failed push status.",
+		Value:    false,
+	},
+	&cli.StringFlag{
+		Name:     "s3-endpoint-url",
+		Required: false,
+		Usage:    "optional endpoint of an S3 compatible object store to --upload s3:// urls to, instead of AWS.",
+	},
+	&cli.StringFlag{
+		Name:     "trace",
+		Required: false,
+		Usage:    "optional file to write a timeline of the run to, in the Chrome trace event format (chrome://tracing, Perfetto), with spans for every piece and the stages of its processing.",
+	},
+	&cli.StringFlag{
+		Name:     "log-level",
+		Required: false,
+		Usage:    "minimum level of the log entries written to stderr: debug (which includes every piece written), info, warn or error.",
+		Value:    "info",
+	},
+	&cli.StringFlag{
+		Name:     "log-format",
+		Required: false,
+		Usage:    "format of the log entries written to stderr: text, or json for a json object per line, for log aggregation.",
+		Value:    logging.FormatText,
+	},
 }
 
 func splitAndCommpAction(c *cli.Context) error {
-	fi, err := getReader(c)
+	start := time.Now()
+	if err := logging.Configure(c.String("log-level"), c.String("log-format")); err != nil {
+		return err
+	}
+	r, sources, err := getReader(c)
 	if err != nil {
 		return err
 	}
+	fi := &countingReader{r: r}
 
-	size := c.Int("size")
+	if err := preflight.SetPieceSize(c); err != nil {
+		return err
+	}
+	if err := preflight.SetMinerSize(c); err != nil {
+		return err
+	}
+	if !c.IsSet("size") {
+		return fmt.Errorf("--size, --piece-size or --miner is required")
+	}
+	size := preflight.Size(c, "size")
 	output := c.String("output")
 	meta := c.String("metadata")
 	dryRun := c.Bool("dry-run")
 
-	var filenamePrefix string
+	filenamePrefix, err := splitter.NamePrefix(output, !dryRun)
+	if err != nil {
+		return err
+	}
 
-	if output != "" {
-		filenamePrefix = fmt.Sprintf("%s-", output)
+	if !dryRun && !c.Bool("ignore-disk-space") {
+		if err := checkDiskSpace(c, output); err != nil {
+			return err
+		}
 	}
 
-	var carPieceFilesMeta *carlet.CarPiecesAndMetadata
-	if dryRun {
-		carPieceFilesMeta, err = carlet.SplitAndCommpDryRun(fi, size, filenamePrefix)
-	} else {
-		carPieceFilesMeta, err = carlet.SplitAndCommp(fi, size, filenamePrefix)
+	ts, err := metadata.NewTimestamps(c.String("timestamp-format"), c.String("timezone"))
+	if err != nil {
+		return err
+	}
+	if err := metadata.ValidateFormat(c.String("format")); err != nil {
+		return err
 	}
+	docs, err := metadata.ParseDocuments(c.String("metadata-format"))
 	if err != nil {
 		return err
 	}
+	if err := preflight.CheckMetadataPaths(meta, c.String("format"), filenamePrefix); err != nil {
+		return err
+	}
 
-	metaFile, err := os.Create(meta)
+	splitOpts := splitter.Options{
+		DryRun:         dryRun,
+		CommPEvery:     c.Int("commp-every"),
+		CommPSample:    c.Float64("commp-sample"),
+		CommPSkipZeros: c.Bool("commp-skip-zeros"),
+		CommPWorkers:   c.Int("commp-workers"),
+		CarVersion:     c.Int("car-version"),
+		PadTo:          c.Uint64("pad-to"),
+		PadLast:        c.Bool("pad-last"),
+		Sources:        sources,
+
+		ContentDefinedBoundaries: c.Bool("content-defined-pieces"),
+	}
+	if splitOpts.NameTemplate, err = splitter.ParseNameTemplate(c.String("name-template")); err != nil {
+		return err
+	}
+	renameToCommP := c.Bool("rename-to-commp")
+	if renameToCommP {
+		if err := splitter.ValidateRenameToCommP(dryRun, c.IsSet); err != nil {
+			return err
+		}
+	}
+	if splitOpts.PieceRootMode, err = splitter.ParsePieceRootMode(c.String("piece-root-mode")); err != nil {
+		return err
+	}
+	if splitOpts.Framing, err = splitter.ParseFraming(c.String("framing")); err != nil {
+		return err
+	}
+	if splitOpts.CommPAlgorithm, err = splitter.ParseCommPAlgorithm(c.String("commp-algorithm")); err != nil {
+		return err
+	}
+	if len(sources) > 0 && splitOpts.Framing != splitter.CARv1Framing {
+		return fmt.Errorf("--framing %s is not supported with several input car files", splitOpts.Framing.Name())
+	}
+	if err := splitOpts.Validate(); err != nil {
+		return err
+	}
+	aggregateProofs := c.Bool("aggregate-proofs")
+	if aggregateProofs && (splitOpts.CommPEvery > 1 || (splitOpts.CommPSample > 0 && splitOpts.CommPSample < 1)) {
+		return fmt.Errorf("--aggregate-proofs needs the commP of every piece, it is not supported with --commp-every and --commp-sample")
+	}
+	if c.Bool("sort-pieces-by-size") {
+		if err := splitter.ValidateSectorSize(c.Uint64("sector-size")); err != nil {
+			return err
+		}
+	}
+	if dir := c.String("commp-cache"); dir != "" {
+		if splitOpts.CommPCache, err = splitter.OpenCommPCache(dir); err != nil {
+			return err
+		}
+	}
+	var payloadCid cid.Cid
+	if v := c.String("payload-cid"); v != "" {
+		if payloadCid, err = cid.Decode(v); err != nil {
+			return fmt.Errorf("invalid payload cid %q: %s", v, err)
+		}
+		splitOpts.DatasetRoot = payloadCid
+	}
+	checkpointFile := strings.TrimSuffix(meta, filepath.Ext(meta)) + ".checkpoint.yaml"
+	interval := c.Duration("checkpoint-interval")
+	if interval > 0 {
+		splitOpts.CheckpointInterval = interval
+		splitOpts.OnCheckpoint = func(cp splitter.Checkpoint) error {
+			return splitter.WriteCheckpoint(checkpointFile, cp)
+		}
+	}
+	if c.Bool("resume") {
+		if splitOpts.Resume, err = splitter.ReadCheckpoint(checkpointFile); err != nil {
+			return err
+		}
+	}
+	if path := c.String("emit-retrieval-index"); path != "" {
+		if splitOpts.Resume != nil {
+			// the blocks of the pieces written before the checkpoint are not known anymore
+			return fmt.Errorf("--emit-retrieval-index is not supported with --resume")
+		}
+		if splitOpts.RetrievalIndex, err = splitter.CreateRetrievalIndex(path); err != nil {
+			return err
+		}
+	}
+	if cmdline := c.String("exec"); cmdline != "" {
+		hook, err := hooks.NewExecHook(cmdline, c.Bool("exec-continue-on-error"))
+		if err != nil {
+			return err
+		}
+		splitOpts.OnPiece = hook.Run
+	}
+	run := c.String("run-id")
+	if run == "" {
+		run = meta
+	}
+	var dbSink *metadata.SqliteSink
+	if path := c.String("metadata-db"); path != "" {
+		if dbSink, err = metadata.NewSqliteSink(path, run); err != nil {
+			return err
+		}
+	}
+	var webhook *hooks.WebhookHook
+	if u := c.String("webhook"); u != "" {
+		var rootCid string
+		if payloadCid.Defined() {
+			rootCid = payloadCid.String()
+		}
+		if webhook, err = hooks.NewWebhookHook(u, run, rootCid, c.Int("webhook-retries"), c.Bool("webhook-continue-on-error")); err != nil {
+			return err
+		}
+		splitOpts.OnPiece = hooks.Chain(splitOpts.OnPiece, webhook.Run)
+	}
+	var push *hooks.PushHook
+	if u := c.String("push"); u != "" {
+		if dryRun {
+			return fmt.Errorf("--push is not supported with --dry-run")
+		}
+		if c.String("upload") != "" && !c.Bool("upload-keep-local") {
+			// the upload would remove piece files still being pushed
+			return fmt.Errorf("--push needs --upload-keep-local with --upload")
+		}
+		if push, err = hooks.NewPushHook(u, c.String("push-token"), c.Int("push-concurrency"), c.Int("push-retries"), c.Bool("push-continue-on-error")); err != nil {
+			return err
+		}
+		splitOpts.OnPiece = hooks.Chain(splitOpts.OnPiece, push.Run)
+	}
+	var upload *hooks.UploadHook
+	if u := c.String("upload"); u != "" {
+		if dryRun {
+			return fmt.Errorf("--upload is not supported with --dry-run")
+		}
+		if upload, err = hooks.NewUploadHook(u, c.String("s3-endpoint-url"), c.Int("upload-concurrency"), c.Int("upload-retries"), c.Bool("upload-keep-local")); err != nil {
+			return err
+		}
+		// last, so that the hooks before it still find the piece file
+		splitOpts.OnPiece = hooks.Chain(splitOpts.OnPiece, upload.Run)
+		splitOpts.UploadURL, _ = hooks.UploadURL(u)
+	}
+	if c.String("trace") != "" {
+		splitOpts.Tracer = trace.New()
+	}
+	var streamed metadata.MetadataSink
+	if !c.Bool("no-metadata") && docs.Table && c.String("format") == metadata.FormatNDJSON && push == nil && !renameToCommP {
+		// the rows are written as the pieces complete, so they are of use even if the run doesn't. Not with --push, the
+		// push status of a piece is only known later, nor with --rename-to-commp, which renames the pieces at the end.
+		if streamed, err = metadata.NewDocumentsSink(meta, metadata.FormatNDJSON, docs, nil, ts); err != nil {
+			return err
+		}
+		splitOpts.OnPiece = metadata.StreamPieces(streamed, splitOpts.OnPiece)
+	}
+
+	carPieceFilesMeta, err := splitter.SplitAndCommpContext(c.Context, fi, size, filenamePrefix, splitOpts)
 	if err != nil {
+		if upload != nil {
+			// the pieces completed so far are recorded as uploaded
+			upload.Wait()
+		}
+		if push != nil {
+			push.Wait()
+			push.Record(carPieceFilesMeta.CarPieces)
+		}
+		if c.Context.Err() != nil && len(carPieceFilesMeta.CarPieces) > 0 && !c.Bool("no-metadata") {
+			// interrupted, keep the metadata of the pieces completed so far; with --checkpoint-interval, the checkpoint
+			// is kept as well for --resume
+			if merr := writeMetadata(streamed, meta, c.String("format"), docs, "", carPieceFilesMeta, len(sources) > 0, upload != nil, push != nil, c.Int("car-version") == 2, metadata.NewTool(c), ts); merr != nil {
+				return fmt.Errorf("%s, and failed to write the metadata of the completed pieces: %s", err, merr)
+			}
+		}
 		return err
 	}
-	defer metaFile.Close()
+	if upload != nil {
+		if err := upload.Wait(); err != nil {
+			return err
+		}
+	}
+	if push != nil {
+		if err := push.Wait(); err != nil {
+			return err
+		}
+		push.Record(carPieceFilesMeta.CarPieces)
+	}
+	if splitOpts.RetrievalIndex != nil {
+		if err := splitOpts.RetrievalIndex.Close(); err != nil {
+			return err
+		}
+	}
+	if renameToCommP {
+		if _, err := splitter.RenameToCommP(carPieceFilesMeta.CarPieces); err != nil {
+			return err
+		}
+	}
+	if c.Bool("sort-pieces-by-size") {
+		if carPieceFilesMeta.Packing, err = splitter.PackSectors(carPieceFilesMeta.CarPieces, c.Uint64("sector-size")); err != nil {
+			return err
+		}
+	}
 
-	csvWriter := csv.NewWriter(metaFile)
-	err = csvWriter.Write([]string{
-		"timestamp",
-		"car file",
-		"piece cid",
-		"padded piece size",
-		"header size",
-		"content size",
-	})
+	if aggregateProofs {
+		if carPieceFilesMeta.Aggregate, err = splitter.NewAggregate(carPieceFilesMeta.CarPieces, c.Uint64("aggregate-deal-size")); err != nil {
+			return err
+		}
+	}
+
+	headerRoots, err := carPieceFilesMeta.HeaderRoots()
 	if err != nil {
 		return err
 	}
-	defer csvWriter.Flush()
-	for _, cf := range carPieceFilesMeta.CarPieces {
-		err = csvWriter.Write([]string{
-			time.Now().Format(time.RFC3339),
-			cf.Name,
-			cf.CommP.String(),
-			strconv.FormatUint(cf.PaddedSize, 10),
-			strconv.FormatUint(cf.HeaderSize, 10),
-			strconv.FormatUint(cf.ContentSize, 10),
+	if !payloadCid.Defined() && len(headerRoots) > 0 {
+		payloadCid = headerRoots[0]
+	} else if payloadCid.Defined() && len(headerRoots) > 0 && !headerRoots[0].Equals(payloadCid) {
+		logging.Warn("the car header declares another root, recording the payload cid instead", "headerRoot", headerRoots[0], "payloadCid", payloadCid)
+	}
+	var rootCid string
+	if payloadCid.Defined() {
+		rootCid = payloadCid.String()
+	}
+
+	if path := c.String("piece-index"); path != "" {
+		if err := metadata.UpdatePieceIndex(path, c.Bool("merge-piece-index"), run, rootCid, carPieceFilesMeta); err != nil {
+			return err
+		}
+	}
+
+	if !c.Bool("no-metadata") {
+		if err := writeMetadata(streamed, meta, c.String("format"), docs, rootCid, carPieceFilesMeta, len(sources) > 0, upload != nil, push != nil, c.Int("car-version") == 2, metadata.NewTool(c), ts); err != nil {
+			return err
+		}
+	}
+	if dbSink != nil {
+		if err := metadata.Write(dbSink, metadata.Summary{RootCid: rootCid, CarPiecesMeta: carPieceFilesMeta, Tool: metadata.NewTool(c)}); err != nil {
+			return err
+		}
+	}
+	if interval > 0 || c.Bool("resume") {
+		// the run completed and its metadata is written, the checkpoint is of no use anymore
+		os.Remove(checkpointFile)
+	}
+
+	if webhook != nil {
+		if err := webhook.Finish(rootCid, len(carPieceFilesMeta.CarPieces)); err != nil {
+			return err
+		}
+	}
+	if c.Bool("audit") {
+		// uploaded pieces are not on disk anymore, their sizes are checked like those of a dry run
+		violations := splitter.Audit(carPieceFilesMeta.CarPieces, dryRun || (upload != nil && !c.Bool("upload-keep-local")))
+		for _, v := range violations {
+			fmt.Printf("audit: %s\n", v)
+		}
+		if len(violations) > 0 {
+			return fmt.Errorf("audit found %d violations of the piece size invariants", len(violations))
+		}
+	}
+	if c.Bool("audit-total") {
+		if err := auditTotal(fi.n, carPieceFilesMeta, splitOpts); err != nil {
+			return err
+		}
+	}
+	if err := splitOpts.Tracer.WriteFile(c.String("trace")); err != nil {
+		return err
+	}
+	if !c.Bool("quiet") {
+		metadata.Report{RootCid: rootCid, InputSize: fi.n, Pieces: carPieceFilesMeta.CarPieces, Elapsed: time.Since(start)}.Print(os.Stdout)
+	}
+	return nil
+}
+
+// auditTotal checks that the blocks in the pieces add up to the car stream read, less its header, which catches
+// blocks dropped or duplicated between pieces. Streams in other framings are re-framed, and resumed runs skip part of
+// the stream, so the check only applies to complete CARv1 streams.
+func auditTotal(input uint64, m *splitter.CarPiecesAndMetadata, opts splitter.Options) error {
+	if opts.Framing != splitter.CARv1Framing || opts.Resume != nil {
+		logging.Warn("--audit-total only checks complete carv1 streams, skipping it")
+		return nil
+	}
+	if expected, content := input-m.OriginalCarHeaderSize, splitter.ContentSize(m.CarPieces); content != expected {
+		fmt.Printf("audit-total: the pieces hold %d bytes of blocks, but the input car holds %d bytes behind its header\n", content, expected)
+		return fmt.Errorf("audit found a discrepancy between the input and the pieces")
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// Seek passes seeks on to the underlying reader, so that resuming a file input can still skip ahead without reading.
+func (c *countingReader) Seek(offset int64, whence int) (int64, error) {
+	if seeker, ok := c.r.(io.Seeker); ok {
+		return seeker.Seek(offset, whence)
+	}
+	return 0, fmt.Errorf("input is not seekable")
+}
+
+// writeMetadata writes the metadata documents selected by docs: the piece table (csv, or parquet or ndjson next to the
+// metadata path), the yaml file with the full car pieces metadata, and the json document. The root cid of the payload
+// is recorded if known. With several input cars, the csv gets a column with the roots of the cars every piece holds
+// blocks of, with uploaded pieces one for their url, with pushed pieces one for their push status, and with CARv2 pieces one for the size of their index. If streamed is set, it is the sink the rows were already
+// written to while the pieces completed, and the metadata is finished there.
+func writeMetadata(streamed metadata.MetadataSink, meta string, tableFormat string, docs metadata.Documents, rootCid string, m *splitter.CarPiecesAndMetadata, withSources bool, uploaded bool, pushed bool, carV2 bool, tool metadata.Tool, ts metadata.Timestamps) error {
+	columns := []string{
+		metadata.ColumnTimestamp,
+		metadata.ColumnCarFile,
+		metadata.ColumnPieceCid,
+		metadata.ColumnPaddedSize,
+		metadata.ColumnHeaderSize,
+		metadata.ColumnContentSize,
+	}
+	if rootCid != "" {
+		columns = append(columns, metadata.ColumnRootCid)
+	}
+	if withSources {
+		columns = append(columns, metadata.ColumnSourceRoots)
+	}
+	if uploaded {
+		columns = append(columns, metadata.ColumnURL)
+	}
+	if pushed {
+		columns = append(columns, metadata.ColumnPushStatus)
+	}
+	if carV2 {
+		columns = append(columns, metadata.ColumnIndexSize)
+	}
+	sink := streamed
+	if sink == nil {
+		var err error
+		if sink, err = metadata.NewDocumentsSink(meta, tableFormat, docs, columns, ts); err != nil {
+			return err
+		}
+	}
+	return metadata.Write(sink, metadata.Summary{RootCid: rootCid, CarPiecesMeta: m, Tool: tool})
+}
+
+// checkDiskSpace compares the size of the input car files with the free space in the output directory. The pieces
+// hold the same blocks, plus a small header each. Input from stdin has no known size and is not checked.
+func checkDiskSpace(c *cli.Context, output string) error {
+	var needed uint64
+	for _, path := range c.Args().Slice() {
+		err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// same as getReader: a directory contributes the car files directly in it
+			if d.IsDir() {
+				if p != path {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if p != path && filepath.Ext(p) != ".car" {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			needed += uint64(fi.Size())
+			return nil
 		})
 		if err != nil {
-			return fmt.Errorf("failed to write csv row: %s", err)
+			return err
 		}
 	}
-	{
-		// save also as yaml, which will include the whole car pieces metadata (including the original car header)
-		yamlFilename := strings.TrimSuffix(meta, filepath.Ext(meta)) + ".yaml"
-		yamlFile, err := os.Create(yamlFilename)
+	if needed == 0 {
+		return nil
+	}
+	// 1% margin for the piece headers
+	return preflight.CheckDiskSpace(filepath.Dir(output), needed+needed/100)
+}
+
+// getReader returns the car stream to split: stdin, a single car file, or the concatenation of several car files (or
+// all *.car files in a directory), in which case the sources making up the stream are returned as well.
+func getReader(c *cli.Context) (io.Reader, []splitter.Source, error) {
+	if !c.Args().Present() {
+		return os.Stdin, nil, nil
+	}
+
+	var paths []string
+	for _, path := range c.Args().Slice() {
+		fi, err := os.Stat(path)
 		if err != nil {
-			panic(fmt.Errorf("failed to create yaml metadata file: %s", err))
+			return nil, nil, err
 		}
-		defer yamlFile.Close()
-
-		yamlWriter := yaml.NewEncoder(yamlFile)
-		var carFilesYaml struct {
-			CarPiecesMeta *carlet.CarPiecesAndMetadata `yaml:"car_pieces_meta"`
+		if !fi.IsDir() {
+			paths = append(paths, path)
+			continue
 		}
-		carFilesYaml.CarPiecesMeta = carPieceFilesMeta
-		err = yamlWriter.Encode(carFilesYaml)
+		cars, err := filepath.Glob(filepath.Join(path, "*.car"))
 		if err != nil {
-			panic(fmt.Errorf("failed to write yaml: %s", err))
+			return nil, nil, err
+		}
+		if len(cars) == 0 {
+			return nil, nil, fmt.Errorf("no car files found in %s", path)
 		}
+		paths = append(paths, cars...)
 	}
-	return nil
-}
 
-func getReader(c *cli.Context) (io.Reader, error) {
-	if c.Args().Present() {
-		path := c.Args().First()
-		fi, err := os.Open(path)
+	if len(paths) == 1 {
+		fi, err := os.Open(paths[0])
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		return fi, nil
+		return fi, nil, nil
 	}
-	return os.Stdin, nil
+	return splitter.ConcatCars(paths)
 }
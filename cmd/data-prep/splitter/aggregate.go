@@ -0,0 +1,340 @@
+package splitter
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+)
+
+// segmentIndexEntrySize is the padded size of an entry of the data segment index: the commP of the segment, its
+// padded offset and size, and a checksum.
+const segmentIndexEntrySize = 64
+
+// Segment is a piece placed in an aggregate.
+type Segment struct {
+	Name       string   `json:"name" yaml:"name"`
+	CommP      PieceCid `json:"commP" yaml:"commP"`
+	PaddedSize uint64   `json:"paddedSize" yaml:"paddedSize"`
+	// Offset is the padded offset of the segment in the aggregate.
+	Offset uint64 `json:"offset" yaml:"offset"`
+	// Proof, if set, proves that the segment and its entry of the data segment index are part of the aggregate.
+	Proof *InclusionProof `json:"proof,omitempty" yaml:"proof,omitempty"`
+}
+
+// InclusionProof proves that a segment is part of an aggregate, as defined by FRC-0058: ProofSubtree proves the commP
+// of the segment at its offset, and ProofIndex its entry of the data segment index.
+type InclusionProof struct {
+	ProofSubtree ProofData `json:"proofSubtree" yaml:"proofSubtree"`
+	ProofIndex   ProofData `json:"proofIndex" yaml:"proofIndex"`
+}
+
+// ProofData is the merkle proof of a node of the tree of an aggregate: the index of the node among those of its level,
+// and the hex encoded siblings on its path to the root, lowest first.
+type ProofData struct {
+	Index uint64   `json:"index" yaml:"index"`
+	Path  []string `json:"path" yaml:"path"`
+}
+
+// Aggregate is the FRC-0058 aggregate of a set of pieces: its commP and padded size, and the segment of every piece
+// with the proof of its inclusion.
+type Aggregate struct {
+	CommP      PieceCid  `json:"commP" yaml:"commP"`
+	PaddedSize uint64    `json:"paddedSize" yaml:"paddedSize"`
+	Segments   []Segment `json:"segments" yaml:"segments"`
+}
+
+// NewAggregate lays out the pieces in an aggregate as LayoutAggregate does, and proves the inclusion of every one of
+// them. The commP of the aggregate is derived from the commPs of the pieces, the aggregate itself is never written.
+func NewAggregate(pieces []CarFile, dealSize uint64) (*Aggregate, error) {
+	segments, dealSize, err := LayoutAggregate(pieces, dealSize)
+	if err != nil {
+		return nil, err
+	}
+	index, err := segmentIndex(segments, dealSize)
+	if err != nil {
+		return nil, err
+	}
+	root, err := aggregateRoot(segments, index, dealSize, 0, dealSize)
+	if err != nil {
+		return nil, err
+	}
+	commCid, err := commcid.DataCommitmentV1ToCID(root[:])
+	if err != nil {
+		return nil, err
+	}
+	proofs, err := AggregateProofs(segments, dealSize)
+	if err != nil {
+		return nil, err
+	}
+	for i := range segments {
+		segments[i].Proof = &proofs[i]
+	}
+	return &Aggregate{CommP: PieceCid{Cid: commCid}, PaddedSize: dealSize, Segments: segments}, nil
+}
+
+// maxSegmentIndexEntries returns the number of entries the data segment index of an aggregate of the given padded
+// size has room for, as defined by FRC-0058.
+func maxSegmentIndexEntries(dealSize uint64) uint64 {
+	n := dealSize / 2048 / segmentIndexEntrySize
+	entries := uint64(4)
+	for entries < n {
+		entries <<= 1
+	}
+	return entries
+}
+
+// segmentIndexStart returns the padded offset of the data segment index, which fills the end of the aggregate.
+func segmentIndexStart(dealSize uint64) uint64 {
+	return dealSize - maxSegmentIndexEntries(dealSize)*segmentIndexEntrySize
+}
+
+// LayoutAggregate places the pieces in an aggregate, largest first, each at an offset aligned to its padded size. It
+// returns the segments in the order of their offsets, and the padded size of the aggregate: dealSize if set, else the
+// smallest one holding all segments and the data segment index behind them.
+func LayoutAggregate(pieces []CarFile, dealSize uint64) ([]Segment, uint64, error) {
+	if len(pieces) == 0 {
+		return nil, 0, fmt.Errorf("no pieces to aggregate")
+	}
+	segments := make([]Segment, len(pieces))
+	for i, cf := range pieces {
+		if !cf.CommP.Defined() {
+			return nil, 0, fmt.Errorf("piece %s has no commP", cf.Name)
+		}
+		segments[i] = Segment{Name: cf.Name, CommP: cf.CommP, PaddedSize: cf.PaddedSize}
+	}
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].PaddedSize > segments[j].PaddedSize })
+
+	var end uint64
+	for i := range segments {
+		// sizes are powers of two in decreasing order, so every offset is aligned to the size of its segment
+		segments[i].Offset = end
+		end += segments[i].PaddedSize
+	}
+
+	fits := func(size uint64) bool {
+		// the index of the smallest sizes is larger than the size itself
+		indexSize := maxSegmentIndexEntries(size) * segmentIndexEntrySize
+		return indexSize < size && end <= size-indexSize && uint64(len(segments)) <= maxSegmentIndexEntries(size)
+	}
+	if dealSize != 0 {
+		if dealSize < 128 || bits.OnesCount64(dealSize) != 1 {
+			return nil, 0, fmt.Errorf("deal size %d is not a valid padded piece size, expected a power of two of at least 128", dealSize)
+		}
+		if !fits(dealSize) {
+			return nil, 0, fmt.Errorf("the %d pieces and their index don't fit into a deal size of %d", len(segments), dealSize)
+		}
+		return segments, dealSize, nil
+	}
+	size := uint64(128)
+	for !fits(size) {
+		size <<= 1
+	}
+	return segments, size, nil
+}
+
+// WriteAggregate writes the aggregate of the segments laid out by LayoutAggregate to path: the data of every segment
+// at its offset (unpadded), zeros in between, and the data segment index at the end. The gaps are left as holes, so
+// the file only takes up the space of the segments on filesystems supporting sparse files. The segments are read
+// from the files they are named after. It returns the raw commP of the aggregate, which is derived from the commPs
+// of the segments rather than by hashing the file.
+func WriteAggregate(path string, segments []Segment, dealSize uint64) ([]byte, error) {
+	index, err := segmentIndex(segments, dealSize)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aggregate %s: %s", path, err)
+	}
+	defer f.Close()
+
+	for _, seg := range segments {
+		if err := writeSegment(f, seg); err != nil {
+			return nil, err
+		}
+	}
+	indexOffset := int64(segmentIndexStart(dealSize) / 128 * 127)
+	if _, err := f.Seek(indexOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(unpadIndex(index)); err != nil {
+		return nil, fmt.Errorf("failed to write the data segment index: %s", err)
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	root, err := aggregateRoot(segments, index, dealSize, 0, dealSize)
+	if err != nil {
+		return nil, err
+	}
+	return root[:], nil
+}
+
+// writeSegment copies the data of a segment to its unpadded offset in f.
+func writeSegment(f *os.File, seg Segment) error {
+	in, err := os.Open(seg.Name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if _, err := f.Seek(int64(seg.Offset/128*127), io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.Copy(f, bufio.NewReaderSize(in, bufSize))
+	if err != nil {
+		return fmt.Errorf("failed to copy %s into the aggregate: %s", seg.Name, err)
+	}
+	if uint64(n) > seg.PaddedSize/128*127 {
+		return fmt.Errorf("%s holds %d bytes, more than fit into its padded size of %d", seg.Name, n, seg.PaddedSize)
+	}
+	return nil
+}
+
+// segmentIndex returns the padded data segment index: an entry for every segment, followed by zeroed entries up to
+// the size of the index.
+func segmentIndex(segments []Segment, dealSize uint64) ([]byte, error) {
+	index := make([]byte, maxSegmentIndexEntries(dealSize)*segmentIndexEntrySize)
+	for i, seg := range segments {
+		rawCommP, err := commcid.CIDToDataCommitmentV1(seg.CommP.Cid)
+		if err != nil {
+			return nil, fmt.Errorf("invalid commP of %s: %s", seg.Name, err)
+		}
+		entry := index[i*segmentIndexEntrySize : (i+1)*segmentIndexEntrySize]
+		copy(entry, rawCommP)
+		binary.LittleEndian.PutUint64(entry[32:], seg.Offset)
+		binary.LittleEndian.PutUint64(entry[40:], seg.PaddedSize)
+		// the checksum is taken over the entry with a zeroed checksum, and truncated to fit into a node
+		sum := sha256.Sum256(entry)
+		copy(entry[48:], sum[:16])
+		entry[63] &= 0x3F
+	}
+	return index, nil
+}
+
+// unpadIndex returns the unpadded bytes that fr32 expand to the padded index.
+func unpadIndex(index []byte) []byte {
+	out := make([]byte, 0, len(index)/128*127)
+	for i := 0; i < len(index); i += 128 {
+		var quad [4 * nodeSize]byte
+		copy(quad[:], index[i:])
+		var unpadded [quadSize]byte
+		fr32Unpad(&unpadded, &quad)
+		out = append(out, unpadded[:]...)
+	}
+	return out
+}
+
+// fr32Unpad is the inverse of fr32Expand: it drops the 2 zero bits after every 254 bits of the 4 leaves.
+func fr32Unpad(out *[quadSize]byte, in *[4 * nodeSize]byte) {
+	for bit := 0; bit < quadSize*8; bit++ {
+		src := bit/254*256 + bit%254
+		if in[src/8]>>(src%8)&1 == 1 {
+			out[bit/8] |= 1 << (bit % 8)
+		}
+	}
+}
+
+// aggregateRoot returns the root of the subtree of the aggregate covering size padded bytes at start. Subtrees that
+// are a segment have its commP as root, subtrees without any data are zero subtrees, and the nodes of the index are
+// hashed as they are.
+func aggregateRoot(segments []Segment, index []byte, dealSize, start, size uint64) ([nodeSize]byte, error) {
+	indexStart := segmentIndexStart(dealSize)
+	if start >= indexStart {
+		if size == nodeSize {
+			var node [nodeSize]byte
+			copy(node[:], index[start-indexStart:])
+			return node, nil
+		}
+	} else {
+		empty := start+size <= indexStart
+		for _, seg := range segments {
+			if seg.Offset == start && seg.PaddedSize == size {
+				rawCommP, err := commcid.CIDToDataCommitmentV1(seg.CommP.Cid)
+				if err != nil {
+					return [nodeSize]byte{}, fmt.Errorf("invalid commP of %s: %s", seg.Name, err)
+				}
+				var node [nodeSize]byte
+				copy(node[:], rawCommP)
+				return node, nil
+			}
+			if seg.Offset < start+size && start < seg.Offset+seg.PaddedSize {
+				empty = false
+			}
+		}
+		if empty {
+			return zeroComms[bits.TrailingZeros64(size/nodeSize)], nil
+		}
+	}
+
+	left, err := aggregateRoot(segments, index, dealSize, start, size/2)
+	if err != nil {
+		return [nodeSize]byte{}, err
+	}
+	right, err := aggregateRoot(segments, index, dealSize, start+size/2, size/2)
+	if err != nil {
+		return [nodeSize]byte{}, err
+	}
+	return hashPair(&left, &right), nil
+}
+
+// AggregateProofs returns the inclusion proofs of the segments laid out by LayoutAggregate, in the order of the
+// segments.
+func AggregateProofs(segments []Segment, dealSize uint64) ([]InclusionProof, error) {
+	index, err := segmentIndex(segments, dealSize)
+	if err != nil {
+		return nil, err
+	}
+	indexStart := segmentIndexStart(dealSize)
+	// the siblings near the root are on the path of every proof, and those covering the index are expensive
+	siblings := make(map[[2]uint64][nodeSize]byte)
+	proofs := make([]InclusionProof, len(segments))
+	for i, seg := range segments {
+		if proofs[i].ProofSubtree, err = aggregateProof(segments, index, dealSize, seg.Offset, seg.PaddedSize, siblings); err != nil {
+			return nil, err
+		}
+		entryStart := indexStart + uint64(i)*segmentIndexEntrySize
+		if proofs[i].ProofIndex, err = aggregateProof(segments, index, dealSize, entryStart, segmentIndexEntrySize, siblings); err != nil {
+			return nil, err
+		}
+	}
+	return proofs, nil
+}
+
+// aggregateProof returns the merkle proof of the subtree of the aggregate covering size padded bytes at start.
+func aggregateProof(segments []Segment, index []byte, dealSize, start, size uint64, siblings map[[2]uint64][nodeSize]byte) (ProofData, error) {
+	var path []string
+	for offset, span := uint64(0), dealSize; span > size; span /= 2 {
+		half := span / 2
+		sibling := offset + half
+		if start >= offset+half {
+			sibling = offset
+			offset += half
+		}
+		node, ok := siblings[[2]uint64{sibling, half}]
+		if !ok {
+			var err error
+			if node, err = aggregateRoot(segments, index, dealSize, sibling, half); err != nil {
+				return ProofData{}, err
+			}
+			siblings[[2]uint64{sibling, half}] = node
+		}
+		path = append(path, hex.EncodeToString(node[:]))
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return ProofData{Index: start / size, Path: path}, nil
+}
@@ -0,0 +1,362 @@
+package splitter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+)
+
+func TestMaxSegmentIndexEntries(t *testing.T) {
+	cases := []struct {
+		dealSize uint64
+		want     uint64
+	}{
+		{dealSize: 128, want: 4},
+		{dealSize: 1 << 20, want: 8},
+		{dealSize: 8 << 20, want: 64},
+		{dealSize: 16 << 20, want: 128},
+		{dealSize: 32 << 30, want: 1 << 18},
+		{dealSize: 64 << 30, want: 1 << 19},
+	}
+	for _, tc := range cases {
+		if got := maxSegmentIndexEntries(tc.dealSize); got != tc.want {
+			t.Errorf("deal size %d: got %d index entries, want %d", tc.dealSize, got, tc.want)
+		}
+	}
+}
+
+// testSegmentPieces writes a piece file of every given size into dir and returns the pieces with their commP.
+func testSegmentPieces(t *testing.T, dir string, sizes ...int) []CarFile {
+	t.Helper()
+
+	rnd := rand.New(rand.NewSource(int64(len(sizes))))
+	var pieces []CarFile
+	for i, size := range sizes {
+		data := make([]byte, size)
+		rnd.Read(data)
+		name := filepath.Join(dir, fmt.Sprintf("piece-%d.car", i))
+		if err := os.WriteFile(name, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var calc commp.Calc
+		calc.Write(data)
+		rawCommP, paddedSize, err := calc.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := commcid.DataCommitmentV1ToCID(rawCommP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pieces = append(pieces, CarFile{Name: name, CommP: PieceCid{Cid: c}, PaddedSize: paddedSize})
+	}
+	return pieces
+}
+
+// truncHash is the sha2-256-trunc254 hash of two nodes, independent of the one of the package.
+func truncHash(left, right []byte) [nodeSize]byte {
+	sum := sha256.Sum256(append(append([]byte{}, left...), right...))
+	sum[nodeSize-1] &= 0x3F
+	return sum
+}
+
+// proofRoot folds a proof of the given subtree root up to the root of the whole tree.
+func proofRoot(t *testing.T, node [nodeSize]byte, p ProofData) [nodeSize]byte {
+	t.Helper()
+
+	index := p.Index
+	for _, h := range p.Path {
+		sibling, err := hex.DecodeString(h)
+		if err != nil || len(sibling) != nodeSize {
+			t.Fatalf("invalid proof node %q", h)
+		}
+		if index&1 == 0 {
+			node = truncHash(node[:], sibling)
+		} else {
+			node = truncHash(sibling, node[:])
+		}
+		index >>= 1
+	}
+	if index != 0 {
+		t.Fatalf("proof of index %d ends below the root", p.Index)
+	}
+	return node
+}
+
+// TestAggregate writes aggregates and checks them against a commP calculation over the whole file: the aggregate
+// commP, the data segment index read back from the file, and the inclusion proofs of every segment and index entry.
+func TestAggregate(t *testing.T) {
+	cases := []struct {
+		name     string
+		sizes    []int
+		dealSize uint64
+	}{
+		{name: "single segment", sizes: []int{5000}},
+		{name: "segments of one size", sizes: []int{1000, 1000, 1000}},
+		{name: "mixed sizes", sizes: []int{127, 65, 70000, 4000, 127 * 64, 300, 127*64 + 1}},
+		{name: "more segments than the smallest index holds", sizes: []int{100, 200, 300, 400, 500, 600, 700, 800, 900, 1000}},
+		{name: "fixed deal size", sizes: []int{20000, 3000}, dealSize: 1 << 20},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			pieces := testSegmentPieces(t, dir, tc.sizes...)
+			segments, dealSize, err := LayoutAggregate(pieces, tc.dealSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.dealSize != 0 && dealSize != tc.dealSize {
+				t.Fatalf("got deal size %d, want %d", dealSize, tc.dealSize)
+			}
+			path := filepath.Join(dir, "aggregate.car")
+			root, err := WriteAggregate(path, segments, dealSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uint64(len(data)) != dealSize/128*127 {
+				t.Fatalf("aggregate of %d bytes, want the %d of its deal size", len(data), dealSize/128*127)
+			}
+			var calc commp.Calc
+			calc.Write(data)
+			wantRoot, paddedSize, err := calc.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if paddedSize != dealSize || !bytes.Equal(root, wantRoot) {
+				t.Fatalf("aggregate commP %x of %d bytes, want %x of %d bytes", root, dealSize, wantRoot, paddedSize)
+			}
+
+			// the segments are in place, and every one is listed in the index
+			indexStart := segmentIndexStart(dealSize)
+			index := make([]byte, dealSize-indexStart)
+			for i := 0; i < len(index); i += 128 {
+				var quad [4 * nodeSize]byte
+				fr32Expand(&quad, data[(indexStart+uint64(i))/128*127:])
+				copy(index[i:], quad[:])
+			}
+			for i, seg := range segments {
+				if seg.Offset%seg.PaddedSize != 0 || seg.Offset+seg.PaddedSize > indexStart {
+					t.Errorf("segment %d of %d bytes at offset %d is misplaced", i, seg.PaddedSize, seg.Offset)
+				}
+				content, err := os.ReadFile(seg.Name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if start := seg.Offset / 128 * 127; !bytes.Equal(data[start:start+uint64(len(content))], content) {
+					t.Errorf("segment %d is not at its offset %d", i, seg.Offset)
+				}
+
+				entry := index[i*segmentIndexEntrySize : (i+1)*segmentIndexEntrySize]
+				rawCommP, _ := commcid.CIDToDataCommitmentV1(seg.CommP.Cid)
+				if !bytes.Equal(entry[:32], rawCommP) || binary.LittleEndian.Uint64(entry[32:]) != seg.Offset || binary.LittleEndian.Uint64(entry[40:]) != seg.PaddedSize {
+					t.Errorf("index entry %d is %x, want commP %x at offset %d of %d bytes", i, entry, rawCommP, seg.Offset, seg.PaddedSize)
+				}
+				checked := append(append([]byte{}, entry[:48]...), make([]byte, 16)...)
+				sum := sha256.Sum256(checked)
+				sum[15] &= 0x3F
+				if !bytes.Equal(entry[48:], sum[:16]) {
+					t.Errorf("index entry %d: checksum %x, want %x", i, entry[48:], sum[:16])
+				}
+			}
+			if rest := index[len(segments)*segmentIndexEntrySize:]; !bytes.Equal(rest, make([]byte, len(rest))) {
+				t.Errorf("the index has more than %d entries", len(segments))
+			}
+
+			proofs, err := AggregateProofs(segments, dealSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(proofs) != len(segments) {
+				t.Fatalf("got %d proofs for %d segments", len(proofs), len(segments))
+			}
+			for i, seg := range segments {
+				var leaf [nodeSize]byte
+				rawCommP, _ := commcid.CIDToDataCommitmentV1(seg.CommP.Cid)
+				copy(leaf[:], rawCommP)
+				if got := proofRoot(t, leaf, proofs[i].ProofSubtree); !bytes.Equal(got[:], wantRoot) {
+					t.Errorf("segment %d: subtree proof leads to %x, not the aggregate commP %x", i, got, wantRoot)
+				}
+				if proofs[i].ProofSubtree.Index != seg.Offset/seg.PaddedSize {
+					t.Errorf("segment %d: subtree proof of index %d, want %d", i, proofs[i].ProofSubtree.Index, seg.Offset/seg.PaddedSize)
+				}
+
+				entry := index[i*segmentIndexEntrySize : (i+1)*segmentIndexEntrySize]
+				entryNode := truncHash(entry[:32], entry[32:])
+				if got := proofRoot(t, entryNode, proofs[i].ProofIndex); !bytes.Equal(got[:], wantRoot) {
+					t.Errorf("segment %d: index proof leads to %x, not the aggregate commP %x", i, got, wantRoot)
+				}
+
+				// a proof doesn't hold for another segment
+				if len(segments) > 1 {
+					other := segments[(i+1)%len(segments)]
+					otherCommP, _ := commcid.CIDToDataCommitmentV1(other.CommP.Cid)
+					copy(leaf[:], otherCommP)
+					if got := proofRoot(t, leaf, proofs[i].ProofSubtree); bytes.Equal(got[:], wantRoot) {
+						t.Errorf("segment %d: subtree proof holds for another segment", i)
+					}
+				}
+			}
+		})
+	}
+}
+
+// paddedAggregate returns the padded bytes of the aggregate of the segments: the fr32 expanded data of every segment at
+// its offset, and the data segment index, built here after FRC-0058, at the end.
+func paddedAggregate(t *testing.T, segments []Segment, dealSize uint64) []byte {
+	t.Helper()
+
+	padded := make([]byte, dealSize)
+	for _, seg := range segments {
+		data, err := os.ReadFile(seg.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for off := 0; off < len(data); off += quadSize {
+			var chunk [quadSize]byte
+			copy(chunk[:], data[off:])
+			var quad [4 * nodeSize]byte
+			fr32Expand(&quad, chunk[:])
+			copy(padded[seg.Offset+uint64(off/quadSize*128):], quad[:])
+		}
+	}
+
+	entries := maxSegmentIndexEntries(dealSize)
+	index := padded[dealSize-entries*segmentIndexEntrySize:]
+	for i, seg := range segments {
+		entry := index[i*segmentIndexEntrySize : (i+1)*segmentIndexEntrySize]
+		rawCommP, _ := commcid.CIDToDataCommitmentV1(seg.CommP.Cid)
+		copy(entry, rawCommP)
+		binary.LittleEndian.PutUint64(entry[32:], seg.Offset)
+		binary.LittleEndian.PutUint64(entry[40:], seg.PaddedSize)
+		sum := sha256.Sum256(entry)
+		sum[15] &= 0x3F
+		copy(entry[48:], sum[:16])
+	}
+	return padded
+}
+
+// treeRoot returns the root of the binary merkle tree over the 32 byte leaves of padded.
+func treeRoot(padded []byte) [nodeSize]byte {
+	level := make([][nodeSize]byte, len(padded)/nodeSize)
+	for i := range level {
+		copy(level[i][:], padded[i*nodeSize:])
+	}
+	for len(level) > 1 {
+		for i := range level[:len(level)/2] {
+			level[i] = truncHash(level[2*i][:], level[2*i+1][:])
+		}
+		level = level[:len(level)/2]
+	}
+	return level[0]
+}
+
+// TestNewAggregate checks aggregates against the root of the merkle tree over all of their padded bytes: the
+// aggregate commP, and the inclusion proofs of every segment and index entry.
+func TestNewAggregate(t *testing.T) {
+	cases := []struct {
+		name     string
+		sizes    []int
+		dealSize uint64
+	}{
+		{name: "single segment", sizes: []int{5000}},
+		{name: "segments of one size", sizes: []int{1000, 1000, 1000}},
+		{name: "mixed sizes", sizes: []int{127, 65, 70000, 4000, 127 * 64, 300, 127*64 + 1}},
+		{name: "more segments than the smallest index holds", sizes: []int{100, 200, 300, 400, 500, 600, 700, 800, 900, 1000}},
+		{name: "fixed deal size", sizes: []int{20000, 3000}, dealSize: 1 << 20},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pieces := testSegmentPieces(t, t.TempDir(), tc.sizes...)
+			ag, err := NewAggregate(pieces, tc.dealSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.dealSize != 0 && ag.PaddedSize != tc.dealSize {
+				t.Fatalf("got deal size %d, want %d", ag.PaddedSize, tc.dealSize)
+			}
+			if len(ag.Segments) != len(pieces) {
+				t.Fatalf("got %d segments for %d pieces", len(ag.Segments), len(pieces))
+			}
+
+			padded := paddedAggregate(t, ag.Segments, ag.PaddedSize)
+			wantRoot := treeRoot(padded)
+			rawCommP, err := commcid.CIDToDataCommitmentV1(ag.CommP.Cid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rawCommP, wantRoot[:]) {
+				t.Fatalf("aggregate commP %x, want %x", rawCommP, wantRoot)
+			}
+
+			indexStart := segmentIndexStart(ag.PaddedSize)
+			for i, seg := range ag.Segments {
+				if seg.Offset%seg.PaddedSize != 0 || seg.Offset+seg.PaddedSize > indexStart {
+					t.Errorf("segment %d of %d bytes at offset %d is misplaced", i, seg.PaddedSize, seg.Offset)
+				}
+				if seg.Proof == nil {
+					t.Fatalf("segment %d has no proof", i)
+				}
+
+				var leaf [nodeSize]byte
+				segCommP, _ := commcid.CIDToDataCommitmentV1(seg.CommP.Cid)
+				copy(leaf[:], segCommP)
+				if got := proofRoot(t, leaf, seg.Proof.ProofSubtree); got != wantRoot {
+					t.Errorf("segment %d: subtree proof leads to %x, not the aggregate commP %x", i, got, wantRoot)
+				}
+				if seg.Proof.ProofSubtree.Index != seg.Offset/seg.PaddedSize {
+					t.Errorf("segment %d: subtree proof of index %d, want %d", i, seg.Proof.ProofSubtree.Index, seg.Offset/seg.PaddedSize)
+				}
+
+				entry := padded[indexStart+uint64(i)*segmentIndexEntrySize:][:segmentIndexEntrySize]
+				entryNode := truncHash(entry[:32], entry[32:])
+				if got := proofRoot(t, entryNode, seg.Proof.ProofIndex); got != wantRoot {
+					t.Errorf("segment %d: index proof leads to %x, not the aggregate commP %x", i, got, wantRoot)
+				}
+
+				// a proof doesn't hold for another segment
+				if len(ag.Segments) > 1 {
+					other := ag.Segments[(i+1)%len(ag.Segments)]
+					otherCommP, _ := commcid.CIDToDataCommitmentV1(other.CommP.Cid)
+					copy(leaf[:], otherCommP)
+					if got := proofRoot(t, leaf, seg.Proof.ProofSubtree); got == wantRoot {
+						t.Errorf("segment %d: subtree proof holds for another segment", i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLayoutAggregateErrors(t *testing.T) {
+	pieces := testSegmentPieces(t, t.TempDir(), 5000, 5000)
+	if _, _, err := LayoutAggregate(nil, 0); err == nil {
+		t.Error("laid out an aggregate of no pieces")
+	}
+	if _, _, err := LayoutAggregate(pieces, 3<<20); err == nil {
+		t.Error("laid out an aggregate of a deal size that is not a power of two")
+	}
+	if _, _, err := LayoutAggregate(pieces, 16<<10); err == nil {
+		t.Error("laid out an aggregate of a deal size the pieces and the index don't fit into")
+	}
+	noCommP := append([]CarFile{}, pieces...)
+	noCommP[1].CommP = PieceCid{}
+	if _, _, err := LayoutAggregate(noCommP, 0); err == nil {
+		t.Error("laid out an aggregate of a piece without commP")
+	}
+}
@@ -0,0 +1,138 @@
+package splitter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// sizeViolations returns the inconsistencies between the size fields of a piece: the header, content and index (of a
+// CARv2 piece) make up the whole car piece, which is pieceLen bytes long (pass -1 if unknown), and the padded size is the next power of two of
+// its fr32 expanded length (or the natural padded size is, for pieces padded to a fixed size).
+func sizeViolations(cf CarFile, pieceLen int64) []string {
+	var violations []string
+	length := cf.HeaderSize + cf.ContentSize + cf.IndexSize
+	if cf.HeaderSize == 0 {
+		violations = append(violations, "header size is 0")
+	}
+	if pieceLen >= 0 && uint64(pieceLen) != length && cf.IndexSize > 0 {
+		violations = append(violations, fmt.Sprintf("header size %d + content size %d + index size %d = %d, but the piece is %d bytes long", cf.HeaderSize, cf.ContentSize, cf.IndexSize, length, pieceLen))
+	} else if pieceLen >= 0 && uint64(pieceLen) != length {
+		violations = append(violations, fmt.Sprintf("header size %d + content size %d = %d, but the piece is %d bytes long", cf.HeaderSize, cf.ContentSize, length, pieceLen))
+	}
+	if bits.OnesCount64(cf.PaddedSize) != 1 {
+		violations = append(violations, fmt.Sprintf("padded size %d is not a power of two", cf.PaddedSize))
+	}
+	if cf.NaturalPaddedSize != 0 {
+		// padded further to a fixed size
+		if expected := paddedPieceSize(length); cf.NaturalPaddedSize != expected {
+			violations = append(violations, fmt.Sprintf("natural padded size %d doesn't match the piece length %d, expected %d", cf.NaturalPaddedSize, length, expected))
+		}
+		if cf.PaddedSize < cf.NaturalPaddedSize {
+			violations = append(violations, fmt.Sprintf("padded size %d is smaller than the natural padded size %d", cf.PaddedSize, cf.NaturalPaddedSize))
+		}
+	} else if expected := paddedPieceSize(length); cf.PaddedSize != expected {
+		violations = append(violations, fmt.Sprintf("padded size %d doesn't match the piece length %d, expected %d", cf.PaddedSize, length, expected))
+	}
+	return violations
+}
+
+// Audit checks the size invariants of every piece, comparing with the length of the piece files on disk unless they
+// were not written (dry run). It returns a description of every violation found.
+func Audit(pieces []CarFile, dryRun bool) []string {
+	var violations []string
+	for _, cf := range pieces {
+		pieceLen := int64(-1)
+		if !dryRun {
+			fi, err := os.Stat(cf.Name)
+			if err != nil {
+				violations = append(violations, fmt.Sprintf("%s: %s", cf.Name, err))
+				continue
+			}
+			pieceLen = fi.Size()
+		}
+		for _, v := range sizeViolations(cf, pieceLen) {
+			violations = append(violations, fmt.Sprintf("%s: %s", cf.Name, v))
+		}
+	}
+	return violations
+}
+
+// VerifyPiece reads the piece file at path, and returns how it differs from its metadata cf: a piece file of another
+// length, a car header of another size, or another commP (unless none was recorded). For a piece padded to a fixed
+// size, commP is padded the same way. The error is only set if the file can't be read at all.
+func VerifyPiece(cf CarFile, path string, algorithm CommPAlgorithm, skipZeros bool) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	violations := sizeViolations(cf, fi.Size())
+
+	br := bufio.NewReader(f)
+	_, dataOffset, _, _, err := ReadCarV2Header(br)
+	if err == nil {
+		var headerSize int64
+		if _, headerSize, err = readHeader(br, CARv1Framing); err == nil && uint64(headerSize)+dataOffset != cf.HeaderSize {
+			violations = append(violations, fmt.Sprintf("the car header is %d bytes, the metadata records %d", uint64(headerSize)+dataOffset, cf.HeaderSize))
+		}
+	}
+	if err != nil {
+		violations = append(violations, fmt.Sprintf("invalid car header: %s", err))
+	}
+
+	if !cf.CommP.Defined() {
+		return violations, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	cp := algorithm.newCalc(skipZeros)
+	if _, err := io.Copy(cp, bufio.NewReaderSize(f, bufSize)); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	rawCommP, paddedSize, err := cp.Digest()
+	if err != nil {
+		return append(violations, fmt.Sprintf("failed to calculate commP: %s", err)), nil
+	}
+	if cf.NaturalPaddedSize != 0 && paddedSize <= cf.PaddedSize {
+		if rawCommP, err = algorithm.pad(rawCommP, paddedSize, cf.PaddedSize); err != nil {
+			return nil, err
+		}
+	}
+	commCid, err := algorithm.toCid(rawCommP)
+	if err != nil {
+		return nil, err
+	}
+	if !commCid.Equals(cf.CommP.Cid) {
+		violations = append(violations, fmt.Sprintf("commP is %s, the metadata records %s", commCid, cf.CommP))
+	}
+	return violations, nil
+}
+
+// ContentSize returns the total size of the blocks held by the pieces, car headers not included.
+func ContentSize(pieces []CarFile) uint64 {
+	var total uint64
+	for _, cf := range pieces {
+		total += cf.ContentSize
+	}
+	return total
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
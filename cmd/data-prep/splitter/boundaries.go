@@ -0,0 +1,30 @@
+package splitter
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+)
+
+// With content defined piece boundaries, a piece is cut after a block picked by its cid rather than at the first block
+// reaching the target size. A run of blocks shared by two streams (e.g. the blocks of a file that is in both) then gets
+// cut at the same blocks in both, no matter what comes before it, so the pieces in between come out identical and
+// deduplicate at the piece level. Pieces end up between half the target size and the target size.
+
+// contentBoundary reports whether a piece may end after the block with the given cid and frame length. Every block is
+// picked with a probability proportional to its length, so that past the minimum size, a piece grows by a quarter of
+// the target size on average before it is cut, whatever the block sizes.
+func contentBoundary(blockCid []byte, frameLen uint64, targetSize int) bool {
+	if blockCid == nil {
+		return false
+	}
+	// the cid is hashed again, for a uniform value whatever its hash function
+	sum := sha256.Sum256(blockCid)
+	v := float64(binary.BigEndian.Uint64(sum[:8])) / math.MaxUint64
+	return v < float64(frameLen)/(float64(targetSize)/4)
+}
+
+// minContentDefinedSize is the size a piece has to reach before it may be cut at a content defined boundary.
+func minContentDefinedSize(targetSize int) int64 {
+	return int64(targetSize) / 2
+}
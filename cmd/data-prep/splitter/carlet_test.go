@@ -0,0 +1,98 @@
+package splitter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anjor/carlet"
+)
+
+// TestSplitAndCommpMatchesCarlet checks that the splitter produces the same pieces, byte for byte, and the same
+// metadata as github.com/anjor/carlet, which it replaces.
+func TestSplitAndCommpMatchesCarlet(t *testing.T) {
+	cases := []struct {
+		name       string
+		blockSizes []int
+		targetSize int
+	}{
+		{name: "single piece", blockSizes: repeatSizes(10, 1000), targetSize: 1 << 20},
+		{name: "many pieces", blockSizes: repeatSizes(200, 4000), targetSize: 64 << 10},
+		{name: "uneven blocks", blockSizes: []int{1, 70000, 3, 1 << 20, 12, 999, 65536, 17}, targetSize: 100 << 10},
+		{name: "block larger than target", blockSizes: []int{300 << 10, 5, 300 << 10, 5}, targetSize: 128 << 10},
+	}
+
+	for _, tc := range cases {
+		for _, dryRun := range []bool{false, true} {
+			name := tc.name
+			if dryRun {
+				name += " dry run"
+			}
+			t.Run(name, func(t *testing.T) {
+				stream := testCarStream(t, tc.blockSizes...)
+
+				carletDir := t.TempDir()
+				var want *carlet.CarPiecesAndMetadata
+				var err error
+				if dryRun {
+					want, err = carlet.SplitAndCommpDryRun(bytes.NewReader(stream), tc.targetSize, filepath.Join(carletDir, "p-"))
+				} else {
+					want, err = carlet.SplitAndCommp(bytes.NewReader(stream), tc.targetSize, filepath.Join(carletDir, "p-"))
+				}
+				if err != nil {
+					t.Fatalf("carlet: %s", err)
+				}
+				if last := want.CarPieces[len(want.CarPieces)-1]; last.ContentSize == 0 {
+					t.Fatal("test stream ends exactly at a piece boundary")
+				}
+
+				dir := t.TempDir()
+				got, err := SplitAndCommp(bytes.NewReader(stream), tc.targetSize, filepath.Join(dir, "p-"), Options{DryRun: dryRun})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got.OriginalCarHeader != want.OriginalCarHeader || got.OriginalCarHeaderSize != want.OriginalCarHeaderSize {
+					t.Errorf("original header = %d %q, want %d %q", got.OriginalCarHeaderSize, got.OriginalCarHeader, want.OriginalCarHeaderSize, want.OriginalCarHeader)
+				}
+				if len(got.CarPieces) != len(want.CarPieces) {
+					t.Fatalf("got %d pieces, want %d", len(got.CarPieces), len(want.CarPieces))
+				}
+				for i, g := range got.CarPieces {
+					w := want.CarPieces[i]
+					if filepath.Base(g.Name) != filepath.Base(w.Name) {
+						t.Errorf("piece %d: name = %s, want %s", i, filepath.Base(g.Name), filepath.Base(w.Name))
+					}
+					if g.CommP.String() != w.CommP.String() {
+						t.Errorf("piece %d: commP = %s, want %s", i, g.CommP, w.CommP)
+					}
+					if g.PaddedSize != w.PaddedSize || g.HeaderSize != w.HeaderSize || g.ContentSize != w.ContentSize {
+						t.Errorf("piece %d: sizes (padded, header, content) = (%d, %d, %d), want (%d, %d, %d)", i,
+							g.PaddedSize, g.HeaderSize, g.ContentSize, w.PaddedSize, w.HeaderSize, w.ContentSize)
+					}
+					if dryRun {
+						continue
+					}
+					gotBytes, err := os.ReadFile(g.Name)
+					if err != nil {
+						t.Fatal(err)
+					}
+					wantBytes, err := os.ReadFile(w.Name)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(gotBytes, wantBytes) {
+						t.Errorf("piece %d: %d bytes differ from carlet's %d bytes", i, len(gotBytes), len(wantBytes))
+					}
+				}
+
+				if dryRun {
+					if ents, _ := os.ReadDir(dir); len(ents) != 0 {
+						t.Errorf("dry run wrote %d files", len(ents))
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package splitter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// carV2Pragma is the fixed start of every CARv2 file: a CARv1 header of version 2 without roots.
+	carV2Pragma = "\x0a" + // 10 bytes of header
+		// map with 1 key
+		"\xA1" +
+		// text-key with length 7
+		"\x67" + "version" +
+		// 2
+		"\x02"
+	// carV2PrefixSize is the size of the pragma and the CARv2 header behind it: 16 bytes of characteristics and the
+	// data offset, data size and index offset as little endian uint64.
+	carV2PrefixSize = len(carV2Pragma) + 40
+
+	// multicodec of the MultihashIndexSorted index format, the one go-car writes by default
+	multihashIndexSorted = 0x0401
+)
+
+// carV2Block is a block of a CARv2 piece, with the offset of its frame relative to the CARv1 data of the piece.
+type carV2Block struct {
+	cid    []byte
+	offset uint64
+}
+
+// carV2Prefix returns the pragma and CARv2 header of a piece whose CARv1 data, header and blocks, follows right behind
+// them, and is followed by the index. Characteristics are all unset: identity cids are left out of the index, so it
+// doesn't fully index the data.
+func carV2Prefix(dataSize uint64) []byte {
+	b := make([]byte, carV2PrefixSize)
+	copy(b, carV2Pragma)
+	h := b[len(carV2Pragma)+16:]
+	binary.LittleEndian.PutUint64(h, uint64(carV2PrefixSize))
+	binary.LittleEndian.PutUint64(h[8:], dataSize)
+	binary.LittleEndian.PutUint64(h[16:], uint64(carV2PrefixSize)+dataSize)
+	return b
+}
+
+// carV2Index returns the MultihashIndexSorted index of the given blocks, as go-car writes it: the multicodec of the
+// format, then the blocks grouped by multihash code and digest length, both in ascending order, every group a sorted
+// list of digests each followed by the offset of its block.
+func carV2Index(blocks []carV2Block) ([]byte, error) {
+	// code -> digest length -> entries
+	groups := make(map[uint64]map[int][][]byte)
+	for _, b := range blocks {
+		c, err := cid.Cast(b.cid)
+		if err != nil {
+			return nil, fmt.Errorf("undecodeable cid of an indexed block: %s", err)
+		}
+		dmh, err := multihash.Decode(c.Hash())
+		if err != nil {
+			return nil, fmt.Errorf("undecodeable multihash of block %s: %s", c, err)
+		}
+		if dmh.Code == multihash.IDENTITY {
+			continue
+		}
+		if groups[dmh.Code] == nil {
+			groups[dmh.Code] = make(map[int][][]byte)
+		}
+		entry := binary.LittleEndian.AppendUint64(append([]byte(nil), dmh.Digest...), b.offset)
+		groups[dmh.Code][len(dmh.Digest)] = append(groups[dmh.Code][len(dmh.Digest)], entry)
+	}
+
+	out := binary.AppendUvarint(nil, multihashIndexSorted)
+	codes := make([]uint64, 0, len(groups))
+	for code := range groups {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(codes)))
+	for _, code := range codes {
+		out = binary.LittleEndian.AppendUint64(out, code)
+		lengths := make([]int, 0, len(groups[code]))
+		for l := range groups[code] {
+			lengths = append(lengths, l)
+		}
+		sort.Ints(lengths)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(lengths)))
+		for _, l := range lengths {
+			entries := groups[code][l]
+			sort.SliceStable(entries, func(i, j int) bool { return bytes.Compare(entries[i][:l], entries[j][:l]) < 0 })
+			width := l + 8
+			out = binary.LittleEndian.AppendUint32(out, uint32(width))
+			out = binary.LittleEndian.AppendUint64(out, uint64(len(entries)*width))
+			for _, e := range entries {
+				out = append(out, e...)
+			}
+		}
+	}
+	return out, nil
+}
+
+// finishCarV2 writes the index behind the blocks of a CARv2 piece, and fills in the CARv2 header written as zeros at
+// the start of the piece file, now that the size of the data is known. It returns the size of the index.
+func finishCarV2(pieceFile fileLike, w io.Writer, fBuf *bufio.Writer, blocks []carV2Block, dataSize uint64) (int64, error) {
+	index, err := carV2Index(blocks)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(index); err != nil {
+		return 0, fmt.Errorf("failed to write piece index: %s", err)
+	}
+	if err := fBuf.Flush(); err != nil {
+		return 0, err
+	}
+	if f, ok := pieceFile.(*os.File); ok {
+		if _, err := f.WriteAt(carV2Prefix(dataSize), 0); err != nil {
+			return 0, fmt.Errorf("failed to write piece header: %s", err)
+		}
+	}
+	return int64(len(index)), nil
+}
+
+// ReadCarV2Header reads the pragma and header of a CARv2 file, if r starts with them, and returns where the CARv1 data
+// is and how large it is, and where the index starts (0 if there is none). r is left at the start of the CARv1 data. If
+// r doesn't start with a CARv2 pragma, nothing is read.
+func ReadCarV2Header(r *bufio.Reader) (isV2 bool, dataOffset, dataSize, indexOffset uint64, err error) {
+	b, _ := r.Peek(len(carV2Pragma))
+	if string(b) != carV2Pragma {
+		return false, 0, 0, 0, nil
+	}
+	h := make([]byte, carV2PrefixSize)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return true, 0, 0, 0, fmt.Errorf("failed to read the CARv2 header: %s", err)
+	}
+	h = h[len(carV2Pragma)+16:]
+	dataOffset = binary.LittleEndian.Uint64(h)
+	dataSize = binary.LittleEndian.Uint64(h[8:])
+	indexOffset = binary.LittleEndian.Uint64(h[16:])
+	if dataOffset < uint64(carV2PrefixSize) {
+		return true, 0, 0, 0, fmt.Errorf("invalid CARv2 data offset %d", dataOffset)
+	}
+	if _, err := r.Discard(int(dataOffset) - carV2PrefixSize); err != nil {
+		return true, 0, 0, 0, fmt.Errorf("failed to skip to the CARv2 data: %s", err)
+	}
+	return true, dataOffset, dataSize, indexOffset, nil
+}
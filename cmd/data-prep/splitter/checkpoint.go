@@ -0,0 +1,98 @@
+package splitter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Checkpoint captures the progress of a split, so that an interrupted run can be resumed: the offset in the car
+// stream right after the last completed piece, and the pieces completed up to there.
+type Checkpoint struct {
+	TargetSize        int       `yaml:"targetSize"`
+	NamePrefix        string    `yaml:"namePrefix"`
+	NameTemplate      string    `yaml:"nameTemplate,omitempty"`
+	OriginalCarHeader string    `yaml:"originalCarHeader"`
+	StreamOffset      int64     `yaml:"streamOffset"`
+	CarPieces         []CarFile `yaml:"carPieces"`
+	// Inputs are the files read into the car stream, in order, if the caller knows them. A resume from the checkpoint
+	// has to read the very same files for the stream offset to be of any use.
+	Inputs []CheckpointInput `yaml:"inputs,omitempty"`
+}
+
+// CheckpointInput is a file read into a checkpointed car stream, along with its size (-1 if not known up front).
+type CheckpointInput struct {
+	Path string `yaml:"path"`
+	Size int64  `yaml:"size"`
+}
+
+// WriteCheckpoint atomically replaces the checkpoint file at path.
+func WriteCheckpoint(path string, cp Checkpoint) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := yaml.NewEncoder(tmp).Encode(cp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write checkpoint: %s", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write checkpoint: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %s", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadCheckpoint reads a checkpoint file written by WriteCheckpoint.
+func ReadCheckpoint(path string) (*Checkpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint: %s", err)
+	}
+	defer f.Close()
+
+	var cp Checkpoint
+	if err := yaml.NewDecoder(f).Decode(&cp); err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint %s: %s", path, err)
+	}
+	return &cp, nil
+}
+
+// validateResume checks that a checkpoint belongs to the split about to be resumed.
+func validateResume(cp *Checkpoint, targetSize int, namePrefix string, nameTemplate NameTemplate, originalCarHeader string) error {
+	switch {
+	case cp.TargetSize != targetSize:
+		return fmt.Errorf("can't resume: checkpoint was taken with target size %d, not %d", cp.TargetSize, targetSize)
+	case cp.NamePrefix != namePrefix:
+		return fmt.Errorf("can't resume: checkpoint was taken with name prefix %q, not %q", cp.NamePrefix, namePrefix)
+	case cp.NameTemplate != nameTemplate.String():
+		return fmt.Errorf("can't resume: checkpoint was taken with name template %q, not %q", cp.NameTemplate, nameTemplate.String())
+	case cp.OriginalCarHeader != originalCarHeader:
+		return fmt.Errorf("can't resume: checkpoint was taken for a car stream with a different header")
+	}
+	return nil
+}
+
+// ValidateResumeInputs checks that a run resumed from a checkpoint reads the same files as the one that took it.
+// Checkpoints taken without inputs are not checked.
+func ValidateResumeInputs(cp *Checkpoint, inputs []CheckpointInput) error {
+	if len(cp.Inputs) == 0 {
+		return nil
+	}
+	if len(cp.Inputs) != len(inputs) {
+		return fmt.Errorf("can't resume: checkpoint was taken with %d input files, not %d", len(cp.Inputs), len(inputs))
+	}
+	for i, in := range inputs {
+		if cp.Inputs[i] != in {
+			return fmt.Errorf("can't resume: input file %d was %s of %d bytes when the checkpoint was taken, not %s of %d bytes", i+1, cp.Inputs[i].Path, cp.Inputs[i].Size, in.Path, in.Size)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package splitter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/ipfs/go-cid"
+)
+
+// CommPAlgorithm is a piece commitment scheme: how the commitment of a piece is calculated, and how it is encoded as
+// a piece cid. Schemes are added here, next to the current one, so that the splitter and the metadata don't need to
+// know about the details of any of them.
+type CommPAlgorithm interface {
+	// Name is the name the algorithm is selected by, and recorded as in the metadata.
+	Name() string
+	// newCalc returns a calculator for the commitment of a piece. skipZeros asks for one that short-circuits all-zero
+	// regions, if the algorithm has one.
+	newCalc(skipZeros bool) commPCalc
+	// toCid encodes a raw commitment as a piece cid.
+	toCid(rawCommP []byte) (cid.Cid, error)
+	// pad returns the commitment of a piece of the given padded size when followed by zeros up to the padded size to.
+	pad(rawCommP []byte, paddedSize, to uint64) ([]byte, error)
+}
+
+// FilCommitmentUnsealed is the sha2-256-trunc254-padded commitment of Filecoin's unsealed sectors, the default.
+var FilCommitmentUnsealed CommPAlgorithm = fr32Sha256Trunc254{}
+
+var commPAlgorithms = map[string]CommPAlgorithm{}
+
+func init() {
+	for _, a := range []CommPAlgorithm{FilCommitmentUnsealed} {
+		commPAlgorithms[a.Name()] = a
+	}
+}
+
+// ParseCommPAlgorithm returns the commP algorithm with the given name.
+func ParseCommPAlgorithm(name string) (CommPAlgorithm, error) {
+	if a, ok := commPAlgorithms[name]; ok {
+		return a, nil
+	}
+	return nil, fmt.Errorf("unknown commP algorithm %q, expected one of: %s", name, strings.Join(CommPAlgorithmNames(), ", "))
+}
+
+// CommPAlgorithmNames lists the names of all available commP algorithms.
+func CommPAlgorithmNames() []string {
+	names := make([]string, 0, len(commPAlgorithms))
+	for name := range commPAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type fr32Sha256Trunc254 struct{}
+
+func (fr32Sha256Trunc254) Name() string { return "sha2-256-trunc254-padded" }
+
+func (fr32Sha256Trunc254) newCalc(skipZeros bool) commPCalc {
+	if skipZeros {
+		return new(zeroAwareCalc)
+	}
+	return new(commp.Calc)
+}
+
+func (fr32Sha256Trunc254) toCid(rawCommP []byte) (cid.Cid, error) {
+	return commcid.DataCommitmentV1ToCID(rawCommP)
+}
+
+func (fr32Sha256Trunc254) pad(rawCommP []byte, paddedSize, to uint64) ([]byte, error) {
+	return commp.PadCommP(rawCommP, paddedSize, to)
+}
+
+func (o Options) commPAlgorithm() CommPAlgorithm {
+	if o.CommPAlgorithm == nil {
+		return FilCommitmentUnsealed
+	}
+	return o.CommPAlgorithm
+}
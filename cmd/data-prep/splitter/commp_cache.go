@@ -0,0 +1,183 @@
+package splitter
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-cid"
+)
+
+// bumped whenever the key derivation changes, so that old entries are never matched
+const commPCacheVersion = "commp-cache-v1"
+
+// CommPCache keeps the commP of pieces on disk, keyed by their content, so that the pieces of a dataset that didn't
+// change since the last run don't need their commP calculated again. The key of a piece is derived from its car
+// header and the length and cid of every block in it, which is far cheaper than hashing the piece: as long as the
+// block cids match their data, a piece with the same key has the same bytes, and any change to a block changes its
+// cid and with it the key.
+type CommPCache struct {
+	dir string
+}
+
+type commPCacheEntry struct {
+	CommP      string `json:"commP"` // hex encoded raw commP
+	PaddedSize uint64 `json:"paddedSize"`
+}
+
+// OpenCommPCache opens the cache in dir, creating the directory if needed.
+func OpenCommPCache(dir string) (*CommPCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create commP cache directory: %s", err)
+	}
+	return &CommPCache{dir: dir}, nil
+}
+
+func (c *CommPCache) path(key []byte) string {
+	k := hex.EncodeToString(key)
+	return filepath.Join(c.dir, k[:2], k)
+}
+
+// lookup returns the raw commP and padded size cached for the key. A missing or broken entry is a miss.
+func (c *CommPCache) lookup(key []byte) ([]byte, uint64, bool) {
+	b, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, 0, false
+	}
+	var e commPCacheEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, 0, false
+	}
+	rawCommP, err := hex.DecodeString(e.CommP)
+	if err != nil || len(rawCommP) != 32 || e.PaddedSize == 0 {
+		return nil, 0, false
+	}
+	return rawCommP, e.PaddedSize, true
+}
+
+// store caches the raw commP and padded size for the key. The entry is written to a temporary file first and renamed,
+// so that concurrent runs sharing a cache never see half written entries.
+func (c *CommPCache) store(key []byte, rawCommP []byte, paddedSize uint64) error {
+	b, err := json.Marshal(commPCacheEntry{CommP: hex.EncodeToString(rawCommP), PaddedSize: paddedSize})
+	if err != nil {
+		return err
+	}
+	p := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("failed to write commP cache: %s", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write commP cache: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write commP cache: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write commP cache: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return fmt.Errorf("failed to write commP cache: %s", err)
+	}
+	return nil
+}
+
+// pieceKey derives the cache key of a piece while it is being written.
+type pieceKey struct {
+	h hash.Hash
+	// set if a block has no decodeable cid, the piece is then not cached
+	unkeyed bool
+}
+
+func newPieceKey(algorithm string, header string) *pieceKey {
+	k := &pieceKey{h: sha256.New()}
+	io.WriteString(k.h, commPCacheVersion)
+	// commPs of different algorithms never match
+	k.h.Write(binary.AppendUvarint(nil, uint64(len(algorithm))))
+	io.WriteString(k.h, algorithm)
+	k.h.Write(binary.AppendUvarint(nil, uint64(len(header))))
+	io.WriteString(k.h, header)
+	return k
+}
+
+// addFrame adds the length and block cid of a frame. A frame without a decodeable cid leaves the piece unkeyed.
+func (k *pieceKey) addFrame(frameLen uint64, blockCid []byte) {
+	if blockCid == nil {
+		k.unkeyed = true
+		return
+	}
+	k.h.Write(binary.AppendUvarint(nil, frameLen))
+	k.h.Write(blockCid)
+}
+
+// peekBlock returns the length and the block cid of the next frame of the stream, without consuming it. The cid is
+// nil if it can't be decoded, and both are zero at the end of the stream or for frames copyFrame rejects. The cid
+// points into the stream buffer, and is only valid until the stream is read from.
+func peekBlock(streamBuf *bufio.Reader, framing Framing) (uint64, []byte) {
+	// enough for the prefix and any practical cid
+	b, _ := streamBuf.Peek(framing.MaxPrefixLen() + 256)
+	frameLen, viL := framing.DecodeLen(b)
+	if viL <= 0 || frameLen == 0 {
+		return 0, nil
+	}
+	block := b[viL:]
+	if uint64(len(block)) > frameLen {
+		block = block[:frameLen]
+	}
+	n, _, err := cid.CidFromBytes(block)
+	if err != nil {
+		return frameLen, nil
+	}
+	return frameLen, block[:n]
+}
+
+func (k *pieceKey) sum() []byte {
+	return k.h.Sum(nil)
+}
+
+// pieceCommP returns the commP of a piece that was just written and closed. Without a cache it was streamed into cp
+// while the piece was written. With a cache, it is looked up by the piece key, and on a miss taken from cp if it was
+// streamed, or else calculated by reading the piece file back, and then cached.
+func pieceCommP(cp commPCalc, cache *CommPCache, key *pieceKey, streamed bool, fname string) ([]byte, uint64, error) {
+	if cache != nil && key.unkeyed {
+		cache = nil
+	}
+	var k []byte
+	if cache != nil {
+		k = key.sum()
+		if rawCommP, paddedSize, ok := cache.lookup(k); ok {
+			return rawCommP, paddedSize, nil
+		}
+	}
+	if !streamed {
+		cp.Reset()
+		f, err := os.Open(fname)
+		if err != nil {
+			return nil, 0, err
+		}
+		_, err = io.Copy(cp, bufio.NewReaderSize(f, bufSize))
+		f.Close()
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read back piece %s: %s", fname, err)
+		}
+	}
+	rawCommP, paddedSize, err := cp.Digest()
+	if err != nil {
+		return nil, 0, err
+	}
+	if cache != nil {
+		if err := cache.store(k, rawCommP, paddedSize); err != nil {
+			return nil, 0, err
+		}
+	}
+	return rawCommP, paddedSize, nil
+}
@@ -0,0 +1,87 @@
+package splitter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ExistingPiece reads a car file that is already on disk, e.g. a piece written before its metadata was kept, and
+// returns its metadata: commP and padded size calculated over the whole file, the size of its car header, and the size
+// of the blocks behind it. For a CARv2 file, the header size includes the CARv2 pragma and header, and the index behind
+// the blocks is recorded as such.
+func ExistingPiece(path string, algorithm CommPAlgorithm, skipZeros bool) (CarFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return CarFile{}, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return CarFile{}, err
+	}
+	br := bufio.NewReader(f)
+	isV2, dataOffset, dataSize, indexOffset, err := ReadCarV2Header(br)
+	if err != nil {
+		return CarFile{}, fmt.Errorf("invalid car file %s: %s", path, err)
+	}
+	hdr, headerSize, err := readHeader(br, CARv1Framing)
+	if err != nil {
+		return CarFile{}, fmt.Errorf("invalid car file %s: %s", path, err)
+	}
+	// the blocks of a CARv2 file end with its data, anything behind that is the index (or padding)
+	contentSize := fi.Size() - headerSize
+	var indexSize int64
+	if isV2 {
+		contentSize = int64(dataSize) - headerSize
+		headerSize += int64(dataOffset)
+		if indexOffset != 0 {
+			indexSize = fi.Size() - int64(indexOffset)
+		}
+		if contentSize < 0 || headerSize+contentSize+indexSize != fi.Size() {
+			return CarFile{}, fmt.Errorf("invalid car file %s: the CARv2 header doesn't match its size of %d bytes", path, fi.Size())
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return CarFile{}, err
+	}
+
+	commP, paddedSize, _, err := CommP(f, algorithm, skipZeros)
+	if err != nil {
+		return CarFile{}, fmt.Errorf("%s: %s", path, err)
+	}
+
+	cf := CarFile{
+		Name:        path,
+		CommP:       commP,
+		PaddedSize:  paddedSize,
+		HeaderSize:  uint64(headerSize),
+		ContentSize: uint64(contentSize),
+		IndexSize:   uint64(indexSize),
+	}
+	if roots, err := carHeaderRoots(hdr); err == nil && len(roots) > 0 && !isNulRoot(roots[0]) {
+		cf.HeaderRoot = roots[0].String()
+	}
+	return cf, nil
+}
+
+// CommP calculates the commP of everything read from r, taken as the payload of a piece as is, and returns it with the
+// padded piece size and the number of bytes read.
+func CommP(r io.Reader, algorithm CommPAlgorithm, skipZeros bool) (PieceCid, uint64, int64, error) {
+	cp := algorithm.newCalc(skipZeros)
+	n, err := io.Copy(cp, bufio.NewReaderSize(r, bufSize))
+	if err != nil {
+		return PieceCid{}, 0, n, fmt.Errorf("failed to read: %s", err)
+	}
+	rawCommP, paddedSize, err := cp.Digest()
+	if err != nil {
+		return PieceCid{}, 0, n, fmt.Errorf("failed to calculate commP: %s", err)
+	}
+	commCid, err := algorithm.toCid(rawCommP)
+	if err != nil {
+		return PieceCid{}, 0, n, err
+	}
+	return PieceCid{commCid}, paddedSize, n, nil
+}
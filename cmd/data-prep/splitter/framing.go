@@ -0,0 +1,82 @@
+package splitter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Framing decodes the length prefixes of the input stream, i.e. the one of the car header and the ones of the block
+// frames. Pieces are always written with CARv1 framing, so the framing only affects how the input is read, which lets
+// the splitter accept block streams from dag builders with a different length prefix convention.
+type Framing interface {
+	// Name is the name the framing is selected by.
+	Name() string
+	// MaxPrefixLen is the number of bytes needed to decode any prefix.
+	MaxPrefixLen() int
+	// DecodeLen decodes the length prefix at the start of buf, which holds up to MaxPrefixLen bytes. It returns the
+	// encoded length, and the size of the prefix, which is <= 0 if buf does not start with a valid prefix.
+	DecodeLen(buf []byte) (uint64, int)
+}
+
+// CARv1Framing is the unsigned varint framing of CARv1, the default.
+var CARv1Framing Framing = uvarintFraming{}
+
+var framings = map[string]Framing{}
+
+func init() {
+	for _, f := range []Framing{CARv1Framing, fixedFraming{name: "be32", order: binary.BigEndian}, fixedFraming{name: "le32", order: binary.LittleEndian}} {
+		framings[f.Name()] = f
+	}
+}
+
+// ParseFraming returns the framing with the given name.
+func ParseFraming(name string) (Framing, error) {
+	if f, ok := framings[name]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown framing %q, expected one of: %s", name, strings.Join(FramingNames(), ", "))
+}
+
+// FramingNames lists the names of all available framings.
+func FramingNames() []string {
+	names := make([]string, 0, len(framings))
+	for name := range framings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type uvarintFraming struct{}
+
+func (uvarintFraming) Name() string      { return "carv1" }
+func (uvarintFraming) MaxPrefixLen() int { return varintSize }
+
+func (uvarintFraming) DecodeLen(buf []byte) (uint64, int) {
+	return binary.Uvarint(buf)
+}
+
+// fixedFraming is a 4 byte length prefix.
+type fixedFraming struct {
+	name  string
+	order binary.ByteOrder
+}
+
+func (f fixedFraming) Name() string    { return f.name }
+func (fixedFraming) MaxPrefixLen() int { return 4 }
+
+func (f fixedFraming) DecodeLen(buf []byte) (uint64, int) {
+	if len(buf) < 4 {
+		return 0, 0
+	}
+	return uint64(f.order.Uint32(buf)), 4
+}
+
+func (o Options) framing() Framing {
+	if o.Framing == nil {
+		return CARv1Framing
+	}
+	return o.Framing
+}
@@ -0,0 +1,242 @@
+package splitter
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// PieceRootMode selects the root that goes into the car header of every piece.
+type PieceRootMode string
+
+const (
+	// PieceRootNull uses the nul-identity cid as root, like carlet does.
+	PieceRootNull PieceRootMode = "null"
+	// PieceRootFirstBlock uses the cid of the first block in the piece.
+	PieceRootFirstBlock PieceRootMode = "first-block"
+	// PieceRootDataset uses the root of the whole dataset.
+	PieceRootDataset PieceRootMode = "dataset"
+)
+
+func ParsePieceRootMode(s string) (PieceRootMode, error) {
+	switch m := PieceRootMode(s); m {
+	case PieceRootNull, PieceRootFirstBlock, PieceRootDataset:
+		return m, nil
+	case "":
+		return PieceRootNull, nil
+	default:
+		return "", fmt.Errorf("unknown piece root mode %q, expected one of: %s, %s, %s", s, PieceRootNull, PieceRootFirstBlock, PieceRootDataset)
+	}
+}
+
+// pieceHeader returns the car header to write at the start of the next piece, along with the root it carries
+// (undefined for a nul root).
+func (o Options) pieceHeader(streamBuf *bufio.Reader) (string, cid.Cid, error) {
+	var root cid.Cid
+	switch o.PieceRootMode {
+	case PieceRootDataset:
+		root = o.DatasetRoot
+	case PieceRootFirstBlock:
+		var err error
+		if root, err = peekFrameCid(streamBuf, o.framing()); err != nil {
+			return "", cid.Undef, err
+		}
+	}
+
+	if !root.Defined() {
+		return nulRootCarHeader, cid.Undef, nil
+	}
+	return carHeader(root), root, nil
+}
+
+// peekFrameCid returns the cid of the next block in the stream without consuming it, or an undefined cid at the end of
+// the stream.
+func peekFrameCid(streamBuf *bufio.Reader, framing Framing) (cid.Cid, error) {
+	maybeNextFrameLen, _ := streamBuf.Peek(framing.MaxPrefixLen())
+	if len(maybeNextFrameLen) == 0 {
+		return cid.Undef, nil
+	}
+	frameLen, viL := framing.DecodeLen(maybeNextFrameLen)
+	if viL <= 0 || frameLen > maxBlockSize {
+		// leave it to the frame copying to report a broken stream
+		return cid.Undef, nil
+	}
+	frame, err := streamBuf.Peek(viL + int(frameLen))
+	if err != nil {
+		return cid.Undef, nil
+	}
+	_, c, err := cid.CidFromBytes(frame[viL:])
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to decode block cid: %s", err)
+	}
+	return c, nil
+}
+
+// carHeader encodes a CARv1 header with a single root as varint prefixed DAG-CBOR, i.e. {"roots":[root],"version":1}.
+func carHeader(root cid.Cid) string {
+	// cids are encoded as tag 42 over a byte string prefixed with \x00
+	link := append([]byte{0x00}, root.Bytes()...)
+
+	hdr := []byte{0xA2, 0x65}
+	hdr = append(hdr, "roots"...)
+	hdr = append(hdr, 0x81, 0xD8, 0x2A)
+	hdr = appendCborHead(hdr, 0x40, uint64(len(link)))
+	hdr = append(hdr, link...)
+	hdr = append(hdr, 0x67)
+	hdr = append(hdr, "version"...)
+	hdr = append(hdr, 0x01)
+
+	prefix := binary.AppendUvarint(nil, uint64(len(hdr)))
+	return string(prefix) + string(hdr)
+}
+
+func appendCborHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n < 1<<8:
+		return append(b, major|24, byte(n))
+	default:
+		return append(b, major|25, byte(n>>8), byte(n))
+	}
+}
+
+// carHeaderRoots extracts the roots from a DAG-CBOR encoded CARv1 header (without its varint prefix).
+func carHeaderRoots(hdr []byte) ([]cid.Cid, error) {
+	roots, _, err := parseCarHeader(hdr)
+	return roots, err
+}
+
+// parseCarHeader decodes the roots and the version from a DAG-CBOR encoded car header (without its varint prefix).
+// Only the subset of CBOR a car header is made of is understood.
+func parseCarHeader(hdr []byte) ([]cid.Cid, uint64, error) {
+	r := &cborReader{buf: hdr}
+	major, n, err := r.head()
+	if err != nil {
+		return nil, 0, err
+	}
+	if major != 5 {
+		return nil, 0, fmt.Errorf("car header is not a map")
+	}
+
+	var roots []cid.Cid
+	var version uint64
+	for i := uint64(0); i < n; i++ {
+		key, err := r.text()
+		if err != nil {
+			return nil, 0, err
+		}
+		major, count, err := r.head()
+		if err != nil {
+			return nil, 0, err
+		}
+		switch {
+		case key == "roots" && major == 4:
+			for j := uint64(0); j < count; j++ {
+				c, err := r.link()
+				if err != nil {
+					return nil, 0, err
+				}
+				roots = append(roots, c)
+			}
+		case key == "version" && major == 0:
+			version = count
+		case major == 0:
+			// any other unsigned int
+		default:
+			return nil, 0, fmt.Errorf("unexpected car header entry %q", key)
+		}
+	}
+	return roots, version, nil
+}
+
+// HeaderRoots returns the roots declared in the header of the split car, leaving out nul roots.
+func (m *CarPiecesAndMetadata) HeaderRoots() ([]cid.Cid, error) {
+	hdr, err := base64.StdEncoding.DecodeString(m.OriginalCarHeader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode car header: %s", err)
+	}
+	roots, err := carHeaderRoots(hdr)
+	if err != nil {
+		return nil, err
+	}
+	var out []cid.Cid
+	for _, r := range roots {
+		if !isNulRoot(r) {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+// isNulRoot reports whether c is the nul-identity cid used as a placeholder root.
+func isNulRoot(c cid.Cid) bool {
+	return c.Prefix().MhType == multihash.IDENTITY && len(c.Hash()) <= 2
+}
+
+type cborReader struct {
+	buf []byte
+	off int
+}
+
+func (r *cborReader) head() (byte, uint64, error) {
+	if r.off >= len(r.buf) {
+		return 0, 0, fmt.Errorf("unexpected end of car header at offset %d", r.off)
+	}
+	b := r.buf[r.off]
+	r.off++
+	major, info := b>>5, b&0x1f
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	size := 1 << (info - 24)
+	if info > 27 || r.off+size > len(r.buf) {
+		return 0, 0, fmt.Errorf("malformed car header at offset %d", r.off-1)
+	}
+	var n uint64
+	for _, c := range r.buf[r.off : r.off+size] {
+		n = n<<8 | uint64(c)
+	}
+	r.off += size
+	return major, n, nil
+}
+
+func (r *cborReader) bytes(wantMajor byte) ([]byte, error) {
+	major, n, err := r.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != wantMajor || uint64(len(r.buf)-r.off) < n {
+		return nil, fmt.Errorf("malformed car header at offset %d", r.off)
+	}
+	b := r.buf[r.off : r.off+int(n)]
+	r.off += int(n)
+	return b, nil
+}
+
+func (r *cborReader) text() (string, error) {
+	b, err := r.bytes(3)
+	return string(b), err
+}
+
+func (r *cborReader) link() (cid.Cid, error) {
+	major, tag, err := r.head()
+	if err != nil {
+		return cid.Undef, err
+	}
+	if major != 6 || tag != 42 {
+		return cid.Undef, fmt.Errorf("expected a cid in the car header roots at offset %d", r.off)
+	}
+	b, err := r.bytes(2)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if len(b) == 0 || b[0] != 0 {
+		return cid.Undef, fmt.Errorf("invalid cid in the car header roots")
+	}
+	return cid.Cast(b[1:])
+}
@@ -0,0 +1,23 @@
+package splitter
+
+import "fmt"
+
+// InvalidCarError reports an input that is not a valid car stream, with the offset in the stream at which this became
+// apparent.
+type InvalidCarError struct {
+	Framing Framing
+	Offset  int64
+	Reason  string
+}
+
+func (e *InvalidCarError) Error() string {
+	kind := "CARv1"
+	if e.Framing != CARv1Framing {
+		kind = fmt.Sprintf("%s framed car stream", e.Framing.Name())
+	}
+	return fmt.Sprintf("not a valid %s: %s at offset %d", kind, e.Reason, e.Offset)
+}
+
+func invalidCar(framing Framing, offset int64, format string, args ...interface{}) error {
+	return &InvalidCarError{Framing: framing, Offset: offset, Reason: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,79 @@
+package splitter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSplitAndCommpInvalidCar(t *testing.T) {
+	stream := testCarStream(t, 1000, 2000, 3000)
+	hdrLen, prefixLen := binary.Uvarint(stream)
+	hdrEnd := prefixLen + int(hdrLen)
+	headerOnly := stream[:hdrEnd]
+	// the version is the last byte of the header
+	v2 := append([]byte{}, stream...)
+	v2[hdrEnd-1] = 2
+	be32, err := ParseFraming("be32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	be32Header := binary.BigEndian.AppendUint32(nil, uint32(hdrLen))
+	be32Header = append(be32Header, stream[prefixLen:hdrEnd]...)
+
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	cases := []struct {
+		name    string
+		input   []byte
+		framing Framing
+		// the reason and offset of the InvalidCarError, an empty reason for an error of another type
+		wantReason string
+		wantOffset int64
+		wantErr    string
+	}{
+		{name: "empty input", input: nil, wantReason: "empty input", wantOffset: 0},
+		{name: "truncated header length", input: []byte{0x80}, wantReason: "undecodeable carv1 header length prefix", wantOffset: 0},
+		{name: "zero header length", input: []byte{0, 1, 2}, wantReason: "empty header", wantOffset: 0},
+		{name: "huge header length", input: binary.AppendUvarint(nil, 3<<20), wantReason: "unexpectedly large header length of 3145728 bytes", wantOffset: 0},
+		{name: "truncated header", input: stream[:10], wantReason: "unexpected EOF in the", wantOffset: 10},
+		{name: "garbage header", input: cat([]byte{5}, []byte("\xff\xfe\xfd\xfc\xfb")), wantReason: "undecodeable header", wantOffset: 1},
+		// the "h" reads as a header length of 104
+		{name: "text instead of a car", input: []byte("hello, this is not a car file\n"), wantReason: "unexpected EOF in the 104 byte header", wantOffset: 30},
+		{name: "car version 2", input: v2, wantReason: "unsupported car version 2", wantOffset: int64(prefixLen)},
+		{name: "truncated block", input: stream[:len(stream)-5], wantReason: "unexpected EOF in a block of", wantOffset: int64(len(stream) - 5)},
+		{name: "truncated block length", input: cat(stream, []byte{0x80}), wantReason: "undecodeable carv1 block length prefix", wantOffset: int64(len(stream))},
+		{name: "trailing garbage", input: cat(stream, bytes.Repeat([]byte{0xff}, 12)), wantReason: "undecodeable carv1 block length prefix", wantOffset: int64(len(stream))},
+		{name: "empty block", input: cat(stream, []byte{0}), wantReason: "empty block", wantOffset: int64(len(stream))},
+		{name: "huge block", input: cat(stream, binary.AppendUvarint(nil, 3<<20)), wantReason: "unexpectedly large block length of 3145728 bytes", wantOffset: int64(len(stream))},
+		{name: "header only", input: headerOnly, wantErr: "holds no blocks after its header"},
+		{name: "be32 empty input", input: nil, framing: be32, wantReason: "empty input", wantOffset: 0},
+		{name: "be32 truncated header length", input: []byte{0, 0}, framing: be32, wantReason: "undecodeable be32 header length prefix", wantOffset: 0},
+		{name: "be32 truncated header", input: be32Header[:20], framing: be32, wantReason: "unexpected EOF in the", wantOffset: 20},
+		{name: "be32 truncated block", input: cat(be32Header, []byte{0, 0, 1, 0}, make([]byte, 100)), framing: be32, wantReason: "unexpected EOF in a block of 256 bytes", wantOffset: int64(len(be32Header) + 104)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := SplitAndCommp(bytes.NewReader(tc.input), 1<<20, dir+"/p-", Options{Framing: tc.framing})
+			if err == nil {
+				t.Fatal("invalid input split without an error")
+			}
+			var invalid *InvalidCarError
+			if tc.wantErr != "" {
+				if errors.As(err, &invalid) || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if !errors.As(err, &invalid) {
+				t.Fatalf("got error %v, want an InvalidCarError", err)
+			}
+			if !strings.Contains(invalid.Reason, tc.wantReason) || invalid.Offset != tc.wantOffset {
+				t.Fatalf("got reason %q at offset %d, want %q at offset %d", invalid.Reason, invalid.Offset, tc.wantReason, tc.wantOffset)
+			}
+		})
+	}
+}
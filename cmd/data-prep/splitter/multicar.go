@@ -0,0 +1,159 @@
+package splitter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Source is one of several car files concatenated into a single car stream by ConcatCars.
+type Source struct {
+	Path   string
+	Roots  []cid.Cid
+	Offset int64 // Offset of the first block of the source in the concatenated stream.
+}
+
+// ConcatCars concatenates the block streams of several CARv1 files into a single car stream, so that they can be
+// split uniformly. The header of every file is validated up front. The stream starts with the header of the first car
+// if all cars share the same roots, and with a nul root header otherwise. The files are opened one after the other as
+// the stream is read.
+func ConcatCars(paths []string) (io.Reader, []Source, error) {
+	if len(paths) == 0 {
+		return nil, nil, fmt.Errorf("no car files to concatenate")
+	}
+
+	var header []byte
+	var sources []Source
+	var bodies []io.Reader
+	var offset int64
+	sameRoots := true
+	for i, path := range paths {
+		hdr, hdrLen, size, err := readCarFileHeader(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		roots, version, err := parseCarHeader(hdr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid car header in %s: %s", path, err)
+		}
+		if version != 1 {
+			return nil, nil, fmt.Errorf("%s is not a CARv1 file: header version is %d", path, version)
+		}
+
+		if i == 0 {
+			header = binary.AppendUvarint(nil, uint64(len(hdr)))
+			header = append(header, hdr...)
+		} else if !sameCids(roots, sources[0].Roots) {
+			sameRoots = false
+		}
+
+		// offsets are relative to the end of the header for now, its size is only known at the end
+		sources = append(sources, Source{Path: path, Roots: roots, Offset: offset})
+		bodies = append(bodies, &carBody{path: path, offset: hdrLen, size: size - hdrLen})
+		offset += size - hdrLen
+	}
+
+	if !sameRoots {
+		header = []byte(nulRootCarHeader)
+	}
+	for i := range sources {
+		sources[i].Offset += int64(len(header))
+	}
+
+	return io.MultiReader(append([]io.Reader{bytes.NewReader(header)}, bodies...)...), sources, nil
+}
+
+// readCarFileHeader reads the header of a car file, returning it without its varint prefix, along with the size of
+// the header including the prefix and the size of the whole file.
+func readCarFileHeader(path string) ([]byte, int64, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	hdr, hdrLen, err := readHeader(bufio.NewReader(f), CARv1Framing)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("invalid car file %s: %s", path, err)
+	}
+	return hdr, hdrLen, fi.Size(), nil
+}
+
+func sameCids(a, b []cid.Cid) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equals(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sourceRoots returns the roots of all sources with blocks in the stream range [start, end).
+func sourceRoots(sources []Source, start, end int64) []string {
+	var roots []string
+	seen := make(map[string]bool)
+	for i, s := range sources {
+		if s.Offset >= end {
+			break
+		}
+		if i+1 < len(sources) && sources[i+1].Offset <= start {
+			continue
+		}
+		for _, r := range s.Roots {
+			if !seen[r.String()] {
+				seen[r.String()] = true
+				roots = append(roots, r.String())
+			}
+		}
+	}
+	return roots
+}
+
+// carBody reads the blocks of a car file, i.e. everything after the header. The file is opened on the first read and
+// closed once it has been read to the end.
+type carBody struct {
+	path   string
+	offset int64
+	size   int64
+
+	r    io.Reader
+	f    *os.File
+	read int64
+}
+
+func (b *carBody) Read(p []byte) (int, error) {
+	if b.f == nil {
+		if b.read == b.size {
+			return 0, io.EOF
+		}
+		f, err := os.Open(b.path)
+		if err != nil {
+			return 0, err
+		}
+		b.f = f
+		b.r = io.NewSectionReader(f, b.offset, b.size)
+	}
+
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	if err == io.EOF {
+		b.f.Close()
+		b.f = nil
+		if b.read != b.size {
+			return n, fmt.Errorf("%s changed while reading: expected %d bytes of blocks, got %d", b.path, b.size, b.read)
+		}
+	}
+	return n, err
+}
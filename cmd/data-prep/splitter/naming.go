@@ -0,0 +1,251 @@
+package splitter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// NamePrefix turns an output option into the prefix of the piece file names. The prefix may point into a directory
+// (e.g. subdir/dataset), which is created if createDir is set. It is separated from the rest of the piece name by a
+// dash, unless it is empty or names just a directory (e.g. subdir/), where the dash would make the pieces start with
+// a "-", which gets taken for a flag by many tools.
+func NamePrefix(output string, createDir bool) (string, error) {
+	if output == "" {
+		return "", nil
+	}
+
+	dir, base := filepath.Split(output)
+	if createDir && dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return "", fmt.Errorf("failed to create output directory %s: %s", dir, err)
+		}
+	}
+
+	if base == "" {
+		return output, nil
+	}
+	if strings.HasPrefix(base, "-") {
+		return "", fmt.Errorf("invalid output prefix %q: piece names would start with a \"-\"", output)
+	}
+	return output + "-", nil
+}
+
+// IsPieceName reports whether path is the name of a piece file written with the given name prefix: either the name of
+// a piece by its index, while it is written, or by its commP.
+func IsPieceName(path, namePrefix string) bool {
+	prefixDir, prefixBase := filepath.Split(namePrefix)
+	if prefixDir == "" {
+		prefixDir = "."
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return false
+	}
+	if pieceDir, err := filepath.Abs(prefixDir); err != nil || pieceDir != dir {
+		return false
+	}
+	base := filepath.Base(path)
+	if !strings.HasPrefix(base, prefixBase) || !strings.HasSuffix(base, ".car") {
+		return false
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(base, prefixBase), ".car")
+	if id == "" {
+		return false
+	}
+	if strings.Trim(id, "0123456789") == "" {
+		return true
+	}
+	_, err = cid.Decode(id)
+	return err == nil
+}
+
+// DefaultNameTemplate names every piece after its commP, behind the name prefix.
+const DefaultNameTemplate = "{prefix}{piececid}.car"
+
+var (
+	namePlaceholder = regexp.MustCompile(`\{([a-z]+)(?::([^{}]*))?\}`)
+	indexVerb       = regexp.MustCompile(`^0?[0-9]*d$`)
+)
+
+// NameTemplate is the name of the piece files, with placeholders filled in for every piece once its commP is known:
+// {prefix} (the name prefix, without its directory), {index} (the index of the piece in the run, optionally with a
+// printf verb like {index:05d}), {piececid} and {rootcid} (the root of the input car). Pieces are written into the
+// directory of the name prefix. The zero value is DefaultNameTemplate.
+type NameTemplate struct {
+	raw      string
+	usesCid  bool
+	usesRoot bool
+}
+
+// ParseNameTemplate parses a piece name template. To keep piece names unique, it has to hold {index} or {piececid}.
+func ParseNameTemplate(s string) (NameTemplate, error) {
+	if s == "" {
+		return NameTemplate{}, nil
+	}
+	t := NameTemplate{raw: s}
+	var unique bool
+	for _, m := range namePlaceholder.FindAllStringSubmatch(s, -1) {
+		name, verb := m[1], m[2]
+		switch name {
+		case "index":
+			if verb != "" && !indexVerb.MatchString(verb) {
+				return NameTemplate{}, fmt.Errorf("invalid name template %q: unsupported index format %q, expected e.g. 05d", s, verb)
+			}
+			unique = true
+			continue
+		case "piececid":
+			t.usesCid, unique = true, true
+		case "rootcid":
+			t.usesRoot = true
+		case "prefix":
+		default:
+			return NameTemplate{}, fmt.Errorf("invalid name template %q: unknown placeholder {%s}, expected one of {prefix}, {index}, {piececid}, {rootcid}", s, name)
+		}
+		if verb != "" {
+			return NameTemplate{}, fmt.Errorf("invalid name template %q: {%s} takes no format", s, name)
+		}
+	}
+	switch rest := namePlaceholder.ReplaceAllString(s, ""); {
+	case strings.ContainsAny(rest, "{}"):
+		return NameTemplate{}, fmt.Errorf("invalid name template %q: unbalanced braces", s)
+	case strings.ContainsRune(s, '/') || strings.ContainsRune(s, filepath.Separator):
+		return NameTemplate{}, fmt.Errorf("invalid name template %q: piece names can't hold a path, use --output for the directory", s)
+	case !strings.HasSuffix(s, ".car"):
+		return NameTemplate{}, fmt.Errorf("invalid name template %q: piece names have to end in .car", s)
+	case strings.HasPrefix(s, "-"):
+		return NameTemplate{}, fmt.Errorf("invalid name template %q: piece names would start with a \"-\"", s)
+	case !unique:
+		return NameTemplate{}, fmt.Errorf("invalid name template %q: it has to hold {index} or {piececid} for the piece names to be unique", s)
+	}
+	return t, nil
+}
+
+// String returns the template as it was parsed, empty for the default one.
+func (t NameTemplate) String() string {
+	return t.raw
+}
+
+// UsesRootCid reports whether the template holds {rootcid}, which needs the root of the input car up front.
+func (t NameTemplate) UsesRootCid() bool {
+	return t.usesRoot
+}
+
+// pieceNames names the pieces of a split: by their index while they are written, and by the name template once they
+// are complete.
+type pieceNames struct {
+	prefix   string
+	template NameTemplate
+	// root fills in {rootcid}
+	root cid.Cid
+}
+
+// indexName returns the name a piece is written under.
+func (n pieceNames) indexName(index int) string {
+	return fmt.Sprintf("%s%d.car", n.prefix, index)
+}
+
+// name returns the final name of a piece. Pieces without commP keep their index based name if the template holds
+// {piececid}.
+func (n pieceNames) name(index int, commP cid.Cid) string {
+	t := n.template
+	if t.raw == "" {
+		t = NameTemplate{raw: DefaultNameTemplate, usesCid: true}
+	}
+	if t.usesCid && !commP.Defined() {
+		return n.indexName(index)
+	}
+	dir, prefix := filepath.Split(n.prefix)
+	name := namePlaceholder.ReplaceAllStringFunc(t.raw, func(p string) string {
+		m := namePlaceholder.FindStringSubmatch(p)
+		switch m[1] {
+		case "prefix":
+			return prefix
+		case "index":
+			verb := m[2]
+			if verb == "" {
+				verb = "d"
+			}
+			return fmt.Sprintf("%"+verb, index)
+		case "piececid":
+			return commP.String()
+		default:
+			return n.root.String()
+		}
+	})
+	return dir + name
+}
+
+// renameToCommPConflicts are the options of a run handing out the names of the pieces while it runs, which a rename
+// at its end would leave pointing nowhere: the retrieval index, the exec hook and webhook, pushes and uploads.
+var renameToCommPConflicts = []string{"emit-retrieval-index", "exec", "webhook", "push", "upload"}
+
+// ValidateRenameToCommP checks that the pieces of a run can be renamed with RenameToCommP once it completed: the piece
+// files have to be there at the end of the run, and their names not handed out before. isSet tells whether an option of
+// the run is set, by its flag name.
+func ValidateRenameToCommP(dryRun bool, isSet func(name string) bool) error {
+	if dryRun {
+		return fmt.Errorf("--rename-to-commp is not supported with --dry-run")
+	}
+	for _, name := range renameToCommPConflicts {
+		if isSet(name) {
+			return fmt.Errorf("--rename-to-commp is not supported with --%s, which sees the names of the pieces during the run, use --name-template {piececid}.car instead", name)
+		}
+	}
+	return nil
+}
+
+// RenameToCommP renames every piece file with a commP to <piececid>.car in its directory, and records the new names in
+// pieces. It returns the new name of every renamed piece by its old one. A rename never replaces an existing file,
+// unless it is a piece of the same run with the same commP, i.e. an identical piece, which the piece file is then
+// dropped in favour of. Pieces without commP keep their name.
+func RenameToCommP(pieces []CarFile) (map[string]string, error) {
+	renamed := make(map[string]string)
+	// the commP of the files renamed so far, by their new name
+	commPs := make(map[string]string)
+	for i, cf := range pieces {
+		if !cf.CommP.Defined() {
+			continue
+		}
+		newn := filepath.Join(filepath.Dir(cf.Name), cf.CommP.String()+".car")
+		if n, ok := renamed[cf.Name]; ok {
+			// the same file as an earlier piece, with identical pieces named after their commP
+			pieces[i].Name = n
+			continue
+		}
+		if newn == cf.Name {
+			continue
+		}
+		err := renameNoReplace(cf.Name, newn)
+		if os.IsExist(err) && commPs[newn] == cf.CommP.String() {
+			err = os.Remove(cf.Name)
+		}
+		if err != nil {
+			return renamed, fmt.Errorf("failed to rename piece %s to %s: %s", cf.Name, newn, err)
+		}
+		renamed[cf.Name] = newn
+		commPs[newn] = cf.CommP.String()
+		pieces[i].Name = newn
+	}
+	return renamed, nil
+}
+
+// renameNoReplace renames a file, failing if newpath exists. The file is hard linked to its new name first, so that an
+// existing file is never replaced. On file systems without hard links, it falls back to a rename after a check.
+func renameNoReplace(oldpath, newpath string) error {
+	err := os.Link(oldpath, newpath)
+	if err == nil {
+		return os.Remove(oldpath)
+	}
+	if os.IsExist(err) {
+		return err
+	}
+	if _, err := os.Lstat(newpath); err == nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrExist}
+	}
+	return os.Rename(oldpath, newpath)
+}
@@ -0,0 +1,120 @@
+package splitter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNamePrefix(t *testing.T) {
+	cases := []struct {
+		name    string
+		output  string
+		want    string
+		wantDir string
+		wantErr string
+	}{
+		{name: "empty", output: "", want: ""},
+		{name: "name only", output: "dataset", want: "dataset-"},
+		{name: "dash inside the name", output: "my-dataset", want: "my-dataset-"},
+		{name: "trailing dash", output: "dataset-", want: "dataset--"},
+		{name: "name in a directory", output: "out/dataset", want: "out/dataset-", wantDir: "out"},
+		{name: "name in nested directories", output: "out/a/b/dataset", want: "out/a/b/dataset-", wantDir: "out/a/b"},
+		{name: "directory only", output: "out/", want: "out/", wantDir: "out"},
+		{name: "nested directory only", output: "out/a/", want: "out/a/", wantDir: "out/a"},
+		{name: "dash directory", output: "-out/dataset", want: "-out/dataset-", wantDir: "-out"},
+		{name: "leading dash", output: "-dataset", wantErr: `piece names would start with a "-"`},
+		{name: "only a dash", output: "-", wantErr: `piece names would start with a "-"`},
+		{name: "leading dash in a directory", output: "out/-dataset", wantErr: `piece names would start with a "-"`},
+	}
+
+	for _, tc := range cases {
+		for _, createDir := range []bool{false, true} {
+			name := tc.name
+			if createDir {
+				name += " creating the directory"
+			}
+			t.Run(name, func(t *testing.T) {
+				root := t.TempDir()
+				output := tc.output
+				if output != "" {
+					output = filepath.Join(root, output)
+					if strings.HasSuffix(tc.output, "/") {
+						output += "/"
+					}
+				}
+
+				got, err := NamePrefix(output, createDir)
+				if tc.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+						t.Fatalf("got prefix %q and error %v, want %q", got, err, tc.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := tc.want
+				if want != "" {
+					want = root + "/" + want
+				}
+				if got != want {
+					t.Errorf("got prefix %q, want %q", got, want)
+				}
+
+				if tc.wantDir == "" {
+					return
+				}
+				_, err = os.Stat(filepath.Join(root, tc.wantDir))
+				if createDir && err != nil {
+					t.Errorf("output directory not created: %s", err)
+				}
+				if !createDir && err == nil {
+					t.Errorf("output directory created without createDir")
+				}
+			})
+		}
+	}
+}
+
+func TestValidateRenameToCommP(t *testing.T) {
+	cases := []struct {
+		name    string
+		dryRun  bool
+		set     []string
+		wantErr string
+	}{
+		{name: "nothing else set"},
+		{name: "unrelated options", set: []string{"name-template", "upload-keep-local"}},
+		{name: "dry run", dryRun: true, wantErr: "--dry-run"},
+		{name: "exec hook", set: []string{"exec"}, wantErr: "--exec"},
+		{name: "webhook", set: []string{"webhook"}, wantErr: "--webhook"},
+		{name: "upload", set: []string{"upload", "upload-keep-local"}, wantErr: "--upload"},
+		{name: "push", set: []string{"push"}, wantErr: "--push"},
+		{name: "retrieval index", set: []string{"emit-retrieval-index"}, wantErr: "--emit-retrieval-index"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			isSet := func(name string) bool {
+				for _, s := range tc.set {
+					if s == name {
+						return true
+					}
+				}
+				return false
+			}
+			err := ValidateRenameToCommP(tc.dryRun, isSet)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package splitter
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// Packing is a hint on how to pack the pieces of a run into sectors. It doesn't change the pieces, nor their order in
+// the metadata, which is the order of the car stream.
+type Packing struct {
+	SectorSize uint64 `json:"sectorSize" yaml:"sectorSize"`
+	// Order lists the names of the pieces by padded size, largest first.
+	Order []string `json:"order" yaml:"order"`
+	// Sectors groups the pieces into as few sectors as possible.
+	Sectors []SectorPacking `json:"sectors" yaml:"sectors"`
+}
+
+// SectorPacking is the pieces packed into a single sector.
+type SectorPacking struct {
+	Pieces []string `json:"pieces" yaml:"pieces"`
+	// PaddedSize is the padded size of the pieces in the sector, the rest of the sector is left free.
+	PaddedSize uint64 `json:"paddedSize" yaml:"paddedSize"`
+}
+
+// PackSectors sorts the pieces by padded size, largest first, and groups them into sectors of the given padded size,
+// placing every piece into the first sector with room left for it. As padded sizes are powers of two, this leaves no
+// gaps in any sector but the last one, so it takes the fewest sectors possible.
+func PackSectors(pieces []CarFile, sectorSize uint64) (*Packing, error) {
+	if err := ValidateSectorSize(sectorSize); err != nil {
+		return nil, err
+	}
+	sorted := make([]CarFile, len(pieces))
+	copy(sorted, pieces)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].PaddedSize > sorted[j].PaddedSize })
+
+	p := &Packing{SectorSize: sectorSize, Order: make([]string, 0, len(sorted))}
+	for _, cf := range sorted {
+		if cf.PaddedSize > sectorSize {
+			return nil, fmt.Errorf("piece %s has a padded size of %d, more than the sector size of %d", cf.Name, cf.PaddedSize, sectorSize)
+		}
+		p.Order = append(p.Order, cf.Name)
+		placed := false
+		for i := range p.Sectors {
+			if p.Sectors[i].PaddedSize+cf.PaddedSize <= sectorSize {
+				p.Sectors[i].Pieces = append(p.Sectors[i].Pieces, cf.Name)
+				p.Sectors[i].PaddedSize += cf.PaddedSize
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			p.Sectors = append(p.Sectors, SectorPacking{Pieces: []string{cf.Name}, PaddedSize: cf.PaddedSize})
+		}
+	}
+	return p, nil
+}
+
+// ValidateSectorSize checks that a sector size is a valid padded size, so that a run can fail before pieces are
+// written rather than when packing them.
+func ValidateSectorSize(sectorSize uint64) error {
+	if sectorSize < 128 || bits.OnesCount64(sectorSize) != 1 {
+		return fmt.Errorf("sector size %d is not a valid padded size, expected a power of two of at least 128", sectorSize)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package splitter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/trace"
+	"github.com/ipfs/go-cid"
+)
+
+// pieceJob is what is left to do for a piece once it has been written: calculating its commP, naming it after it, and
+// checking its sizes.
+type pieceJob struct {
+	fname       string
+	index       int // index of the piece in the run
+	headerRoot  cid.Cid
+	headerLen   int64 // bytes before the blocks, the CARv2 pragma and header included
+	contentLen  int64
+	indexLen    int64 // bytes of the CARv2 index behind the blocks
+	written     int64
+	start, end  int64
+	calcCommP   bool
+	streamCommP bool
+	key         *pieceKey
+	blocks      []indexedBlock
+	// thread is the trace thread of the commP span
+	thread string
+	// padTo is the padded size to pad the piece to, if any
+	padTo uint64
+}
+
+// completePiece does what is left to do for a written piece. cp is the calculator the piece was streamed through, or a
+// fresh one if commP is to be calculated from the piece file.
+func (o Options) completePiece(cp commPCalc, job pieceJob, names pieceNames) (CarFile, error) {
+	var carFile CarFile
+	var err error
+	if job.calcCommP {
+		commPSpan := o.Tracer.Start(job.thread, "piece", "commp")
+		var rawCommP []byte
+		var paddedSize uint64
+		rawCommP, paddedSize, err = pieceCommP(cp, o.CommPCache, job.key, job.streamCommP, job.fname)
+		if err != nil {
+			return CarFile{}, err
+		}
+		carFile, err = finalizePiece(o.commPAlgorithm(), rawCommP, paddedSize, job.fname, names, job.index, o.DryRun, job.padTo)
+		commPSpan.Arg("piece", job.fname).End()
+	} else {
+		carFile, err = finalizePieceWithoutCommP(job.fname, names, job.index, uint64(job.headerLen+job.contentLen+job.indexLen), job.padTo, o.DryRun)
+	}
+	if err != nil {
+		return CarFile{}, err
+	}
+	carFile.HeaderSize = uint64(job.headerLen)
+	carFile.ContentSize = uint64(job.contentLen)
+	carFile.IndexSize = uint64(job.indexLen)
+	if job.headerRoot.Defined() {
+		carFile.HeaderRoot = job.headerRoot.String()
+	}
+	if len(o.Sources) > 0 {
+		carFile.SourceRoots = sourceRoots(o.Sources, job.start, job.end)
+	}
+	if violations := sizeViolations(carFile, job.written); len(violations) > 0 {
+		return CarFile{}, fmt.Errorf("inconsistent sizes of piece %s: %s", carFile.Name, strings.Join(violations, ", "))
+	}
+	return carFile, nil
+}
+
+// pendingPiece is a piece whose commP is calculated in the background.
+type pendingPiece struct {
+	job     pieceJob
+	span    *trace.Span
+	done    chan struct{}
+	carFile CarFile
+	err     error
+}
+
+// commPQueue calculates commP of up to workers pieces at the same time, from their files, while the split goes on
+// writing the next pieces. The pieces come out of the queue in the order they went in, whichever completes first.
+type commPQueue struct {
+	opts    Options
+	names   pieceNames
+	sem     chan struct{}
+	pending []*pendingPiece
+}
+
+func newCommPQueue(opts Options, names pieceNames) *commPQueue {
+	return &commPQueue{opts: opts, names: names, sem: make(chan struct{}, opts.CommPWorkers)}
+}
+
+// add starts completing a piece in the background.
+func (q *commPQueue) add(job pieceJob, span *trace.Span) {
+	p := &pendingPiece{job: job, span: span, done: make(chan struct{})}
+	q.pending = append(q.pending, p)
+	go func() {
+		defer close(p.done)
+		q.sem <- struct{}{}
+		defer func() { <-q.sem }()
+		// every worker needs a calculator of its own
+		p.carFile, p.err = q.opts.completePiece(q.opts.commPAlgorithm().newCalc(q.opts.CommPSkipZeros), p.job, q.names)
+	}()
+}
+
+// full reports whether enough pieces are waiting to keep all workers busy, so that the split can wait for the oldest
+// instead of running further ahead.
+func (q *commPQueue) full() bool {
+	return len(q.pending) >= 2*cap(q.sem)
+}
+
+// next returns the oldest piece once it is complete, or nil if there is none (or no queue). Unless wait is set, it
+// doesn't wait for a piece that is not complete yet, and returns nil instead.
+func (q *commPQueue) next(wait bool) *pendingPiece {
+	if q == nil || len(q.pending) == 0 {
+		return nil
+	}
+	p := q.pending[0]
+	if wait {
+		<-p.done
+	} else {
+		select {
+		case <-p.done:
+		default:
+			return nil
+		}
+	}
+	q.pending = q.pending[1:]
+	return p
+}
@@ -0,0 +1,144 @@
+package splitter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-cid"
+)
+
+// PiecePath returns where to find a piece of a run: at its recorded path, or under its base name in dir if set, for
+// pieces that were moved or retrieved from storage providers.
+func PiecePath(cf CarFile, dir string) string {
+	if dir == "" {
+		return cf.Name
+	}
+	return filepath.Join(dir, filepath.Base(cf.Name))
+}
+
+// Reassemble returns the car stream that was split into the given pieces: the original car header, followed by the
+// blocks of every piece in order, without the header and padding of the pieces. The piece files are opened as the
+// stream gets to them, see PiecePath for dir. The stream is always framed as CARv1, like the pieces, whatever the
+// framing of the split input.
+func Reassemble(m *CarPiecesAndMetadata, dir string) (io.Reader, error) {
+	hdr, err := base64.StdEncoding.DecodeString(m.OriginalCarHeader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode car header: %s", err)
+	}
+	if len(hdr) == 0 {
+		return nil, fmt.Errorf("the metadata has no original car header, expected yaml metadata")
+	}
+	readers := []io.Reader{bytes.NewReader(append(binary.AppendUvarint(nil, uint64(len(hdr))), hdr...))}
+	for _, cf := range m.CarPieces {
+		readers = append(readers, &pieceContentReader{path: PiecePath(cf, dir), headerSize: cf.HeaderSize, contentSize: cf.ContentSize})
+	}
+	return io.MultiReader(readers...), nil
+}
+
+// pieceContentReader reads the blocks of a piece file, skipping its header (and leaving out the index of a CARv2
+// piece). The file is opened on the first read and
+// closed once all blocks are read.
+type pieceContentReader struct {
+	path        string
+	headerSize  uint64
+	contentSize uint64
+	f           *os.File
+	r           io.Reader
+	done        bool
+}
+
+func (p *pieceContentReader) Read(b []byte) (int, error) {
+	if p.done {
+		return 0, io.EOF
+	}
+	if p.r == nil {
+		if err := p.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := p.r.Read(b)
+	if err == io.EOF {
+		p.done = true
+		p.f.Close()
+		if left := p.r.(*io.LimitedReader).N; left > 0 {
+			return n, fmt.Errorf("piece %s is truncated, %d bytes of blocks are missing", p.path, left)
+		}
+	}
+	return n, err
+}
+
+// open opens the piece file and skips its header, checking that it is as long as recorded.
+func (p *pieceContentReader) open() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return fmt.Errorf("failed to open piece: %s", err)
+	}
+	br := bufio.NewReader(f)
+	// the blocks of a CARv2 piece are behind its CARv2 header, and the CARv1 header after that
+	_, dataOffset, _, _, err := ReadCarV2Header(br)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("invalid piece %s: %s", p.path, err)
+	}
+	hdrLen, err := binary.ReadUvarint(br)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to read the header of piece %s: %s", p.path, err)
+	}
+	if got := dataOffset + uint64(len(binary.AppendUvarint(nil, hdrLen))) + hdrLen; got != p.headerSize {
+		f.Close()
+		return fmt.Errorf("piece %s has a header of %d bytes, the metadata records %d", p.path, got, p.headerSize)
+	}
+	if _, err := br.Discard(int(hdrLen)); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to read the header of piece %s: %s", p.path, err)
+	}
+	p.f = f
+	p.r = &io.LimitedReader{R: br, N: int64(p.contentSize)}
+	return nil
+}
+
+// PieceCids calls fn with the cid of every block of a piece, in order, see PiecePath for dir.
+func PieceCids(cf CarFile, dir string, fn func(cid.Cid) error) error {
+	p := &pieceContentReader{path: PiecePath(cf, dir), headerSize: cf.HeaderSize, contentSize: cf.ContentSize}
+	defer func() {
+		if p.f != nil && !p.done {
+			p.f.Close()
+		}
+	}()
+	br := bufio.NewReaderSize(p, 1<<20)
+	for {
+		l, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read a block of piece %s: %s", p.path, err)
+		}
+		// the cid is at most a few dozen bytes, peek at enough of the frame to decode it
+		peek := 128
+		if l < uint64(peek) {
+			peek = int(l)
+		}
+		head, err := br.Peek(peek)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read a block of piece %s: %s", p.path, err)
+		}
+		_, c, err := cid.CidFromBytes(head)
+		if err != nil {
+			return fmt.Errorf("undecodeable cid of a block of piece %s: %s", p.path, err)
+		}
+		if _, err := br.Discard(int(l)); err != nil {
+			return fmt.Errorf("failed to read a block of piece %s: %s", p.path, err)
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+}
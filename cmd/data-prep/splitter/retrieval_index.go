@@ -0,0 +1,78 @@
+package splitter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	retrievalIndexMagic = "DPRIDX1\n"
+
+	retrievalIndexPiece = 0x01
+	retrievalIndexBlock = 0x02
+)
+
+// RetrievalIndex writes an index of where every block ended up, for a gateway to fetch single blocks from the pieces.
+// The format is a magic "DPRIDX1\n", followed by records of a type byte and uvarint encoded fields:
+//
+//	piece: 0x01, name length, name (the base name of the piece file)
+//	block: 0x02, cid length, cid bytes, offset, length
+//
+// Block records belong to the piece record before them. The offset and length are those of the block data in the
+// piece file, i.e. behind the length prefix and cid of the block.
+type RetrievalIndex struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+// indexedBlock is a block of a piece that is not complete yet.
+type indexedBlock struct {
+	cid    []byte
+	offset uint64
+	length uint64
+}
+
+// CreateRetrievalIndex creates the index file at path.
+func CreateRetrievalIndex(path string) (*RetrievalIndex, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create retrieval index: %s", err)
+	}
+	ix := &RetrievalIndex{f: f, w: bufio.NewWriter(f)}
+	if _, err := ix.w.WriteString(retrievalIndexMagic); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write retrieval index: %s", err)
+	}
+	return ix, nil
+}
+
+// addPiece writes the records of a complete piece.
+func (ix *RetrievalIndex) addPiece(name string, blocks []indexedBlock) error {
+	rec := []byte{retrievalIndexPiece}
+	base := filepath.Base(name)
+	rec = binary.AppendUvarint(rec, uint64(len(base)))
+	rec = append(rec, base...)
+	for _, b := range blocks {
+		rec = append(rec, retrievalIndexBlock)
+		rec = binary.AppendUvarint(rec, uint64(len(b.cid)))
+		rec = append(rec, b.cid...)
+		rec = binary.AppendUvarint(rec, b.offset)
+		rec = binary.AppendUvarint(rec, b.length)
+	}
+	if _, err := ix.w.Write(rec); err != nil {
+		return fmt.Errorf("failed to write retrieval index: %s", err)
+	}
+	return nil
+}
+
+// Close flushes and closes the index file.
+func (ix *RetrievalIndex) Close() error {
+	if err := ix.w.Flush(); err != nil {
+		ix.f.Close()
+		return fmt.Errorf("failed to write retrieval index: %s", err)
+	}
+	return ix.f.Close()
+}
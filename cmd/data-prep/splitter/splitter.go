@@ -0,0 +1,836 @@
+package splitter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/logging"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/trace"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	bufSize          = (4 << 20) / 128 * 127
+	varintSize       = 10
+	nulRootCarHeader = "\x19" + // 25 bytes of CBOR (encoded as varint :cryingbear: )
+		// map with 2 keys
+		"\xA2" +
+		// text-key with length 5
+		"\x65" + "roots" +
+		// 1 element array
+		"\x81" +
+		// tag 42
+		"\xD8\x2A" +
+		// bytes with length 5
+		"\x45" +
+		// nul-identity-cid prefixed with \x00 as required in DAG-CBOR: https://github.com/ipld/specs/blob/master/block-layer/codecs/dag-cbor.md#links
+		"\x00\x01\x55\x00\x00" +
+		// text-key with length 7
+		"\x67" + "version" +
+		// 1, we call this v0 due to the nul-identity CID being an open question: https://github.com/ipld/go-car/issues/26#issuecomment-604299576
+		"\x01"
+	maxBlockSize = 2 << 20 // 2 MiB
+
+	_KiB = 1024
+	_MiB = _KiB * 1024
+)
+
+// CarFile describes a single car piece. The layout matches github.com/anjor/carlet so that metadata stays compatible.
+type CarFile struct {
+	Name        string   `json:"name" yaml:"name"`
+	CommP       PieceCid `json:"commP" yaml:"commP"`
+	PaddedSize  uint64   `json:"paddedSize" yaml:"paddedSize"`
+	HeaderSize  uint64   `json:"headerSize" yaml:"headerSize"`                       // Header size prefix + actual header size (nulRootCarHeader)
+	ContentSize uint64   `json:"contentSize" yaml:"contentSize"`                     // Actual content size, not including header and padding.
+	HeaderRoot  string   `json:"headerRoot,omitempty" yaml:"headerRoot,omitempty"`   // Root in the piece car header, empty for a nul root.
+	File        string   `json:"file,omitempty" yaml:"file,omitempty"`               // Input file held by the piece, only set with one car per file.
+	FileRoot    string   `json:"fileRoot,omitempty" yaml:"fileRoot,omitempty"`       // Root cid of File.
+	SourceRoots []string `json:"sourceRoots,omitempty" yaml:"sourceRoots,omitempty"` // Roots of the input cars the piece holds blocks of, only set for multiple input cars.
+	TreeNodes   bool     `json:"treeNodes,omitempty" yaml:"treeNodes,omitempty"`     // Piece holds only directory nodes, only set when these are grouped.
+	// Padded size of the piece content alone, only set if the piece was padded further to a fixed PaddedSize.
+	NaturalPaddedSize uint64 `json:"naturalPaddedSize,omitempty" yaml:"naturalPaddedSize,omitempty"`
+	URL               string `json:"url,omitempty" yaml:"url,omitempty"`               // Remote copy of the piece, only set when pieces are uploaded.
+	PushStatus        string `json:"pushStatus,omitempty" yaml:"pushStatus,omitempty"` // Outcome of pushing the piece to a storage provider, only set when pieces are pushed.
+	// Size of the index behind the blocks, only set for CARv2 pieces. Their HeaderSize includes the CARv2 pragma and header.
+	IndexSize uint64 `json:"indexSize,omitempty" yaml:"indexSize,omitempty"`
+}
+
+// PieceCid is the commP of a piece. It is undefined for pieces whose commP calculation was skipped, in which case it
+// is rendered as an empty string.
+type PieceCid struct {
+	cid.Cid
+}
+
+func (c PieceCid) String() string {
+	if !c.Defined() {
+		return ""
+	}
+	return c.Cid.String()
+}
+
+func (c PieceCid) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+func (c *PieceCid) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return c.parse(s)
+}
+
+func (c PieceCid) MarshalYAML() (interface{}, error) {
+	return c.String(), nil
+}
+
+func (c *PieceCid) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return c.parse(s)
+}
+
+func (c *PieceCid) parse(s string) error {
+	if s == "" {
+		*c = PieceCid{}
+		return nil
+	}
+	parsed, err := cid.Decode(s)
+	if err != nil {
+		return err
+	}
+	*c = PieceCid{parsed}
+	return nil
+}
+
+type CarPiecesAndMetadata struct {
+	OriginalCarHeaderSize uint64    `json:"originalCarHeaderSize" yaml:"originalCarHeaderSize"`       // Size of the original car header, including the size prefix.
+	OriginalCarHeader     string    `json:"originalCarHeader" yaml:"originalCarHeader"`               // Base64-encoded original car header (without the size prefix).
+	CommPAlgorithm        string    `json:"commPAlgorithm,omitempty" yaml:"commPAlgorithm,omitempty"` // Algorithm of the piece cids, sha2-256-trunc254-padded if empty.
+	CarPieces             []CarFile `json:"carPieces" yaml:"carPieces"`                               // List of car file pieces.
+	// Hint on how to pack the pieces into sectors, only set with --sort-pieces-by-size.
+	Packing *Packing `json:"packing,omitempty" yaml:"packing,omitempty"`
+
+	// Aggregate holds the inclusion proofs of the pieces in an aggregate of all of them, only set with
+	// --aggregate-proofs.
+	Aggregate *Aggregate `json:"aggregate,omitempty" yaml:"aggregate,omitempty"`
+}
+
+// Options controls how a car stream gets split.
+type Options struct {
+	// DryRun calculates commP and metadata without writing any pieces to disk.
+	DryRun bool
+
+	// CommPEvery, if greater than 1, only calculates commP for every n-th piece, starting with the first one.
+	CommPEvery int
+
+	// CommPSample, if between 0 and 1, only calculates commP for that fraction of pieces, spread evenly and starting
+	// with the first one. Ignored when CommPEvery is set.
+	CommPSample float64
+
+	// CommPSkipZeros calculates commP with a calculator that short-circuits all-zero regions instead of hashing them.
+	// The result is the same, but sparse inputs like disk images get through a lot faster.
+	CommPSkipZeros bool
+
+	// CommPAlgorithm is the piece commitment scheme. Defaults to FilCommitmentUnsealed.
+	CommPAlgorithm CommPAlgorithm
+
+	// PieceRootMode selects the root written into the car header of every piece. Defaults to a nul root.
+	PieceRootMode PieceRootMode
+
+	// DatasetRoot is the root used with PieceRootDataset. If undefined, the first root of the input car header is used.
+	DatasetRoot cid.Cid
+
+	// CheckpointInterval, if set, makes the split call OnCheckpoint after a completed piece whenever at least that much
+	// time has passed since the last checkpoint.
+	CheckpointInterval time.Duration
+	OnCheckpoint       func(Checkpoint) error
+
+	// Resume, if set, continues a split from a checkpoint: the stream is skipped up to the checkpoint offset (seeking
+	// if the reader supports it), and the pieces completed before the checkpoint are kept as they are.
+	Resume *Checkpoint
+
+	// Framing decodes the length prefixes of the input stream. Defaults to CARv1Framing.
+	Framing Framing
+
+	// Sources, if set, describes the input cars making up the stream (see ConcatCars), and makes every piece record the
+	// roots of the sources it holds blocks of.
+	Sources []Source
+
+	// PadTo, if set, pads every piece to this padded size instead of the next power of two of its length, and
+	// calculates commP over the padded piece. Must be a valid padded piece size (a power of two of at least 128).
+	PadTo uint64
+
+	// PadLast, if set, pads the last piece, which is usually much smaller than the others, to the padded size of a
+	// piece filled up to the target size, and calculates commP over the padded piece. Has no effect with PadTo.
+	PadLast bool
+
+	// NameTemplate names the piece files once they are complete. Defaults to DefaultNameTemplate, naming them after
+	// their commP.
+	NameTemplate NameTemplate
+
+	// FirstIndex is the index of the first piece of the split, for runs made of several splits into the same name
+	// prefix, for the pieces to be numbered through.
+	FirstIndex int
+
+	// CommPCache, if set, looks up the commP of every piece by its content before calculating it, and caches it
+	// afterwards. Unless DryRun is set, commP is then only calculated for pieces not in the cache, from the piece file.
+	CommPCache *CommPCache
+
+	// RetrievalIndex, if set, gets the location of every block in the pieces written.
+	RetrievalIndex *RetrievalIndex
+
+	// OnPiece, if set, is called for every piece as soon as it is complete, i.e. its file has been written and
+	// renamed, and its commP is known (unless skipped). Returning an error aborts the split.
+	OnPiece func(CarFile) error
+
+	// UploadURL, if set, is where the pieces are uploaded to (by OnPiece), every piece is recorded with the url of its
+	// remote copy: UploadURL followed by the base name of the piece file.
+	UploadURL string
+
+	// ContentDefinedBoundaries cuts pieces after blocks picked by their cid, once they hold at least half the target
+	// size, instead of at the target size. Identical runs of blocks in different streams then make for identical pieces.
+	ContentDefinedBoundaries bool
+
+	// Tracer, if set, records a span for every piece, and for the stages of its processing, on the "split" thread.
+	Tracer *trace.Tracer
+
+	// CommPWorkers, if greater than 1, calculates commP of up to that many pieces at the same time, from their files,
+	// while the next pieces are being written. The pieces are still reported (and passed to OnPiece) in stream order.
+	// Ignored in dry runs, which have no piece files to calculate commP from.
+	CommPWorkers int
+
+	// CarVersion is the car format of the pieces, 1 (the default) or 2. A CARv2 piece is the CARv1 piece, header and
+	// blocks, behind the CARv2 pragma and header, and followed by a MultihashIndexSorted index of its blocks. Its commP
+	// is calculated from the piece file, so CARv2 pieces can't be split in dry runs.
+	CarVersion int
+}
+
+type fileLike interface {
+	io.Writer
+	io.Closer
+	Sync() error
+}
+
+type devNullFile struct{}
+
+func (devNullFile) Write(p []byte) (n int, err error) {
+	return len(p), nil
+}
+
+func (devNullFile) Close() error {
+	return nil
+}
+
+func (devNullFile) Sync() error {
+	return nil
+}
+
+// Validate checks the options for values that can't be acted upon.
+func (o Options) Validate() error {
+	if o.CommPSample < 0 || o.CommPSample > 1 {
+		return fmt.Errorf("commP sample must be a fraction between 0 and 1, got %v", o.CommPSample)
+	}
+	if o.CommPEvery < 0 {
+		return fmt.Errorf("commP every must not be negative, got %d", o.CommPEvery)
+	}
+	if o.CommPWorkers < 0 {
+		return fmt.Errorf("commP workers must not be negative, got %d", o.CommPWorkers)
+	}
+	if o.CarVersion < 0 || o.CarVersion > 2 {
+		return fmt.Errorf("unsupported car version %d, expected 1 or 2", o.CarVersion)
+	}
+	if o.CarVersion == 2 && o.DryRun {
+		return fmt.Errorf("CARv2 pieces can't be split in a dry run, their commP is calculated from the piece files")
+	}
+	if o.PadTo != 0 && (o.PadTo < 128 || bits.OnesCount64(o.PadTo) != 1) {
+		return fmt.Errorf("pad to size %d is not a valid padded piece size, expected a power of two of at least 128", o.PadTo)
+	}
+	return nil
+}
+
+func (o Options) shouldCommP(i int) bool {
+	if o.CommPEvery > 1 {
+		return i%o.CommPEvery == 0
+	}
+	if o.CommPSample > 0 && o.CommPSample < 1 {
+		return math.Ceil(float64(i+1)*o.CommPSample) > math.Ceil(float64(i)*o.CommPSample)
+	}
+	return true
+}
+
+// SplitAndCommp splits a car stream into smaller car files of (roughly) the target size, calculating commP for each
+// of them at the same time. Every piece gets its own car header and is named after its commP, or by the name template.
+func SplitAndCommp(r io.Reader, targetSize int, namePrefix string, opts Options) (*CarPiecesAndMetadata, error) {
+	return SplitAndCommpContext(context.Background(), r, targetSize, namePrefix, opts)
+}
+
+// SplitAndCommpContext is SplitAndCommp, stopping between blocks once ctx is done. The piece being written is removed,
+// and the pieces completed so far are returned along with the error. With checkpoints enabled, a last checkpoint is
+// written right after the last completed piece, so that a resumed run continues from there. The same goes for a
+// stream failing because the stage writing it was cancelled.
+func SplitAndCommpContext(ctx context.Context, r io.Reader, targetSize int, namePrefix string, opts Options) (*CarPiecesAndMetadata, error) {
+	out := &CarPiecesAndMetadata{CommPAlgorithm: opts.commPAlgorithm().Name()}
+
+	streamBuf := bufio.NewReaderSize(r, bufSize)
+
+	actualHeader, streamLen, err := readHeader(streamBuf, opts.framing())
+	if err != nil {
+		return out, err
+	}
+	out.OriginalCarHeaderSize = uint64(streamLen)
+	out.OriginalCarHeader = base64.StdEncoding.EncodeToString(actualHeader)
+
+	if opts.PieceRootMode == PieceRootDataset && !opts.DatasetRoot.Defined() {
+		roots, err := carHeaderRoots(actualHeader)
+		if err != nil {
+			return out, err
+		}
+		if len(roots) == 0 || isNulRoot(roots[0]) {
+			return out, fmt.Errorf("the input car header has no root to use as dataset root for the piece headers")
+		}
+		opts.DatasetRoot = roots[0]
+	}
+
+	names := pieceNames{prefix: namePrefix, template: opts.NameTemplate}
+	if opts.NameTemplate.UsesRootCid() {
+		if names.root = opts.DatasetRoot; !names.root.Defined() {
+			roots, err := carHeaderRoots(actualHeader)
+			if err != nil {
+				return out, err
+			}
+			if len(roots) == 0 || isNulRoot(roots[0]) {
+				return out, fmt.Errorf("the name template uses {rootcid}, but the input car header has no root")
+			}
+			names.root = roots[0]
+		}
+	}
+
+	if opts.Resume != nil {
+		if err := validateResume(opts.Resume, targetSize, namePrefix, opts.NameTemplate, out.OriginalCarHeader); err != nil {
+			return out, err
+		}
+		if err := skipTo(r, streamBuf, streamLen, opts.Resume.StreamOffset); err != nil {
+			return out, err
+		}
+		streamLen = opts.Resume.StreamOffset
+		out.CarPieces = append(out.CarPieces, opts.Resume.CarPieces...)
+	}
+	lastCheckpoint := time.Now()
+	checkpoint := func(offset int64) error {
+		return opts.OnCheckpoint(Checkpoint{
+			TargetSize:        targetSize,
+			NamePrefix:        namePrefix,
+			NameTemplate:      opts.NameTemplate.String(),
+			OriginalCarHeader: out.OriginalCarHeader,
+			StreamOffset:      offset,
+			CarPieces:         out.CarPieces,
+		})
+	}
+	checkpointing := opts.OnCheckpoint != nil && opts.CheckpointInterval > 0
+
+	// the commP calculator and the piece write buffer are reused for all pieces, so memory use stays flat no matter
+	// how many pieces the stream is split into
+	cp := opts.commPAlgorithm().newCalc(opts.CommPSkipZeros)
+	fiWriteBuffer := bufio.NewWriterSize(nil, alignToPageSize(_MiB*12))
+
+	// report adds a completed piece to the metadata, in stream order
+	report := func(carFile CarFile, blocks []indexedBlock, pieceSpan *trace.Span) error {
+		if opts.UploadURL != "" {
+			carFile.URL = strings.TrimSuffix(opts.UploadURL, "/") + "/" + filepath.Base(carFile.Name)
+		}
+		out.CarPieces = append(out.CarPieces, carFile)
+		logging.Debug("piece written", "name", carFile.Name, "commP", carFile.CommP, "paddedSize", carFile.PaddedSize, "contentSize", carFile.ContentSize)
+		if opts.RetrievalIndex != nil {
+			if err := opts.RetrievalIndex.addPiece(carFile.Name, blocks); err != nil {
+				return err
+			}
+		}
+		if opts.OnPiece != nil {
+			hookSpan := opts.Tracer.Start("split", "piece", "on piece")
+			if err := opts.OnPiece(carFile); err != nil {
+				return err
+			}
+			hookSpan.End()
+		}
+		pieceSpan.Arg("name", carFile.Name).Arg("contentSize", carFile.ContentSize).End()
+		return nil
+	}
+	// with several commP workers, the pieces are completed in the background, and reported once all pieces before them
+	// are
+	var queue *commPQueue
+	if opts.CommPWorkers > 1 && !opts.DryRun {
+		queue = newCommPQueue(opts, names)
+	}
+	flush := func(wait bool) error {
+		for p := queue.next(wait); p != nil; p = queue.next(wait) {
+			if p.err != nil {
+				return p.err
+			}
+			if err := report(p.carFile, p.job.blocks, p.span); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if queue != nil {
+		// whatever the split fails with, the pieces completed in the background up to there are kept in the metadata
+		defer flush(true)
+	}
+
+	for i := len(out.CarPieces); ; i++ {
+		fname := names.indexName(opts.FirstIndex + i)
+		pieceSpan := opts.Tracer.Start("split", "piece", fmt.Sprintf("piece %d", i))
+		var pieceFile fileLike = devNullFile{}
+		if !opts.DryRun {
+			if pieceFile, err = os.Create(fname); err != nil {
+				return out, fmt.Errorf("failed to create file %q: %s", fname, err)
+			}
+		}
+		fiWriteBuffer.Reset(pieceFile)
+
+		cp.Reset()
+		calcCommP := opts.shouldCommP(i)
+		carV2 := opts.CarVersion == 2
+		// with a cache or commP workers, commP of a piece that is written to disk is calculated from the piece file,
+		// if at all, as it is for CARv2 pieces, whose header is only known once the piece is complete
+		streamCommP := calcCommP && ((opts.CommPCache == nil && queue == nil && !carV2) || opts.DryRun)
+		// count what actually goes into the piece, to check the size accounting against it
+		written := &countingWriter{w: fiWriteBuffer}
+		var wr io.Writer = written
+		if streamCommP {
+			wr = io.MultiWriter(written, cp)
+		}
+
+		header, headerRoot, err := opts.pieceHeader(streamBuf)
+		if err != nil {
+			return out, err
+		}
+		var key *pieceKey
+		if calcCommP && opts.CommPCache != nil {
+			keyHeader := header
+			if carV2 {
+				// the rest of a CARv2 piece follows from its blocks
+				keyHeader = carV2Pragma + header
+			}
+			key = newPieceKey(opts.commPAlgorithm().Name(), keyHeader)
+		}
+		var blocks []indexedBlock
+		var v2Blocks []carV2Block
+		if carV2 {
+			// filled in once the piece is complete
+			if _, err := wr.Write(make([]byte, carV2PrefixSize)); err != nil {
+				return out, fmt.Errorf("failed to write piece header: %s", err)
+			}
+		}
+		if _, err := io.WriteString(wr, header); err != nil {
+			return out, fmt.Errorf("failed to write piece header: %s", err)
+		}
+		headerLen := written.n
+
+		pieceStart := streamLen
+		var carletLen int64
+		var eof, boundary bool
+		copySpan := opts.Tracer.Start("split", "piece", "copy")
+		for carletLen < int64(targetSize) && !eof && !boundary {
+			var cut bool
+			if key != nil || opts.RetrievalIndex != nil || opts.ContentDefinedBoundaries || carV2 {
+				frameLen, blockCid := peekBlock(streamBuf, opts.framing())
+				// decided before the copy, blockCid points into the stream buffer
+				cut = opts.ContentDefinedBoundaries && contentBoundary(blockCid, frameLen, targetSize)
+				if key != nil && frameLen > 0 {
+					key.addFrame(frameLen, blockCid)
+				}
+				if opts.RetrievalIndex != nil && blockCid != nil {
+					// the frame is written with a carv1 prefix whatever the input framing
+					prefixLen := uint64(len(binary.AppendUvarint(nil, frameLen)))
+					blocks = append(blocks, indexedBlock{
+						cid:    append([]byte(nil), blockCid...),
+						offset: uint64(written.n) + prefixLen + uint64(len(blockCid)),
+						length: frameLen - uint64(len(blockCid)),
+					})
+				}
+				if carV2 && blockCid != nil {
+					v2Blocks = append(v2Blocks, carV2Block{
+						cid:    append([]byte(nil), blockCid...),
+						offset: uint64(written.n) - uint64(carV2PrefixSize),
+					})
+				}
+			}
+			var inLen, outLen int64
+			if err = ctx.Err(); err == nil {
+				inLen, outLen, eof, err = copyFrame(wr, streamBuf, streamLen, opts.framing())
+			}
+			streamLen += inLen
+			carletLen += outLen
+			if err != nil {
+				// don't leave a broken piece behind
+				pieceFile.Close()
+				if !opts.DryRun {
+					os.Remove(fname)
+				}
+				if ctx.Err() != nil {
+					// the checkpoint covers the pieces still completing in the background
+					if ferr := flush(true); ferr != nil {
+						return out, fmt.Errorf("%s, and failed to complete the pieces before: %s", err, ferr)
+					}
+					if checkpointing {
+						if cerr := checkpoint(pieceStart); cerr != nil {
+							return out, fmt.Errorf("%s, and failed to write a checkpoint: %s", err, cerr)
+						}
+					}
+					return out, fmt.Errorf("interrupted after %d pieces: %s", len(out.CarPieces), err)
+				}
+				return out, err
+			}
+			boundary = cut && carletLen >= minContentDefinedSize(targetSize)
+		}
+		if !eof {
+			// a piece that ends right where the stream does is the last one, instead of being followed by a piece
+			// holding nothing but a header
+			if _, err := streamBuf.Peek(1); err == io.EOF {
+				eof = true
+			}
+		}
+		if eof && carletLen == 0 {
+			pieceFile.Close()
+			if !opts.DryRun {
+				os.Remove(fname)
+			}
+			if err := flush(true); err != nil {
+				return out, err
+			}
+			if len(out.CarPieces) == 0 {
+				return out, fmt.Errorf("the car stream holds no blocks after its header, there is nothing to split")
+			}
+			// resumed from a checkpoint taken at the very end of the stream
+			return out, nil
+		}
+
+		copySpan.Arg("bytes", carletLen).End()
+
+		closeSpan := opts.Tracer.Start("split", "piece", "close")
+		var indexLen int64
+		if carV2 {
+			if indexLen, err = finishCarV2(pieceFile, written, fiWriteBuffer, v2Blocks, uint64(written.n)-uint64(carV2PrefixSize)); err != nil {
+				pieceFile.Close()
+				os.Remove(fname)
+				return out, err
+			}
+		}
+		if err := closePiece(pieceFile, fiWriteBuffer); err != nil {
+			return out, err
+		}
+		closeSpan.End()
+
+		job := pieceJob{
+			fname:       fname,
+			index:       opts.FirstIndex + i,
+			headerRoot:  headerRoot,
+			headerLen:   headerLen,
+			contentLen:  carletLen,
+			indexLen:    indexLen,
+			written:     written.n,
+			start:       pieceStart,
+			end:         streamLen,
+			calcCommP:   calcCommP,
+			streamCommP: streamCommP,
+			key:         key,
+			blocks:      blocks,
+			thread:      "split",
+			padTo:       opts.PadTo,
+		}
+		if eof && opts.PadLast && opts.PadTo == 0 {
+			job.padTo = padLastTo(targetSize, written.n)
+		}
+		if queue != nil {
+			job.thread = "commp"
+			queue.add(job, pieceSpan)
+			// report the pieces completed in the meantime, and hold back while the workers are behind
+			if err := flush(false); err != nil {
+				return out, err
+			}
+			for queue.full() {
+				p := queue.next(true)
+				if p.err != nil {
+					return out, p.err
+				}
+				if err := report(p.carFile, p.job.blocks, p.span); err != nil {
+					return out, err
+				}
+			}
+		} else {
+			carFile, err := opts.completePiece(cp, job, names)
+			if err != nil {
+				return out, err
+			}
+			if err := report(carFile, blocks, pieceSpan); err != nil {
+				return out, err
+			}
+		}
+
+		if eof {
+			return out, flush(true)
+		}
+
+		if checkpointing && time.Since(lastCheckpoint) >= opts.CheckpointInterval {
+			// a checkpoint only holds completed pieces, and has to cover the stream up to its offset
+			if err := flush(true); err != nil {
+				return out, err
+			}
+			if err := checkpoint(streamLen); err != nil {
+				return out, err
+			}
+			lastCheckpoint = time.Now()
+		}
+	}
+}
+
+// skipTo moves the stream forward to the given offset. streamLen is the current offset of streamBuf.
+func skipTo(r io.Reader, streamBuf *bufio.Reader, streamLen int64, offset int64) error {
+	if offset < streamLen {
+		return fmt.Errorf("can't resume at offset %d, before the end of the car header at %d", offset, streamLen)
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		if _, err := seeker.Seek(offset, io.SeekStart); err == nil {
+			streamBuf.Reset(r)
+			return nil
+		}
+	}
+	if _, err := io.CopyN(io.Discard, streamBuf, offset-streamLen); err != nil {
+		return fmt.Errorf("failed to skip to the checkpoint offset %d: %s", offset, err)
+	}
+	return nil
+}
+
+// copyFrame copies a single length-prefixed frame from the stream, rewriting its prefix to CARv1 framing if the input
+// uses a different one. It returns the number of bytes consumed from the stream and written to w, and reports eof
+// once the stream is exhausted.
+func copyFrame(w io.Writer, streamBuf *bufio.Reader, streamLen int64, framing Framing) (int64, int64, bool, error) {
+	maybeNextFrameLen, err := streamBuf.Peek(framing.MaxPrefixLen())
+	if err == io.EOF && len(maybeNextFrameLen) == 0 {
+		return 0, 0, true, nil
+	}
+	if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+		return 0, 0, false, fmt.Errorf("unexpected error at offset %d: %s", streamLen, err)
+	}
+	if len(maybeNextFrameLen) == 0 {
+		return 0, 0, false, fmt.Errorf("impossible 0-length peek without io.EOF at offset %d", streamLen)
+	}
+
+	frameLen, viL := framing.DecodeLen(maybeNextFrameLen)
+	if viL <= 0 {
+		// car file with trailing garbage behind it
+		return 0, 0, false, invalidCar(framing, streamLen, "undecodeable %s block length prefix", framing.Name())
+	}
+	if frameLen == 0 {
+		return 0, 0, false, invalidCar(framing, streamLen, "empty block")
+	}
+	if frameLen > maxBlockSize {
+		// anything over ~2MiB got to be a mistake
+		return 0, 0, false, invalidCar(framing, streamLen, "unexpectedly large block length of %d bytes", frameLen)
+	}
+
+	if framing == CARv1Framing {
+		actualFrameLen, err := io.CopyN(w, streamBuf, int64(viL)+int64(frameLen))
+		if err == io.EOF {
+			// a complete stream ends right after a frame, and is caught by the peek above
+			return actualFrameLen, actualFrameLen, false, invalidCar(framing, streamLen+actualFrameLen, "unexpected EOF in a block of %d bytes", frameLen)
+		}
+		if err != nil {
+			return actualFrameLen, actualFrameLen, false, fmt.Errorf("unexpected error at offset %d: %s", streamLen, err)
+		}
+		return actualFrameLen, actualFrameLen, false, nil
+	}
+
+	if _, err := streamBuf.Discard(viL); err != nil {
+		return 0, 0, false, fmt.Errorf("unexpected error at offset %d: %s", streamLen, err)
+	}
+	prefix := binary.AppendUvarint(nil, frameLen)
+	if _, err := w.Write(prefix); err != nil {
+		return int64(viL), 0, false, err
+	}
+	actualFrameLen, err := io.CopyN(w, streamBuf, int64(frameLen))
+	inLen, outLen := int64(viL)+actualFrameLen, int64(len(prefix))+actualFrameLen
+	if err == io.EOF {
+		return inLen, outLen, false, invalidCar(framing, streamLen+inLen, "unexpected EOF in a block of %d bytes", frameLen)
+	}
+	if err != nil {
+		return inLen, outLen, false, fmt.Errorf("unexpected error at offset %d: %s", streamLen, err)
+	}
+	return inLen, outLen, false, nil
+}
+
+func readHeader(streamBuf *bufio.Reader, framing Framing) ([]byte, int64, error) {
+	maybeHeaderLen, err := streamBuf.Peek(framing.MaxPrefixLen())
+	if len(maybeHeaderLen) == 0 {
+		if err == io.EOF {
+			return nil, 0, invalidCar(framing, 0, "empty input")
+		}
+		return nil, 0, fmt.Errorf("failed to read header: %s", err)
+	}
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, 0, fmt.Errorf("failed to read header: %s", err)
+	}
+
+	hdrLen, viLen := framing.DecodeLen(maybeHeaderLen)
+	if viLen <= 0 {
+		return nil, 0, invalidCar(framing, 0, "undecodeable %s header length prefix", framing.Name())
+	}
+	if hdrLen == 0 {
+		return nil, 0, invalidCar(framing, 0, "empty header")
+	}
+	if hdrLen > maxBlockSize {
+		return nil, 0, invalidCar(framing, 0, "unexpectedly large header length of %d bytes", hdrLen)
+	}
+
+	var streamLen int64
+	actualViLen, err := io.CopyN(io.Discard, streamBuf, int64(viLen))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to discard header length prefix: %s", err)
+	}
+	streamLen += actualViLen
+
+	headerBuf := new(bytes.Buffer)
+	actualHdrLen, err := io.CopyN(headerBuf, streamBuf, int64(hdrLen))
+	streamLen += actualHdrLen
+	if err == io.EOF {
+		return nil, 0, invalidCar(framing, streamLen, "unexpected EOF in the %d byte header", hdrLen)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read header: %s", err)
+	}
+
+	// headers of other framings are not necessarily DAG-CBOR
+	if framing == CARv1Framing {
+		_, version, err := parseCarHeader(headerBuf.Bytes())
+		if err != nil {
+			return nil, 0, invalidCar(framing, actualViLen, "undecodeable header: %s", err)
+		}
+		if version != 1 {
+			return nil, 0, invalidCar(framing, actualViLen, "unsupported car version %d", version)
+		}
+	}
+
+	return headerBuf.Bytes(), streamLen, nil
+}
+
+// finalizePiece names a written and closed piece by the name template, usually after its commP.
+func finalizePiece(
+	algorithm CommPAlgorithm,
+	rawCommP []byte,
+	paddedSize uint64,
+	fname string,
+	names pieceNames,
+	index int,
+	dryRun bool,
+	padTo uint64,
+) (CarFile, error) {
+	var err error
+	var naturalPaddedSize uint64
+	if padTo != 0 {
+		if paddedSize > padTo {
+			return CarFile{}, fmt.Errorf("piece %s needs a padded size of %d, more than the %d to pad to", fname, paddedSize, padTo)
+		}
+		// the piece is followed by zeros up to the padded size, which commP accounts for with zero subtrees
+		if rawCommP, err = algorithm.pad(rawCommP, paddedSize, padTo); err != nil {
+			return CarFile{}, err
+		}
+		naturalPaddedSize, paddedSize = paddedSize, padTo
+	}
+
+	commCid, err := algorithm.toCid(rawCommP)
+	if err != nil {
+		return CarFile{}, err
+	}
+
+	newn := names.name(index, commCid)
+
+	if !dryRun && newn != fname {
+		if err := os.Rename(fname, newn); err != nil {
+			return CarFile{}, err
+		}
+	}
+
+	return CarFile{
+		Name:              newn,
+		CommP:             PieceCid{commCid},
+		PaddedSize:        paddedSize,
+		NaturalPaddedSize: naturalPaddedSize,
+	}, nil
+}
+
+// finalizePieceWithoutCommP describes a piece whose commP was not calculated. The piece keeps its index based name,
+// unless the name template names pieces without their commP, and its padded size is derived from the piece size alone.
+func finalizePieceWithoutCommP(fname string, names pieceNames, index int, pieceSize uint64, padTo uint64, dryRun bool) (CarFile, error) {
+	cf := CarFile{
+		Name:       names.name(index, cid.Undef),
+		PaddedSize: paddedPieceSize(pieceSize),
+	}
+	if padTo != 0 {
+		if cf.PaddedSize > padTo {
+			return CarFile{}, fmt.Errorf("piece %s needs a padded size of %d, more than the %d to pad to", fname, cf.PaddedSize, padTo)
+		}
+		cf.NaturalPaddedSize, cf.PaddedSize = cf.PaddedSize, padTo
+	}
+	if !dryRun && cf.Name != fname {
+		if err := os.Rename(fname, cf.Name); err != nil {
+			return CarFile{}, err
+		}
+	}
+	return cf, nil
+}
+
+// padLastTo returns the padded size the last piece is padded to with PadLast: that of a piece holding the target size,
+// or its own if it is larger already.
+func padLastTo(targetSize int, pieceSize int64) uint64 {
+	padTo := paddedPieceSize(uint64(targetSize))
+	if own := paddedPieceSize(uint64(pieceSize)); own > padTo {
+		return own
+	}
+	return padTo
+}
+
+func closePiece(pieceFile fileLike, fBuf *bufio.Writer) error {
+	if err := fBuf.Flush(); err != nil {
+		return err
+	}
+	if err := pieceFile.Sync(); err != nil {
+		return err
+	}
+	return pieceFile.Close()
+}
+
+// paddedPieceSize returns the padded piece size of the given amount of unpadded bytes: every 127 bytes get fr32
+// expanded to 128, and the result rounded up to the next power of two.
+func paddedPieceSize(size uint64) uint64 {
+	padded := (size + 126) / 127 * 128
+	if padded < 128 {
+		return 128
+	}
+	if bits.OnesCount64(padded) != 1 {
+		padded = 1 << (64 - bits.LeadingZeros64(padded))
+	}
+	return padded
+}
+
+func alignToPageSize(size int) int {
+	alignment := int(os.Getpagesize())
+	mask := alignment - 1
+	mem := uintptr(size + alignment)
+	return int((mem + uintptr(mask)) & ^uintptr(mask))
+}
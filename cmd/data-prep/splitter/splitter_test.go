@@ -0,0 +1,153 @@
+package splitter
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testFrameSize is the size of the frame of a raw block of the given size in a car stream: the varint length prefix,
+// the 36 byte cidv1 and the data.
+func testFrameSize(size int) int {
+	return 2 + 36 + size
+}
+
+// checkPieces checks that every piece holds blocks, not only a header, and that the files in dir are exactly the
+// pieces.
+func checkPieces(t *testing.T, dir string, m *CarPiecesAndMetadata, wantPieces int) {
+	t.Helper()
+
+	if len(m.CarPieces) != wantPieces {
+		t.Fatalf("got %d pieces, want %d", len(m.CarPieces), wantPieces)
+	}
+	for i, p := range m.CarPieces {
+		if p.ContentSize == 0 {
+			t.Errorf("piece %d holds only a header", i)
+		}
+		fi, err := os.Stat(p.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint64(fi.Size()) != p.HeaderSize+p.ContentSize {
+			t.Errorf("piece %d: file of %d bytes, want %d of header and %d of content", i, fi.Size(), p.HeaderSize, p.ContentSize)
+		}
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != len(m.CarPieces) {
+		t.Errorf("%d files left for %d pieces", len(ents), len(m.CarPieces))
+	}
+}
+
+func TestSplitAndCommpStreamEnd(t *testing.T) {
+	frame := testFrameSize(1000)
+	cases := []struct {
+		name       string
+		blocks     int
+		targetSize int
+		wantPieces int
+	}{
+		{name: "ends at a piece boundary", blocks: 9, targetSize: 3 * frame, wantPieces: 3},
+		{name: "ends at the boundary of a single piece", blocks: 3, targetSize: 3 * frame, wantPieces: 1},
+		{name: "ends one byte after a piece boundary", blocks: 9, targetSize: 3*frame - 1, wantPieces: 3},
+		{name: "ends one byte before a piece boundary", blocks: 9, targetSize: 3*frame + 1, wantPieces: 3},
+		{name: "ends a block after a piece boundary", blocks: 10, targetSize: 3 * frame, wantPieces: 4},
+		{name: "single block at the boundary", blocks: 1, targetSize: frame, wantPieces: 1},
+	}
+
+	for _, tc := range cases {
+		for _, dryRun := range []bool{false, true} {
+			name := tc.name
+			if dryRun {
+				name += " dry run"
+			}
+			t.Run(name, func(t *testing.T) {
+				stream := testCarStream(t, repeatSizes(tc.blocks, 1000)...)
+				dir := t.TempDir()
+				m, err := SplitAndCommp(bytes.NewReader(stream), tc.targetSize, filepath.Join(dir, "p-"), Options{DryRun: dryRun})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if dryRun {
+					if len(m.CarPieces) != tc.wantPieces {
+						t.Fatalf("got %d pieces, want %d", len(m.CarPieces), tc.wantPieces)
+					}
+					for i, p := range m.CarPieces {
+						if p.ContentSize == 0 {
+							t.Errorf("piece %d holds only a header", i)
+						}
+					}
+					return
+				}
+				checkPieces(t, dir, m, tc.wantPieces)
+			})
+		}
+	}
+}
+
+func TestSplitAndCommpResume(t *testing.T) {
+	frame := testFrameSize(1000)
+	targetSize := 3 * frame
+	// the stream ends at a piece boundary
+	stream := testCarStream(t, repeatSizes(9, 1000)...)
+
+	dir := t.TempDir()
+	prefix := filepath.Join(dir, "p-")
+	var checkpoints []Checkpoint
+	full, err := SplitAndCommp(bytes.NewReader(stream), targetSize, prefix, Options{
+		CheckpointInterval: time.Nanosecond,
+		OnCheckpoint: func(cp Checkpoint) error {
+			checkpoints = append(checkpoints, cp)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPieces(t, dir, full, 3)
+	// every piece but the last, which ends the stream, is followed by a checkpoint
+	if len(checkpoints) != 2 {
+		t.Fatalf("got %d checkpoints, want 2", len(checkpoints))
+	}
+
+	atEnd := Checkpoint{
+		TargetSize:        targetSize,
+		NamePrefix:        prefix,
+		OriginalCarHeader: full.OriginalCarHeader,
+		StreamOffset:      int64(len(stream)),
+		CarPieces:         full.CarPieces,
+	}
+	cases := []struct {
+		name string
+		cp   Checkpoint
+	}{
+		{name: "after the first piece", cp: checkpoints[0]},
+		{name: "before the last piece", cp: checkpoints[1]},
+		{name: "at the end of the stream", cp: atEnd},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cp := tc.cp
+			// the pieces after the checkpoint are gone, as after a crash
+			for _, p := range full.CarPieces[len(cp.CarPieces):] {
+				os.Remove(p.Name)
+			}
+
+			m, err := SplitAndCommp(bytes.NewReader(stream), targetSize, prefix, Options{Resume: &cp})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkPieces(t, dir, m, len(full.CarPieces))
+			for i, p := range m.CarPieces {
+				w := full.CarPieces[i]
+				if p.Name != w.Name || p.CommP.String() != w.CommP.String() || p.ContentSize != w.ContentSize {
+					t.Errorf("piece %d: got %s %s of %d bytes, want %s %s of %d bytes", i, p.Name, p.CommP, p.ContentSize, w.Name, w.CommP, w.ContentSize)
+				}
+			}
+		})
+	}
+}
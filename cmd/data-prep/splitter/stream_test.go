@@ -0,0 +1,75 @@
+package splitter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// testCarStream builds a car v1 stream with one raw block of every given size and the first block as its root.
+func testCarStream(t testing.TB, blockSizes ...int) []byte {
+	t.Helper()
+
+	rnd := rand.New(rand.NewSource(int64(len(blockSizes))))
+	var blocks bytes.Buffer
+	var root cid.Cid
+	for i, size := range blockSizes {
+		data := make([]byte, size)
+		rnd.Read(data)
+		c := testRawCid(t, data)
+		if i == 0 {
+			root = c
+		}
+		writeFrame(&blocks, c.Bytes(), data)
+	}
+	if !root.Defined() {
+		root = testRawCid(t, nil)
+	}
+
+	// dag-cbor {"roots": [root], "version": 1}
+	var hdr bytes.Buffer
+	hdr.WriteString("\xA2\x65roots\x81\xD8\x2A")
+	rootBytes := append([]byte{0}, root.Bytes()...)
+	hdr.Write([]byte{0x58, byte(len(rootBytes))})
+	hdr.Write(rootBytes)
+	hdr.WriteString("\x67version\x01")
+
+	var out bytes.Buffer
+	writeFrame(&out, hdr.Bytes())
+	out.Write(blocks.Bytes())
+	return out.Bytes()
+}
+
+func testRawCid(t testing.TB, data []byte) cid.Cid {
+	t.Helper()
+
+	mh, err := multihash.Sum(data, multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(cid.Raw, mh)
+}
+
+func writeFrame(w *bytes.Buffer, parts ...[]byte) {
+	var frameLen int
+	for _, p := range parts {
+		frameLen += len(p)
+	}
+	w.Write(binary.AppendUvarint(nil, uint64(frameLen)))
+	for _, p := range parts {
+		w.Write(p)
+	}
+}
+
+// repeatSizes returns n block sizes of size bytes each.
+func repeatSizes(n, size int) []int {
+	sizes := make([]int, n)
+	for i := range sizes {
+		sizes[i] = size
+	}
+	return sizes
+}
@@ -0,0 +1,180 @@
+package splitter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/bits"
+
+	sha256simd "github.com/minio/sha256-simd"
+)
+
+const (
+	quadSize    = 127 // unpadded bytes that fr32-expand into 4 32 byte leaves
+	minPayload  = 65  // commP is not defined for less data, matching go-fil-commp-hashhash
+	maxLayers   = 64
+	quadLayer   = 2 // tree layer of the node covering the 4 leaves of a quad
+	nodeSize    = 32
+	lastByteIdx = nodeSize - 1
+)
+
+type commPCalc interface {
+	io.Writer
+	Reset()
+	Digest() (commP []byte, paddedPieceSize uint64, err error)
+}
+
+var (
+	zeroQuad [quadSize]byte
+
+	// zeroComms[l] is the root of a subtree of height l over all-zero leaves
+	zeroComms [maxLayers][nodeSize]byte
+)
+
+func init() {
+	for l := 1; l < maxLayers; l++ {
+		zeroComms[l] = hashPair(&zeroComms[l-1], &zeroComms[l-1])
+	}
+}
+
+// zeroAwareCalc calculates commP like go-fil-commp-hashhash, but short-circuits all-zero regions: an all-zero quad is
+// replaced with its precomputed commitment, and two sibling subtrees that are both all-zero are combined into the
+// precomputed commitment of the parent instead of being hashed. For sparse data (disk images, sparse files) this
+// skips the bulk of the hashing. The result is identical to the regular calculation.
+//
+// Digest finalizes the calculation, so the calculator must be Reset before it can be reused.
+type zeroAwareCalc struct {
+	partial []byte
+	quads   uint64
+	total   uint64
+
+	layers  [maxLayers][nodeSize]byte
+	pending [maxLayers]bool
+}
+
+func (c *zeroAwareCalc) Reset() {
+	*c = zeroAwareCalc{partial: c.partial[:0]}
+}
+
+func (c *zeroAwareCalc) Write(p []byte) (int, error) {
+	n := len(p)
+	c.total += uint64(n)
+
+	if len(c.partial) > 0 {
+		need := quadSize - len(c.partial)
+		if len(p) < need {
+			c.partial = append(c.partial, p...)
+			return n, nil
+		}
+		c.partial = append(c.partial, p[:need]...)
+		c.addQuad(c.partial)
+		c.partial = c.partial[:0]
+		p = p[need:]
+	}
+	for len(p) >= quadSize {
+		c.addQuad(p[:quadSize])
+		p = p[quadSize:]
+	}
+	c.partial = append(c.partial, p...)
+
+	return n, nil
+}
+
+func (c *zeroAwareCalc) Digest() ([]byte, uint64, error) {
+	if c.total < minPayload {
+		return nil, 0, fmt.Errorf("insufficient state accumulated: commP is not defined for inputs shorter than %d bytes, but only %d processed so far", minPayload, c.total)
+	}
+
+	if len(c.partial) > 0 {
+		c.partial = append(c.partial, zeroQuad[:quadSize-len(c.partial)]...)
+		c.addQuad(c.partial)
+		c.partial = c.partial[:0]
+	}
+
+	paddedSize := c.quads * 128
+	if bits.OnesCount64(paddedSize) != 1 {
+		paddedSize = 1 << (64 - bits.LeadingZeros64(paddedSize))
+	}
+	rootLayer := bits.TrailingZeros64(paddedSize / nodeSize)
+
+	// fill up the right edge of the tree with zero subtrees
+	for l := 0; l < rootLayer; l++ {
+		if c.pending[l] {
+			c.pending[l] = false
+			c.push(l+1, combine(l, &c.layers[l], &zeroComms[l]))
+		}
+	}
+
+	root := c.layers[rootLayer]
+	return root[:], paddedSize, nil
+}
+
+func (c *zeroAwareCalc) addQuad(q []byte) {
+	c.quads++
+
+	if bytes.Equal(q, zeroQuad[:]) {
+		c.push(quadLayer, zeroComms[quadLayer])
+		return
+	}
+
+	var out [4 * nodeSize]byte
+	fr32Expand(&out, q)
+
+	var leaves [4][nodeSize]byte
+	for i := range leaves {
+		copy(leaves[i][:], out[i*nodeSize:])
+	}
+	left := hashPair(&leaves[0], &leaves[1])
+	right := hashPair(&leaves[2], &leaves[3])
+	c.push(quadLayer, hashPair(&left, &right))
+}
+
+// push adds a node at the given layer, carrying it up the tree as long as it completes a pair.
+func (c *zeroAwareCalc) push(layer int, node [nodeSize]byte) {
+	for c.pending[layer] {
+		c.pending[layer] = false
+		node = combine(layer, &c.layers[layer], &node)
+		layer++
+	}
+	c.layers[layer] = node
+	c.pending[layer] = true
+}
+
+func combine(layer int, left, right *[nodeSize]byte) [nodeSize]byte {
+	if *left == zeroComms[layer] && *right == zeroComms[layer] {
+		return zeroComms[layer+1]
+	}
+	return hashPair(left, right)
+}
+
+// hashPair is the sha2-256-trunc254 hash of two nodes
+func hashPair(left, right *[nodeSize]byte) [nodeSize]byte {
+	h := sha256simd.New()
+	h.Write(left[:])
+	h.Write(right[:])
+	var out [nodeSize]byte
+	h.Sum(out[:0])
+	out[lastByteIdx] &= 0x3F
+	return out
+}
+
+// fr32Expand spreads 127 bytes over 4 32 byte leaves, inserting 2 zero bits after every 254 bits.
+func fr32Expand(out *[4 * nodeSize]byte, in []byte) {
+	copy(out[0:32], in[0:32])
+	out[31] &= 0x3F
+
+	for i := 32; i < 64; i++ {
+		out[i] = in[i-1]>>6 | in[i]<<2
+	}
+	out[63] &= 0x3F
+
+	for i := 64; i < 96; i++ {
+		out[i] = in[i-1]>>4 | in[i]<<4
+	}
+	out[95] &= 0x3F
+
+	for i := 96; i < 127; i++ {
+		out[i] = in[i-1]>>2 | in[i]<<6
+	}
+	out[127] = in[126] >> 2
+}
@@ -0,0 +1,143 @@
+package splitter
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+)
+
+// sparseData returns size bytes that are zero but for runs of random data of dataLen bytes at the given offsets.
+func sparseData(size int, dataLen int, offsets ...int) []byte {
+	data := make([]byte, size)
+	rnd := rand.New(rand.NewSource(int64(size)))
+	for _, off := range offsets {
+		end := off + dataLen
+		if end > size {
+			end = size
+		}
+		rnd.Read(data[off:end])
+	}
+	return data
+}
+
+func TestZeroAwareCalcMatchesCommP(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{name: "shortest zeros", data: make([]byte, minPayload)},
+		{name: "one zero quad", data: make([]byte, quadSize)},
+		{name: "zero quads and a partial one", data: make([]byte, 5*quadSize+3)},
+		{name: "zeros of a power of two quads", data: make([]byte, 1024*quadSize)},
+		{name: "zeros one byte short of a quad", data: make([]byte, 8*quadSize-1)},
+		{name: "large zeros", data: make([]byte, 8<<20)},
+		{name: "data only", data: sparseData(100000, 100000, 0)},
+		{name: "data then zeros", data: sparseData(1<<20, 1000, 0)},
+		{name: "zeros then data", data: sparseData(1<<20, 1000, 1<<20-1000)},
+		{name: "data in the middle of zeros", data: sparseData(1<<20, 300, 500000)},
+		{name: "a nonzero byte in the last quad", data: sparseData(64*quadSize, 1, 64*quadSize-1)},
+		{name: "a nonzero byte in every other quad", data: sparseData(16*quadSize, 1, 0, 2*quadSize, 4*quadSize+126, 6*quadSize, 14*quadSize)},
+		{name: "sparse with partial quad", data: sparseData(3<<20+17, 4096, 0, 1<<20, 2<<20+5, 3<<20)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var want commp.Calc
+			want.Write(tc.data)
+			wantCommP, wantSize, err := want.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// in one write, and in writes that don't line up with quads
+			for _, chunk := range []int{len(tc.data), 1000, quadSize + 1} {
+				var got zeroAwareCalc
+				for rest := tc.data; len(rest) > 0; {
+					n := chunk
+					if n > len(rest) {
+						n = len(rest)
+					}
+					got.Write(rest[:n])
+					rest = rest[n:]
+				}
+				gotCommP, gotSize, err := got.Digest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(gotCommP, wantCommP) || gotSize != wantSize {
+					t.Errorf("writes of %d bytes: got commP %x of %d bytes, want %x of %d bytes", chunk, gotCommP, gotSize, wantCommP, wantSize)
+				}
+			}
+		})
+	}
+}
+
+func TestZeroAwareCalcReset(t *testing.T) {
+	first := sparseData(1<<20, 5000, 300)
+	second := sparseData(200000, 100, 0)
+
+	var want commp.Calc
+	want.Write(second)
+	wantCommP, _, err := want.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calc zeroAwareCalc
+	calc.Write(first[:len(first)-7])
+	calc.Reset()
+	calc.Write(second)
+	gotCommP, _, err := calc.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotCommP, wantCommP) {
+		t.Fatalf("after a reset got commP %x, want %x", gotCommP, wantCommP)
+	}
+}
+
+func TestZeroAwareCalcTooShort(t *testing.T) {
+	var calc zeroAwareCalc
+	calc.Write(make([]byte, minPayload-1))
+	if _, _, err := calc.Digest(); err == nil {
+		t.Fatalf("got a commP of %d bytes", minPayload-1)
+	}
+}
+
+// BenchmarkCommP compares the zero-aware calculator with the regular one over data from dense to all-zero.
+func BenchmarkCommP(b *testing.B) {
+	const size = 32 << 20
+	inputs := []struct {
+		name string
+		data []byte
+	}{
+		{name: "dense", data: sparseData(size, size, 0)},
+		{name: "sparse", data: sparseData(size, 1<<20, 0, 8<<20, 24<<20)},
+		{name: "zeros", data: make([]byte, size)},
+	}
+	calcs := []struct {
+		name string
+		new  func() commPCalc
+	}{
+		{name: "regular", new: func() commPCalc { return new(commp.Calc) }},
+		{name: "zero-aware", new: func() commPCalc { return new(zeroAwareCalc) }},
+	}
+
+	for _, in := range inputs {
+		for _, calc := range calcs {
+			b.Run(fmt.Sprintf("%s %s", in.name, calc.name), func(b *testing.B) {
+				b.SetBytes(size)
+				for i := 0; i < b.N; i++ {
+					c := calc.new()
+					c.Write(in.data)
+					if _, _, err := c.Digest(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// minBlocked is the shortest time a read or write has to block to be recorded. Reads and writes on the pipes between
+// the stages are frequent and mostly quick, recording every one of them would make traces huge.
+const minBlocked = time.Millisecond
+
+// Tracer records a timeline of spans, and writes it in the Chrome trace event format, as read by chrome://tracing,
+// Perfetto and speedscope. Spans are recorded on named threads, one for every stage of the pipeline, so that the
+// stages show up as separate tracks. All methods are safe for concurrent use, and do nothing on a nil Tracer, so that
+// callers don't have to check whether tracing is enabled.
+type Tracer struct {
+	start time.Time
+
+	mu      sync.Mutex
+	events  []event
+	threads map[string]int
+}
+
+// event is a trace event: a complete span ("X") or the name of a thread ("M").
+type event struct {
+	Name     string                 `json:"name"`
+	Category string                 `json:"cat,omitempty"`
+	Phase    string                 `json:"ph"`
+	Ts       int64                  `json:"ts"`
+	Dur      int64                  `json:"dur,omitempty"`
+	Pid      int                    `json:"pid"`
+	Tid      int                    `json:"tid"`
+	Args     map[string]interface{} `json:"args,omitempty"`
+}
+
+// Span is a span that has been started, and is recorded once it ends.
+type Span struct {
+	t        *Tracer
+	thread   string
+	name     string
+	category string
+	start    time.Time
+	args     map[string]interface{}
+}
+
+// New returns a tracer, with the timeline starting now.
+func New() *Tracer {
+	return &Tracer{start: time.Now(), threads: make(map[string]int)}
+}
+
+// Start starts a span of the given category on a thread.
+func (t *Tracer) Start(thread, category, name string) *Span {
+	if t == nil {
+		return nil
+	}
+	return &Span{t: t, thread: thread, name: name, category: category, start: time.Now()}
+}
+
+// Arg adds an argument to the span, shown along with it in the trace viewer.
+func (s *Span) Arg(key string, value interface{}) *Span {
+	if s == nil {
+		return nil
+	}
+	if s.args == nil {
+		s.args = make(map[string]interface{})
+	}
+	s.args[key] = value
+	return s
+}
+
+// End records the span.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.t.record(s.thread, s.category, s.name, s.start, time.Since(s.start), s.args)
+}
+
+func (t *Tracer) record(thread, category, name string, start time.Time, dur time.Duration, args map[string]interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tid, ok := t.threads[thread]
+	if !ok {
+		tid = len(t.threads) + 1
+		t.threads[thread] = tid
+		t.events = append(t.events, event{Name: "thread_name", Phase: "M", Pid: 1, Tid: tid, Args: map[string]interface{}{"name": thread}})
+	}
+	// a span shorter than the resolution of the timestamps still shows up
+	us := dur.Microseconds()
+	if us == 0 {
+		us = 1
+	}
+	t.events = append(t.events, event{
+		Name:     name,
+		Category: category,
+		Phase:    "X",
+		Ts:       start.Sub(t.start).Microseconds(),
+		Dur:      us,
+		Pid:      1,
+		Tid:      tid,
+		Args:     args,
+	})
+}
+
+// Reader returns a reader recording a span on the thread whenever a read from r blocks for a while, i.e. the stage
+// reading is stalled waiting for its input. On a nil Tracer, r is returned as it is.
+func (t *Tracer) Reader(thread, name string, r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &blockedReader{t: t, thread: thread, name: name, r: r}
+}
+
+// Writer returns a writer recording a span on the thread whenever a write to w blocks for a while, i.e. the stage
+// writing is stalled waiting for the next one to catch up. On a nil Tracer, w is returned as it is.
+func (t *Tracer) Writer(thread, name string, w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	return &blockedWriter{t: t, thread: thread, name: name, w: w}
+}
+
+type blockedReader struct {
+	t      *Tracer
+	thread string
+	name   string
+	r      io.Reader
+}
+
+func (b *blockedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := b.r.Read(p)
+	if dur := time.Since(start); dur >= minBlocked {
+		b.t.record(b.thread, "blocked", b.name, start, dur, map[string]interface{}{"bytes": n})
+	}
+	return n, err
+}
+
+type blockedWriter struct {
+	t      *Tracer
+	thread string
+	name   string
+	w      io.Writer
+}
+
+func (b *blockedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := b.w.Write(p)
+	if dur := time.Since(start); dur >= minBlocked {
+		b.t.record(b.thread, "blocked", b.name, start, dur, map[string]interface{}{"bytes": n})
+	}
+	return n, err
+}
+
+// WriteFile writes the spans recorded so far to path, as a json trace.
+func (t *Tracer) WriteFile(path string) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create trace file: %s", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if err := json.NewEncoder(w).Encode(struct {
+		TraceEvents     []event `json:"traceEvents"`
+		DisplayTimeUnit string  `json:"displayTimeUnit"`
+	}{t.events, "ms"}); err != nil {
+		return fmt.Errorf("failed to write trace file: %s", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write trace file: %s", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,172 @@
+package unsplit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-merkledag"
+	"github.com/multiformats/go-multihash"
+	"github.com/urfave/cli/v2"
+)
+
+var Cmd = &cli.Command{
+	Name:      "unsplit",
+	Usage:     "reassemble the car file a run split into pieces, and verify its dag",
+	ArgsUsage: "<metadata.yaml>",
+	Action:    unsplitAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "output",
+			Aliases:  []string{"o"},
+			Required: true,
+			Usage:    "file to write the reassembled car to.",
+		},
+		&cli.StringFlag{
+			Name:     "pieces-dir",
+			Required: false,
+			Usage:    "optional directory to find the pieces in, by the base name of their file, instead of at the paths recorded in the metadata.",
+		},
+	},
+}
+
+func unsplitAction(c *cli.Context) error {
+	if !c.Args().Present() {
+		return fmt.Errorf("expected a metadata file, found none")
+	}
+	m, err := metadata.Read(c.Args().First())
+	if err != nil {
+		return err
+	}
+	if len(m.CarPiecesMeta.CarPieces) == 0 {
+		return fmt.Errorf("no pieces in %s", c.Args().First())
+	}
+
+	// the root of the dag, or the roots declared in the car header if the metadata doesn't record it
+	var roots []cid.Cid
+	if m.RootCid != "" {
+		root, err := cid.Decode(m.RootCid)
+		if err != nil {
+			return fmt.Errorf("invalid root cid in the metadata: %s", err)
+		}
+		roots = append(roots, root)
+	} else if roots, err = m.CarPiecesMeta.HeaderRoots(); err != nil {
+		return err
+	}
+
+	stream, err := splitter.Reassemble(m.CarPiecesMeta, c.String("pieces-dir"))
+	if err != nil {
+		return err
+	}
+	output := c.String("output")
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 1<<20)
+	blocks, err := verifyCar(io.TeeReader(stream, w), roots)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+
+	fmt.Printf("wrote %s, %d blocks from %d pieces\n", output, blocks, len(m.CarPiecesMeta.CarPieces))
+	if len(roots) == 0 {
+		fmt.Printf("no root cid recorded, only the blocks were checked against their cids\n")
+	}
+	for _, root := range roots {
+		fmt.Printf("root cid = %s, dag complete\n", root)
+	}
+	return nil
+}
+
+// verifyCar reads a car stream to its end, checks every block against its cid, and checks that the dags of the roots
+// are complete, i.e. every block linked from them is in the stream. Links are followed for dag-pb blocks only, the
+// blocks unixfs dags are made of. It returns the number of blocks.
+func verifyCar(r io.Reader, roots []cid.Cid) (int, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	var offset uint64
+	var buf []byte
+	readFrame := func() ([]byte, error) {
+		l, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if cap(buf) < int(l) {
+			buf = make([]byte, l)
+		}
+		buf = buf[:l]
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, fmt.Errorf("unexpected end of the car stream in a frame of %d bytes: %s", l, err)
+		}
+		offset += uint64(len(binary.AppendUvarint(nil, l))) + l
+		return buf, nil
+	}
+
+	if _, err := readFrame(); err != nil {
+		return 0, fmt.Errorf("failed to read the car header: %s", err)
+	}
+	links := make(map[string][]cid.Cid)
+	var blocks int
+	for {
+		start := offset
+		frame, err := readFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return blocks, fmt.Errorf("failed to read the block at offset %d: %s", start, err)
+		}
+		n, c, err := cid.CidFromBytes(frame)
+		if err != nil {
+			return blocks, fmt.Errorf("undecodeable cid of the block at offset %d: %s", start, err)
+		}
+		sum, err := c.Prefix().Sum(frame[n:])
+		if err != nil {
+			return blocks, fmt.Errorf("failed to hash block %s: %s", c, err)
+		}
+		if !sum.Equals(c) {
+			return blocks, fmt.Errorf("the data of block %s at offset %d doesn't match its cid", c, start)
+		}
+		var ls []cid.Cid
+		if c.Type() == cid.DagProtobuf {
+			pn, err := merkledag.DecodeProtobuf(frame[n:])
+			if err != nil {
+				return blocks, fmt.Errorf("undecodeable block %s: %s", c, err)
+			}
+			for _, l := range pn.Links() {
+				ls = append(ls, l.Cid)
+			}
+		}
+		links[string(c.Bytes())] = ls
+		blocks++
+	}
+
+	seen := make(map[string]bool)
+	stack := append([]cid.Cid(nil), roots...)
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if c.Prefix().MhType == multihash.IDENTITY || seen[string(c.Bytes())] {
+			continue
+		}
+		seen[string(c.Bytes())] = true
+		ls, ok := links[string(c.Bytes())]
+		if !ok {
+			return blocks, fmt.Errorf("block %s of the dag is missing", c)
+		}
+		stack = append(stack, ls...)
+	}
+	return blocks, nil
+}
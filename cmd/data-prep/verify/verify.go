@@ -0,0 +1,109 @@
+package verify
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/metadata"
+	"github.com/anjor/go-fil-dataprep/cmd/data-prep/splitter"
+	"github.com/urfave/cli/v2"
+)
+
+var Cmd = &cli.Command{
+	Name:      "verify",
+	Usage:     "check the pieces of a run against its metadata: recalculate commP, and check that no piece is missing or of another size",
+	ArgsUsage: "<metadata.csv|metadata.yaml>",
+	Action:    verifyAction,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "pieces-dir",
+			Required: false,
+			Usage:    "optional directory to find the pieces in, by the base name of their file, instead of at the paths recorded in the metadata.",
+		},
+		&cli.IntFlag{
+			Name:     "workers",
+			Required: false,
+			Value:    runtime.NumCPU(),
+			Usage:    "number of pieces to verify concurrently.",
+		},
+		&cli.BoolFlag{
+			Name:     "commp-skip-zeros",
+			Required: false,
+			Usage:    "optional, short-circuit commP over all-zero regions instead of hashing them. Gives the same commP, but is much faster on sparse pieces.",
+		},
+	},
+}
+
+// verifyAction verifies every piece of a run, reporting each of them, and fails if any piece is missing or doesn't
+// match its metadata.
+func verifyAction(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		return fmt.Errorf("expected a metadata file")
+	}
+	m, err := metadata.Read(c.Args().First())
+	if err != nil {
+		return err
+	}
+	pieces := m.CarPiecesMeta.CarPieces
+	if len(pieces) == 0 {
+		return fmt.Errorf("no pieces in %s", c.Args().First())
+	}
+	algorithm := splitter.FilCommitmentUnsealed
+	if name := m.CarPiecesMeta.CommPAlgorithm; name != "" {
+		if algorithm, err = splitter.ParseCommPAlgorithm(name); err != nil {
+			return err
+		}
+	}
+
+	workers := c.Int("workers")
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([][]string, len(pieces))
+	errs := make([]error, len(pieces))
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+	for i, cf := range pieces {
+		wg.Add(1)
+		go func(i int, cf splitter.CarFile) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i], errs[i] = splitter.VerifyPiece(cf, splitter.PiecePath(cf, c.String("pieces-dir")), algorithm, c.Bool("commp-skip-zeros"))
+		}(i, cf)
+	}
+	wg.Wait()
+
+	var missing, mismatched, unchecked int
+	for i, cf := range pieces {
+		path := splitter.PiecePath(cf, c.String("pieces-dir"))
+		switch {
+		case os.IsNotExist(errs[i]):
+			missing++
+			fmt.Printf("MISSING  %s\n", path)
+		case errs[i] != nil:
+			mismatched++
+			fmt.Printf("FAIL     %s: %s\n", path, errs[i])
+		case len(results[i]) > 0:
+			mismatched++
+			fmt.Printf("FAIL     %s: %s\n", path, strings.Join(results[i], ", "))
+		case !cf.CommP.Defined():
+			unchecked++
+			fmt.Printf("ok       %s (sizes only, no commP recorded)\n", path)
+		default:
+			fmt.Printf("ok       %s\n", path)
+		}
+	}
+
+	fmt.Printf("%d pieces, %d ok, %d missing, %d not matching the metadata\n", len(pieces), len(pieces)-missing-mismatched, missing, mismatched)
+	if unchecked > 0 {
+		fmt.Printf("%d pieces have no commP recorded, only their sizes were checked\n", unchecked)
+	}
+	if missing > 0 || mismatched > 0 {
+		return fmt.Errorf("%d of %d pieces failed verification", missing+mismatched, len(pieces))
+	}
+	return nil
+}